@@ -12,6 +12,22 @@ const (
 	UpdateAction  = "update"
 	DeleteAction  = "delete"
 	RefreshAction = "refresh"
+	StatusAction  = "status"
+	VerifyAction  = "verify"
+	// sent by the providers after each poll, listing the services found
+	SnapshotAction = "snapshot"
+
+	// define the service states reported by the core in status messages
+	DeployedState   = "deployed"
+	UndeployedState = "undeployed"
+	// the service's step failed after its last attempt
+	FailedState = "failed"
+
+	// define the actual states reported by the extensions in verify messages
+	// the extension's objects match the service definition
+	InSyncState = "in-sync"
+	// the extension's objects are missing or differ from the service definition, described by the message error
+	DriftedState = "drifted"
 )
 
 // Message holds config information with providers
@@ -22,7 +38,12 @@ type Message struct {
 	Sender      string
 	Destination string
 	Error       string
-	Service     Service
+	// workflow state of the service, set by the core on status messages
+	// or actual state of the service, set by the extensions on verify messages
+	State   string
+	Service Service
+	// names of the services found by the provider, set on snapshot messages
+	Snapshot []string
 }
 
 // Target holds the ip and port of service backend
@@ -75,6 +96,8 @@ type Service struct {
 	TLS        bool     `json:"tls,omitempty"`
 	PublicIP   string   `json:"public_ip,omitempty"`
 	DNSAliases []string `json:"dns_name,omitempty"`
+	// name of the workflow to follow, the default one if empty
+	Workflow string `json:"workflow,omitempty"`
 }
 
 // IsSameThan compares given service definition received from provider
@@ -96,6 +119,10 @@ func (s *Service) IsSameThan(targetService Service) (bool, []string) {
 		diff = append(diff, "Targets")
 	}
 
+	if s.Workflow != targetService.Workflow {
+		diff = append(diff, "Workflow")
+	}
+
 	if len(diff) > 0 {
 		return false, diff
 	}
@@ -112,3 +139,13 @@ func BuildDeleteMessage(svcName string) Message {
 
 	return msg
 }
+
+// BuildSnapshotMessage returns a "snapshot" message listing the given services
+func BuildSnapshotMessage(svcNames []string) Message {
+	msg := Message{
+		Action:   SnapshotAction,
+		Snapshot: svcNames,
+	}
+
+	return msg
+}
@@ -124,6 +124,15 @@ func TestService_IsSameThan(t *testing.T) {
 			PublicIP:   "10.10.10.10",
 			DNSAliases: []string{"www.test.dom"},
 		}, false, []string{"Targets"}},
+		{"Workflow", svc, Service{
+			Provider:   "provider.swarm",
+			Name:       "test",
+			Targets:    target8080,
+			TLS:        false,
+			PublicIP:   "10.10.10.10",
+			DNSAliases: []string{"www.test.dom"},
+			Workflow:   "approved",
+		}, false, []string{"Workflow"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -240,3 +249,21 @@ func TestBuildDeleteMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildSnapshotMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		svcNames []string
+		want     Message
+	}{
+		{"services", []string{"one", "two"}, Message{Action: SnapshotAction, Snapshot: []string{"one", "two"}}},
+		{"empty", nil, Message{Action: SnapshotAction}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := BuildSnapshotMessage(tt.svcNames); !cmp.Equal(got, tt.want) {
+				t.Errorf("BuildSnapshotMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
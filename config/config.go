@@ -1,15 +1,24 @@
 package config
 
 import (
+	"fmt"
 	"github.com/interlook/interlook/provisioner/dns/consul"
 	"github.com/interlook/interlook/provisioner/loadbalancer/f5ltm"
 	"github.com/interlook/interlook/provisioner/loadbalancer/kemplm"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"time"
 
+	"github.com/interlook/interlook/provider/api"
+	consulprovider "github.com/interlook/interlook/provider/consul"
+	"github.com/interlook/interlook/provider/docker"
+	"github.com/interlook/interlook/provider/file"
 	"github.com/interlook/interlook/provider/kubernetes"
+	"github.com/interlook/interlook/provider/nomad"
 	"github.com/interlook/interlook/provider/swarm"
 	"github.com/interlook/interlook/provisioner/ipam/ipalloc"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
@@ -17,20 +26,50 @@ import (
 // This includes all the providers and extensions
 type ServerConfiguration struct {
 	Core struct {
-		LogLevel                         string        `yaml:"logLevel"`
-		ListenPort                       int           `yaml:"listenPort"`
-		LogFile                          string        `yaml:"logFile"`
-		WorkflowSteps                    string        `yaml:"workflowSteps"`
-		WorkflowEntriesFile              string        `yaml:"workflowEntriesFile"`
+		LogLevel      string `yaml:"logLevel"`
+		ListenPort    int    `yaml:"listenPort"`
+		LogFile       string `yaml:"logFile"`
+		WorkflowSteps string `yaml:"workflowSteps"`
+		// named workflows, selected by the services
+		Workflows           map[string]string `yaml:"workflows"`
+		WorkflowEntriesFile string            `yaml:"workflowEntriesFile"`
+		// store of the workflow entries: file (saved on shutdown), bolt (each change saved) or consul (shared by the replicas)
+		WorkflowEntriesStore             string        `yaml:"workflowEntriesStore"`
 		WorkflowActivityLauncherInterval time.Duration `yaml:"workflowActivityLauncherInterval"`
 		WorkflowHousekeeperInterval      time.Duration `yaml:"workflowHousekeeperInterval"`
 		ServiceWIPTimeout                time.Duration `yaml:"serviceWIPTimeout"`
 		ServiceMaxLastUpdated            time.Duration `yaml:"serviceMaxLastUpdated"`
 		CleanUndeployedServiceAfter      time.Duration `yaml:"cleanUndeployedServiceAfter"`
+		// failed steps are retried up to stepMaxAttempts, with an exponential backoff
+		StepMaxAttempts      int           `yaml:"stepMaxAttempts"`
+		StepRetryInterval    time.Duration `yaml:"stepRetryInterval"`
+		StepMaxRetryInterval time.Duration `yaml:"stepMaxRetryInterval"`
+		// roll back the completed steps of a service failing to deploy
+		RollbackOnFailure bool `yaml:"rollbackOnFailure"`
+		// fail the deployments waiting for approval for longer than, no timeout if not set
+		ApprovalTimeout time.Duration `yaml:"approvalTimeout"`
+		// consul KV of the consul store and of the leader election
+		Consul struct {
+			Address string `yaml:"address"`
+			Token   string `yaml:"token"`
+			// prefix of the interlook keys
+			Prefix string `yaml:"prefix"`
+		} `yaml:"consul"`
+		// only the replica elected leader runs the extensions
+		LeaderElection bool `yaml:"leaderElection"`
+		// how often the provisioners are asked to verify the deployed services, no verification if not set
+		DriftCheckInterval time.Duration `yaml:"driftCheckInterval"`
+		// flag (default) or redeploy the drifted services
+		DriftRemediation string `yaml:"driftRemediation"`
 	} `yaml:"core"`
 	Provider struct {
-		Swarm      *swarm.Provider       `yaml:"swarm"`
-		Kubernetes *kubernetes.Extension `yaml:"kubernetes"`
+		Swarm      *swarm.Provider          `yaml:"swarm"`
+		Kubernetes *kubernetes.Extension    `yaml:"kubernetes"`
+		File       *file.Provider           `yaml:"file"`
+		Consul     *consulprovider.Provider `yaml:"consul"`
+		Docker     *docker.Provider         `yaml:"docker"`
+		Nomad      *nomad.Provider          `yaml:"nomad"`
+		API        *api.Provider            `yaml:"api"`
 	} `yaml:"provider"`
 	IPAM struct {
 		IPAlloc *ipalloc.IPAlloc `yaml:"ipalloc"`
@@ -42,6 +81,14 @@ type ServerConfiguration struct {
 		KempLM *kemplm.KempLM `yaml:"kemplm"`
 		F5LTM  *f5ltm.BigIP   `yaml:"f5ltm"`
 	} `yaml:"lb"`
+	// Instances holds the named instances configured in the instances section of the extensions
+	// they are indexed by their lower case workflow step name (ie lb.f5ltm.dc1)
+	Instances map[string]interface{} `yaml:"-"`
+}
+
+// extensionInstances is the instances section of an extension
+type extensionInstances struct {
+	Instances map[string]yaml.Node `yaml:"instances"`
 }
 
 // ReadConfig parse the configuration
@@ -55,5 +102,62 @@ func ReadConfig(filename string) (*ServerConfiguration, error) {
 	if err != nil {
 		return &cfg, err
 	}
+	cfg.Instances, err = readInstances(file, &cfg)
+	if err != nil {
+		return &cfg, err
+	}
 	return &cfg, nil
 }
+
+// readInstances parses the instances section of each extension into a new extension of the same type
+func readInstances(file []byte, cfg *ServerConfiguration) (map[string]interface{}, error) {
+	instances := make(map[string]interface{})
+
+	var sections map[string]yaml.Node
+	if err := yaml.Unmarshal(file, &sections); err != nil {
+		return instances, err
+	}
+
+	cfgType := reflect.TypeOf(*cfg)
+	for i := 0; i < cfgType.NumField(); i++ {
+		extType := cfgType.Field(i)
+		// the core section is not an extension type
+		node, ok := sections[yamlName(extType)]
+		if !ok || extType.Type.Kind() != reflect.Struct || extType.Name == "Core" {
+			continue
+		}
+
+		var extensions map[string]extensionInstances
+		if err := node.Decode(&extensions); err != nil {
+			return instances, err
+		}
+
+		for j := 0; j < extType.Type.NumField(); j++ {
+			ext := extType.Type.Field(j)
+			for name, instanceNode := range extensions[yamlName(ext)].Instances {
+				if name == "" || strings.Contains(name, ".") {
+					return instances, errors.New(fmt.Sprintf("invalid instance name %q for %v.%v", name, yamlName(extType), yamlName(ext)))
+				}
+
+				// the workflow steps are matched case insensitively
+				key := strings.ToLower(yamlName(extType) + "." + yamlName(ext) + "." + name)
+				if _, ok := instances[key]; ok {
+					return instances, errors.New(fmt.Sprintf("duplicate instance name %q for %v.%v, names are case insensitive", name, yamlName(extType), yamlName(ext)))
+				}
+
+				instance := reflect.New(ext.Type.Elem()).Interface()
+				if err := instanceNode.Decode(instance); err != nil {
+					return instances, err
+				}
+				instances[key] = instance
+			}
+		}
+	}
+
+	return instances, nil
+}
+
+// yamlName returns the yaml key of the struct field
+func yamlName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("yaml"), ",")[0]
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"github.com/interlook/interlook/provisioner/loadbalancer/f5ltm"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -47,19 +48,44 @@ lb:
         httpEndpoint: https://10.32.20.100
         username: api
         authProvider: tmos
+        instances:
+            dc1:
+                httpEndpoint: https://10.32.21.100
+            DC2:
+                httpEndpoint: https://10.32.22.100
 `
 	invalidYAML := `---
 {-core:
     -logLevel: DEBUG}
 `
 	_ = ioutil.WriteFile("./configOK.yml", []byte(validYAML), 0644)
+	invalidInstanceYAML := `---
+lb:
+    f5ltm:
+        instances:
+            dc1.a:
+                httpEndpoint: https://10.32.21.100
+`
+	duplicateInstanceYAML := `---
+lb:
+    f5ltm:
+        instances:
+            dc1:
+                httpEndpoint: https://10.32.21.100
+            DC1:
+                httpEndpoint: https://10.32.22.100
+`
 	_ = ioutil.WriteFile("./configKO.yml", []byte(invalidYAML), 0644)
+	_ = ioutil.WriteFile("./configInstanceKO.yml", []byte(invalidInstanceYAML), 0644)
+	_ = ioutil.WriteFile("./configDuplicateInstance.yml", []byte(duplicateInstanceYAML), 0644)
 
 }
 
 func cleanUP() {
 	_ = os.Remove("./configOK.yml")
 	_ = os.Remove("./configKO.yml")
+	_ = os.Remove("./configInstanceKO.yml")
+	_ = os.Remove("./configDuplicateInstance.yml")
 }
 func TestReadConfig(t *testing.T) {
 
@@ -74,6 +100,8 @@ func TestReadConfig(t *testing.T) {
 		{"ok", args{filename: "./configOK.yml"}, false},
 		{"ko", args{filename: "./configKO.yml"}, true},
 		{"missing", args{filename: "./noVonfig.yml"}, true},
+		{"invalidInstance", args{filename: "./configInstanceKO.yml"}, true},
+		{"duplicateInstance", args{filename: "./configDuplicateInstance.yml"}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -88,3 +116,31 @@ func TestReadConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfig_instances(t *testing.T) {
+	got, err := ReadConfig("./configOK.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the instances are indexed by their lower case name
+	want := map[string]string{"lb.f5ltm.dc1": "https://10.32.21.100", "lb.f5ltm.dc2": "https://10.32.22.100"}
+	if len(got.Instances) != len(want) {
+		t.Errorf("ReadConfig() got %v instances, want %v", len(got.Instances), len(want))
+	}
+	for name, endpoint := range want {
+		instance, ok := got.Instances[name].(*f5ltm.BigIP)
+		if !ok {
+			t.Errorf("instance %v not found", name)
+			continue
+		}
+		if instance.Endpoint != endpoint || instance.User != "" {
+			t.Errorf("instance %v got endpoint %v, want %v", name, instance.Endpoint, endpoint)
+		}
+	}
+
+	// the default instance is kept
+	if got.LB.F5LTM.Endpoint != "https://10.32.20.100" {
+		t.Errorf("ReadConfig() got endpoint %v, want https://10.32.20.100", got.LB.F5LTM.Endpoint)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/interlook/interlook/log"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 func (s *server) startAPI() {
@@ -17,6 +18,9 @@ func (s *server) startAPI() {
 	mux.HandleFunc("/workflow", s.getWorkflow)
 	mux.HandleFunc("/extensions", s.getActiveExtensions)
 	mux.HandleFunc("/version", s.getVersion)
+	mux.HandleFunc("/approvals", s.getApprovals)
+	mux.HandleFunc("/approvals/", s.postApproval)
+	mux.HandleFunc("/retry/", s.postRetry)
 	log.Infof("API server started on port %v", s.config.Core.ListenPort)
 	log.Info(s.apiServer.ListenAndServe())
 }
@@ -48,12 +52,80 @@ func (s *server) getServices(w http.ResponseWriter, r *http.Request) {
 func (s *server) getWorkflow(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	// TODO: custom parser for better presentation
-	err := json.NewEncoder(w).Encode(workflow)
+	err := json.NewEncoder(w).Encode(workflows)
 	if err != nil {
 		log.Errorf("Error encoding JSON response %v", err)
 	}
 }
 
+func (s *server) getApprovals(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(s.workflowEntries.pendingApprovals())
+	if err != nil {
+		log.Errorf("Error encoding JSON response %v", err)
+	}
+}
+
+// postApproval records the decision on the deployment of the service waiting at the approval gate
+func (s *server) postApproval(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var decision approvalDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		http.Error(w, "invalid decision: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(decision.Approver) == "" {
+		http.Error(w, "approver is required", http.StatusBadRequest)
+		return
+	}
+
+	// service names can contain slashes (ie kubernetes namespace/name)
+	name := strings.TrimPrefix(r.URL.Path, "/approvals/")
+	s.workflowEntries.Lock()
+	entry, ok := s.workflowEntries.Entries[name]
+	s.workflowEntries.Unlock()
+	if !ok {
+		http.Error(w, "service "+name+" not found", http.StatusNotFound)
+		return
+	}
+
+	if err := entry.decide(decision); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postRetry restarts the failed step of the service
+func (s *server) postRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// service names can contain slashes (ie kubernetes namespace/name)
+	name := strings.TrimPrefix(r.URL.Path, "/retry/")
+	found, err := s.workflowEntries.retry(name)
+	if !found {
+		http.Error(w, "service "+name+" not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *server) getActiveExtensions(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
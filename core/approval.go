@@ -0,0 +1,214 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// approvalStep holds the deployments until they are approved through the API
+	approvalStep = "gate.approval"
+	// approval statuses
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalRejected = "rejected"
+	approvalExpired  = "expired"
+	// the approved deployment was un-deployed
+	approvalClosed = "closed"
+)
+
+// approval holds the approval of a deployment at the approval gate
+type approval struct {
+	Status      string    `json:"status"`
+	RequestTime time.Time `json:"request_time"`
+	// hosts and tls setting of the deployment to approve
+	Hosts        []string  `json:"hosts,omitempty"`
+	TLS          bool      `json:"tls,omitempty"`
+	Approver     string    `json:"approver,omitempty"`
+	Comment      string    `json:"comment,omitempty"`
+	DecisionTime time.Time `json:"decision_time,omitempty"`
+}
+
+// approvalDecision is the decision posted to the API
+type approvalDecision struct {
+	Approved bool   `json:"approved"`
+	Approver string `json:"approver"`
+	Comment  string `json:"comment"`
+}
+
+// requestApproval holds the entry at the approval gate until a decision is made
+func (e *workflowEntry) requestApproval() {
+	e.Lock()
+	e.WorkInProgress = false
+	e.WIPTime = time.Time{}
+	e.Approval = &approval{
+		Status:      approvalPending,
+		RequestTime: time.Now(),
+		Hosts:       e.Service.DNSAliases,
+		TLS:         e.Service.TLS,
+	}
+	e.Unlock()
+
+	log.Infof("Service %v is waiting for approval", e.Service.Name)
+	e.sendStatus()
+}
+
+// isApproved returns true if the deployment of the current hosts and tls setting was approved
+// so that the updates of the targets of an approved service are not held
+func (e *workflowEntry) isApproved() bool {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.Approval != nil &&
+		e.Approval.Status == approvalApproved &&
+		e.Approval.covers(e.Service)
+}
+
+// covers returns true if the hosts and tls setting of the service are the ones to approve
+func (a *approval) covers(svc comm.Service) bool {
+	return reflect.DeepEqual(a.Hosts, svc.DNSAliases) && a.TLS == svc.TLS
+}
+
+// isPendingApproval returns true if the entry is held at the approval gate
+// the caller must hold the entry lock
+func (e *workflowEntry) isPendingApproval() bool {
+	return e.State == approvalStep && !e.isReverse() && e.Approval != nil && e.Approval.Status == approvalPending
+}
+
+// isHeldAtGate returns true if the deployment of the entry waits for a decision, or was refused, at the approval gate
+// the caller must hold the entry lock
+func (e *workflowEntry) isHeldAtGate() bool {
+	if e.State != approvalStep || e.isReverse() || e.Approval == nil {
+		return false
+	}
+
+	switch e.Approval.Status {
+	case approvalPending, approvalRejected, approvalExpired:
+		return true
+	}
+
+	return false
+}
+
+// updateHeldAtGate records the provider update of a service held at the approval gate, without following the workflow again
+// so that the pending approval is kept, and a refused deployment is not requested again
+// it returns false if the update changes the hosts, tls setting or workflow of the service, which need a new approval
+func (we *workflowEntries) updateHeldAtGate(msg comm.Message) bool {
+	if !strings.HasPrefix(msg.Sender, "provider.") || msg.Action != comm.AddAction {
+		return false
+	}
+
+	we.Lock()
+	entry, ok := we.Entries[msg.Service.Name]
+	we.Unlock()
+	if !ok {
+		return false
+	}
+
+	entry.Lock()
+	held := entry.isHeldAtGate() && entry.Approval.covers(msg.Service) && entry.Service.Workflow == msg.Service.Workflow
+	entry.Unlock()
+	if !held {
+		return false
+	}
+
+	log.Debugf("Service %v held at the approval gate, update recorded", msg.Service.Name)
+	entry.updateService(msg)
+	entry.setLastUpdate()
+	entry.persist()
+
+	return true
+}
+
+// decide records the decision on the pending approval
+func (e *workflowEntry) decide(decision approvalDecision) error {
+	e.Lock()
+	if !e.isPendingApproval() {
+		e.Unlock()
+		return errors.New(fmt.Sprintf("service %v is not waiting for approval", e.Service.Name))
+	}
+
+	// the decision was made on the hosts and tls setting of the service listed when requested
+	// an update of the service while pending needs a new review
+	if !e.Approval.covers(e.Service) {
+		e.Approval.RequestTime = time.Now()
+		e.Approval.Hosts = e.Service.DNSAliases
+		e.Approval.TLS = e.Service.TLS
+		e.Unlock()
+
+		e.persist()
+		return errors.New(fmt.Sprintf("service %v was updated while waiting for approval, its new hosts and tls setting need a new decision", e.Service.Name))
+	}
+
+	e.Approval.Approver = decision.Approver
+	e.Approval.Comment = decision.Comment
+	e.Approval.DecisionTime = time.Now()
+	if decision.Approved {
+		e.Approval.Status = approvalApproved
+	} else {
+		e.Approval.Status = approvalRejected
+		e.Error = fmt.Sprintf("deployment rejected by %v: %v", decision.Approver, decision.Comment)
+	}
+	msg := comm.BuildMessage(e.Service, false)
+	status := e.Approval.Status
+	e.Unlock()
+
+	log.Infof("Deployment of %v %v by %v: %v", msg.Service.Name, status, decision.Approver, decision.Comment)
+	e.persist()
+
+	go func() {
+		if decision.Approved {
+			goToNextStep(e, msg)
+		} else {
+			e.fail()
+		}
+		e.persist()
+	}()
+
+	return nil
+}
+
+// expireApproval fails the entry if its pending approval was requested before the given time
+func (e *workflowEntry) expireApproval(requestedBefore time.Time) bool {
+	e.Lock()
+	if !e.isPendingApproval() || e.Approval.RequestTime.After(requestedBefore) {
+		e.Unlock()
+		return false
+	}
+
+	e.Approval.Status = approvalExpired
+	e.Approval.DecisionTime = time.Now()
+	e.Error = "approval timed out"
+	e.Unlock()
+
+	log.Warnf("Approval of %v timed out", e.Service.Name)
+	go func() {
+		e.fail()
+		e.persist()
+	}()
+
+	return true
+}
+
+// pendingApprovals returns the pending approvals by service name
+func (we *workflowEntries) pendingApprovals() map[string]approval {
+	we.Lock()
+	defer we.Unlock()
+
+	approvals := make(map[string]approval)
+	for name, entry := range we.Entries {
+		entry.Lock()
+		if entry.isPendingApproval() {
+			approvals[name] = *entry.Approval
+		}
+		entry.Unlock()
+	}
+
+	return approvals
+}
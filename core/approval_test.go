@@ -0,0 +1,267 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+// newApprovalTest returns entries with a service waiting at the approval gate
+// the caller restores the workflows
+func newApprovalTest(t *testing.T) (*workflowEntries, func() comm.Message) {
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,gate.approval,lb.three")}
+
+	// receive returns the next message sent to an extension
+	// statuses are sent asynchronously, each test receives all its messages
+	receive := func() comm.Message {
+		select {
+		case msg := <-msgToExtension:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message sent")
+		}
+		return comm.Message{}
+	}
+
+	we := initWorkflowEntries(nil)
+	svc := comm.Service{Name: "svc", DNSAliases: []string{"svc.dummy.com"}, Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	if err := we.mergeMessage(comm.Message{Action: comm.UpdateAction, Sender: "ipam.two", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider is notified that the service is waiting for approval
+	if got := receive(); got.Action != comm.StatusAction || got.State != approvalStep {
+		t.Fatalf("got %v %v, want status %v", got.Action, got.State, approvalStep)
+	}
+	if _, ok := we.pendingApprovals()["svc"]; !ok {
+		t.Fatal("service not waiting for approval")
+	}
+
+	return we, receive
+}
+
+func Test_server_postApproval(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"approve", http.MethodPost, "/approvals/svc", `{"approved": true, "approver": "jdoe", "comment": "CHG0042"}`, http.StatusNoContent},
+		{"reject", http.MethodPost, "/approvals/svc", `{"approved": false, "approver": "jdoe"}`, http.StatusNoContent},
+		{"noApprover", http.MethodPost, "/approvals/svc", `{"approved": true}`, http.StatusBadRequest},
+		{"invalidBody", http.MethodPost, "/approvals/svc", `{"approved": `, http.StatusBadRequest},
+		{"notFound", http.MethodPost, "/approvals/other", `{"approved": true, "approver": "jdoe"}`, http.StatusNotFound},
+		{"invalidMethod", http.MethodGet, "/approvals/svc", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we, receive := newApprovalTest(t)
+			s := &server{workflowEntries: we}
+
+			rec := httptest.NewRecorder()
+			s.postApproval(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v (%v)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			// the decision sends the service to the next step or fails it
+			if rec.Code == http.StatusNoContent {
+				receive()
+			}
+		})
+	}
+}
+
+func Test_workflowEntry_decide(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	we, receive := newApprovalTest(t)
+	entry := we.Entries["svc"]
+
+	if err := entry.decide(approvalDecision{Approved: true, Approver: "jdoe", Comment: "CHG0042"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deployment goes on once approved
+	if got := receive(); got.Destination != "lb.three" {
+		t.Errorf("sent to %v, want lb.three", got.Destination)
+	}
+
+	entry.Lock()
+	got := *entry.Approval
+	entry.Unlock()
+	if got.Status != approvalApproved || got.Approver != "jdoe" || got.Comment != "CHG0042" || got.DecisionTime.IsZero() {
+		t.Errorf("approval = %v", got)
+	}
+
+	// a decision is only accepted once
+	if err := entry.decide(approvalDecision{Approved: false, Approver: "jdoe"}); err == nil {
+		t.Errorf("decide() expected error on decided approval")
+	}
+}
+
+func Test_workflowEntry_decideUpdatedWhilePending(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	we, receive := newApprovalTest(t)
+	entry := we.Entries["svc"]
+
+	// the provider changes the hosts of the service after the approval request
+	entry.updateService(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: comm.Service{
+		Name:       "svc",
+		DNSAliases: []string{"www.dummy.com"},
+		Targets:    []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}},
+	}})
+
+	// the decision was made on the former hosts
+	if err := entry.decide(approvalDecision{Approved: true, Approver: "jdoe"}); err == nil {
+		t.Fatal("decide() expected error on updated service")
+	}
+	pending, ok := we.pendingApprovals()["svc"]
+	if !ok {
+		t.Fatal("service no longer waiting for approval")
+	}
+	if want := []string{"www.dummy.com"}; !reflect.DeepEqual(pending.Hosts, want) || pending.Approver != "" {
+		t.Errorf("pending approval = %v, want hosts %v", pending, want)
+	}
+
+	// the new hosts can then be approved
+	if err := entry.decide(approvalDecision{Approved: true, Approver: "jdoe"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(); got.Destination != "lb.three" {
+		t.Errorf("sent to %v, want lb.three", got.Destination)
+	}
+	if !entry.isApproved() {
+		t.Errorf("isApproved() = false, want the new hosts approved")
+	}
+}
+
+func Test_workflowEntry_decideReject(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	we, receive := newApprovalTest(t)
+	entry := we.Entries["svc"]
+
+	if err := entry.decide(approvalDecision{Approved: false, Approver: "jdoe", Comment: "no change window"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "deployment rejected by jdoe: no change window"
+	if got := receive(); got.Action != comm.StatusAction || got.State != comm.FailedState || got.Error != want {
+		t.Errorf("got %v %v %v, want failed status with error %v", got.Action, got.State, got.Error, want)
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+	if !entry.Failed || entry.Approval.Status != approvalRejected {
+		t.Errorf("entry failed %v, approval %v", entry.Failed, entry.Approval.Status)
+	}
+}
+
+func Test_workflowEntry_expireApproval(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	we, receive := newApprovalTest(t)
+	entry := we.Entries["svc"]
+
+	if entry.expireApproval(time.Now().Add(-time.Hour)) {
+		t.Errorf("expireApproval() expired a recent approval")
+	}
+	if !entry.expireApproval(time.Now().Add(time.Second)) {
+		t.Errorf("expireApproval() did not expire the approval")
+	}
+	if got := receive(); got.Action != comm.StatusAction || got.State != comm.FailedState {
+		t.Errorf("got %v %v, want failed status", got.Action, got.State)
+	}
+	if len(we.pendingApprovals()) != 0 {
+		t.Errorf("pendingApprovals() still lists the expired approval")
+	}
+}
+
+func Test_workflowEntries_updateHeldAtGate(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	we, receive := newApprovalTest(t)
+	entry := we.Entries["svc"]
+
+	entry.Lock()
+	requested := entry.Approval.RequestTime
+	svc := entry.Service
+	entry.Unlock()
+	poll := func(svc comm.Service) {
+		if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the workflow is executed asynchronously, it would send the service to the first step
+	noMessage := func() {
+		select {
+		case got := <-msgToExtension:
+			t.Errorf("unexpected message %v %v to %v", got.Action, got.State, got.Destination)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// the polls of the pending service keep its approval request, the targets are updated
+	poll(svc)
+	svc.Targets = []comm.Target{{Host: "10.32.2.2", Port: 80, Weight: 1}}
+	poll(svc)
+	noMessage()
+	entry.Lock()
+	if entry.Approval.Status != approvalPending || !entry.Approval.RequestTime.Equal(requested) || !reflect.DeepEqual(entry.Service.Targets, svc.Targets) {
+		t.Errorf("approval %v requested at %v, targets %v", entry.Approval.Status, entry.Approval.RequestTime, entry.Service.Targets)
+	}
+	entry.Unlock()
+
+	// a rejected deployment is not requested again by the next poll
+	if err := entry.decide(approvalDecision{Approved: false, Approver: "jdoe"}); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	poll(svc)
+	noMessage()
+	entry.Lock()
+	if entry.Approval.Status != approvalRejected || !entry.Failed || entry.State != approvalStep {
+		t.Errorf("approval %v, failed %v, state %v", entry.Approval.Status, entry.Failed, entry.State)
+	}
+	entry.Unlock()
+
+	// new hosts need a new approval
+	svc.DNSAliases = []string{"www.dummy.com"}
+	poll(svc)
+	if got := receive(); got.Destination != "ipam.two" {
+		t.Errorf("sent to %v, want ipam.two", got.Destination)
+	}
+}
+
+func Test_workflowEntry_isApproved(t *testing.T) {
+	approved := &approval{Status: approvalApproved, Hosts: []string{"svc.dummy.com"}, TLS: true}
+	tests := []struct {
+		name     string
+		approval *approval
+		service  comm.Service
+		want     bool
+	}{
+		{"targetsChanged", approved, comm.Service{DNSAliases: []string{"svc.dummy.com"}, TLS: true, Targets: []comm.Target{{Host: "10.32.2.2"}}}, true},
+		{"hostsChanged", approved, comm.Service{DNSAliases: []string{"www.dummy.com"}, TLS: true}, false},
+		{"tlsChanged", approved, comm.Service{DNSAliases: []string{"svc.dummy.com"}}, false},
+		{"closed", &approval{Status: approvalClosed, Hosts: []string{"svc.dummy.com"}, TLS: true}, comm.Service{DNSAliases: []string{"svc.dummy.com"}, TLS: true}, false},
+		{"none", nil, comm.Service{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &workflowEntry{Approval: tt.approval, Service: tt.service}
+			if got := e.isApproved(); got != tt.want {
+				t.Errorf("isApproved() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pkg/errors"
+)
+
+const (
+	// each entry change is saved to the consul KV, shared by the interlook replicas
+	consulStoreType = "consul"
+	// default prefix of the interlook keys
+	defaultConsulPrefix = "interlook"
+)
+
+func newConsulClient(address, token string) (*api.Client, error) {
+	cfg := api.DefaultConfig()
+	if address != "" {
+		cfg.Address = address
+	}
+	if token != "" {
+		cfg.Token = token
+	}
+
+	return api.NewClient(cfg)
+}
+
+// consulStore saves each entry change to the consul KV
+// the entries are saved under prefix/entries/
+type consulStore struct {
+	kv     *api.KV
+	txn    *api.Txn
+	prefix string
+	// with leader election, the changes are only saved while the leadership is held
+	leader *consulElector
+}
+
+func newConsulStore(client *api.Client, prefix string) *consulStore {
+	return &consulStore{kv: client.KV(), txn: client.Txn(), prefix: prefix + "/entries/"}
+}
+
+func (s *consulStore) load() (map[string]*workflowEntry, error) {
+	pairs, _, err := s.kv.List(s.prefix, &api.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*workflowEntry)
+	for _, pair := range pairs {
+		var entry workflowEntry
+		if err := json.Unmarshal(pair.Value, &entry); err != nil {
+			return nil, errors.Wrapf(err, "could not read entry %v", pair.Key)
+		}
+		entries[strings.TrimPrefix(pair.Key, s.prefix)] = &entry
+	}
+
+	return entries, nil
+}
+
+func (s *consulStore) put(name string, entry *workflowEntry) error {
+	data, err := entry.marshal()
+	if err != nil {
+		return err
+	}
+
+	if s.leader != nil {
+		return s.leaderTxn(&api.KVTxnOp{Verb: api.KVSet, Key: s.prefix + name, Value: data})
+	}
+
+	_, err = s.kv.Put(&api.KVPair{Key: s.prefix + name, Value: data}, nil)
+	return err
+}
+
+func (s *consulStore) delete(name string) error {
+	if s.leader != nil {
+		return s.leaderTxn(&api.KVTxnOp{Verb: api.KVDelete, Key: s.prefix + name})
+	}
+
+	_, err := s.kv.Delete(s.prefix+name, nil)
+	return err
+}
+
+// leaderTxn runs the operation only if the leader key is still locked by the session of the replica
+// so that a deposed leader does not overwrite the entries of the new one
+func (s *consulStore) leaderTxn(op *api.KVTxnOp) error {
+	session := s.leader.session()
+	if session == "" {
+		return errors.New("not leader, the entries can not be saved")
+	}
+
+	ops := api.TxnOps{
+		{KV: &api.KVTxnOp{Verb: api.KVCheckSession, Key: s.leader.key, Session: session}},
+		{KV: op},
+	}
+	ok, resp, _, err := s.txn.Txn(ops, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		var reasons []string
+		for _, txnErr := range resp.Errors {
+			reasons = append(reasons, txnErr.What)
+		}
+		return errors.New(fmt.Sprintf("could not save %v, leadership lost: %v", op.Key, strings.Join(reasons, ", ")))
+	}
+
+	return nil
+}
+
+// close saves the entries changes that are not persisted (ie last update time)
+func (s *consulStore) close(entries map[string]*workflowEntry) error {
+	for name, entry := range entries {
+		if err := s.put(name, entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// elector elects the leader of the interlook replicas
+type elector interface {
+	// campaign blocks until the leadership is acquired or stop is closed
+	// it returns a channel closed if the leadership is lost, nil if stopped
+	campaign(stop <-chan struct{}) (<-chan struct{}, error)
+	// resign releases the leadership
+	resign() error
+}
+
+// consulElector elects the leader with a consul lock, held as long as the session of the leader is renewed
+type consulElector struct {
+	sync.Mutex
+	kv   *api.KV
+	key  string
+	lock *api.Lock
+	// session holding the lock once elected
+	sessionID string
+}
+
+// newConsulElector returns an elector locking the given key, its value is the host name of the leader
+func newConsulElector(client *api.Client, key string) (*consulElector, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := client.LockOpts(&api.LockOptions{Key: key, Value: []byte(hostname), SessionName: "interlook"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulElector{kv: client.KV(), key: key, lock: lock}, nil
+}
+
+func (e *consulElector) campaign(stop <-chan struct{}) (<-chan struct{}, error) {
+	lost, err := e.lock.Lock(stop)
+	if err != nil || lost == nil {
+		return lost, err
+	}
+
+	// the session of the lock guards the writes of the leader
+	pair, _, err := e.kv.Get(e.key, &api.QueryOptions{RequireConsistent: true})
+	if err == nil && (pair == nil || pair.Session == "") {
+		err = errors.New(fmt.Sprintf("leader key %v is not locked", e.key))
+	}
+	if err != nil {
+		e.lock.Unlock()
+		return nil, errors.Wrapf(err, "could not read the session of the leader")
+	}
+
+	e.Lock()
+	e.sessionID = pair.Session
+	e.Unlock()
+
+	return lost, nil
+}
+
+func (e *consulElector) resign() error {
+	e.Lock()
+	e.sessionID = ""
+	e.Unlock()
+
+	return e.lock.Unlock()
+}
+
+// session returns the session holding the leadership, empty if not elected
+func (e *consulElector) session() string {
+	e.Lock()
+	defer e.Unlock()
+
+	return e.sessionID
+}
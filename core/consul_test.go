@@ -0,0 +1,391 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/interlook/interlook/comm"
+)
+
+// fakeConsul is an in-process stand-in of the consul KV and sessions APIs used by the store and the elector
+type fakeConsul struct {
+	sync.Mutex
+	pairs    map[string]*api.KVPair
+	sessions map[string]bool
+	index    uint64
+	// closed on each change, to answer the blocking queries
+	changed chan struct{}
+	server  *httptest.Server
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{pairs: make(map[string]*api.KVPair), sessions: make(map[string]bool), index: 1, changed: make(chan struct{})}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeConsul) client(t *testing.T) *api.Client {
+	client, err := newConsulClient(strings.TrimPrefix(f.server.URL, "http://"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// change bumps the index and wakes up the blocking queries, the caller must hold the lock
+func (f *fakeConsul) change() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// releaseLock releases the lock of the key, as if the session of its holder was invalidated
+func (f *fakeConsul) releaseLock(key string) {
+	f.Lock()
+	defer f.Unlock()
+	if pair, ok := f.pairs[key]; ok {
+		pair.Session = ""
+		pair.ModifyIndex = f.index + 1
+		f.change()
+	}
+}
+
+func (f *fakeConsul) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/session/create"):
+		f.Lock()
+		id := strconv.FormatUint(f.index, 10)
+		f.sessions[id] = true
+		f.change()
+		f.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/renew/"):
+		json.NewEncoder(w).Encode([]*api.SessionEntry{{ID: strings.TrimPrefix(r.URL.Path, "/v1/session/renew/"), TTL: "15s"}})
+	case strings.HasPrefix(r.URL.Path, "/v1/session/destroy/"):
+		f.Lock()
+		// the locks of the session are released
+		id := strings.TrimPrefix(r.URL.Path, "/v1/session/destroy/")
+		delete(f.sessions, id)
+		for _, pair := range f.pairs {
+			if pair.Session == id {
+				pair.Session = ""
+				pair.ModifyIndex = f.index + 1
+			}
+		}
+		f.change()
+		f.Unlock()
+		w.Write([]byte("true"))
+	case r.URL.Path == "/v1/txn":
+		f.handleTxn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		f.handleKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		// blocking query, until the index changes or the wait time elapses
+		if index, _ := strconv.ParseUint(query.Get("index"), 10, 64); index != 0 && index == f.index {
+			changed := f.changed
+			wait, err := time.ParseDuration(query.Get("wait"))
+			if err != nil {
+				wait = 5 * time.Second
+			}
+			f.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			case <-r.Context().Done():
+			}
+			f.Lock()
+		}
+
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		_, recurse := query["recurse"]
+		var pairs []*api.KVPair
+		for k, pair := range f.pairs {
+			if k == key || (recurse && strings.HasPrefix(k, key)) {
+				copied := *pair
+				pairs = append(pairs, &copied)
+			}
+		}
+		if len(pairs) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(r.Body)
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		pair, ok := f.pairs[key]
+		if !ok {
+			pair = &api.KVPair{Key: key, CreateIndex: f.index + 1}
+		}
+
+		switch {
+		case query.Get("acquire") != "":
+			if pair.Session != "" && pair.Session != query.Get("acquire") {
+				w.Write([]byte("false"))
+				return
+			}
+			pair.Session = query.Get("acquire")
+		case query.Get("release") != "":
+			if pair.Session != query.Get("release") {
+				w.Write([]byte("false"))
+				return
+			}
+			pair.Session = ""
+		}
+
+		pair.Value = value
+		pair.Flags = flags
+		pair.ModifyIndex = f.index + 1
+		f.pairs[key] = pair
+		f.change()
+		w.Write([]byte("true"))
+
+	case http.MethodDelete:
+		delete(f.pairs, key)
+		f.change()
+		w.Write([]byte("true"))
+	}
+}
+
+// handleTxn runs the KV operations of the transaction, none of them if one of its checks fails
+func (f *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops api.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	for i, op := range ops {
+		if op.KV.Verb != api.KVCheckSession {
+			continue
+		}
+		if pair, ok := f.pairs[op.KV.Key]; !ok || pair.Session != op.KV.Session {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(api.TxnResponse{Errors: api.TxnErrors{{OpIndex: i, What: "lock not held by session " + op.KV.Session}}})
+			return
+		}
+	}
+
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case api.KVSet:
+			pair, ok := f.pairs[op.KV.Key]
+			if !ok {
+				pair = &api.KVPair{Key: op.KV.Key, CreateIndex: f.index + 1}
+				f.pairs[op.KV.Key] = pair
+			}
+			pair.Value = op.KV.Value
+			pair.ModifyIndex = f.index + 1
+			f.change()
+		case api.KVDelete:
+			delete(f.pairs, op.KV.Key)
+			f.change()
+		}
+	}
+	json.NewEncoder(w).Encode(api.TxnResponse{})
+}
+
+func Test_consulStore(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.server.Close()
+
+	store := newConsulStore(consul.client(t), "interlook")
+
+	one := &workflowEntry{State: deployedState, Service: comm.Service{Name: "one"}}
+	// kubernetes services are named namespace/name
+	two := &workflowEntry{State: "lb.two", Workflow: "internal", Service: comm.Service{Name: "default/two"}}
+	for _, entry := range []*workflowEntry{one, two} {
+		if err := store.put(entry.Service.Name, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.delete("one"); err != nil {
+		t.Fatal(err)
+	}
+
+	// each change is saved to the KV, so that another replica loads them
+	replica := newConsulStore(consul.client(t), "interlook")
+	got, err := replica.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got["default/two"] == nil || got["default/two"].State != "lb.two" || got["default/two"].Workflow != "internal" {
+		t.Errorf("load() = %v, want entry default/two", got)
+	}
+	consul.Lock()
+	if _, ok := consul.pairs["interlook/entries/default/two"]; !ok {
+		t.Errorf("entry not saved under the prefix: %v", consul.pairs)
+	}
+	consul.Unlock()
+
+	// the entries are all saved on close
+	one.LastUpdate = time.Now()
+	if err := store.close(map[string]*workflowEntry{"one": one}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = replica.load(); got["one"] == nil || !got["one"].LastUpdate.Equal(one.LastUpdate) {
+		t.Errorf("load() = %v, want entry one saved on close", got)
+	}
+}
+
+func Test_consulStore_leader(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.server.Close()
+
+	newLeaderStore := func() *consulStore {
+		elector, err := newConsulElector(consul.client(t), "interlook/leader")
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := newConsulStore(consul.client(t), "interlook")
+		store.leader = elector
+		return store
+	}
+	entry := func(state string) *workflowEntry {
+		return &workflowEntry{State: state, Service: comm.Service{Name: "svc"}}
+	}
+
+	deposed := newLeaderStore()
+	if err := deposed.put("svc", entry("lb.two")); err == nil {
+		t.Errorf("put() expected error before the election")
+	}
+	lost, err := deposed.leader.campaign(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deposed.put("svc", entry("lb.two")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the session of the leader is invalidated, another replica is elected
+	consul.releaseLock("interlook/leader")
+	<-lost
+	leader := newLeaderStore()
+	if _, err := leader.leader.campaign(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer leader.leader.resign()
+	if err := leader.put("svc", entry(deployedState)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deposed leader does not overwrite the entries of the new one
+	if err := deposed.put("svc", entry("lb.two")); err == nil {
+		t.Errorf("put() expected error once deposed")
+	}
+	if err := deposed.delete("svc"); err == nil {
+		t.Errorf("delete() expected error once deposed")
+	}
+	got, err := leader.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["svc"] == nil || got["svc"].State != deployedState {
+		t.Errorf("load() = %v, want the entry saved by the new leader", got["svc"])
+	}
+
+	if err := leader.delete("svc"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := leader.load(); len(got) != 0 {
+		t.Errorf("load() = %v, want no entry", got)
+	}
+}
+
+func Test_consulElector(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.server.Close()
+
+	leader, err := newConsulElector(consul.client(t), "interlook/leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	standby, err := newConsulElector(consul.client(t), "interlook/leader")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lost, err := leader.campaign(nil); err != nil || lost == nil {
+		t.Fatalf("campaign() = %v, %v, want leadership", lost, err)
+	}
+
+	// the standby is elected once the leader resigns
+	elected := make(chan (<-chan struct{}))
+	go func() {
+		lost, err := standby.campaign(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		elected <- lost
+	}()
+
+	select {
+	case <-elected:
+		t.Fatal("standby elected while the leader holds the leadership")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := leader.resign(); err != nil {
+		t.Fatal(err)
+	}
+
+	var lost <-chan struct{}
+	select {
+	case lost = <-elected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("standby not elected")
+	}
+
+	// the leadership is lost if the lock is released by consul (ie session invalidated)
+	consul.releaseLock("interlook/leader")
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("leadership loss not detected")
+	}
+}
+
+func Test_consulElector_campaignStopped(t *testing.T) {
+	consul := newFakeConsul()
+	defer consul.server.Close()
+
+	leader, _ := newConsulElector(consul.client(t), "interlook/leader")
+	standby, _ := newConsulElector(consul.client(t), "interlook/leader")
+	if _, err := leader.campaign(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer leader.resign()
+
+	stop := make(chan struct{})
+	close(stop)
+	if lost, err := standby.campaign(stop); lost != nil || err != nil {
+		t.Errorf("campaign() = %v, %v, want nil once stopped", lost, err)
+	}
+}
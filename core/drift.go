@@ -0,0 +1,161 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+)
+
+const (
+	// the drifted steps are recorded in the entry, until the service is deployed again
+	driftFlag = "flag"
+	// the drifted steps are deployed again, followed by the next steps of the workflow
+	driftRedeploy = "redeploy"
+)
+
+// redeployDrift deploys again the steps whose extension reports a drift
+var redeployDrift bool
+
+// drift records a step whose extension's objects differ from the deployed service
+type drift struct {
+	Step string    `json:"step"`
+	Time time.Time `json:"time"`
+	Info string    `json:"info,omitempty"`
+}
+
+// stepOf returns the step the given extension is a member of, empty if not found
+func (w workflowSteps) stepOf(member string) string {
+	for _, workflowStep := range w {
+		for _, m := range stepMembers(workflowStep.Name) {
+			if m == member {
+				return workflowStep.Name
+			}
+		}
+	}
+	return ""
+}
+
+// isSettled returns true if the service is deployed and no step is running nor failed
+// the caller must hold the entry lock
+func (e *workflowEntry) isSettled() bool {
+	return e.State == deployedState && e.ExpectedState == deployedState && !e.WorkInProgress && !e.Failed
+}
+
+// setVerification records the actual state reported by the extension
+// it returns true if the entry is set back to the drifted step to be redeployed
+func (e *workflowEntry) setVerification(msg comm.Message) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	// the entry changed since the verification was requested
+	if !e.isSettled() {
+		log.Debugf("Verification of %v by %v ignored, the service is not deployed", e.Service.Name, msg.Sender)
+		return false
+	}
+
+	switch msg.State {
+	case comm.InSyncState:
+		e.removeDrift(msg.Sender)
+		return false
+	case comm.DriftedState:
+	default:
+		log.Warnf("Could not verify %v of %v: %v", msg.Sender, e.Service.Name, msg.Error)
+		return false
+	}
+
+	log.Warnf("Step %v of %v drifted: %v", msg.Sender, e.Service.Name, msg.Error)
+	e.removeDrift(msg.Sender)
+	e.Drifts = append(e.Drifts, drift{Step: msg.Sender, Time: time.Now(), Info: msg.Error})
+
+	if !redeployDrift {
+		return false
+	}
+
+	step := e.steps().stepOf(msg.Sender)
+	if step == "" {
+		log.Warnf("Could not redeploy %v of %v: step not found in workflow", msg.Sender, e.Service.Name)
+		return false
+	}
+
+	e.State = step
+	e.transition = e.steps().getTransition(step)
+	e.Error = ""
+	e.CloseTime = time.Time{}
+	e.Info = fmt.Sprintf("step %v drifted: %v, redeploying", msg.Sender, msg.Error)
+
+	return true
+}
+
+// removeDrift of the given step, the caller must hold the entry lock
+func (e *workflowEntry) removeDrift(step string) {
+	for i, d := range e.Drifts {
+		if d.Step == step {
+			e.Drifts = append(e.Drifts[:i], e.Drifts[i+1:]...)
+			return
+		}
+	}
+}
+
+// verifications returns the verify messages of the deployed services
+// one message is sent to each extension of their workflow able to verify them
+func (we *workflowEntries) verifications(isVerifier func(string) bool) []comm.Message {
+	we.Lock()
+	defer we.Unlock()
+
+	var names []string
+	for name := range we.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msgs []comm.Message
+	for _, name := range names {
+		entry := we.Entries[name]
+		entry.Lock()
+		if entry.isSettled() {
+			for _, step := range entry.steps() {
+				// only the provisioners deploy the service
+				if _, ok := step.Transition.(*provisionerState); !ok {
+					continue
+				}
+				for _, member := range stepMembers(step.Name) {
+					if !isVerifier(member) {
+						continue
+					}
+					msgs = append(msgs, comm.Message{Action: comm.VerifyAction, Destination: member, Service: entry.Service})
+				}
+			}
+		}
+		entry.Unlock()
+	}
+
+	return msgs
+}
+
+// mergeVerification records the actual state of the service reported by the extension
+// the drifted step is sent again to its extension if redeployDrift is set
+func (we *workflowEntries) mergeVerification(msg comm.Message) error {
+	we.Lock()
+	entry, ok := we.Entries[msg.Service.Name]
+	we.Unlock()
+	if !ok {
+		return errors.New(fmt.Sprintf("verified service %v not found", msg.Service.Name))
+	}
+
+	if !entry.setVerification(msg) {
+		entry.persist()
+		return nil
+	}
+
+	log.Infof("Redeploying step %v of %v", entry.State, msg.Service.Name)
+	go func() {
+		entry.sendToExtension()
+		entry.persist()
+	}()
+
+	return nil
+}
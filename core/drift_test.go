@@ -0,0 +1,175 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+func deployedEntry(name string) *workflowEntry {
+	return &workflowEntry{
+		State:         deployedState,
+		ExpectedState: deployedState,
+		Service:       comm.Service{Name: name, Provider: "provider.one", PublicIP: "10.1.1.1", DNSAliases: []string{name + ".dummy.com"}},
+	}
+}
+
+func Test_workflowSteps_stepOf(t *testing.T) {
+	steps := initWorkflow("provider.one,ipam.two,dns.three+lb.four")
+	tests := []struct {
+		name   string
+		member string
+		want   string
+	}{
+		{"step", "ipam.two", "ipam.two"},
+		{"groupMember", "lb.four", "dns.three+lb.four"},
+		{"notFound", "lb.five", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := steps.stepOf(tt.member); got != tt.want {
+				t.Errorf("stepOf() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_verifications(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,dns.three+lb.four")}
+
+	we := initWorkflowEntries(nil)
+	we.Entries["deployed"] = deployedEntry("deployed")
+	wip := deployedEntry("wip")
+	wip.WorkInProgress = true
+	we.Entries["wip"] = wip
+	undeploying := deployedEntry("undeploying")
+	undeploying.ExpectedState = undeployedState
+	we.Entries["undeploying"] = undeploying
+	failed := deployedEntry("failed")
+	failed.State = "ipam.two"
+	failed.Failed = true
+	we.Entries["failed"] = failed
+
+	// only the settled entries are verified, by the extensions able to
+	isVerifier := func(name string) bool { return name != "ipam.two" }
+	var got []string
+	for _, msg := range we.verifications(isVerifier) {
+		if msg.Action != comm.VerifyAction {
+			t.Errorf("verifications() action = %v, want %v", msg.Action, comm.VerifyAction)
+		}
+		got = append(got, msg.Service.Name+" "+msg.Destination)
+	}
+
+	want := []string{"deployed dns.three", "deployed lb.four"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("verifications() = %v, want %v", got, want)
+	}
+}
+
+func Test_workflowEntry_setVerification(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	defer func(redeploy bool) { redeployDrift = redeploy }(redeployDrift)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,dns.three+lb.four")}
+
+	tests := []struct {
+		name         string
+		redeploy     bool
+		settled      bool
+		drifts       []drift
+		msg          comm.Message
+		want         bool
+		wantState    string
+		wantDrifts   []string
+		wantRedeploy bool
+	}{
+		{"inSync", false, true, []drift{{Step: "lb.four"}, {Step: "dns.three"}},
+			comm.Message{Sender: "lb.four", State: comm.InSyncState}, false, deployedState, []string{"dns.three"}, false},
+		{"flagged", false, true, nil,
+			comm.Message{Sender: "lb.four", State: comm.DriftedState, Error: "pool not found"}, false, deployedState, []string{"lb.four"}, false},
+		{"flaggedAgain", false, true, []drift{{Step: "lb.four"}},
+			comm.Message{Sender: "lb.four", State: comm.DriftedState, Error: "pool not found"}, false, deployedState, []string{"lb.four"}, false},
+		{"redeployed", true, true, nil,
+			comm.Message{Sender: "lb.four", State: comm.DriftedState, Error: "pool not found"}, true, "dns.three+lb.four", []string{"lb.four"}, true},
+		{"verificationFailed", true, true, nil,
+			comm.Message{Sender: "lb.four", Error: "connection refused"}, false, deployedState, nil, false},
+		{"notSettled", true, false, nil,
+			comm.Message{Sender: "lb.four", State: comm.DriftedState, Error: "pool not found"}, false, deployedState, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			redeployDrift = tt.redeploy
+			e := deployedEntry("svc")
+			e.Drifts = tt.drifts
+			e.WorkInProgress = !tt.settled
+
+			if got := e.setVerification(tt.msg); got != tt.want {
+				t.Errorf("setVerification() = %v, want %v", got, tt.want)
+			}
+			if e.State != tt.wantState {
+				t.Errorf("state = %v, want %v", e.State, tt.wantState)
+			}
+			var drifts []string
+			for _, d := range e.Drifts {
+				drifts = append(drifts, d.Step)
+			}
+			if !reflect.DeepEqual(drifts, tt.wantDrifts) {
+				t.Errorf("drifts = %v, want %v", drifts, tt.wantDrifts)
+			}
+			if _, ok := e.transition.(*provisionerState); ok != tt.wantRedeploy {
+				t.Errorf("transition = %v, want redeploy %v", e.transition, tt.wantRedeploy)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_mergeVerification(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	defer func(redeploy bool) { redeployDrift = redeploy }(redeployDrift)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,lb.three")}
+	redeployDrift = true
+
+	receive := func() comm.Message {
+		select {
+		case msg := <-msgToExtension:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message sent")
+		}
+		return comm.Message{}
+	}
+
+	we := initWorkflowEntries(nil)
+	entry := deployedEntry("svc")
+	we.Entries["svc"] = entry
+
+	if err := we.mergeMessage(comm.Message{Action: comm.VerifyAction, Sender: "lb.three", State: comm.DriftedState, Error: "pool not found", Service: entry.Service}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the drifted step is deployed again
+	if got := receive(); got.Destination != "lb.three" || got.Action != comm.AddAction {
+		t.Fatalf("got %v to %v, want %v to lb.three", got.Action, got.Destination, comm.AddAction)
+	}
+
+	if err := we.mergeMessage(comm.Message{Action: comm.UpdateAction, Sender: "lb.three", Service: entry.Service}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(); got.Action != comm.StatusAction || got.State != deployedState {
+		t.Errorf("got %v %v, want status %v", got.Action, got.State, deployedState)
+	}
+
+	entry.Lock()
+	if entry.State != deployedState || entry.Drifts != nil {
+		t.Errorf("entry state %v, drifts %v, want deployed without drift", entry.State, entry.Drifts)
+	}
+	entry.Unlock()
+
+	// the verification of an unknown service is an error
+	if err := we.mergeMessage(comm.Message{Action: comm.VerifyAction, Sender: "lb.three", State: comm.InSyncState, Service: comm.Service{Name: "other"}}); err == nil {
+		t.Errorf("mergeMessage() expected error on unknown service")
+	}
+}
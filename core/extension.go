@@ -16,3 +16,31 @@ type Provider interface {
 	Extension
 	RefreshService(msg comm.Message)
 }
+
+// StatusReceiver adds the ServiceStatus on top of the provider interface
+// allowing the core to report the workflow state of the services pushed by the provider
+type StatusReceiver interface {
+	Provider
+	ServiceStatus(msg comm.Message)
+}
+
+// Snapshotter adds the Snapshot on top of the provider interface
+// allowing the core to request all the services of the provider, followed by a "snapshot" of their names
+type Snapshotter interface {
+	Provider
+	Snapshot(msg comm.Message)
+}
+
+// Verifier adds the VerifyService on top of the extension interface
+// allowing the core to detect the drift of the extension's objects from the definition of the deployed services
+type Verifier interface {
+	Extension
+	VerifyService(msg comm.Message)
+}
+
+// LegacyKeyChecker adds the IsLegacyKey on top of the provider interface
+// allowing the core to drop the entries stored under a key the provider no more uses
+type LegacyKeyChecker interface {
+	Provider
+	IsLegacyKey(name string) bool
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+)
+
+// retryPolicy defines the attempts of the failed workflow steps
+type retryPolicy struct {
+	maxAttempts int
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+// newRetryPolicy returns the retry policy, with default values for the unset settings
+func newRetryPolicy(maxAttempts int, interval, maxInterval time.Duration) retryPolicy {
+	if maxAttempts <= 0 {
+		maxAttempts = 5
+	}
+
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	if maxInterval <= 0 {
+		maxInterval = 5 * time.Minute
+	}
+
+	return retryPolicy{maxAttempts: maxAttempts, interval: interval, maxInterval: maxInterval}
+}
+
+// backoff returns the delay before the attempt following the given failed attempt
+// the delay doubles at each attempt up to maxInterval, half of it being random so that entries failing together are not retried together
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.interval
+	for i := 1; i < attempt && delay < p.maxInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > p.maxInterval {
+		delay = p.maxInterval
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isRetrying returns true if the deployment of the entry failed at its current step, and waits for a new attempt or for an operator
+// the caller must hold the entry lock
+func (e *workflowEntry) isRetrying() bool {
+	return !e.isReverse() && (e.Failed || e.Attempts > 0)
+}
+
+// retry restarts the failed step of the service, as requested by an operator
+// it returns an error if the deployment of the service did not fail
+func (we *workflowEntries) retry(name string) (found bool, err error) {
+	we.Lock()
+	entry, ok := we.Entries[name]
+	we.Unlock()
+	if !ok {
+		return false, nil
+	}
+
+	entry.Lock()
+	if !entry.Failed || entry.isReverse() || entry.WorkInProgress {
+		entry.Unlock()
+		return true, errors.New(fmt.Sprintf("deployment of service %v did not fail", name))
+	}
+
+	entry.Failed = false
+	entry.Attempts = 0
+	entry.RetryTime = time.Time{}
+	entry.transition = entry.steps().getTransition(entry.State)
+	transition := entry.transition
+	step := entry.State
+	msg := comm.BuildMessage(entry.Service, false)
+	entry.Unlock()
+
+	log.Infof("Retrying step %v of %v as requested", step, name)
+	go func() {
+		transition.execute(entry, msg)
+		entry.persist()
+	}()
+
+	return true, nil
+}
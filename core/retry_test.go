@@ -0,0 +1,107 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+func Test_newRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		interval    time.Duration
+		maxInterval time.Duration
+		want        retryPolicy
+	}{
+		{"defaults", 0, 0, 0, retryPolicy{maxAttempts: 5, interval: 5 * time.Second, maxInterval: 5 * time.Minute}},
+		{"configured", 3, time.Second, time.Minute, retryPolicy{maxAttempts: 3, interval: time.Second, maxInterval: time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newRetryPolicy(tt.maxAttempts, tt.interval, tt.maxInterval); got != tt.want {
+				t.Errorf("newRetryPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_retryPolicy_backoff(t *testing.T) {
+	p := newRetryPolicy(10, time.Second, 10*time.Second)
+	tests := []struct {
+		name    string
+		attempt int
+		max     time.Duration
+	}{
+		{"first", 1, time.Second},
+		{"second", 2, 2 * time.Second},
+		{"third", 3, 4 * time.Second},
+		{"capped", 8, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := p.backoff(tt.attempt); got < tt.max/2 || got > tt.max {
+					t.Fatalf("backoff() = %v, want between %v and %v", got, tt.max/2, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func Test_server_postRetry(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,lb.three")}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		entry      *workflowEntry
+		wantStatus int
+		wantStep   string
+	}{
+		{"failed", http.MethodPost, "/retry/svc", &workflowEntry{State: "lb.three", ExpectedState: deployedState, Attempts: 5, Failed: true}, http.StatusNoContent, "lb.three"},
+		{"deployed", http.MethodPost, "/retry/svc", &workflowEntry{State: deployedState, ExpectedState: deployedState}, http.StatusConflict, ""},
+		{"undeploying", http.MethodPost, "/retry/svc", &workflowEntry{State: "lb.three", ExpectedState: undeployedState, Failed: true}, http.StatusConflict, ""},
+		{"notFound", http.MethodPost, "/retry/other", &workflowEntry{}, http.StatusNotFound, ""},
+		{"invalidMethod", http.MethodGet, "/retry/svc", &workflowEntry{}, http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := initWorkflowEntries(nil)
+			entry := tt.entry
+			entry.Service = comm.Service{Name: "svc", Provider: "provider.one", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+			we.Entries["svc"] = entry
+			s := &server{workflowEntries: we}
+
+			rec := httptest.NewRecorder()
+			s.postRetry(rec, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v (%v)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStep == "" {
+				return
+			}
+
+			// the failed step is sent again to its extension
+			select {
+			case got := <-msgToExtension:
+				if got.Destination != tt.wantStep || got.Action != comm.AddAction {
+					t.Errorf("got %v to %v, want add to %v", got.Action, got.Destination, tt.wantStep)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message sent")
+			}
+			entry.Lock()
+			defer entry.Unlock()
+			if entry.Failed || entry.Attempts != 0 || !entry.WorkInProgress {
+				t.Errorf("entry failed %v, attempts %v, wip %v", entry.Failed, entry.Attempts, entry.WorkInProgress)
+			}
+		})
+	}
+}
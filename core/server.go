@@ -18,11 +18,14 @@ import (
 	"os/signal"
 )
 
+// delay between the leader election attempts, ie consul not reachable
+var leaderElectionRetryInterval = 5 * time.Second
+
 var (
 	//	srv        server
 	configFile     string
 	Version        = "dev"
-	workflow       workflowSteps
+	workflows      map[string]workflowSteps
 	msgToExtension chan comm.Message
 )
 
@@ -40,6 +43,14 @@ type server struct {
 	housekeeperTicker   *time.Ticker
 	housekeeperShutdown chan bool
 	housekeeperWG       sync.WaitGroup
+	retryTicker         *time.Ticker
+	retryShutdown       chan bool
+	// elects the leader of the replicas, nil if leader election is not enabled
+	elector        elector
+	leaderShutdown chan bool
+	// set once the leadership is lost, the entries being owned by the new leader
+	leadershipLost bool
+	stopOnce       sync.Once
 }
 
 // Start initialize server and run it
@@ -48,20 +59,22 @@ func Start() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	srv.run()
+	if err := srv.run(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 // initialize the server components
-func initServer() (server, error) {
+func initServer() (*server, error) {
 	var err error
-	var s server
+	s := &server{}
 
 	flag.StringVar(&configFile, "conf", "", "interlook configuration file")
 	flag.Parse()
 
 	s.config, err = config.ReadConfig(configFile)
 	if err != nil {
-		return s, err
+		return nil, err
 	}
 
 	// init logger
@@ -72,59 +85,173 @@ func initServer() (server, error) {
 	s.signals = make(chan os.Signal, 1)
 	s.housekeeperShutdown = make(chan bool)
 	s.housekeeperTicker = time.NewTicker(s.config.Core.WorkflowHousekeeperInterval)
+	s.retryShutdown = make(chan bool)
+	if s.config.Core.WorkflowActivityLauncherInterval == time.Duration(0) {
+		s.config.Core.WorkflowActivityLauncherInterval = 3 * time.Second
+	}
+	s.retryTicker = time.NewTicker(s.config.Core.WorkflowActivityLauncherInterval)
 	s.extensionChannels = make(map[string]*extensionChannels)
 	msgToExtension = make(chan comm.Message)
 
-	// init workflow
-	workflow = initWorkflow(s.config.Core.WorkflowSteps)
+	// init failed steps retries
+	stepRetry = newRetryPolicy(s.config.Core.StepMaxAttempts, s.config.Core.StepRetryInterval, s.config.Core.StepMaxRetryInterval)
+	rollbackOnFailure = s.config.Core.RollbackOnFailure
+
+	// init drift remediation
+	switch s.config.Core.DriftRemediation {
+	case "", driftFlag:
+		redeployDrift = false
+	case driftRedeploy:
+		redeployDrift = true
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown drift remediation %v", s.config.Core.DriftRemediation))
+	}
+
+	// init workflows
+	workflows, err = initWorkflows(s.config.Core.WorkflowSteps, s.config.Core.Workflows)
+	if err != nil {
+		return nil, err
+	}
 
 	// init configured extensions
-	s.initExtensions()
+	if err := s.initExtensions(); err != nil {
+		return nil, err
+	}
 
-	// init workflowEntries table
-	s.workflowEntries = initWorkflowEntries(s.config.Core.WorkflowEntriesFile)
-	if err := s.workflowEntries.load(); err != nil {
-		log.Errorf("Could not load entries from file: %v", err)
+	// init workflowEntries table, loaded when running
+	store, err := s.initEntryStore()
+	if err != nil {
+		return nil, err
 	}
+	s.workflowEntries = initWorkflowEntries(store)
 
 	return s, nil
 }
 
-// initExtensions initializes the extensions that are configured in the workflow steps
-func (s *server) initExtensions() {
+// initEntryStore returns the configured workflow entries store
+// the replicas electing a leader share the consul store
+func (s *server) initEntryStore() (entryStore, error) {
+	cfg := s.config.Core
+	if cfg.WorkflowEntriesStore != consulStoreType {
+		if cfg.LeaderElection {
+			return nil, errors.New("leader election requires the consul workflow entries store")
+		}
+		return newEntryStore(cfg.WorkflowEntriesStore, cfg.WorkflowEntriesFile)
+	}
+
+	client, err := newConsulClient(cfg.Consul.Address, cfg.Consul.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := cfg.Consul.Prefix
+	if prefix == "" {
+		prefix = defaultConsulPrefix
+	}
+
+	store := newConsulStore(client, prefix)
+	if cfg.LeaderElection {
+		elector, err := newConsulElector(client, prefix+"/leader")
+		if err != nil {
+			return nil, err
+		}
+		s.elector = elector
+		store.leader = elector
+	}
+
+	return store, nil
+}
+
+// initExtensions initializes the extensions that are configured in the workflows steps
+// it returns an error if a step names an instance that is not configured
+func (s *server) initExtensions() error {
 	s.extensions = make(map[string]Extension)
-	srvConf := structs.New(s.config)
-
-	// get needed extensions from workflow
-	for _, step := range workflow {
-		ext := strings.Split(step.Name, ".")
-		if len(ext) == 2 {
-			extType := strings.ToLower(ext[0])
-			extName := strings.ToLower(ext[1])
-			// loop through struct fields. Ifs are needed due to case sensitivity
-			for _, f := range srvConf.Fields() {
-				if strings.ToLower(f.Name()) == extType && f.Kind() == reflect.Struct {
-					for _, n := range srvConf.Field(f.Name()).Fields() {
-						if strings.ToLower(n.Name()) == extName {
-							s.extensions[step.Name] = n.Value().(Extension)
-							log.Infof("Extension %v initialized", step)
-						}
+
+	// get needed extensions from workflows, steps can be shared by several workflows
+	for _, wf := range workflows {
+		for _, step := range wf {
+			for _, member := range stepMembers(step.Name) {
+				// gates are handled by the core
+				if strings.HasPrefix(member, "gate.") {
+					continue
+				}
+				if _, ok := s.extensions[member]; !ok {
+					if err := s.initExtension(member); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// initExtension initializes the extension of the given workflow step
+func (s *server) initExtension(step string) error {
+	ext := strings.Split(step, ".")
+	// named instance of an extension (ie lb.f5ltm.dc1), the instances are indexed by their lower case name
+	if len(ext) == 3 {
+		instance, ok := s.config.Instances[strings.ToLower(step)]
+		if !ok {
+			return errors.New(fmt.Sprintf("extension %v has no configured instance", step))
+		}
+		s.extensions[step] = instance.(Extension)
+		log.Infof("Extension %v initialized", step)
+	}
+	if len(ext) == 2 {
+		srvConf := structs.New(s.config)
+		extType := strings.ToLower(ext[0])
+		extName := strings.ToLower(ext[1])
+		// loop through struct fields. Ifs are needed due to case sensitivity
+		for _, f := range srvConf.Fields() {
+			if strings.ToLower(f.Name()) == extType && f.Kind() == reflect.Struct {
+				for _, n := range srvConf.Field(f.Name()).Fields() {
+					if strings.ToLower(n.Name()) == extName {
+						s.extensions[step] = n.Value().(Extension)
+						log.Infof("Extension %v initialized", step)
 					}
 				}
 			}
 		}
 	}
+
+	return nil
 }
 
 // run starts all core components and extensions
-func (s *server) run() {
+// it returns an error if the leadership is lost
+func (s *server) run() error {
 	signal.Notify(s.signals, os.Interrupt)
 	signal.Notify(s.signals, os.Kill)
 
+	// the standby replicas wait for the leadership, only the leader runs the workflow
+	if s.elector != nil {
+		lost, elected := s.waitLeadership()
+		if !elected {
+			log.Info("Stopped before being elected leader")
+			return nil
+		}
+		log.Info("Elected leader")
+		s.leaderShutdown = make(chan bool, 1)
+		s.coreWG.Add(1)
+		go s.watchLeadership(lost)
+	}
+
+	// load the entries once leader, as the previous leader changed them
+	if err := s.workflowEntries.load(); err != nil {
+		log.Errorf("Could not load workflow entries: %v", err)
+	}
+	s.workflowEntries.dropLegacyEntries(s.isLegacyKey)
+
 	// run workflowHouseKeeper
 	s.coreWG.Add(1)
 	go s.housekeeper()
 
+	// run retryLauncher
+	s.coreWG.Add(1)
+	go s.retryLauncher()
+
 	// run messageForwarder
 	go s.messageSender()
 
@@ -152,6 +279,9 @@ func (s *server) run() {
 		}()
 	}
 
+	// the loaded entries may be out of sync, the providers answer once started
+	go s.resync()
+
 	// run http core
 	s.coreWG.Add(1)
 	go s.startAPI()
@@ -159,27 +289,159 @@ func (s *server) run() {
 	// SIGs to handle proper extensions and core components shutdown
 	go func() {
 		for range s.signals {
-			log.Info("Stopping workflow manager")
-
-			s.housekeeperShutdown <- true
+			s.stop()
 
-			for name, extension := range s.extensions {
-				log.Infof("Stopping extension %v", name)
-				if err := extension.Stop(); err != nil {
-					log.Errorf("Error stopping extension %v:%v", name, err)
-				}
+			if s.elector != nil {
+				s.leaderShutdown <- true
 			}
-			s.extensionsWG.Wait()
-			log.Info("All extensions are down")
-			s.stopAPI()
 		}
 	}()
 
 	s.coreWG.Wait()
-	if err := s.workflowEntries.save(); err != nil {
+
+	// the entries are not saved once the leadership is lost, they are owned by the new leader
+	if s.leadershipLost {
+		if err := s.elector.resign(); err != nil {
+			log.Debugf("Error resigning lost leadership: %v", err)
+		}
+		return errors.New("leadership lost, stepped down")
+	}
+
+	if err := s.workflowEntries.close(); err != nil {
 		log.Error(err.Error())
 	}
 	log.Infof("Saved flow entries to %v", s.config.Core.WorkflowEntriesFile)
+
+	// the entries are saved before another replica takes over
+	if s.elector != nil {
+		if err := s.elector.resign(); err != nil {
+			log.Errorf("Error resigning leadership: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// stop stops the work loops, the extensions and the API, once
+func (s *server) stop() {
+	s.stopOnce.Do(func() {
+		log.Info("Stopping workflow manager")
+
+		s.housekeeperShutdown <- true
+		s.retryShutdown <- true
+
+		for name, extension := range s.extensions {
+			log.Infof("Stopping extension %v", name)
+			if err := extension.Stop(); err != nil {
+				log.Errorf("Error stopping extension %v:%v", name, err)
+			}
+		}
+		s.extensionsWG.Wait()
+		log.Info("All extensions are down")
+		s.stopAPI()
+	})
+}
+
+// waitLeadership blocks until the replica is elected leader
+// it returns the channel closed if the leadership is lost, and false if interlook is stopped before
+func (s *server) waitLeadership() (<-chan struct{}, bool) {
+	log.Info("Waiting for leadership")
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-s.signals:
+			close(stop)
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+
+	for {
+		lost, err := s.elector.campaign(stop)
+		if err == nil {
+			close(done)
+			if <-interrupted {
+				if lost != nil {
+					if err := s.elector.resign(); err != nil {
+						log.Errorf("Error resigning leadership: %v", err)
+					}
+				}
+				return nil, false
+			}
+			return lost, true
+		}
+
+		log.Errorf("Error electing leader: %v", err)
+		select {
+		case <-stop:
+			close(done)
+			<-interrupted
+			return nil, false
+		case <-time.After(leaderElectionRetryInterval):
+		}
+	}
+}
+
+// watchLeadership stops interlook if the leadership is lost, so that the entries are not changed by two replicas
+func (s *server) watchLeadership(lost <-chan struct{}) {
+	select {
+	case <-lost:
+		log.Error("Leadership lost, stepping down")
+		s.leadershipLost = true
+		s.stop()
+		s.coreWG.Done()
+	case <-s.leaderShutdown:
+		s.coreWG.Done()
+	}
+}
+
+// resync reconciles the loaded entries with the extensions and the providers
+// the in-flight entries are sent again to their extension, and the providers are asked for a snapshot of their services,
+// so that the services added or deleted while interlook was down are deployed or un-deployed without waiting for serviceMaxLastUpdated
+// the providers not sending snapshots are asked for the current definition of the other services
+func (s *server) resync() {
+	services := s.workflowEntries.providedServices()
+
+	s.resumeEntries()
+
+	snapshotters := make(map[string]bool)
+	for _, name := range s.providers() {
+		if s.isSnapshotter(name) {
+			snapshotters[name] = true
+			log.Infof("Requesting a snapshot of the services of %v", name)
+			s.sendMessageToExtension(comm.Message{Action: comm.SnapshotAction}, name)
+		}
+	}
+
+	var refreshes []comm.Service
+	for _, service := range services {
+		if !snapshotters[service.Provider] {
+			refreshes = append(refreshes, service)
+		}
+	}
+
+	log.Infof("Refreshing %v services from their provider", len(refreshes))
+	for _, service := range refreshes {
+		if err := s.refreshService(service.Name, service.Provider); err != nil {
+			log.Errorf("Error sending service refresh to provider %v", err)
+		}
+	}
+}
+
+// resumeEntries sends again the in-flight entries to their extension
+// ie taken over from the previous leader, or interlook stopped before the extension answered
+func (s *server) resumeEntries() {
+	for _, entry := range s.workflowEntries.inFlight() {
+		log.Infof("Resuming step %v of %v", entry.State, entry.Service.Name)
+		go func(entry *workflowEntry) {
+			entry.sendToExtension()
+			entry.persist()
+		}(entry)
+	}
 }
 
 // extensionListener gets messages from extensions and send them to workflow
@@ -195,6 +457,18 @@ func (s *server) extensionListener(extension *extensionChannels) {
 		newMessage.Sender = extension.name
 		newMessage.SetTargetWeight()
 
+		// a service can only be managed by one provider, and follow a configured workflow
+		err := s.workflowEntries.checkProvider(newMessage)
+		if err == nil {
+			err = checkWorkflow(newMessage)
+		}
+		if err != nil {
+			log.Warnf("Message from %v rejected: %v", extension.name, err)
+			s.rejectMessage(newMessage, err)
+			s.coreWG.Done()
+			continue
+		}
+
 		log.Debugf("Received message from %v, sending to message handler", extension.name)
 
 		// inject message to workflow
@@ -207,6 +481,7 @@ func (s *server) extensionListener(extension *extensionChannels) {
 
 // housekeeper
 func (s *server) housekeeper() {
+	var lastDriftCheck time.Time
 	for {
 		select {
 		case <-s.housekeeperShutdown:
@@ -218,63 +493,196 @@ func (s *server) housekeeper() {
 		case <-s.housekeeperTicker.C:
 			s.housekeeperWG.Add(1)
 			log.Debug("Running housekeeper")
+			var refreshes []comm.Service
 			s.workflowEntries.Lock()
 			for k, entry := range s.workflowEntries.Entries {
 				if entry.State == entry.ExpectedState && !entry.WorkInProgress {
 					// remove old closed entry
 					if entry.State == undeployedState && time.Now().Sub(entry.CloseTime) > s.config.Core.CleanUndeployedServiceAfter {
-						delete(s.workflowEntries.Entries, k)
+						s.workflowEntries.remove(k)
 					}
 				}
 				// ask refresh to provider
 				if time.Now().Sub(entry.LastUpdate) > s.config.Core.ServiceMaxLastUpdated && entry.State == deployedState {
-					err := s.refreshService(entry.Service.Name)
-					if err != nil {
-						log.Errorf("Error sending service refresh to provider %entry", err)
-					}
+					refreshes = append(refreshes, entry.Service)
+				}
+				// fail the deployments waiting for approval for too long
+				if s.config.Core.ApprovalTimeout > 0 {
+					entry.expireApproval(time.Now().Add(-s.config.Core.ApprovalTimeout))
 				}
-				// closing of WIP timed out
-				if entry.WorkInProgress && time.Now().Sub(entry.WIPTime) > s.config.Core.ServiceWIPTimeout {
-					errorMsg := fmt.Sprintf("Closed due to ServiceWIPTimeout reached at step %v. Err: %v", entry.State, entry.Error)
-					entry.close(errorMsg)
-					log.Warn(errorMsg)
+				// retry or fail the steps of WIP timed out
+				entry.timeoutStep(time.Now().Add(-s.config.Core.ServiceWIPTimeout))
+				// entries in error are retried by the retryLauncher
+			}
+			s.workflowEntries.Unlock()
+
+			// the extensions answer through the listener, which needs the entries lock
+			if s.config.Core.DriftCheckInterval > 0 && time.Now().Sub(lastDriftCheck) > s.config.Core.DriftCheckInterval {
+				lastDriftCheck = time.Now()
+				for _, msg := range s.workflowEntries.verifications(s.isVerifier) {
+					log.Debugf("Sending verification of %v to %v", msg.Service.Name, msg.Destination)
+					s.sendMessageToExtension(msg, msg.Destination)
+				}
+			}
+
+			// the providers answer through the listener, which needs the entries lock
+			for _, service := range refreshes {
+				if err := s.refreshService(service.Name, service.Provider); err != nil {
+					log.Errorf("Error sending service refresh to provider %v", err)
 				}
-				// add closing of in error flows
 			}
 			s.housekeeperWG.Done()
 		}
-		s.workflowEntries.Unlock()
 	}
 }
 
-func (s *server) refreshService(serviceName string) error {
-	log.Infof("Sending refresh request for %v", serviceName)
-	for name, extension := range s.extensions {
+// retryLauncher sends again the entries whose failed step is due for a new attempt
+// and merges the provider updates held until the rollback of their service is over
+func (s *server) retryLauncher() {
+	for {
+		select {
+		case <-s.retryShutdown:
+			log.Info("Stopping retry launcher")
+			s.retryTicker.Stop()
+			s.coreWG.Done()
+			return
 
-		_, ok := extension.(Provider)
-		if ok {
-			msg := comm.Message{
-				Action: comm.RefreshAction,
-				Service: comm.Service{
-					Name: serviceName,
-				},
+		case <-s.retryTicker.C:
+			for _, entry := range s.workflowEntries.dueRetries(time.Now()) {
+				log.Infof("Retrying step %v of %v, attempt %v", entry.State, entry.Service.Name, entry.Attempts+1)
+				go func(entry *workflowEntry) {
+					entry.sendToExtension()
+					entry.persist()
+				}(entry)
 			}
-			log.Debugf("Sending refresh request to %v", name)
-			s.sendMessageToExtension(msg, name)
-			return nil
+			for _, msg := range s.workflowEntries.releaseHeldUpdates() {
+				log.Infof("Merging the update of %v held during its rollback", msg.Service.Name)
+				if err := s.workflowEntries.mergeMessage(msg); err != nil {
+					log.Errorf("Error %v when inserting %v to flow\n", err, msg.Service.Name)
+				}
+			}
+		}
+	}
+}
+
+// refreshService sends a refresh request to the provider of the service
+// entries without provider (ie loaded from an older entries file) are sent to the provider if only one is configured
+func (s *server) refreshService(serviceName, providerName string) error {
+	log.Infof("Sending refresh request for %v", serviceName)
+
+	if providerName == "" {
+		providers := s.providers()
+		if len(providers) != 1 {
+			return errors.New(fmt.Sprintf("Could not send refresh message for %v: unknown provider", serviceName))
+		}
+		providerName = providers[0]
+	}
+
+	if _, ok := s.extensions[providerName].(Provider); !ok {
+		return errors.New(fmt.Sprintf("Could not send refresh message for %v: provider %v is not running", serviceName, providerName))
+	}
+
+	msg := comm.Message{
+		Action: comm.RefreshAction,
+		Service: comm.Service{
+			Name: serviceName,
+		},
+	}
+	log.Debugf("Sending refresh request to %v", providerName)
+	s.sendMessageToExtension(msg, providerName)
+
+	return nil
+}
+
+// providers returns the names of the running providers
+func (s *server) providers() []string {
+	var names []string
+	for name, extension := range s.extensions {
+		if _, ok := extension.(Provider); ok {
+			names = append(names, name)
 		}
 	}
-	return errors.New("Could not send refresh message to provider")
+	return names
+}
+
+// rejectMessage reports the rejection of the provider's message through a status message
+func (s *server) rejectMessage(msg comm.Message, err error) {
+	if msg.Action != comm.AddAction {
+		return
+	}
+
+	status := comm.Message{
+		Action:      comm.StatusAction,
+		Destination: msg.Sender,
+		Error:       err.Error(),
+		State:       undeployedState,
+		Service:     msg.Service,
+	}
+
+	go func() {
+		msgToExtension <- status
+	}()
 }
 
 func (s *server) messageSender() {
 	for {
 		msg := <-msgToExtension
+		if msg.Action == comm.StatusAction && !s.isStatusReceiver(msg.Destination) {
+			continue
+		}
 		log.Debugf("Forwarding msg %v", msg)
 		s.sendMessageToExtension(msg, msg.Destination)
 	}
 }
 
+// isStatusReceiver returns true if the extension wants to be notified of the services state
+func (s *server) isStatusReceiver(extensionName string) bool {
+	extension, ok := s.extensions[extensionName]
+	if !ok {
+		return false
+	}
+
+	_, ok = extension.(StatusReceiver)
+	return ok
+}
+
+// isLegacyKey returns true if the provider of the service no more identifies it with the given key
+// entries without provider (ie loaded from an older entries file) are checked by the provider if only one is configured
+func (s *server) isLegacyKey(serviceName, providerName string) bool {
+	if providerName == "" {
+		providers := s.providers()
+		if len(providers) != 1 {
+			return false
+		}
+		providerName = providers[0]
+	}
+
+	checker, ok := s.extensions[providerName].(LegacyKeyChecker)
+	return ok && checker.IsLegacyKey(serviceName)
+}
+
+// isSnapshotter returns true if the extension sends a snapshot of its services when requested
+func (s *server) isSnapshotter(extensionName string) bool {
+	extension, ok := s.extensions[extensionName]
+	if !ok {
+		return false
+	}
+
+	_, ok = extension.(Snapshotter)
+	return ok
+}
+
+// isVerifier returns true if the extension verifies the actual state of the services
+func (s *server) isVerifier(extensionName string) bool {
+	extension, ok := s.extensions[extensionName]
+	if !ok {
+		return false
+	}
+
+	_, ok = extension.(Verifier)
+	return ok
+}
+
 func (s *server) sendMessageToExtension(msg comm.Message, extensionName string) {
 	// get the extension channel to write message to
 	ext, ok := s.extensionChannels[extensionName]
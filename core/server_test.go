@@ -0,0 +1,462 @@
+package core
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/config"
+	"github.com/interlook/interlook/provider/swarm"
+	"github.com/interlook/interlook/provisioner/loadbalancer/f5ltm"
+)
+
+type fakeExtension struct{}
+
+func (f *fakeExtension) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+	return nil
+}
+func (f *fakeExtension) Stop() error { return nil }
+
+type fakeProvider struct {
+	fakeExtension
+}
+
+func (f *fakeProvider) RefreshService(msg comm.Message) {}
+
+type fakeStatusProvider struct {
+	fakeProvider
+}
+
+func (f *fakeStatusProvider) ServiceStatus(msg comm.Message) {}
+
+type fakeSnapshotter struct {
+	fakeProvider
+}
+
+func (f *fakeSnapshotter) Snapshot(msg comm.Message) {}
+
+type fakeLegacyKeyChecker struct {
+	fakeProvider
+}
+
+func (f *fakeLegacyKeyChecker) IsLegacyKey(name string) bool { return name == "legacy" }
+
+func Test_server_isStatusReceiver(t *testing.T) {
+	s := server{extensions: map[string]Extension{
+		"provider.one":    &fakeProvider{},
+		"provider.status": &fakeStatusProvider{},
+		"lb.one":          &fakeExtension{},
+	}}
+
+	tests := []struct {
+		name      string
+		extension string
+		want      bool
+	}{
+		{"provider", "provider.one", false},
+		{"statusProvider", "provider.status", true},
+		{"provisioner", "lb.one", false},
+		{"unknown", "provider.unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.isStatusReceiver(tt.extension); got != tt.want {
+				t.Errorf("isStatusReceiver() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// newTestServer returns a server with the given extensions and their channels
+func newTestServer(extensions map[string]Extension) *server {
+	s := &server{extensions: extensions, extensionChannels: make(map[string]*extensionChannels)}
+	for name := range extensions {
+		s.extensionChannels[name] = &extensionChannels{
+			name:    name,
+			receive: make(chan comm.Message, 1),
+			send:    make(chan comm.Message),
+		}
+	}
+	return s
+}
+
+func Test_server_refreshService(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]Extension
+		provider   string
+		want       string
+		wantErr    bool
+	}{
+		{"routedToProvider", map[string]Extension{"provider.one": &fakeProvider{}, "provider.two": &fakeProvider{}, "lb.one": &fakeExtension{}}, "provider.two", "provider.two", false},
+		{"providerNotRunning", map[string]Extension{"provider.one": &fakeProvider{}}, "provider.two", "", true},
+		{"notAProvider", map[string]Extension{"provider.one": &fakeProvider{}, "lb.one": &fakeExtension{}}, "lb.one", "", true},
+		{"unknownSingleProvider", map[string]Extension{"provider.one": &fakeProvider{}, "lb.one": &fakeExtension{}}, "", "provider.one", false},
+		{"unknownSeveralProviders", map[string]Extension{"provider.one": &fakeProvider{}, "provider.two": &fakeProvider{}}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(tt.extensions)
+			err := s.refreshService("svc", tt.provider)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("refreshService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for name, ext := range s.extensions {
+				received := len(s.extensionChannels[name].receive) > 0
+				if received != (name == tt.want) {
+					t.Errorf("refresh received by %v = %v, want %v (%T)", name, received, name == tt.want, ext)
+				}
+			}
+		})
+	}
+}
+
+func Test_server_resync(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,lb.two")}
+
+	s := newTestServer(map[string]Extension{"provider.one": &fakeProvider{}, "lb.two": &fakeExtension{}})
+	s.extensionChannels["provider.one"].receive = make(chan comm.Message, 10)
+	s.workflowEntries = initWorkflowEntries(nil)
+	s.workflowEntries.Entries["wip"] = &workflowEntry{State: "lb.two", ExpectedState: deployedState, WorkInProgress: true,
+		Service: comm.Service{Name: "wip", Provider: "provider.one"}}
+	s.workflowEntries.Entries["deployed"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "deployed", Provider: "provider.one"}}
+	s.workflowEntries.Entries["undeployed"] = &workflowEntry{State: undeployedState, ExpectedState: undeployedState,
+		Service: comm.Service{Name: "undeployed", Provider: "provider.one"}}
+
+	s.resync()
+
+	// the in-flight entry is sent again to its extension
+	select {
+	case got := <-msgToExtension:
+		if got.Destination != "lb.two" || got.Service.Name != "wip" {
+			t.Errorf("resumed %v to %v, want wip to lb.two", got.Service.Name, got.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight entry not resumed")
+	}
+
+	// the provider is asked for the other services expected deployed
+	receive := s.extensionChannels["provider.one"].receive
+	if len(receive) != 1 {
+		t.Fatalf("provider received %v refreshes, want 1", len(receive))
+	}
+	if got := <-receive; got.Action != comm.RefreshAction || got.Service.Name != "deployed" {
+		t.Errorf("got %v %v, want refresh of deployed", got.Action, got.Service.Name)
+	}
+}
+
+func Test_server_resyncSnapshot(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,lb.two")}
+
+	s := newTestServer(map[string]Extension{"provider.one": &fakeSnapshotter{}, "provider.two": &fakeProvider{}, "lb.two": &fakeExtension{}})
+	s.workflowEntries = initWorkflowEntries(nil)
+	for _, name := range []string{"kept", "vanished"} {
+		s.workflowEntries.Entries[name] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+			Service: comm.Service{Name: name, Provider: "provider.one"}}
+	}
+	s.workflowEntries.Entries["other"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "other", Provider: "provider.two"}}
+
+	s.resync()
+
+	// the snapshot lists the services added while interlook was down, its services are not refreshed one by one
+	receive := s.extensionChannels["provider.one"].receive
+	if len(receive) != 1 {
+		t.Fatalf("provider.one received %v messages, want 1", len(receive))
+	}
+	if got := <-receive; got.Action != comm.SnapshotAction {
+		t.Errorf("got %v, want snapshot request", got.Action)
+	}
+
+	// the other provider is asked for its services
+	if got := <-s.extensionChannels["provider.two"].receive; got.Action != comm.RefreshAction || got.Service.Name != "other" {
+		t.Errorf("got %v %v, want refresh of other", got.Action, got.Service.Name)
+	}
+
+	// the service deleted while interlook was down is missing from the snapshot
+	snapshot := comm.BuildSnapshotMessage([]string{"kept"})
+	snapshot.Sender = "provider.one"
+	if err := s.workflowEntries.mergeMessage(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-msgToExtension:
+		if got.Action != comm.DeleteAction || got.Destination != "lb.two" || got.Service.Name != "vanished" {
+			t.Errorf("got %v of %v to %v, want delete of vanished to lb.two", got.Action, got.Service.Name, got.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("vanished service not un-deployed")
+	}
+	if got := s.workflowEntries.Entries["kept"]; got.ExpectedState != deployedState {
+		t.Errorf("kept expected state = %v, want %v", got.ExpectedState, deployedState)
+	}
+}
+
+func Test_server_dropLegacyEntries(t *testing.T) {
+	msgToExtension = make(chan comm.Message, 10)
+	s := newTestServer(map[string]Extension{"provider.one": &fakeLegacyKeyChecker{}, "lb.two": &fakeExtension{}})
+	s.workflowEntries = initWorkflowEntries(nil)
+	s.workflowEntries.Entries["legacy"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "legacy", Provider: "provider.one"}}
+	s.workflowEntries.Entries["ns/legacy"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "ns/legacy", Provider: "provider.one"}}
+
+	s.workflowEntries.dropLegacyEntries(s.isLegacyKey)
+
+	if _, ok := s.workflowEntries.Entries["legacy"]; ok {
+		t.Errorf("legacy entry not dropped")
+	}
+	if _, ok := s.workflowEntries.Entries["ns/legacy"]; !ok {
+		t.Errorf("ns/legacy entry dropped")
+	}
+	// the dropped entry is not un-deployed, its DNS aliases are taken over by the entry under the new key
+	if len(msgToExtension) != 0 {
+		t.Errorf("%v messages sent to the extensions, want none", len(msgToExtension))
+	}
+}
+
+func Test_server_isLegacyKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		extensions map[string]Extension
+		provider   string
+		want       bool
+	}{
+		{"legacy", map[string]Extension{"provider.one": &fakeLegacyKeyChecker{}}, "provider.one", true},
+		{"notChecker", map[string]Extension{"provider.one": &fakeProvider{}}, "provider.one", false},
+		{"unknownSingleProvider", map[string]Extension{"provider.one": &fakeLegacyKeyChecker{}, "lb.one": &fakeExtension{}}, "", true},
+		{"unknownSeveralProviders", map[string]Extension{"provider.one": &fakeLegacyKeyChecker{}, "provider.two": &fakeProvider{}}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(tt.extensions)
+			if got := s.isLegacyKey("legacy", tt.provider); got != tt.want {
+				t.Errorf("isLegacyKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_server_extensionListenerRejectsOtherProvider(t *testing.T) {
+	msgToExtension = make(chan comm.Message)
+	s := newTestServer(map[string]Extension{"provider.one": &fakeProvider{}, "provider.two": &fakeStatusProvider{}})
+	s.workflowEntries = initWorkflowEntries(nil)
+	s.workflowEntries.Entries["svc"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "svc", Provider: "provider.one", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80}}}}
+
+	two := s.extensionChannels["provider.two"]
+	go s.extensionListener(two)
+	two.send <- comm.Message{Action: comm.AddAction, Service: comm.Service{Name: "svc", Targets: []comm.Target{{Host: "10.32.2.2", Port: 80}}}}
+
+	got := <-msgToExtension
+	if got.Action != comm.StatusAction || got.Destination != "provider.two" || got.Error == "" {
+		t.Errorf("status = %v, want a status with error to provider.two", got)
+	}
+
+	s.workflowEntries.Lock()
+	defer s.workflowEntries.Unlock()
+	if entry := s.workflowEntries.Entries["svc"]; entry.Service.Provider != "provider.one" || entry.Service.Targets[0].Host != "10.32.2.1" {
+		t.Errorf("entry updated by the other provider: %v", entry.Service)
+	}
+}
+
+func Test_server_initExtensions(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	workflows = map[string]workflowSteps{
+		defaultWorkflow: initWorkflow("provider.swarm,lb.f5ltm.dc1"),
+		"dc2":           initWorkflow("provider.swarm,lb.f5ltm.DC2"),
+	}
+
+	cfg := &config.ServerConfiguration{}
+	cfg.Provider.Swarm = &swarm.Provider{}
+	cfg.LB.F5LTM = &f5ltm.BigIP{}
+	cfg.Instances = map[string]interface{}{
+		"lb.f5ltm.dc1": &f5ltm.BigIP{Endpoint: "https://10.32.21.100"},
+		"lb.f5ltm.dc2": &f5ltm.BigIP{Endpoint: "https://10.32.22.100"},
+	}
+
+	s := server{config: cfg}
+	if err := s.initExtensions(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.extensions) != 3 {
+		t.Errorf("initExtensions() got %v extensions, want 3", len(s.extensions))
+	}
+	if s.extensions["provider.swarm"] != cfg.Provider.Swarm {
+		t.Errorf("initExtensions() provider.swarm not initialized")
+	}
+	// the steps are matched case insensitively with the instances
+	for step, name := range map[string]string{"lb.f5ltm.dc1": "lb.f5ltm.dc1", "lb.f5ltm.DC2": "lb.f5ltm.dc2"} {
+		if s.extensions[step] != cfg.Instances[name] {
+			t.Errorf("initExtensions() %v not initialized", step)
+		}
+	}
+	// the instances do not share the default extension
+	if _, ok := s.extensions["lb.f5ltm"]; ok {
+		t.Errorf("initExtensions() lb.f5ltm initialized")
+	}
+
+	// a step naming an instance not configured fails the startup
+	workflows["dc3"] = initWorkflow("provider.swarm,lb.f5ltm.dc3")
+	s = server{config: cfg}
+	if err := s.initExtensions(); err == nil {
+		t.Errorf("initExtensions() expected an error for lb.f5ltm.dc3")
+	}
+}
+
+type fakeElector struct {
+	// closed to elect the replica
+	elected  chan struct{}
+	lost     chan struct{}
+	resigned bool
+}
+
+func (e *fakeElector) campaign(stop <-chan struct{}) (<-chan struct{}, error) {
+	select {
+	case <-e.elected:
+		return e.lost, nil
+	case <-stop:
+		return nil, nil
+	}
+}
+
+func (e *fakeElector) resign() error {
+	e.resigned = true
+	return nil
+}
+
+func Test_server_waitLeadership(t *testing.T) {
+	tests := []struct {
+		name        string
+		elect       bool
+		wantElected bool
+	}{
+		{"elected", true, true},
+		{"stoppedBeforeElected", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &fakeElector{elected: make(chan struct{}), lost: make(chan struct{})}
+			s := &server{elector: e, signals: make(chan os.Signal, 1)}
+			if tt.elect {
+				close(e.elected)
+			} else {
+				s.signals <- os.Interrupt
+			}
+
+			lost, elected := s.waitLeadership()
+			if elected != tt.wantElected || (lost != nil) != tt.wantElected {
+				t.Errorf("waitLeadership() = %v, %v, want elected %v", lost, elected, tt.wantElected)
+			}
+			if e.resigned {
+				t.Errorf("waitLeadership() resigned")
+			}
+			// the signals are not consumed once elected
+			if tt.elect {
+				s.signals <- os.Interrupt
+				if len(s.signals) != 1 {
+					t.Errorf("signal consumed after the election")
+				}
+			}
+		})
+	}
+}
+
+// stoppedExtension records that it was stopped
+type stoppedExtension struct {
+	fakeExtension
+	stopped chan struct{}
+}
+
+func (f *stoppedExtension) Stop() error {
+	close(f.stopped)
+	return nil
+}
+
+func Test_server_watchLeadershipLost(t *testing.T) {
+	extension := &stoppedExtension{stopped: make(chan struct{})}
+	s := &server{
+		config:              &config.ServerConfiguration{},
+		extensions:          map[string]Extension{"provider.one": extension},
+		workflowEntries:     initWorkflowEntries(nil),
+		apiServer:           &http.Server{},
+		housekeeperShutdown: make(chan bool),
+		housekeeperTicker:   time.NewTicker(time.Hour),
+		retryShutdown:       make(chan bool),
+		retryTicker:         time.NewTicker(time.Hour),
+		leaderShutdown:      make(chan bool, 1),
+	}
+	// the work loops and the API
+	s.coreWG.Add(4)
+	go s.housekeeper()
+	go s.retryLauncher()
+
+	lost := make(chan struct{})
+	go s.watchLeadership(lost)
+	close(lost)
+
+	// the work loops are stopped, instead of exiting without stopping the extensions
+	stopped := make(chan struct{})
+	go func() {
+		s.coreWG.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("work loops not stopped once the leadership is lost")
+	}
+	select {
+	case <-extension.stopped:
+	default:
+		t.Errorf("extension not stopped")
+	}
+	if !s.leadershipLost {
+		t.Errorf("leadership loss not recorded")
+	}
+
+	// a signal received once stepped down does not block
+	s.stop()
+	s.leaderShutdown <- true
+}
+
+func Test_server_initEntryStore(t *testing.T) {
+	tests := []struct {
+		name           string
+		storeType      string
+		leaderElection bool
+		wantElector    bool
+		wantErr        bool
+	}{
+		{"file", fileStoreType, false, false, false},
+		{"consul", consulStoreType, false, false, false},
+		{"consulLeaderElection", consulStoreType, true, true, false},
+		{"fileLeaderElection", fileStoreType, true, false, true},
+		{"unknown", "unknown", false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ServerConfiguration{}
+			cfg.Core.WorkflowEntriesStore = tt.storeType
+			cfg.Core.LeaderElection = tt.leaderElection
+			s := &server{config: cfg}
+
+			_, err := s.initEntryStore()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initEntryStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (s.elector != nil) != tt.wantElector {
+				t.Errorf("initEntryStore() elector = %v, want %v", s.elector, tt.wantElector)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// the entries are saved to a JSON file on shutdown
+	fileStoreType = "file"
+	// each entry change is saved to a bolt database
+	boltStoreType = "bolt"
+)
+
+var entriesBucket = []byte("entries")
+
+// entryStore persists the workflow entries
+type entryStore interface {
+	// load returns the persisted entries by service name
+	load() (map[string]*workflowEntry, error)
+	// put saves the entry, the caller must not hold the entry lock
+	put(name string, entry *workflowEntry) error
+	// delete removes the entry
+	delete(name string) error
+	// close saves the given entries and releases the store, the caller must not hold their lock
+	close(entries map[string]*workflowEntry) error
+}
+
+// newEntryStore returns the store of the given type, saving the entries to path
+func newEntryStore(storeType, path string) (entryStore, error) {
+	switch storeType {
+	case "", fileStoreType:
+		return &fileStore{path: path}, nil
+	case boltStoreType:
+		store, err := openBoltStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("unknown workflow entries store %v", storeType))
+	}
+}
+
+// marshal returns the JSON of the entry, locked while marshalled
+func (e *workflowEntry) marshal() ([]byte, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	return json.Marshal(e)
+}
+
+// fileStore saves all the entries to a JSON file on shutdown
+// the changes since startup are lost if interlook does not stop cleanly
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) load() (map[string]*workflowEntry, error) {
+	file, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*workflowEntry)
+	if err = json.Unmarshal(file, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// put does nothing, the entries are saved on close
+func (s *fileStore) put(name string, entry *workflowEntry) error {
+	return nil
+}
+
+// delete does nothing, the entries are saved on close
+func (s *fileStore) delete(name string) error {
+	return nil
+}
+
+func (s *fileStore) close(entries map[string]*workflowEntry) error {
+	marshalled := make(map[string]json.RawMessage, len(entries))
+	for name, entry := range entries {
+		data, err := entry.marshal()
+		if err != nil {
+			return err
+		}
+		marshalled[name] = data
+	}
+
+	data, err := json.Marshal(marshalled)
+	if err != nil {
+		return err
+	}
+
+	dbFile, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = dbFile.Write(data); err != nil {
+		dbFile.Close()
+		return err
+	}
+
+	if err := dbFile.Sync(); err != nil {
+		dbFile.Close()
+		return err
+	}
+
+	return dbFile.Close()
+}
+
+// boltStore saves each entry change to a bolt database, in its own transaction
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// do not wait forever for another interlook holding the database
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open workflow entries database %v", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) load() (map[string]*workflowEntry, error) {
+	entries := make(map[string]*workflowEntry)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(name, data []byte) error {
+			var entry workflowEntry
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return errors.Wrapf(err, "could not read entry %s", name)
+			}
+			entries[string(name)] = &entry
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func (s *boltStore) put(name string, entry *workflowEntry) error {
+	data, err := entry.marshal()
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Put([]byte(name), data)
+	})
+}
+
+func (s *boltStore) delete(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(name))
+	})
+}
+
+// close saves the entries changes that are not persisted (ie last update time)
+func (s *boltStore) close(entries map[string]*workflowEntry) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		for name, entry := range entries {
+			data, err := entry.marshal()
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.db.Close()
+		return err
+	}
+
+	return s.db.Close()
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+func tempStore(t *testing.T, storeType string) (entryStore, string) {
+	dir, err := ioutil.TempDir("", "interlook-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newEntryStore(storeType, filepath.Join(dir, "entries.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, dir
+}
+
+func Test_newEntryStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		storeType string
+		path      string
+		wantErr   bool
+	}{
+		{"default", "", "/notfound/entries.db", false},
+		{"file", fileStoreType, "/notfound/entries.db", false},
+		{"bolt", boltStoreType, filepath.Join(os.TempDir(), "interlook-entries-test.db"), false},
+		{"boltInvalidPath", boltStoreType, "/notfound/entries.db", true},
+		{"unknown", "unknown", "/notfound/entries.db", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newEntryStore(tt.storeType, tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newEntryStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if store != nil {
+				store.close(nil)
+			}
+			if tt.storeType == boltStoreType && !tt.wantErr {
+				os.Remove(tt.path)
+			}
+		})
+	}
+}
+
+func Test_entryStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		storeType string
+		// entries put are loaded before the store is closed
+		persistsChanges bool
+	}{
+		{"file", fileStoreType, false},
+		{"bolt", boltStoreType, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, dir := tempStore(t, tt.storeType)
+			defer os.RemoveAll(dir)
+
+			one := &workflowEntry{State: deployedState, Service: comm.Service{Name: "one"}}
+			two := &workflowEntry{State: "lb.two", Workflow: "internal", Service: comm.Service{Name: "two"}}
+			for _, entry := range []*workflowEntry{one, two} {
+				if err := store.put(entry.Service.Name, entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.delete("one"); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.load()
+			if tt.persistsChanges {
+				if err != nil || len(got) != 1 || got["two"] == nil || got["two"].State != "lb.two" || got["two"].Workflow != "internal" {
+					t.Errorf("load() = %v, %v, want entry two", got, err)
+				}
+			} else if err == nil {
+				t.Errorf("load() = %v, want error as the entries are not saved", got)
+			}
+
+			// the entries are all saved on close
+			one.LastUpdate = time.Now()
+			if err := store.close(map[string]*workflowEntry{"one": one}); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := newEntryStore(tt.storeType, filepath.Join(dir, "entries.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.close(nil)
+
+			got, err = reopened.load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got["one"] == nil || !got["one"].LastUpdate.Equal(one.LastUpdate) {
+				t.Errorf("load() = %v, want entry one saved on close", got)
+			}
+			if _, ok := got["two"]; ok != tt.persistsChanges {
+				t.Errorf("load() entry two found %v, want %v", ok, tt.persistsChanges)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_persist(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two")}
+
+	store, dir := tempStore(t, boltStoreType)
+	defer os.RemoveAll(dir)
+	defer store.close(nil)
+
+	we := initWorkflowEntries(store)
+	svc := comm.Service{Name: "svc", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	<-msgToExtension
+
+	// the entry sent to ipam.two is saved without closing the store
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := store.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, ok := got["svc"]; ok && entry.State == "ipam.two" && entry.WorkInProgress {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("entry not saved: %v", got["svc"])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// removed entries are deleted from the store
+	we.Lock()
+	we.remove("svc")
+	we.Unlock()
+	if got, _ := store.load(); len(got) != 0 {
+		t.Errorf("load() = %v, want no entry", got)
+	}
+
+	// loaded entries are saved to the store
+	if err := store.put("svc", &workflowEntry{State: deployedState, Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	loaded := initWorkflowEntries(store)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if entry := loaded.Entries["svc"]; entry == nil || entry.store != store {
+		t.Errorf("load() entry %v not attached to the store", entry)
+	}
+}
+
+// lockCheckStore fails the saves of the entries locked while written
+type lockCheckStore struct {
+	fileStore
+	err error
+}
+
+func (s *lockCheckStore) put(name string, entry *workflowEntry) error {
+	unlocked := make(chan struct{})
+	go func() {
+		entry.Lock()
+		entry.Unlock()
+		close(unlocked)
+	}()
+
+	select {
+	case <-unlocked:
+		s.err = nil
+	case <-time.After(100 * time.Millisecond):
+		s.err = errors.New("entry locked while written")
+	}
+	return s.err
+}
+
+func Test_workflowEntry_persistUnlocked(t *testing.T) {
+	store := &lockCheckStore{}
+	entry := &workflowEntry{State: deployedState, Service: comm.Service{Name: "svc"}, store: store}
+
+	entry.Lock()
+	store.put("svc", entry)
+	entry.Unlock()
+	if store.err == nil {
+		t.Fatal("put() expected error on locked entry")
+	}
+
+	// the entry is only locked while read, the transitions are not blocked by the store
+	entry.persist()
+	if store.err != nil {
+		t.Errorf("persist() error = %v", store.err)
+	}
+}
+
+func Test_workflowEntries_closeConcurrentChanges(t *testing.T) {
+	for _, storeType := range []string{fileStoreType, boltStoreType} {
+		t.Run(storeType, func(t *testing.T) {
+			store, dir := tempStore(t, storeType)
+			defer os.RemoveAll(dir)
+
+			we := initWorkflowEntries(store)
+			entry := &workflowEntry{State: "lb.two", ExpectedState: deployedState, Service: comm.Service{Name: "svc"}, store: store}
+			we.Entries["svc"] = entry
+
+			// the entry changes while the entries are saved, go test -race reports unlocked reads
+			started := make(chan struct{})
+			stop := make(chan struct{})
+			changed := make(chan struct{})
+			go func() {
+				defer close(changed)
+				close(started)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						entry.setWIP(true)
+						entry.setError("error")
+					}
+				}
+			}()
+
+			<-started
+			err := we.close()
+			close(stop)
+			<-changed
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := newEntryStore(storeType, filepath.Join(dir, "entries.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.close(nil)
+			if got, err := reopened.load(); err != nil || got["svc"] == nil || got["svc"].State != "lb.two" {
+				t.Errorf("load() = %v, %v, want entry svc", got, err)
+			}
+		})
+	}
+}
@@ -70,6 +70,7 @@ func (s *providerDeleteState) execute(we *workflowEntry, msg comm.Message) {
 		we.setNextStep()
 	}
 
+	we.clearFailure()
 	we.setTargetState(undeployedState)
 	we.setNextStep()
 	// update service with entry info as provider might not have all info in case service is un-deployed (ie host, dns alias)
@@ -85,6 +86,11 @@ func (s *provisionerState) execute(we *workflowEntry, msg comm.Message) {
 	// if wip, we expect an update from extension (meaning through message)
 	if we.WorkInProgress {
 		log.Debug("ProvisionerState -> WIP", msg)
+		if we.isGroupStep() {
+			s.executeGroup(we, msg)
+			return
+		}
+
 		if msg.Sender != we.State {
 			logMsg := fmt.Sprintf("Transition from %v to %v not possible %v", we.State, msg.Sender, we.Service.Name)
 			log.Warn(logMsg)
@@ -93,22 +99,17 @@ func (s *provisionerState) execute(we *workflowEntry, msg comm.Message) {
 		}
 
 		if msg.Error != "" {
-			we.setWIP(false)
 			we.setError(msg.Error)
 			log.Errorf("%v entry in error %v", msg.Service.Name, msg.Error)
+			we.stepFailed()
 			return
 		}
 
-		we.updateService(msg)
-		we.setNextStep()
-
-		if workflow.isLastStep(we.State, we.isReverse()) {
-			we.transition = &closeState{}
-			we.transition.execute(we, msg)
-			return
+		if we.isCompensating() {
+			we.addCompensation(msg.Sender)
 		}
-		log.Debugf("ProvisionerState sending %v state %v to transition", msg.Service.Name, we.State)
-		we.sendToExtension()
+		we.updateService(msg)
+		goToNextStep(we, msg)
 		return
 	} else {
 		// Transition triggered by previous state, send to extension
@@ -118,6 +119,61 @@ func (s *provisionerState) execute(we *workflowEntry, msg comm.Message) {
 
 }
 
+// executeGroup handles the answers of the members of a step group
+// the entry moves on once all the members succeeded, and is set in error once the failed group is rolled back
+func (s *provisionerState) executeGroup(we *workflowEntry, msg comm.Message) {
+	rollback, merge, outcome, err := we.setGroupResult(msg)
+	if err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
+	if merge {
+		if we.isCompensating() {
+			we.addCompensation(msg.Sender)
+		}
+		we.updateService(msg)
+	}
+
+	for _, member := range rollback {
+		we.rollbackMember(member)
+	}
+
+	switch outcome {
+	case groupSucceeded:
+		goToNextStep(we, msg)
+	case groupFailed:
+		log.Errorf("%v entry in error %v", msg.Service.Name, we.Error)
+		we.stepFailed()
+	}
+}
+
+// goToNextStep moves the entry to the next step and executes it, closing the entry if the last step is reached
+func goToNextStep(we *workflowEntry, msg comm.Message) {
+	we.setNextStep()
+
+	if we.steps().isLastStep(we.State, we.isReverse()) {
+		we.transition = &closeState{}
+		we.transition.execute(we, msg)
+		return
+	}
+	log.Debugf("Sending %v state %v to transition", msg.Service.Name, we.State)
+	we.transition.execute(we, msg)
+}
+
+type approvalState struct{}
+
+// the approval gate holds the deployments until they are approved, un-deployments are not held
+func (s *approvalState) execute(we *workflowEntry, msg comm.Message) {
+	if we.isReverse() || we.isApproved() {
+		log.Debugf("approval gate passed by %v", we.Service.Name)
+		goToNextStep(we, msg)
+		return
+	}
+
+	we.requestApproval()
+}
+
 type closeState struct{}
 
 func (s *closeState) execute(we *workflowEntry, msg comm.Message) {
@@ -1,20 +1,39 @@
 package core
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/interlook/interlook/comm"
 	"github.com/interlook/interlook/log"
-	"io/ioutil"
-	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	deployedState   = "deployed"
-	undeployedState = "undeployed"
+	deployedState   = comm.DeployedState
+	undeployedState = comm.UndeployedState
+	// name of the workflow built from core.workflowSteps, followed by the services not selecting any workflow
+	defaultWorkflow = "default"
+	// separates the extensions of a step group, run concurrently (ie dns.consul+lb.f5ltm)
+	stepGroupSeparator = "+"
+	// state of the members of a step group
+	memberWIP        = "wip"
+	memberDone       = "done"
+	memberFailed     = "failed"
+	memberRollback   = "rollback"
+	memberRolledBack = "rolledback"
+	// outcome of a step group once all its members answered
+	groupSucceeded = "succeeded"
+	groupFailed    = "failed"
+)
+
+var (
+	// stepRetry defines how the failed steps are retried
+	stepRetry = newRetryPolicy(0, 0, 0)
+	// rollbackOnFailure walks back the completed steps of the entries failing to deploy
+	rollbackOnFailure bool
 )
 
 // workflow holds the sequence of "steps" an item must follow to be deployed or un-deployed
@@ -37,6 +56,8 @@ func initWorkflow(workflowConfig string) workflowSteps {
 
 		if extType == "provider" {
 			transitionState = &providerState{}
+		} else if v == approvalStep {
+			transitionState = &approvalState{}
 		} else {
 			transitionState = &provisionerState{}
 		}
@@ -66,6 +87,59 @@ func initWorkflow(workflowConfig string) workflowSteps {
 
 }
 
+// initWorkflows initializes the default workflow and the named workflows from config
+// the provider steps of all the workflows are added to each one, so that a service can select any workflow
+func initWorkflows(defaultSteps string, namedSteps map[string]string) (map[string]workflowSteps, error) {
+	configs := map[string]string{defaultWorkflow: defaultSteps}
+	for name, steps := range namedSteps {
+		if name == defaultWorkflow {
+			return nil, errors.New(fmt.Sprintf("workflow name %v is reserved", defaultWorkflow))
+		}
+		configs[name] = steps
+	}
+
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var providers []string
+	seen := make(map[string]bool)
+	for _, name := range names {
+		for _, step := range strings.Split(configs[name], ",") {
+			if members := stepMembers(step); len(members) > 1 {
+				for _, member := range members {
+					if member == "" || strings.HasPrefix(member, "provider.") || strings.HasPrefix(member, "gate.") {
+						return nil, errors.New(fmt.Sprintf("invalid step group %v in workflow %v: only provisioners can run concurrently", step, name))
+					}
+				}
+				continue
+			}
+			if strings.HasPrefix(step, "gate.") && step != approvalStep {
+				return nil, errors.New(fmt.Sprintf("unknown gate %v in workflow %v", step, name))
+			}
+			if strings.HasPrefix(step, "provider.") && !seen[step] {
+				seen[step] = true
+				providers = append(providers, step)
+			}
+		}
+	}
+
+	wfs := make(map[string]workflowSteps)
+	for _, name := range names {
+		steps := append([]string{}, providers...)
+		for _, step := range strings.Split(configs[name], ",") {
+			if step != "" && !strings.HasPrefix(step, "provider.") {
+				steps = append(steps, step)
+			}
+		}
+		wfs[name] = initWorkflow(strings.Join(steps, ","))
+	}
+
+	return wfs, nil
+}
+
 func (w workflowSteps) isLastStep(step string, reverse bool) bool {
 	var lastStep string
 
@@ -88,13 +162,23 @@ func (w workflowSteps) isLastStep(step string, reverse bool) bool {
 	return true
 }
 
-// getTransition for the given step
+// stepMembers returns the extensions of the step, several for a step group
+func stepMembers(step string) []string {
+	return strings.Split(step, stepGroupSeparator)
+}
+
+// getTransition for the given step, or the step group the given extension is a member of
 func (w workflowSteps) getTransition(step string) transition {
 
 	for _, workflowStep := range w {
 		if workflowStep.Name == step {
 			return workflowStep.Transition
 		}
+		for _, member := range stepMembers(workflowStep.Name) {
+			if member == step {
+				return workflowStep.Transition
+			}
+		}
 	}
 	return nil
 }
@@ -163,11 +247,47 @@ type workflowEntry struct {
 	LastUpdate time.Time    `json:"last_update,omitempty"`
 	Service    comm.Service `json:"service,omitempty"`
 	CloseTime  time.Time    `json:"close_time"`
+	// Name of the workflow followed by the service, the default one if empty
+	Workflow string `json:"workflow,omitempty"`
+	// State of the members of the current step group
+	Group map[string]groupMember `json:"group,omitempty"`
+	// Number of failed attempts of the current step
+	Attempts int `json:"attempts,omitempty"`
+	// Time of the next attempt of the current step
+	RetryTime time.Time `json:"retry_time"`
+	// Indicates the current step failed after its last attempt
+	Failed bool `json:"failed,omitempty"`
+	// Steps rolled back after the entry failed to deploy
+	Compensations []compensation `json:"compensations,omitempty"`
+	// Approval of the deployment at the approval gate
+	Approval *approval `json:"approval,omitempty"`
+	// Steps whose extension reported a drift from the deployed service
+	Drifts []drift `json:"drifts,omitempty"`
+	// Last provider update received while rolling back, merged once the rollback is done
+	HeldUpdate *comm.Message `json:"held_update,omitempty"`
 	transition transition
+	// store persisting the entry changes
+	store entryStore
+	// serializes the saves of the entry
+	persistLock sync.Mutex
 }
 
-func makeNewFlowEntry() *workflowEntry {
+// compensation records the roll back of a step completed before the entry failed
+type compensation struct {
+	Step  string    `json:"step"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// groupMember holds the state of an extension of a step group
+type groupMember struct {
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+func makeNewFlowEntry(workflowName string) *workflowEntry {
 	var ne workflowEntry
+	ne.Workflow = workflowName
 	ne.TimeDetected = time.Now()
 	ne.State = undeployedState
 	ne.ExpectedState = deployedState
@@ -205,17 +325,36 @@ func (e *workflowEntry) setLastUpdate() {
 	e.Unlock()
 }
 
+// setWorkflow followed by the service
+func (e *workflowEntry) setWorkflow(workflowName string) {
+	e.Lock()
+	e.Workflow = workflowName
+	e.Unlock()
+}
+
+// steps returns the steps of the workflow followed by the entry
+// the caller must hold the entry lock if the workflow can be changed concurrently
+func (e *workflowEntry) steps() workflowSteps {
+	if steps, ok := workflows[e.Workflow]; ok {
+		return steps
+	}
+	return workflows[defaultWorkflow]
+}
+
 // setTransition based on given state
 func (e *workflowEntry) setTransition(state string) {
 	e.Lock()
-	e.transition = workflow.getTransition(state)
+	e.transition = e.steps().getTransition(state)
 	e.Unlock()
 }
 
 // setNextStep in the workflow
 func (e *workflowEntry) setNextStep() {
+	e.Lock()
+	steps := e.steps()
+	e.Unlock()
 
-	nextStep, next, err := workflow.getNextStep(e.State, e.isReverse())
+	nextStep, next, err := steps.getNextStep(e.State, e.isReverse())
 	if err != nil {
 		log.Errorf("Error getting transition step for %v:%v", e.State, err)
 		return
@@ -224,6 +363,13 @@ func (e *workflowEntry) setNextStep() {
 	log.Debugf("#### nextStep for %v is %v", e.State, nextStep)
 	e.Lock()
 	e.State = nextStep
+	e.Group = nil
+	e.Attempts = 0
+	e.RetryTime = time.Time{}
+	// the failure is kept while rolling back
+	if !e.Failed {
+		e.Error = ""
+	}
 	e.transition = next
 	e.WorkInProgress = false
 	e.WIPTime = time.Time{}
@@ -239,6 +385,131 @@ func (e *workflowEntry) setState(msg comm.Message, wip bool) {
 	e.WorkInProgress = wip
 	e.Error = msg.Error
 	e.CloseTime = time.Time{}
+	e.Attempts = 0
+	e.RetryTime = time.Time{}
+	e.Failed = false
+	e.Compensations = nil
+	e.Unlock()
+}
+
+// stepFailed schedules a new attempt of the current step
+// the entry is set as failed once the step reached its maximum attempts
+func (e *workflowEntry) stepFailed() {
+	e.Lock()
+	e.WorkInProgress = false
+	e.WIPTime = time.Time{}
+	e.Attempts++
+
+	if e.Attempts < stepRetry.maxAttempts {
+		e.RetryTime = time.Now().Add(stepRetry.backoff(e.Attempts))
+		log.Warnf("Step %v of %v failed (attempt %v/%v), retrying at %v: %v", e.State, e.Service.Name, e.Attempts, stepRetry.maxAttempts, e.RetryTime, e.Error)
+		e.Unlock()
+		return
+	}
+
+	log.Errorf("Step %v of %v failed after %v attempts: %v", e.State, e.Service.Name, e.Attempts, e.Error)
+	e.Unlock()
+
+	e.fail()
+}
+
+// timeoutStep fails the current step if the extension did not answer since the given time
+// the step is retried, then failed, as if the extension had answered an error
+func (e *workflowEntry) timeoutStep(startedBefore time.Time) bool {
+	e.Lock()
+	if !e.WorkInProgress || e.WIPTime.After(startedBefore) {
+		e.Unlock()
+		return false
+	}
+
+	e.Error = fmt.Sprintf("ServiceWIPTimeout reached at step %v", e.State)
+	e.Unlock()
+
+	log.Warnf("Step %v of %v timed out", e.State, e.Service.Name)
+	go func() {
+		e.stepFailed()
+		e.persist()
+	}()
+
+	return true
+}
+
+// fail sets the entry as failed at its current step, without further attempt
+// the completed steps are rolled back if rollbackOnFailure is set
+func (e *workflowEntry) fail() {
+	e.Lock()
+	e.WorkInProgress = false
+	e.WIPTime = time.Time{}
+
+	if e.isCompensating() {
+		e.Compensations = append(e.Compensations, compensation{Step: e.State, Time: time.Now(), Error: e.Error})
+	}
+
+	e.RetryTime = time.Time{}
+	e.Failed = true
+
+	compensate := rollbackOnFailure && !e.isReverse()
+	if compensate {
+		e.ExpectedState = undeployedState
+		e.Info = fmt.Sprintf("step %v failed: %v, rolling back the completed steps", e.State, e.Error)
+	}
+	e.Unlock()
+
+	e.sendStatus()
+
+	if compensate {
+		e.compensate()
+	}
+}
+
+// isCompensating returns true if the entry is rolling back the steps completed before its failure
+func (e *workflowEntry) isCompensating() bool {
+	return e.Failed && e.isReverse()
+}
+
+// isRollingBack returns true until the compensation of the entry is done, or failed
+func (e *workflowEntry) isRollingBack() bool {
+	if !e.isCompensating() || e.State == undeployedState {
+		return false
+	}
+
+	// the rollback stops at the step failing to roll back
+	if n := len(e.Compensations); n > 0 && e.Compensations[n-1].Step == e.State && e.Compensations[n-1].Error != "" {
+		return false
+	}
+
+	return true
+}
+
+// isRolledBack returns true once the compensation of the entry is done, or stopped at the step failing to roll back
+// the caller must hold the entry lock
+func (e *workflowEntry) isRolledBack() bool {
+	return e.isCompensating() && !e.isRollingBack()
+}
+
+// compensate moves the failed entry to the previous step to roll it back
+// the failed step itself is not rolled back
+func (e *workflowEntry) compensate() {
+	log.Infof("Rolling back the completed steps of %v", e.Service.Name)
+	e.Lock()
+	msg := comm.BuildMessage(e.Service, true)
+	e.Unlock()
+
+	goToNextStep(e, msg)
+}
+
+// addCompensation records the roll back of the given step
+func (e *workflowEntry) addCompensation(step string) {
+	e.Lock()
+	e.Compensations = append(e.Compensations, compensation{Step: step, Time: time.Now()})
+	e.Unlock()
+	log.Infof("Step %v of %v rolled back", step, e.Service.Name)
+}
+
+// clearFailure so that the entry status reflects its new target state
+func (e *workflowEntry) clearFailure() {
+	e.Lock()
+	e.Failed = false
 	e.Unlock()
 }
 
@@ -247,9 +518,11 @@ func (e *workflowEntry) setState(msg comm.Message, wip bool) {
 func (e *workflowEntry) updateService(msg comm.Message) {
 	e.Lock()
 	if strings.HasPrefix(msg.Sender, "provider.") && msg.Action != comm.DeleteAction {
+		e.Service.Provider = msg.Sender
 		e.Service.Targets = msg.Service.Targets
 		e.Service.TLS = msg.Service.TLS
 		e.Service.DNSAliases = msg.Service.DNSAliases
+		e.Service.Workflow = msg.Service.Workflow
 	}
 
 	if strings.HasPrefix(msg.Sender, "ipam.") {
@@ -264,9 +537,107 @@ func (e *workflowEntry) sendToExtension() {
 	//e.setNextStep()
 	e.setWIP(true)
 	msg := comm.BuildMessage(e.Service, e.isReverse())
-	msg.Destination = e.State
-	msgToExtension <- msg
 
+	// the members of a step group are all sent the message, their answers are tracked in the group
+	members := stepMembers(e.State)
+	if len(members) > 1 {
+		e.Lock()
+		e.Group = make(map[string]groupMember)
+		for _, member := range members {
+			e.Group[member] = groupMember{State: memberWIP}
+		}
+		e.Unlock()
+	}
+
+	for _, member := range members {
+		msg.Destination = member
+		msgToExtension <- msg
+	}
+}
+
+// isGroupStep returns true if the current step is a step group
+func (e *workflowEntry) isGroupStep() bool {
+	return len(stepMembers(e.State)) > 1
+}
+
+// setGroupResult records the answer of a step group member
+// when deploying, the members done are rolled back as soon as one of them fails
+// it returns the members to roll back, if the answer updates the service,
+// and the group outcome once all the members answered
+func (e *workflowEntry) setGroupResult(msg comm.Message) (rollback []string, merge bool, outcome string, err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	member, ok := e.Group[msg.Sender]
+	if !ok {
+		return nil, false, "", errors.New(fmt.Sprintf("%v is not a member of step %v of %v", msg.Sender, e.State, e.Service.Name))
+	}
+
+	failed := false
+	for _, m := range e.Group {
+		if m.State == memberFailed {
+			failed = true
+		}
+	}
+
+	switch member.State {
+	case memberWIP:
+		switch {
+		case msg.Error != "":
+			e.Group[msg.Sender] = groupMember{State: memberFailed, Error: msg.Error}
+			if !e.isReverse() {
+				for name, m := range e.Group {
+					if m.State == memberDone {
+						e.Group[name] = groupMember{State: memberRollback}
+						rollback = append(rollback, name)
+					}
+				}
+			}
+		case failed && !e.isReverse():
+			e.Group[msg.Sender] = groupMember{State: memberRollback}
+			rollback = append(rollback, msg.Sender)
+		default:
+			e.Group[msg.Sender] = groupMember{State: memberDone}
+			merge = true
+		}
+	case memberRollback:
+		if msg.Error != "" {
+			log.Errorf("Error rolling back %v of %v: %v", msg.Sender, e.Service.Name, msg.Error)
+		}
+		e.Group[msg.Sender] = groupMember{State: memberRolledBack, Error: msg.Error}
+	default:
+		return nil, false, "", errors.New(fmt.Sprintf("unexpected answer from %v in state %v for %v", msg.Sender, member.State, e.Service.Name))
+	}
+	sort.Strings(rollback)
+
+	var errs []string
+	for name, m := range e.Group {
+		if m.State == memberWIP || m.State == memberRollback {
+			return rollback, merge, "", nil
+		}
+		if m.State == memberFailed {
+			errs = append(errs, name+": "+m.Error)
+		}
+	}
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		e.Error = strings.Join(errs, ", ")
+		return rollback, merge, groupFailed, nil
+	}
+
+	return rollback, merge, groupSucceeded, nil
+}
+
+// rollbackMember sends a delete message to the step group member
+func (e *workflowEntry) rollbackMember(member string) {
+	e.Lock()
+	msg := comm.BuildMessage(e.Service, true)
+	e.Unlock()
+
+	log.Infof("Rolling back %v of %v", member, msg.Service.Name)
+	msg.Destination = member
+	msgToExtension <- msg
 }
 
 // close closes the entry workflow
@@ -282,16 +653,48 @@ func (e *workflowEntry) close(errorMessage string) {
 
 	if e.isReverse() {
 		e.State = undeployedState
+		// a new deployment needs a new approval
+		if e.Approval != nil && e.Approval.Status == approvalApproved {
+			e.Approval.Status = approvalClosed
+		}
 	} else {
 		e.State = deployedState
 	}
 
 	e.CloseTime = time.Now()
+	// the drifted steps are deployed again, or un-deployed
+	e.Drifts = nil
 
 	e.Unlock()
 
 	log.Infof("Service %v state %v", e.Service.Name, e.State)
 
+	e.sendStatus()
+}
+
+// sendStatus reports the entry state to the provider of the service
+func (e *workflowEntry) sendStatus() {
+	e.Lock()
+	msg := comm.Message{
+		Action:      comm.StatusAction,
+		Destination: e.Service.Provider,
+		Error:       e.Error,
+		State:       e.State,
+		Service:     e.Service,
+	}
+	if e.Failed {
+		msg.State = comm.FailedState
+	}
+	e.Unlock()
+
+	if msg.Destination == "" {
+		return
+	}
+
+	// do not block the caller, it may hold the entries lock
+	go func() {
+		msgToExtension <- msg
+	}()
 }
 
 // isReverse returns true if the target state is undeployed
@@ -314,17 +717,37 @@ func (e *workflowEntry) isStateAsWanted(action string) bool {
 	return false
 }
 
+// persist saves the entry to its store
+func (e *workflowEntry) persist() {
+	if e.store == nil {
+		return
+	}
+
+	// the entry is not locked while written, the concurrent saves are written in order
+	e.persistLock.Lock()
+	defer e.persistLock.Unlock()
+
+	e.Lock()
+	name := e.Service.Name
+	e.Unlock()
+
+	if err := e.store.put(name, e); err != nil {
+		log.Errorf("Error saving entry %v: %v", name, err)
+	}
+}
+
 // workflowEntries holds the table of tracked services
 type workflowEntries struct {
 	sync.Mutex
 	Entries map[string]*workflowEntry `json:"entries,omitempty"`
-	DBFile  string
+	store   entryStore
 }
 
-func initWorkflowEntries(dbFile string) *workflowEntries {
+// initWorkflowEntries with the store persisting them, the entries are not persisted if nil
+func initWorkflowEntries(store entryStore) *workflowEntries {
 	fe := new(workflowEntries)
 	fe.Entries = make(map[string]*workflowEntry)
-	fe.DBFile = dbFile
+	fe.store = store
 
 	return fe
 }
@@ -342,6 +765,15 @@ func (we *workflowEntries) serviceNeedUpdate(msg comm.Message) bool {
 		return true
 	}
 
+	// the failed step of an unchanged service is retried with backoff, then restarted by an operator
+	// a rolled back service is deployed again once its definition changes
+	curSvc.Lock()
+	parked := curSvc.isRetrying() || curSvc.isRolledBack()
+	curSvc.Unlock()
+	if parked && msg.Action == comm.AddAction {
+		return false
+	}
+
 	serviceStateOK := curSvc.isStateAsWanted(msg.Action)
 	if !serviceStateOK {
 		return true
@@ -350,11 +782,134 @@ func (we *workflowEntries) serviceNeedUpdate(msg comm.Message) bool {
 	return false
 }
 
+// dueRetries returns the entries whose failed step is due for a new attempt
+// their retry time is reset, so that they are returned once
+func (we *workflowEntries) dueRetries(now time.Time) []*workflowEntry {
+	we.Lock()
+	defer we.Unlock()
+
+	var due []*workflowEntry
+	for _, entry := range we.Entries {
+		entry.Lock()
+		if !entry.RetryTime.IsZero() && !entry.WorkInProgress && now.After(entry.RetryTime) {
+			entry.RetryTime = time.Time{}
+			due = append(due, entry)
+		}
+		entry.Unlock()
+	}
+
+	return due
+}
+
+// inFlight returns the entries sent to an extension
+func (we *workflowEntries) inFlight() []*workflowEntry {
+	we.Lock()
+	defer we.Unlock()
+
+	var entries []*workflowEntry
+	for _, entry := range we.Entries {
+		entry.Lock()
+		if entry.WorkInProgress {
+			entries = append(entries, entry)
+		}
+		entry.Unlock()
+	}
+
+	return entries
+}
+
+// providedServices returns the services of the entries expected deployed, except the in-flight ones
+// their providers are asked for their current definition at startup
+func (we *workflowEntries) providedServices() []comm.Service {
+	we.Lock()
+	defer we.Unlock()
+
+	var names []string
+	for name := range we.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var services []comm.Service
+	for _, name := range names {
+		entry := we.Entries[name]
+		entry.Lock()
+		if entry.ExpectedState == deployedState && !entry.WorkInProgress {
+			services = append(services, entry.Service)
+		}
+		entry.Unlock()
+	}
+
+	return services
+}
+
+// checkProvider returns an error if the provider's message is about a service managed by another provider
+// a service un-deployed by its provider can be taken over
+func (we *workflowEntries) checkProvider(msg comm.Message) error {
+	if !strings.HasPrefix(msg.Sender, "provider.") {
+		return nil
+	}
+
+	we.Lock()
+	defer we.Unlock()
+
+	entry, ok := we.Entries[msg.Service.Name]
+	if !ok {
+		return nil
+	}
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	if entry.Service.Provider == "" || entry.Service.Provider == msg.Sender {
+		return nil
+	}
+
+	if entry.State == undeployedState && entry.ExpectedState == undeployedState {
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("service %v is already provided by %v", msg.Service.Name, entry.Service.Provider))
+}
+
+// checkWorkflow returns an error if the service selects a workflow that is not configured
+func checkWorkflow(msg comm.Message) error {
+	if msg.Action != comm.AddAction || msg.Service.Workflow == "" {
+		return nil
+	}
+
+	if _, ok := workflows[msg.Service.Workflow]; !ok {
+		return errors.New(fmt.Sprintf("workflow %v of service %v is not configured", msg.Service.Workflow, msg.Service.Name))
+	}
+
+	return nil
+}
+
 // mergeMessage by inserting/merging it to the workflow entries list
 func (we *workflowEntries) mergeMessage(msg comm.Message) error {
 
+	// verifications do not change the service definition
+	if msg.Action == comm.VerifyAction {
+		return we.mergeVerification(msg)
+	}
+
+	if msg.Action == comm.SnapshotAction {
+		return we.mergeSnapshot(msg)
+	}
+
+	// the provider updates would interrupt the rollback of the service
+	if we.holdUpdate(msg) {
+		return nil
+	}
+
+	// the updates of a service held at the approval gate would request a new approval
+	if we.updateHeldAtGate(msg) {
+		return nil
+	}
+
 	if !we.serviceNeedUpdate(msg) {
 		log.Debugf("Service %v already in desired state\n", msg.Service.Name)
+		// not persisted, the last update time is saved when the store is closed
 		we.Entries[msg.Service.Name].setLastUpdate()
 		return nil
 	}
@@ -362,70 +917,172 @@ func (we *workflowEntries) mergeMessage(msg comm.Message) error {
 	we.Lock()
 	defer we.Unlock()
 
-	_, ok := we.Entries[msg.Service.Name]
+	entry, ok := we.Entries[msg.Service.Name]
 	if !ok {
 		log.Debugf("Service not found, creating it %v", msg)
-		we.Entries[msg.Service.Name] = makeNewFlowEntry()
+		entry = makeNewFlowEntry(msg.Service.Workflow)
+		entry.store = we.store
+		we.Entries[msg.Service.Name] = entry
+	} else if msg.Action == comm.AddAction && entry.Workflow != msg.Service.Workflow {
+		// the steps of a deployed service would not be rolled back with another workflow
+		if entry.State == undeployedState && entry.ExpectedState == undeployedState {
+			entry.setWorkflow(msg.Service.Workflow)
+		} else {
+			log.Warnf("Service %v workflow change to %v will be applied once the service is undeployed", msg.Service.Name, msg.Service.Workflow)
+		}
 	}
 
-	entry, _ := we.Entries[msg.Service.Name]
 	entry.updateService(msg)
 	entry.setTransition(msg.Sender)
 
-	go entry.transition.execute(entry, msg)
+	// the entry is saved once the transition is executed
+	transition := entry.transition
+	go func() {
+		transition.execute(entry, msg)
+		entry.persist()
+	}()
 
 	return nil
 }
 
-// save entries list to file
-func (we *workflowEntries) save() error {
-
-	dbFile, err := os.OpenFile(we.DBFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return err
+// holdUpdate keeps the provider update of a service rolling back its completed steps
+// it returns false if the update can be merged
+func (we *workflowEntries) holdUpdate(msg comm.Message) bool {
+	if !strings.HasPrefix(msg.Sender, "provider.") {
+		return false
 	}
 
-	if err := dbFile.Truncate(0); err != nil {
-		log.Error(err)
+	we.Lock()
+	entry, ok := we.Entries[msg.Service.Name]
+	we.Unlock()
+	if !ok {
+		return false
 	}
 
-	_, err = dbFile.Seek(0, 0)
-	if err != nil {
-		log.Error(err)
+	entry.Lock()
+	if !entry.isRollingBack() {
+		entry.Unlock()
+		return false
 	}
+	entry.HeldUpdate = &msg
+	entry.Unlock()
+
+	log.Infof("Update of %v held until its rollback is done", msg.Service.Name)
+	entry.persist()
+
+	return true
+}
 
-	defer func() {
-		if err := dbFile.Close(); err != nil {
-			log.Errorf("Error closing filename %v", err)
+// releaseHeldUpdates returns the provider updates held by the entries whose rollback is over
+// they are removed from their entry, so that they are returned once
+func (we *workflowEntries) releaseHeldUpdates() []comm.Message {
+	var released []*workflowEntry
+	var updates []comm.Message
+
+	we.Lock()
+	for _, entry := range we.Entries {
+		entry.Lock()
+		if entry.HeldUpdate != nil && !entry.isRollingBack() {
+			updates = append(updates, *entry.HeldUpdate)
+			entry.HeldUpdate = nil
+			released = append(released, entry)
 		}
-	}()
+		entry.Unlock()
+	}
+	we.Unlock()
 
-	data, err := json.Marshal(we.Entries)
-	if err != nil {
-		return err
+	for _, entry := range released {
+		entry.persist()
 	}
 
-	_, err = dbFile.Write(data)
-	if err != nil {
-		return err
+	return updates
+}
+
+// mergeSnapshot un-deploys the services of the provider missing from its snapshot
+// the services found are sent by the provider before its snapshot, so their entries already exist
+func (we *workflowEntries) mergeSnapshot(msg comm.Message) error {
+	found := make(map[string]bool)
+	for _, name := range msg.Snapshot {
+		found[name] = true
 	}
 
-	if err := dbFile.Sync(); err != nil {
-		log.Errorf("Error syncing db file %v", err)
+	var missing []string
+	we.Lock()
+	for name, entry := range we.Entries {
+		entry.Lock()
+		if entry.Service.Provider == msg.Sender && entry.ExpectedState == deployedState && !found[name] {
+			missing = append(missing, name)
+		}
+		entry.Unlock()
+	}
+	we.Unlock()
+	sort.Strings(missing)
+
+	for _, name := range missing {
+		log.Infof("Service %v not found by %v, un-deploying it", name, msg.Sender)
+		deleteMsg := comm.BuildDeleteMessage(name)
+		deleteMsg.Sender = msg.Sender
+		if err := we.mergeMessage(deleteMsg); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// load entries list from file
+// remove the entry from the table and the store
+// the caller must hold the entries lock
+func (we *workflowEntries) remove(name string) {
+	delete(we.Entries, name)
+
+	if we.store == nil {
+		return
+	}
+	if err := we.store.delete(name); err != nil {
+		log.Errorf("Error removing entry %v: %v", name, err)
+	}
+}
+
+// dropLegacyEntries removes the entries stored under a legacy key from the table and the store, without un-deploying them
+// their provider publishes the services under their new key, whose deployment takes their DNS aliases over
+// un-deploying them would de-register these aliases
+func (we *workflowEntries) dropLegacyEntries(isLegacyKey func(serviceName, providerName string) bool) {
+	we.Lock()
+	defer we.Unlock()
+
+	for name, entry := range we.Entries {
+		entry.Lock()
+		provider := entry.Service.Provider
+		entry.Unlock()
+
+		if isLegacyKey(name, provider) {
+			log.Warnf("Service %v is stored under a legacy key, dropping its entry without un-deploying it", name)
+			we.remove(name)
+		}
+	}
+}
+
+// close saves the entries and releases their store
+func (we *workflowEntries) close() error {
+	we.Lock()
+	defer we.Unlock()
+
+	return we.store.close(we.Entries)
+}
+
+// load entries from the store
 func (we *workflowEntries) load() error {
-	file, err := ioutil.ReadFile(we.DBFile)
+	entries, err := we.store.load()
 	if err != nil {
 		return err
 	}
 
-	if err = json.Unmarshal(file, &we.Entries); err != nil {
-		return err
+	for name, entry := range entries {
+		if _, ok := workflows[entry.Workflow]; entry.Workflow != "" && !ok {
+			log.Warnf("Workflow %v of service %v is not configured, following the default workflow", entry.Workflow, name)
+		}
+		entry.store = we.store
+		we.Entries[name] = entry
 	}
 
 	return nil
@@ -3,6 +3,7 @@ package core
 import (
 	"github.com/interlook/interlook/comm"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -220,9 +221,791 @@ func Test_makeNewFlowEntry(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := makeNewFlowEntry(); !weIsEqual(got, tt.want) {
+			if got := makeNewFlowEntry(""); !weIsEqual(got, tt.want) {
 				t.Errorf("makeNewFlowEntry() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func Test_workflowEntry_sendStatus(t *testing.T) {
+	msgToExtension = make(chan comm.Message)
+	workflows = map[string]workflowSteps{defaultWorkflow: testWF}
+
+	e := &workflowEntry{
+		State:         "provisioner.two",
+		ExpectedState: deployedState,
+		Service: comm.Service{
+			Name:     "svc",
+			Provider: "provider.one",
+			PublicIP: "10.32.30.2",
+		},
+	}
+	e.close("")
+
+	got := <-msgToExtension
+	want := comm.Message{
+		Action:      comm.StatusAction,
+		Destination: "provider.one",
+		State:       deployedState,
+		Service:     e.Service,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sendStatus() = %v, want %v", got, want)
+	}
+}
+
+func Test_workflowEntries_checkProvider(t *testing.T) {
+	we := initWorkflowEntries(nil)
+	we.Entries["deployed"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "deployed", Provider: "provider.one"}}
+	we.Entries["undeploying"] = &workflowEntry{State: "provisioner.two", ExpectedState: undeployedState,
+		Service: comm.Service{Name: "undeploying", Provider: "provider.one"}}
+	we.Entries["undeployed"] = &workflowEntry{State: undeployedState, ExpectedState: undeployedState,
+		Service: comm.Service{Name: "undeployed", Provider: "provider.one"}}
+	we.Entries["noProvider"] = &workflowEntry{State: deployedState, ExpectedState: deployedState,
+		Service: comm.Service{Name: "noProvider"}}
+
+	tests := []struct {
+		name    string
+		sender  string
+		service string
+		wantErr bool
+	}{
+		{"owner", "provider.one", "deployed", false},
+		{"otherProvider", "provider.other", "deployed", true},
+		{"otherProviderUndeploying", "provider.other", "undeploying", true},
+		{"takeOverUndeployed", "provider.other", "undeployed", false},
+		{"noProvider", "provider.other", "noProvider", false},
+		{"newService", "provider.other", "new", false},
+		{"provisioner", "lb.one", "deployed", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := comm.Message{Action: comm.AddAction, Sender: tt.sender, Service: comm.Service{Name: tt.service}}
+			if err := we.checkProvider(msg); (err != nil) != tt.wantErr {
+				t.Errorf("checkProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_initWorkflows(t *testing.T) {
+	tests := []struct {
+		name       string
+		namedSteps map[string]string
+		want       map[string][]string
+		wantErr    bool
+	}{
+		{"default", nil, map[string][]string{
+			defaultWorkflow: {undeployedState, "provider.one", "provisioner.two", deployedState}}, false},
+		{"named", map[string]string{"internal": "provider.three,dns.four"}, map[string][]string{
+			defaultWorkflow: {undeployedState, "provider.one", "provider.three", "provisioner.two", deployedState},
+			"internal":      {undeployedState, "provider.one", "provider.three", "dns.four", deployedState}}, false},
+		{"providersOnly", map[string]string{"none": "provider.one"}, map[string][]string{
+			defaultWorkflow: {undeployedState, "provider.one", "provisioner.two", deployedState},
+			"none":          {undeployedState, "provider.one", deployedState}}, false},
+		{"group", map[string]string{"parallel": "ipam.three,dns.four+lb.five"}, map[string][]string{
+			defaultWorkflow: {undeployedState, "provider.one", "provisioner.two", deployedState},
+			"parallel":      {undeployedState, "provider.one", "ipam.three", "dns.four+lb.five", deployedState}}, false},
+		{"approval", map[string]string{"approved": "ipam.three,gate.approval,lb.five"}, map[string][]string{
+			defaultWorkflow: {undeployedState, "provider.one", "provisioner.two", deployedState},
+			"approved":      {undeployedState, "provider.one", "ipam.three", approvalStep, "lb.five", deployedState}}, false},
+		{"unknownGate", map[string]string{"approved": "gate.unknown,lb.five"}, nil, true},
+		{"gateInGroup", map[string]string{"approved": "gate.approval+lb.five"}, nil, true},
+		{"providerInGroup", map[string]string{"parallel": "provider.three+lb.five"}, nil, true},
+		{"emptyGroupMember", map[string]string{"parallel": "dns.four+"}, nil, true},
+		{"reservedName", map[string]string{defaultWorkflow: "provider.one"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := initWorkflows("provider.one,provisioner.two", tt.namedSteps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("initWorkflows() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("initWorkflows() got %v workflows, want %v", len(got), len(tt.want))
+			}
+			for name, want := range tt.want {
+				steps := make([]string, len(got[name]))
+				for _, step := range got[name] {
+					steps[step.ID] = step.Name
+				}
+				if !reflect.DeepEqual(steps, want) {
+					t.Errorf("initWorkflows() %v = %v, want %v", name, steps, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_checkWorkflow(t *testing.T) {
+	workflows = map[string]workflowSteps{defaultWorkflow: testWF, "internal": testWF}
+
+	tests := []struct {
+		name     string
+		action   string
+		workflow string
+		wantErr  bool
+	}{
+		{"default", comm.AddAction, "", false},
+		{"configured", comm.AddAction, "internal", false},
+		{"notConfigured", comm.AddAction, "external", true},
+		{"delete", comm.DeleteAction, "external", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := comm.Message{Action: tt.action, Sender: "provider.one", Service: comm.Service{Name: "svc", Workflow: tt.workflow}}
+			if err := checkWorkflow(msg); (err != nil) != tt.wantErr {
+				t.Errorf("checkWorkflow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_mergeMessageWorkflow(t *testing.T) {
+	msgToExtension = make(chan comm.Message, 1)
+	workflows = map[string]workflowSteps{
+		defaultWorkflow: testWF,
+		"internal":      initWorkflow("provider.one,dns.four"),
+	}
+
+	tests := []struct {
+		name         string
+		entry        *workflowEntry
+		workflow     string
+		wantWorkflow string
+		wantStep     string
+	}{
+		{"new", nil, "internal", "internal", "dns.four"},
+		{"newDefault", nil, "", "", "provisioner.two"},
+		{"undeployed", &workflowEntry{State: undeployedState, ExpectedState: undeployedState}, "internal", "internal", "dns.four"},
+		// the workflow of a deployed service is kept
+		{"deployed", &workflowEntry{State: deployedState, ExpectedState: deployedState}, "internal", "", "provisioner.two"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := initWorkflowEntries(nil)
+			if tt.entry != nil {
+				tt.entry.Service = comm.Service{Name: "svc", Provider: "provider.one"}
+				we.Entries["svc"] = tt.entry
+			}
+
+			msg := comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: comm.Service{
+				Name:     "svc",
+				Workflow: tt.workflow,
+				Targets:  []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}},
+			}}
+			if err := we.mergeMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case got := <-msgToExtension:
+				if got.Destination != tt.wantStep {
+					t.Errorf("mergeMessage() sent to %v, want %v", got.Destination, tt.wantStep)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message sent to extension")
+			}
+
+			if got := we.Entries["svc"].Workflow; got != tt.wantWorkflow {
+				t.Errorf("mergeMessage() workflow = %v, want %v", got, tt.wantWorkflow)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_serviceNeedUpdate(t *testing.T) {
+	deployed := comm.Service{Name: "svc", Provider: "provider.one", DNSAliases: []string{"svc.dummy.com"}, Workflow: "internal"}
+
+	tests := []struct {
+		name     string
+		entry    *workflowEntry
+		workflow string
+		want     bool
+	}{
+		{"sameWorkflow", &workflowEntry{State: deployedState, ExpectedState: deployedState}, "internal", false},
+		{"workflowChanged", &workflowEntry{State: deployedState, ExpectedState: deployedState}, "", true},
+		{"deploying", &workflowEntry{State: "lb.three", ExpectedState: deployedState}, "internal", true},
+		// the failed steps of unchanged services are not restarted
+		{"retryPending", &workflowEntry{State: "lb.three", ExpectedState: deployedState, Attempts: 1, RetryTime: time.Now().Add(time.Minute)}, "internal", false},
+		{"failed", &workflowEntry{State: "lb.three", ExpectedState: deployedState, Attempts: 5, Failed: true}, "internal", false},
+		{"failedChanged", &workflowEntry{State: "lb.three", ExpectedState: deployedState, Attempts: 5, Failed: true}, "", true},
+		{"rolledBack", &workflowEntry{State: undeployedState, ExpectedState: undeployedState, Failed: true}, "internal", false},
+		{"rolledBackChanged", &workflowEntry{State: undeployedState, ExpectedState: undeployedState, Failed: true}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			we := initWorkflowEntries(nil)
+			entry := tt.entry
+			entry.Service = deployed
+			we.Entries["svc"] = entry
+
+			svc := deployed
+			svc.Workflow = tt.workflow
+			if got := we.serviceNeedUpdate(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); got != tt.want {
+				t.Errorf("serviceNeedUpdate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workflowEntry_isRollingBack(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry *workflowEntry
+		want  bool
+	}{
+		{"rollingBack", &workflowEntry{State: "dns.three", ExpectedState: undeployedState, Failed: true}, true},
+		{"rolledBackStep", &workflowEntry{State: "ipam.two", ExpectedState: undeployedState, Failed: true,
+			Compensations: []compensation{{Step: "dns.three"}}}, true},
+		{"rollbackFailed", &workflowEntry{State: "dns.three", ExpectedState: undeployedState, Failed: true,
+			Compensations: []compensation{{Step: "dns.three", Error: "error"}}}, false},
+		{"rolledBack", &workflowEntry{State: undeployedState, ExpectedState: undeployedState, Failed: true}, false},
+		{"undeploying", &workflowEntry{State: "dns.three", ExpectedState: undeployedState}, false},
+		{"failed", &workflowEntry{State: "dns.three", ExpectedState: deployedState, Failed: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.entry.isRollingBack(); got != tt.want {
+				t.Errorf("isRollingBack() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_holdUpdate(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,dns.three,lb.four")}
+
+	we := initWorkflowEntries(nil)
+	entry := &workflowEntry{State: "dns.three", ExpectedState: undeployedState, Failed: true, WorkInProgress: true,
+		Service: comm.Service{Name: "svc", Provider: "provider.one", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}}
+	we.Entries["svc"] = entry
+
+	// the provider update does not interrupt the rollback
+	update := comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: comm.Service{
+		Name:    "svc",
+		Targets: []comm.Target{{Host: "10.32.2.2", Port: 80, Weight: 1}},
+	}}
+	if err := we.mergeMessage(update); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-msgToExtension:
+		t.Fatalf("mergeMessage() sent %v %v during the rollback", got.Action, got.Destination)
+	case <-time.After(100 * time.Millisecond):
+	}
+	entry.Lock()
+	if entry.State != "dns.three" || entry.ExpectedState != undeployedState || entry.HeldUpdate == nil {
+		t.Errorf("entry state = %v, expected state = %v, held update %v", entry.State, entry.ExpectedState, entry.HeldUpdate)
+	}
+	entry.Unlock()
+
+	if got := we.releaseHeldUpdates(); len(got) != 0 {
+		t.Errorf("releaseHeldUpdates() = %v during the rollback", got)
+	}
+
+	// the update is merged once the rollback is over
+	entry.Lock()
+	entry.State = undeployedState
+	entry.WorkInProgress = false
+	entry.Unlock()
+
+	got := we.releaseHeldUpdates()
+	if len(got) != 1 || !reflect.DeepEqual(got[0], update) {
+		t.Fatalf("releaseHeldUpdates() = %v, want %v", got, update)
+	}
+	if got := we.releaseHeldUpdates(); len(got) != 0 {
+		t.Errorf("releaseHeldUpdates() = %v, want the update released once", got)
+	}
+
+	if err := we.mergeMessage(got[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-msgToExtension:
+		if msg.Destination != "ipam.two" || msg.Action != comm.AddAction {
+			t.Errorf("mergeMessage() sent %v %v, want add to ipam.two", msg.Action, msg.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the held update was not deployed")
+	}
+}
+
+func Test_workflowEntry_setGroupResult(t *testing.T) {
+	tests := []struct {
+		name         string
+		group        map[string]groupMember
+		reverse      bool
+		sender       string
+		err          string
+		wantRollback []string
+		wantMerge    bool
+		wantOutcome  string
+		wantErr      bool
+	}{
+		{"firstDone", map[string]groupMember{"dns.one": {State: memberWIP}, "lb.two": {State: memberWIP}},
+			false, "dns.one", "", nil, true, "", false},
+		{"allDone", map[string]groupMember{"dns.one": {State: memberWIP}, "lb.two": {State: memberDone}},
+			false, "dns.one", "", nil, true, groupSucceeded, false},
+		{"failRollsBackDone", map[string]groupMember{"dns.one": {State: memberWIP}, "lb.two": {State: memberDone}, "lb.three": {State: memberWIP}},
+			false, "dns.one", "error", []string{"lb.two"}, false, "", false},
+		{"doneAfterFailure", map[string]groupMember{"dns.one": {State: memberFailed}, "lb.two": {State: memberWIP}},
+			false, "lb.two", "", []string{"lb.two"}, false, "", false},
+		{"rolledBack", map[string]groupMember{"dns.one": {State: memberFailed, Error: "error"}, "lb.two": {State: memberRollback}},
+			false, "lb.two", "", nil, false, groupFailed, false},
+		{"allFailed", map[string]groupMember{"dns.one": {State: memberFailed, Error: "error"}, "lb.two": {State: memberWIP}},
+			false, "lb.two", "error", nil, false, groupFailed, false},
+		{"reverseFailure", map[string]groupMember{"dns.one": {State: memberWIP}, "lb.two": {State: memberDone}},
+			true, "dns.one", "error", nil, false, groupFailed, false},
+		{"notMember", map[string]groupMember{"dns.one": {State: memberWIP}},
+			false, "lb.two", "", nil, false, "", true},
+		{"unexpected", map[string]groupMember{"dns.one": {State: memberDone}, "lb.two": {State: memberWIP}},
+			false, "dns.one", "", nil, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &workflowEntry{State: "dns.one+lb.two", ExpectedState: deployedState, Group: tt.group}
+			if tt.reverse {
+				e.ExpectedState = undeployedState
+			}
+
+			rollback, merge, outcome, err := e.setGroupResult(comm.Message{Sender: tt.sender, Error: tt.err})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("setGroupResult() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(rollback, tt.wantRollback) || merge != tt.wantMerge || outcome != tt.wantOutcome {
+				t.Errorf("setGroupResult() = %v, %v, %v, want %v, %v, %v", rollback, merge, outcome, tt.wantRollback, tt.wantMerge, tt.wantOutcome)
+			}
+			if outcome == groupFailed && e.Error == "" {
+				t.Errorf("setGroupResult() failed group without error")
+			}
+		})
+	}
+}
+
+func Test_workflowEntries_stepGroup(t *testing.T) {
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,dns.three+lb.four")}
+
+	// receive returns the destinations of the messages sent to extensions
+	receive := func(n int) map[string]string {
+		got := make(map[string]string)
+		for i := 0; i < n; i++ {
+			select {
+			case msg := <-msgToExtension:
+				got[msg.Destination] = msg.Action
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got %v messages, want %v", len(got), n)
+			}
+		}
+		return got
+	}
+
+	we := initWorkflowEntries(nil)
+	svc := comm.Service{Name: "svc", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+	answer := func(sender, err string) {
+		if mergeErr := we.mergeMessage(comm.Message{Action: comm.UpdateAction, Sender: sender, Error: err, Service: svc}); mergeErr != nil {
+			t.Fatal(mergeErr)
+		}
+	}
+
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	receive(1)
+
+	// the group members are sent the service together
+	answer("ipam.two", "")
+	if got, want := receive(2), map[string]string{"dns.three": comm.AddAction, "lb.four": comm.AddAction}; !reflect.DeepEqual(got, want) {
+		t.Errorf("group sent to %v, want %v", got, want)
+	}
+
+	// the member done is rolled back when the other one fails
+	answer("dns.three", "")
+	answer("lb.four", "could not create virtual server")
+	if got, want := receive(1), map[string]string{"dns.three": comm.DeleteAction}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rollback sent to %v, want %v", got, want)
+	}
+
+	answer("dns.three", "")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entry := we.Entries["svc"]
+		entry.Lock()
+		wip, state, err := entry.WorkInProgress, entry.State, entry.Error
+		entry.Unlock()
+		if !wip && err != "" {
+			if state != "dns.three+lb.four" || err != "lb.four: could not create virtual server" {
+				t.Errorf("entry state = %v, error = %v", state, err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry not set in error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_workflowEntry_stepFailed(t *testing.T) {
+	msgToExtension = make(chan comm.Message, 1)
+	stepRetry = newRetryPolicy(2, time.Minute, time.Minute)
+	defer func() { stepRetry = newRetryPolicy(0, 0, 0) }()
+
+	e := &workflowEntry{State: "provisioner.two", ExpectedState: deployedState, WorkInProgress: true, Error: "error",
+		Service: comm.Service{Name: "svc", Provider: "provider.one"}}
+
+	// the first failure schedules a new attempt
+	e.stepFailed()
+	if e.WorkInProgress || e.Failed || e.Attempts != 1 || time.Until(e.RetryTime) < 30*time.Second {
+		t.Errorf("stepFailed() = wip %v, failed %v, attempts %v, retry %v", e.WorkInProgress, e.Failed, e.Attempts, e.RetryTime)
+	}
+
+	// the retry is due once
+	we := initWorkflowEntries(nil)
+	we.Entries["svc"] = e
+	if due := we.dueRetries(time.Now()); len(due) != 0 {
+		t.Errorf("dueRetries() = %v entries, want 0", len(due))
+	}
+	if due := we.dueRetries(time.Now().Add(time.Minute)); len(due) != 1 {
+		t.Errorf("dueRetries() = %v entries, want 1", len(due))
+	}
+	if due := we.dueRetries(time.Now().Add(time.Minute)); len(due) != 0 {
+		t.Errorf("dueRetries() = %v entries, want 0", len(due))
+	}
+
+	// the last failure sets the entry as failed and reports it to the provider
+	e.stepFailed()
+	if !e.Failed || !e.RetryTime.IsZero() || e.Attempts != 2 {
+		t.Errorf("stepFailed() = failed %v, attempts %v, retry %v", e.Failed, e.Attempts, e.RetryTime)
+	}
+
+	select {
+	case got := <-msgToExtension:
+		if got.State != comm.FailedState || got.Error != "error" || got.Destination != "provider.one" {
+			t.Errorf("status = %v, want failed status to provider.one", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status sent")
+	}
+
+	// moving to the next step resets the attempts, the failure is kept
+	workflows = map[string]workflowSteps{defaultWorkflow: testWF}
+	e.setNextStep()
+	if !e.Failed || e.Attempts != 0 || e.Error != "error" {
+		t.Errorf("setNextStep() = failed %v, attempts %v, error %v", e.Failed, e.Attempts, e.Error)
+	}
+}
+
+func Test_workflowEntries_mergeMessageFailed(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	stepRetry = newRetryPolicy(2, time.Minute, time.Minute)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,lb.three")}
+	defer func() { stepRetry = newRetryPolicy(0, 0, 0) }()
+
+	receive := func() comm.Message {
+		select {
+		case msg := <-msgToExtension:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message sent")
+		}
+		return comm.Message{}
+	}
+	// the workflow is executed asynchronously, it would send the service to the first step
+	noMessage := func() {
+		select {
+		case got := <-msgToExtension:
+			t.Errorf("unexpected message %v %v to %v", got.Action, got.State, got.Destination)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	we := initWorkflowEntries(nil)
+	svc := comm.Service{Name: "svc", Provider: "provider.one", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+	poll := func(svc comm.Service) {
+		if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	answerError := func() {
+		if err := we.mergeMessage(comm.Message{Action: comm.UpdateAction, Sender: "ipam.two", Error: "no ip left", Service: svc}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry := func() workflowEntry {
+		e := we.Entries["svc"]
+		e.Lock()
+		defer e.Unlock()
+		return workflowEntry{State: e.State, Attempts: e.Attempts, RetryTime: e.RetryTime, Failed: e.Failed, Error: e.Error}
+	}
+
+	poll(svc)
+	receive()
+	answerError()
+	for start := time.Now(); entry().RetryTime.IsZero(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no retry scheduled")
+		}
+	}
+
+	// an unchanged poll keeps the pending retry
+	retry := entry().RetryTime
+	poll(svc)
+	noMessage()
+	if got := entry(); got.Attempts != 1 || !got.RetryTime.Equal(retry) {
+		t.Errorf("entry attempts %v, retry %v, want 1, %v", got.Attempts, got.RetryTime, retry)
+	}
+
+	// the last attempt fails the entry, the next unchanged poll does not restart it
+	for _, e := range we.dueRetries(retry.Add(time.Second)) {
+		e.sendToExtension()
+	}
+	receive()
+	answerError()
+	if got := receive(); got.Action != comm.StatusAction || got.State != comm.FailedState {
+		t.Errorf("got %v %v, want failed status", got.Action, got.State)
+	}
+	poll(svc)
+	noMessage()
+	if got := entry(); !got.Failed || got.State != "ipam.two" || got.Error != "no ip left" {
+		t.Errorf("entry failed %v, state %v, error %v", got.Failed, got.State, got.Error)
+	}
+
+	// a changed definition restarts the deployment
+	svc.Targets = []comm.Target{{Host: "10.32.2.2", Port: 80, Weight: 1}}
+	poll(svc)
+	if got := receive(); got.Destination != "ipam.two" || got.Action != comm.AddAction {
+		t.Errorf("got %v to %v, want add to ipam.two", got.Action, got.Destination)
+	}
+	if got := entry(); got.Failed || got.Attempts != 0 {
+		t.Errorf("entry failed %v, attempts %v", got.Failed, got.Attempts)
+	}
+}
+
+func Test_workflowEntry_timeoutStep(t *testing.T) {
+	msgToExtension = make(chan comm.Message, 1)
+	stepRetry = newRetryPolicy(2, time.Minute, time.Minute)
+	defer func() { stepRetry = newRetryPolicy(0, 0, 0) }()
+
+	e := &workflowEntry{State: "provisioner.two", ExpectedState: deployedState, WorkInProgress: true, WIPTime: time.Now().Add(-time.Hour),
+		Service: comm.Service{Name: "svc", Provider: "provider.one"}}
+	retried := func() bool {
+		e.Lock()
+		defer e.Unlock()
+		return !e.RetryTime.IsZero()
+	}
+
+	if e.timeoutStep(time.Now().Add(-2 * time.Hour)) {
+		t.Errorf("timeoutStep() timed out a recent step")
+	}
+
+	// the first timeout schedules a new attempt of the step
+	if !e.timeoutStep(time.Now()) {
+		t.Fatal("timeoutStep() did not time out the step")
+	}
+	for start := time.Now(); !retried(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("no retry scheduled")
+		}
+	}
+	e.Lock()
+	if e.WorkInProgress || e.Failed || e.Attempts != 1 || e.State != "provisioner.two" {
+		t.Errorf("timeoutStep() = wip %v, failed %v, attempts %v, state %v", e.WorkInProgress, e.Failed, e.Attempts, e.State)
+	}
+	e.WorkInProgress = true
+	e.WIPTime = time.Now().Add(-time.Hour)
+	e.Unlock()
+
+	// the last timeout sets the entry as failed and reports it to the provider
+	if !e.timeoutStep(time.Now()) {
+		t.Fatal("timeoutStep() did not time out the step")
+	}
+	select {
+	case got := <-msgToExtension:
+		if got.State != comm.FailedState || got.Destination != "provider.one" || !strings.Contains(got.Error, "ServiceWIPTimeout") {
+			t.Errorf("status = %v, want failed status to provider.one", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no status sent")
+	}
+}
+
+func Test_workflowEntries_rollbackOnFailure(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	stepRetry = newRetryPolicy(1, time.Minute, time.Minute)
+	rollbackOnFailure = true
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,ipam.two,dns.three,lb.four")}
+	defer func() {
+		stepRetry = newRetryPolicy(0, 0, 0)
+		rollbackOnFailure = false
+	}()
+
+	// receive returns the next message sent to an extension
+	receive := func() comm.Message {
+		select {
+		case msg := <-msgToExtension:
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message sent")
+		}
+		return comm.Message{}
+	}
+
+	we := initWorkflowEntries(nil)
+	svc := comm.Service{Name: "svc", Provider: "provider.one", Targets: []comm.Target{{Host: "10.32.2.1", Port: 80, Weight: 1}}}
+	answer := func(sender, err string) {
+		if mergeErr := we.mergeMessage(comm.Message{Action: comm.UpdateAction, Sender: sender, Error: err, Service: svc}); mergeErr != nil {
+			t.Fatal(mergeErr)
+		}
+	}
+
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	answer("ipam.two", "")
+	receive()
+	answer("dns.three", "")
+	receive()
+	answer("lb.four", "could not create virtual server")
+
+	// the provider is notified of the failure, and the completed steps are rolled back in reverse order
+	// statuses are sent asynchronously
+	statuses := 0
+	for _, step := range []string{"dns.three", "ipam.two"} {
+		got := receive()
+		if got.Action == comm.StatusAction {
+			statuses++
+			if got.State != comm.FailedState {
+				t.Errorf("got status %v, want %v", got.State, comm.FailedState)
+			}
+			got = receive()
+		}
+		if got.Destination != step || got.Action != comm.DeleteAction {
+			t.Errorf("got %v %v, want delete to %v", got.Action, got.Destination, step)
+		}
+		answer(step, "")
+	}
+
+	// the entry is undeployed once rolled back, the provider is notified again
+	for ; statuses < 2; statuses++ {
+		if got := receive(); got.Action != comm.StatusAction || got.State != comm.FailedState {
+			t.Errorf("got %v, want failed status", got)
+		}
+	}
+
+	entry := we.Entries["svc"]
+	entry.Lock()
+	if entry.State != undeployedState || entry.Error != "could not create virtual server" {
+		t.Errorf("entry state = %v, error = %v", entry.State, entry.Error)
+	}
+
+	var steps []string
+	for _, c := range entry.Compensations {
+		steps = append(steps, c.Step)
+	}
+	if want := []string{"dns.three", "ipam.two"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("compensations = %v, want %v", steps, want)
+	}
+	entry.Unlock()
+
+	// the next unchanged poll does not deploy the rolled back service again
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-msgToExtension:
+		t.Errorf("unexpected message %v %v to %v", got.Action, got.State, got.Destination)
+	case <-time.After(100 * time.Millisecond):
+	}
+	entry.Lock()
+	if entry.State != undeployedState || !entry.Failed {
+		t.Errorf("entry state = %v, failed = %v", entry.State, entry.Failed)
+	}
+	entry.Unlock()
+
+	// a changed definition deploys it again
+	svc.Targets = []comm.Target{{Host: "10.32.2.2", Port: 80, Weight: 1}}
+	if err := we.mergeMessage(comm.Message{Action: comm.AddAction, Sender: "provider.one", Service: svc}); err != nil {
+		t.Fatal(err)
+	}
+	if got := receive(); got.Destination != "ipam.two" || got.Action != comm.AddAction {
+		t.Errorf("got %v to %v, want add to ipam.two", got.Action, got.Destination)
+	}
+}
+
+func Test_workflowEntries_inFlight(t *testing.T) {
+	we := initWorkflowEntries(nil)
+	we.Entries["wip"] = &workflowEntry{State: "lb.two", WorkInProgress: true}
+	we.Entries["retry"] = &workflowEntry{State: "lb.two", RetryTime: time.Now()}
+	we.Entries["deployed"] = &workflowEntry{State: deployedState}
+
+	got := we.inFlight()
+	if len(got) != 1 || got[0] != we.Entries["wip"] {
+		t.Errorf("inFlight() = %v, want the wip entry", got)
+	}
+}
+
+func Test_workflowEntries_providedServices(t *testing.T) {
+	we := initWorkflowEntries(nil)
+	we.Entries["wip"] = &workflowEntry{State: "lb.two", ExpectedState: deployedState, WorkInProgress: true, Service: comm.Service{Name: "wip"}}
+	we.Entries["deployed"] = &workflowEntry{State: deployedState, ExpectedState: deployedState, Service: comm.Service{Name: "deployed"}}
+	we.Entries["failed"] = &workflowEntry{State: "lb.two", ExpectedState: deployedState, Failed: true, Service: comm.Service{Name: "failed"}}
+	we.Entries["undeployed"] = &workflowEntry{State: undeployedState, ExpectedState: undeployedState, Service: comm.Service{Name: "undeployed"}}
+
+	var got []string
+	for _, service := range we.providedServices() {
+		got = append(got, service.Name)
+	}
+	if want := []string{"deployed", "failed"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("providedServices() = %v, want %v", got, want)
+	}
+}
+
+func Test_workflowEntries_mergeSnapshot(t *testing.T) {
+	defer func(wfs map[string]workflowSteps) { workflows = wfs }(workflows)
+	msgToExtension = make(chan comm.Message, 10)
+	workflows = map[string]workflowSteps{defaultWorkflow: initWorkflow("provider.one,lb.two")}
+
+	entry := func(name, provider, state string) *workflowEntry {
+		return &workflowEntry{State: state, ExpectedState: state,
+			Service: comm.Service{Name: name, Provider: provider, Targets: []comm.Target{{Host: "10.32.2.1", Port: 80}}}}
+	}
+	we := initWorkflowEntries(nil)
+	we.Entries["found"] = entry("found", "provider.one", deployedState)
+	we.Entries["missing"] = entry("missing", "provider.one", deployedState)
+	we.Entries["other"] = entry("other", "provider.two", deployedState)
+	we.Entries["undeployed"] = entry("undeployed", "provider.one", undeployedState)
+
+	snapshot := comm.BuildSnapshotMessage([]string{"found"})
+	snapshot.Sender = "provider.one"
+	if err := we.mergeMessage(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the missing service of the provider is un-deployed
+	select {
+	case got := <-msgToExtension:
+		if got.Action != comm.DeleteAction || got.Destination != "lb.two" || got.Service.Name != "missing" {
+			t.Errorf("got %v of %v to %v, want delete of missing to lb.two", got.Action, got.Service.Name, got.Destination)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing service not un-deployed")
+	}
+
+	for _, name := range []string{"found", "other", "undeployed"} {
+		e := we.Entries[name]
+		e.Lock()
+		if e.State != e.ExpectedState {
+			t.Errorf("entry %v changed to %v, expected %v", name, e.State, e.ExpectedState)
+		}
+		e.Unlock()
+	}
+}
@@ -6,7 +6,12 @@ import (
 	"fmt"
 	"github.com/interlook/interlook/config"
 	"github.com/interlook/interlook/log"
+	"github.com/interlook/interlook/provider/api"
+	consulprovider "github.com/interlook/interlook/provider/consul"
+	"github.com/interlook/interlook/provider/docker"
+	"github.com/interlook/interlook/provider/file"
 	"github.com/interlook/interlook/provider/kubernetes"
+	"github.com/interlook/interlook/provider/nomad"
 	"github.com/interlook/interlook/provider/swarm"
 	"github.com/interlook/interlook/provisioner/dns/consul"
 	"github.com/interlook/interlook/provisioner/ipam/ipalloc"
@@ -25,6 +30,11 @@ func main() {
 	cfg := config.ServerConfiguration{}
 	cfg.Provider.Swarm = &swarm.Provider{}
 	cfg.Provider.Kubernetes = &kubernetes.Extension{}
+	cfg.Provider.File = &file.Provider{}
+	cfg.Provider.Consul = &consulprovider.Provider{}
+	cfg.Provider.Docker = &docker.Provider{}
+	cfg.Provider.Nomad = &nomad.Provider{}
+	cfg.Provider.API = &api.Provider{}
 	cfg.IPAM.IPAlloc = &ipalloc.IPAlloc{}
 	cfg.DNS.Consul = &consul.Consul{}
 	cfg.LB.KempLM = &kemplm.KempLM{}
@@ -10,25 +10,22 @@ require (
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-units v0.4.0 // indirect
 	github.com/fatih/structs v1.1.0
-	github.com/google/go-cmp v0.3.0
-	github.com/googleapis/gnostic v0.4.0 // indirect
+	github.com/google/go-cmp v0.4.0
 	github.com/gorilla/mux v1.7.1 // indirect
 	github.com/hashicorp/consul/api v1.2.0
 	github.com/morikuni/aec v0.0.0-20170113033406-39771216ff4c // indirect
 	github.com/opencontainers/go-digest v1.0.0-rc1 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
 	github.com/scottdware/go-bigip v0.0.0-00010101000000-000000000000
-
 	github.com/sirupsen/logrus v1.4.2
-	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
-	google.golang.org/grpc v1.19.1 // indirect
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	gopkg.in/yaml.v3 v3.0.0-20190905181640-827449938966
 	gotest.tools v2.2.0+incompatible // indirect
-	k8s.io/api v0.17.2
-	k8s.io/apimachinery v0.17.2
-	k8s.io/client-go v0.17.2
-	k8s.io/utils v0.0.0-20200124190032-861946025e34 // indirect
+	k8s.io/api v0.19.16
+	k8s.io/apimachinery v0.19.16
+	k8s.io/client-go v0.19.16
 )
 
 replace (
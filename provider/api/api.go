@@ -0,0 +1,493 @@
+// Package api exposes a REST API to register the services to be published
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	extensionName = "provider.api"
+	servicesPath  = "/services"
+	// the definitions are small, slow clients must not hold the connections
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// Provider holds the api provider configuration
+type Provider struct {
+	ListenAddress string `yaml:"listenAddress"`
+	// bearer tokens allowed to call the API
+	Tokens  []string `yaml:"tokens"`
+	TLSCert string   `yaml:"tlsCert"`
+	TLSKey  string   `yaml:"tlsKey"`
+	// file the service definitions are persisted to
+	DBFile   string `yaml:"dbFile"`
+	server   *http.Server
+	listener net.Listener
+	shutdown chan bool
+	send     chan<- comm.Message
+	services map[string]serviceDefinition
+	lock     sync.RWMutex
+	// services changed through the api, waiting to be sent to the core
+	changes   chan bool
+	pending   map[string]bool
+	waitGroup sync.WaitGroup
+}
+
+// serviceDefinition describes a service to be published
+type serviceDefinition struct {
+	Name    string   `json:"name"`
+	Hosts   []string `json:"hosts"`
+	TLS     bool     `json:"tls"`
+	Targets []target `json:"targets"`
+	// workflow to follow, the default one if empty
+	Workflow string `json:"workflow,omitempty"`
+}
+
+type target struct {
+	Host string `json:"host"`
+	Port uint32 `json:"port"`
+}
+
+func (p *Provider) init() error {
+
+	p.shutdown = make(chan bool)
+	p.services = make(map[string]serviceDefinition)
+	p.changes = make(chan bool, 1)
+	p.pending = make(map[string]bool)
+
+	if len(p.Tokens) == 0 {
+		return errors.New("at least one token must be configured")
+	}
+
+	for _, token := range p.Tokens {
+		if token == "" {
+			return errors.New("empty token configured")
+		}
+	}
+
+	if p.DBFile == "" {
+		return errors.New("dbFile must be configured")
+	}
+
+	if p.ListenAddress == "" {
+		p.ListenAddress = ":8081"
+	}
+
+	if err := p.load(); err != nil {
+		return err
+	}
+
+	p.server = &http.Server{
+		Handler:           p.handler(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	return nil
+}
+
+// Start the api provider
+func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+	log.Infof("Starting %v on %v\n", extensionName, p.ListenAddress)
+	p.send = send
+
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	var err error
+	if p.listener, err = net.Listen("tcp", p.ListenAddress); err != nil {
+		return err
+	}
+
+	go func() {
+		var err error
+		if p.TLSCert != "" {
+			err = p.server.ServeTLS(p.listener, p.TLSCert, p.TLSKey)
+		} else {
+			err = p.server.Serve(p.listener)
+		}
+		if err != http.ErrServerClosed {
+			log.Errorf("%v server stopped: %v", extensionName, err)
+		}
+	}()
+
+	// the persisted definitions are pushed again in case the core lost them
+	var msgs []comm.Message
+	p.lock.RLock()
+	for _, name := range p.sortedNames() {
+		msgs = append(msgs, p.services[name].buildMessage())
+	}
+	p.lock.RUnlock()
+
+	for _, msg := range msgs {
+		p.send <- msg
+	}
+
+	p.waitGroup.Add(1)
+	for {
+		select {
+		case <-p.shutdown:
+			if err := p.server.Shutdown(context.Background()); err != nil {
+				log.Errorf("Error shutting down %v server: %v", extensionName, err)
+			}
+			p.waitGroup.Done()
+
+			return nil
+
+		case <-p.changes:
+			p.sendPending()
+
+		case msg := <-receive:
+			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
+			switch msg.Action {
+			case comm.RefreshAction:
+				log.Debugf("Request to refresh service %v", msg.Service.Name)
+				p.RefreshService(msg)
+			default:
+				log.Warnf("Unhandled action requested: %v", msg.Action)
+			}
+		}
+	}
+}
+
+// Stop the api provider
+func (p *Provider) Stop() error {
+	log.Debug("Stopping api provider")
+	p.shutdown <- true
+	p.waitGroup.Wait()
+
+	return nil
+}
+
+// RefreshService sends the registered definition of the service, or a delete if it is not registered
+func (p *Provider) RefreshService(msg comm.Message) {
+	p.lock.RLock()
+	definition, ok := p.services[msg.Service.Name]
+	p.lock.RUnlock()
+
+	if !ok {
+		log.Infof("service %v not registered, send delete", msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	p.send <- definition.buildMessage()
+}
+
+func (p *Provider) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(servicesPath, p.authenticated(p.listServices))
+	mux.HandleFunc(servicesPath+"/", p.authenticated(p.serviceHandler))
+	return mux
+}
+
+// authenticated rejects the requests without a valid bearer token
+func (p *Provider) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			token := strings.TrimPrefix(header, "Bearer ")
+			for _, t := range p.Tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+					next(w, r)
+					return
+				}
+			}
+		}
+
+		log.Warnf("%v unauthorized request %v %v from %v", extensionName, r.Method, r.URL.Path, r.RemoteAddr)
+		writeError(w, http.StatusUnauthorized, "invalid or missing token")
+	}
+}
+
+func (p *Provider) listServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	p.lock.RLock()
+	definitions := make([]serviceDefinition, 0, len(p.services))
+	for _, name := range p.sortedNames() {
+		definitions = append(definitions, p.services[name])
+	}
+	p.lock.RUnlock()
+
+	writeJSON(w, http.StatusOK, definitions)
+}
+
+func (p *Provider) serviceHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, servicesPath+"/")
+	if name == "" || strings.Contains(name, "/") {
+		writeError(w, http.StatusNotFound, "invalid service name")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.lock.RLock()
+		definition, ok := p.services[name]
+		p.lock.RUnlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %v not found", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, definition)
+
+	case http.MethodPut:
+		var definition serviceDefinition
+		if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid service definition: "+err.Error())
+			return
+		}
+		definition.Name = name
+		if err := definition.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		created, err := p.putService(definition)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(w, status, definition)
+
+	case http.MethodDelete:
+		found, err := p.deleteService(name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !found {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("service %v not found", name))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// putService registers the definition, it is sent to the core by the Start loop
+func (p *Provider) putService(definition serviceDefinition) (created bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	previous, exists := p.services[definition.Name]
+	p.services[definition.Name] = definition
+	if err := p.save(); err != nil {
+		if exists {
+			p.services[definition.Name] = previous
+		} else {
+			delete(p.services, definition.Name)
+		}
+		return false, err
+	}
+
+	log.Infof("service %v registered through api", definition.Name)
+	p.notifyChange(definition.Name)
+
+	return !exists, nil
+}
+
+// deleteService removes the definition, the delete is sent to the core by the Start loop
+func (p *Provider) deleteService(name string) (found bool, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	previous, exists := p.services[name]
+	if !exists {
+		return false, nil
+	}
+
+	delete(p.services, name)
+	if err := p.save(); err != nil {
+		p.services[name] = previous
+		return true, err
+	}
+
+	log.Infof("service %v deleted through api", name)
+	p.notifyChange(name)
+
+	return true, nil
+}
+
+// notifyChange marks the service as changed, the lock must be held by the caller
+// the handlers do not wait for the core to receive the message
+func (p *Provider) notifyChange(name string) {
+	p.pending[name] = true
+
+	select {
+	case p.changes <- true:
+	default:
+	}
+}
+
+// sendPending sends the current state of the changed services, sorted by name
+// successive changes of a service are merged, the core always receives its last state
+func (p *Provider) sendPending() {
+	var msgs []comm.Message
+
+	p.lock.Lock()
+	var names []string
+	for name := range p.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if definition, ok := p.services[name]; ok {
+			msgs = append(msgs, definition.buildMessage())
+		} else {
+			msgs = append(msgs, comm.BuildDeleteMessage(name))
+		}
+	}
+	p.pending = make(map[string]bool)
+	p.lock.Unlock()
+
+	for _, msg := range msgs {
+		p.send <- msg
+	}
+}
+
+// load reads the persisted definitions, a missing file is not an error
+func (p *Provider) load() error {
+	data, err := ioutil.ReadFile(p.DBFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var definitions []serviceDefinition
+	if err := json.Unmarshal(data, &definitions); err != nil {
+		return errors.New(fmt.Sprintf("could not parse %v: %v", p.DBFile, err.Error()))
+	}
+
+	for _, definition := range definitions {
+		p.services[definition.Name] = definition
+	}
+
+	return nil
+}
+
+// save persists the definitions, the file is replaced atomically
+// the lock must be held by the caller
+func (p *Provider) save() error {
+	definitions := make([]serviceDefinition, 0, len(p.services))
+	for _, name := range p.sortedNames() {
+		definitions = append(definitions, p.services[name])
+	}
+
+	data, err := json.Marshal(definitions)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.DBFile), filepath.Base(p.DBFile))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p.DBFile)
+}
+
+func (p *Provider) sortedNames() []string {
+	var names []string
+	for name := range p.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d serviceDefinition) validate() error {
+	if len(d.Hosts) == 0 {
+		return errors.New(fmt.Sprintf("service %v has no host", d.Name))
+	}
+
+	if len(d.Targets) == 0 {
+		return errors.New(fmt.Sprintf("service %v has no target", d.Name))
+	}
+
+	for _, t := range d.Targets {
+		if t.Host == "" || t.Port == 0 {
+			return errors.New(fmt.Sprintf("service %v has an invalid target %v:%v", d.Name, t.Host, t.Port))
+		}
+	}
+
+	return nil
+}
+
+func (d serviceDefinition) buildMessage() comm.Message {
+	msg := comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       d.Name,
+			Provider:   extensionName,
+			TLS:        d.TLS,
+			DNSAliases: d.Hosts,
+			Workflow:   d.Workflow,
+		}}
+
+	for _, t := range d.Targets {
+		msg.Service.Targets = append(msg.Service.Targets, comm.Target{
+			Host: t.Host,
+			Port: t.Port,
+		})
+	}
+
+	return msg
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Error encoding JSON response %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,244 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+const webDefinition = `{"hosts": ["web.dummy.com"], "tls": true, "targets": [{"host": "10.32.2.1", "port": 8080}]}`
+
+var webMsg = comm.Message{
+	Action: comm.AddAction,
+	Service: comm.Service{
+		Name:       "web",
+		Provider:   extensionName,
+		TLS:        true,
+		DNSAliases: []string{"web.dummy.com"},
+		Targets:    []comm.Target{{Host: "10.32.2.1", Port: 8080}},
+	}}
+
+// newTestProvider returns an initialized provider persisting to a temporary directory
+func newTestProvider(t *testing.T, dir string) (*Provider, chan comm.Message) {
+	send := make(chan comm.Message, 10)
+	p := &Provider{Tokens: []string{"secret"}, DBFile: filepath.Join(dir, "services.db"), send: send}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	return p, send
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "interlook-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func doRequest(p *Provider, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	p.handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProvider_init(t *testing.T) {
+	tests := []struct {
+		name    string
+		p       *Provider
+		wantErr bool
+	}{
+		{"ok", &Provider{Tokens: []string{"secret"}, DBFile: "/notfound/services.db"}, false},
+		{"noToken", &Provider{DBFile: "/notfound/services.db"}, true},
+		{"emptyToken", &Provider{Tokens: []string{""}, DBFile: "/notfound/services.db"}, true},
+		{"noDBFile", &Provider{Tokens: []string{"secret"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.p.init(); (err != nil) != tt.wantErr {
+				t.Errorf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProvider_handler(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		token      string
+		body       string
+		wantStatus int
+		wantMsg    *comm.Message
+	}{
+		{"noToken", http.MethodGet, "/services", "", "", http.StatusUnauthorized, nil},
+		{"invalidToken", http.MethodGet, "/services", "invalid", "", http.StatusUnauthorized, nil},
+		{"list", http.MethodGet, "/services", "secret", "", http.StatusOK, nil},
+		{"get", http.MethodGet, "/services/api", "secret", "", http.StatusOK, nil},
+		{"getNotFound", http.MethodGet, "/services/notfound", "secret", "", http.StatusNotFound, nil},
+		{"create", http.MethodPut, "/services/web", "secret", webDefinition, http.StatusCreated, &webMsg},
+		{"update", http.MethodPut, "/services/api", "secret", `{"hosts": ["api.dummy.com"], "targets": [{"host": "10.32.2.2", "port": 9000}]}`, http.StatusOK,
+			&comm.Message{Action: comm.AddAction, Service: comm.Service{Name: "api", Provider: extensionName, DNSAliases: []string{"api.dummy.com"}, Targets: []comm.Target{{Host: "10.32.2.2", Port: 9000}}}}},
+		{"noHost", http.MethodPut, "/services/web", "secret", `{"targets": [{"host": "10.32.2.2", "port": 9000}]}`, http.StatusBadRequest, nil},
+		{"noTarget", http.MethodPut, "/services/web", "secret", `{"hosts": ["web.dummy.com"]}`, http.StatusBadRequest, nil},
+		{"invalidJSON", http.MethodPut, "/services/web", "secret", `{"hosts": `, http.StatusBadRequest, nil},
+		{"delete", http.MethodDelete, "/services/api", "secret", "", http.StatusNoContent, &comm.Message{Action: comm.DeleteAction, Service: comm.Service{Name: "api"}}},
+		{"deleteNotFound", http.MethodDelete, "/services/notfound", "secret", "", http.StatusNotFound, nil},
+		{"invalidName", http.MethodPut, "/services/a/b", "secret", webDefinition, http.StatusNotFound, nil},
+		{"invalidMethod", http.MethodPost, "/services", "secret", webDefinition, http.StatusMethodNotAllowed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+
+			p, send := newTestProvider(t, dir)
+			if rec := doRequest(p, http.MethodPut, "/services/api", "secret", `{"hosts": ["api.dummy.com"], "targets": [{"host": "10.32.2.3", "port": 9000}]}`); rec.Code != http.StatusCreated {
+				t.Fatalf("could not create fixture: %v", rec.Body.String())
+			}
+			p.sendPending()
+			<-send
+
+			rec := doRequest(p, tt.method, tt.path, tt.token, tt.body)
+			p.sendPending()
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %v, want %v (%v)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+
+			switch {
+			case tt.wantMsg == nil && len(send) > 0:
+				t.Errorf("unexpected message %v", <-send)
+			case tt.wantMsg != nil && len(send) == 0:
+				t.Errorf("no message sent, want %v", *tt.wantMsg)
+			case tt.wantMsg != nil:
+				if got := <-send; !reflect.DeepEqual(got, *tt.wantMsg) {
+					t.Errorf("Msg = %v, want %v", got, *tt.wantMsg)
+				}
+			}
+		})
+	}
+}
+
+func TestProvider_persistence(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	p, _ := newTestProvider(t, dir)
+	doRequest(p, http.MethodPut, "/services/web", "secret", webDefinition)
+	doRequest(p, http.MethodPut, "/services/api", "secret", `{"hosts": ["api.dummy.com"], "targets": [{"host": "10.32.2.3", "port": 9000}]}`)
+	doRequest(p, http.MethodDelete, "/services/api", "secret", "")
+
+	// a new instance answers the refresh requests from the persisted definitions
+	restarted, send := newTestProvider(t, dir)
+	restarted.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "web"}})
+	if got := <-send; !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("Msg = %v, want %v", got, webMsg)
+	}
+
+	restarted.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "api"}})
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildDeleteMessage("api")) {
+		t.Errorf("Msg = %v, want delete api", got)
+	}
+}
+
+func TestProvider_persistenceError(t *testing.T) {
+	p, send := newTestProvider(t, "/notfound")
+
+	if rec := doRequest(p, http.MethodPut, "/services/web", "secret", webDefinition); rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %v, want %v", rec.Code, http.StatusInternalServerError)
+	}
+
+	// the definition is not registered if it could not be persisted
+	if len(send) > 0 || len(p.services) > 0 {
+		t.Errorf("definition registered despite persistence error")
+	}
+}
+
+func TestProvider_Start(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "services.db"), []byte("["+strings.Replace(webDefinition, "{", `{"name": "web", `, 1)+"]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Provider{ListenAddress: "127.0.0.1:0", Tokens: []string{"secret"}, DBFile: filepath.Join(dir, "services.db")}
+	rec, send := make(chan comm.Message), make(chan comm.Message)
+	go func() {
+		if err := p.Start(rec, send); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() { go p.Stop() }()
+
+	// persisted definitions are pushed at startup
+	select {
+	case got := <-send:
+		if !reflect.DeepEqual(got, webMsg) {
+			t.Errorf("Msg = %v, want %v", got, webMsg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	// the request does not wait for the core to receive the message
+	req, _ := http.NewRequest(http.MethodDelete, "http://"+p.listener.Addr().String()+"/services/web", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("status = %v, want %v", res.StatusCode, http.StatusNoContent)
+	}
+
+	select {
+	case got := <-send:
+		if !reflect.DeepEqual(got, comm.BuildDeleteMessage("web")) {
+			t.Errorf("Msg = %v, want delete web", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestProvider_sendPending(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	p, send := newTestProvider(t, dir)
+	doRequest(p, http.MethodPut, "/services/web", "secret", `{"hosts": ["old.dummy.com"], "targets": [{"host": "10.32.2.1", "port": 8080}]}`)
+	doRequest(p, http.MethodPut, "/services/web", "secret", webDefinition)
+	doRequest(p, http.MethodPut, "/services/api", "secret", `{"hosts": ["api.dummy.com"], "targets": [{"host": "10.32.2.3", "port": 9000}]}`)
+	doRequest(p, http.MethodDelete, "/services/api", "secret", "")
+
+	// the changes of a service are merged, its last state is sent
+	p.sendPending()
+	want := []comm.Message{comm.BuildDeleteMessage("api"), webMsg}
+	var got []comm.Message
+	for len(send) > 0 {
+		got = append(got, <-send)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent %v, want %v", got, want)
+	}
+
+	p.sendPending()
+	if len(send) > 0 {
+		t.Errorf("unexpected message %v", <-send)
+	}
+}
@@ -0,0 +1,562 @@
+// Package consul publishes the services registered in the consul catalog
+package consul
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/interlook/interlook/provider/labels"
+)
+
+const (
+	extensionName = "provider.consul"
+	// consul meta keys only allow letters, digits, - and _
+	hostsMeta          = "interlook_hosts"
+	sslMeta            = "interlook_ssl"
+	workflowMeta       = "interlook_workflow"
+	watchRetryInterval = 5 * time.Second
+)
+
+type catalogInterface interface {
+	Services(q *api.QueryOptions) (map[string][]string, *api.QueryMeta, error)
+	Node(node string, q *api.QueryOptions) (*api.CatalogNode, *api.QueryMeta, error)
+}
+
+type healthInterface interface {
+	ServiceMultipleTags(service string, tags []string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error)
+	State(state string, q *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error)
+}
+
+// Provider holds the consul provider configuration
+type Provider struct {
+	Address    string `yaml:"address"`
+	Token      string `yaml:"token"`
+	Datacenter string `yaml:"datacenter"`
+	TLSCa      string `yaml:"tlsCa"`
+	TLSCert    string `yaml:"tlsCert"`
+	TLSKey     string `yaml:"tlsKey"`
+	// only the services having all these tags are considered
+	Tags         []string      `yaml:"tags"`
+	PollInterval time.Duration `yaml:"pollInterval"`
+	// maximum duration of the blocking queries
+	WaitTime   time.Duration `yaml:"waitTime"`
+	pollTicker *time.Ticker
+	shutdown   chan bool
+	changes    chan bool
+	// services whose health changed, waiting to be updated
+	serviceChanges chan bool
+	pending        map[string]bool
+	pendingLock    sync.Mutex
+	// checks by service name and node checks by node name at the last health query
+	healthStates map[string][]string
+	nodeStates   map[string][]string
+	// tags by service name at the last catalog query
+	catalogTags map[string][]string
+	ctx         context.Context
+	cancel      context.CancelFunc
+	send        chan<- comm.Message
+	catalog     catalogInterface
+	health      healthInterface
+	// services pushed to the core
+	services  map[string]bool
+	waitGroup sync.WaitGroup
+}
+
+func (p *Provider) init() error {
+
+	p.shutdown = make(chan bool)
+	p.changes = make(chan bool, 1)
+	p.serviceChanges = make(chan bool, 1)
+	p.pending = make(map[string]bool)
+	p.services = make(map[string]bool)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if p.PollInterval == time.Duration(0) {
+		p.PollInterval = 5 * time.Minute
+	}
+
+	if p.WaitTime == time.Duration(0) {
+		p.WaitTime = 5 * time.Minute
+	}
+
+	p.pollTicker = time.NewTicker(p.PollInterval)
+
+	if p.catalog == nil || p.health == nil {
+		return p.setCli()
+	}
+
+	return nil
+}
+
+func (p *Provider) setCli() error {
+	// the default configuration reads the CONSUL_HTTP_* environment variables
+	cfg := api.DefaultConfig()
+	if p.Address != "" {
+		cfg.Address = p.Address
+	}
+	if p.Token != "" {
+		cfg.Token = p.Token
+	}
+	if p.Datacenter != "" {
+		cfg.Datacenter = p.Datacenter
+	}
+	if p.TLSCa != "" {
+		cfg.TLSConfig.CAFile = p.TLSCa
+	}
+	if p.TLSCert != "" {
+		cfg.TLSConfig.CertFile = p.TLSCert
+		cfg.TLSConfig.KeyFile = p.TLSKey
+	}
+
+	client, err := api.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.catalog = client.Catalog()
+	p.health = client.Health()
+
+	return nil
+}
+
+// Start the consul provider
+func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+	log.Infof("Starting %v on %v\n", extensionName, p.Address)
+	p.send = send
+
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	// catalog changes (registrations) and health changes are watched separately
+	// only the services affected by a change are updated, their first query triggers the initial poll
+	var services map[string][]string
+	go p.watch("catalog", func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		services, meta, err = p.catalog.Services(q)
+		return meta, err
+	}, func() { p.catalogChanged(services) })
+	var checks api.HealthChecks
+	go p.watch("health", func(q *api.QueryOptions) (meta *api.QueryMeta, err error) {
+		checks, meta, err = p.health.State(api.HealthAny, q)
+		return meta, err
+	}, func() { p.healthChanged(checks) })
+
+	p.waitGroup.Add(1)
+	for {
+		select {
+		case <-p.shutdown:
+			p.cancel()
+			p.pollTicker.Stop()
+			p.waitGroup.Done()
+
+			return nil
+
+		case <-p.pollTicker.C:
+			log.Debug("New poll launched")
+			p.poll()
+
+		case <-p.changes:
+			log.Debug("consul changes requested a new poll")
+			p.poll()
+
+		case <-p.serviceChanges:
+			for _, name := range p.takePending() {
+				log.Debugf("consul service %v changed", name)
+				p.updateService(name)
+			}
+
+		case msg := <-receive:
+			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
+			switch msg.Action {
+			case comm.RefreshAction:
+				log.Debugf("Request to refresh service %v", msg.Service.Name)
+				p.RefreshService(msg)
+			default:
+				log.Warnf("Unhandled action requested: %v", msg.Action)
+			}
+		}
+	}
+}
+
+// Stop the consul provider
+func (p *Provider) Stop() error {
+	log.Debug("Stopping consul provider")
+	p.shutdown <- true
+	p.waitGroup.Wait()
+
+	return nil
+}
+
+// watch runs the given blocking query until the provider is stopped
+// changed is called each time the index of the query changes
+func (p *Provider) watch(name string, query func(q *api.QueryOptions) (*api.QueryMeta, error), changed func()) {
+	var index uint64
+
+	for {
+		q := &api.QueryOptions{WaitIndex: index, WaitTime: p.WaitTime}
+		meta, err := query(q.WithContext(p.ctx))
+
+		select {
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Warnf("%v %v blocking query failed: %v", extensionName, name, err)
+			index = 0
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(watchRetryInterval):
+			}
+			continue
+		}
+
+		switch {
+		case meta.LastIndex < index:
+			// the index went backward (ie consul restore), start over
+			index = 0
+		case meta.LastIndex > index:
+			// the first query also triggers a change, the catalog may have changed since the initial poll
+			log.Debugf("%v %v index changed to %v", extensionName, name, meta.LastIndex)
+			changed()
+			index = meta.LastIndex
+		}
+
+		// a null index would not block
+		if index < 1 {
+			index = 1
+		}
+	}
+}
+
+// notifyChange requests a poll, changes received while a poll is pending are merged
+func (p *Provider) notifyChange() {
+	select {
+	case p.changes <- true:
+	default:
+	}
+}
+
+// catalogChanged requests the update of the services registered, deregistered or whose tags changed since the last catalog query
+// the first query requests a poll
+func (p *Provider) catalogChanged(services map[string][]string) {
+	tags := make(map[string][]string)
+	for name, serviceTags := range services {
+		tags[name] = append([]string{}, serviceTags...)
+		sort.Strings(tags[name])
+	}
+
+	previous := p.catalogTags
+	p.catalogTags = tags
+	if previous == nil {
+		p.notifyChange()
+		return
+	}
+
+	var changed []string
+	for _, name := range changedKeys(previous, tags) {
+		// a service not matching the tags, before and after the change, is not published
+		if containsAll(previous[name], p.Tags) || containsAll(tags[name], p.Tags) {
+			changed = append(changed, name)
+		}
+	}
+
+	if len(changed) > 0 {
+		p.notifyServiceChange(changed)
+	}
+}
+
+// healthChanged requests the update of the services whose checks changed since the last health query
+// a node check change updates the services registered on the node, the first query requests a poll
+func (p *Provider) healthChanged(checks api.HealthChecks) {
+	services := make(map[string][]string)
+	nodes := make(map[string][]string)
+	for _, check := range checks {
+		state := check.Node + "/" + check.CheckID + "/" + check.Status
+		if check.ServiceName == "" {
+			nodes[check.Node] = append(nodes[check.Node], state)
+			continue
+		}
+		services[check.ServiceName] = append(services[check.ServiceName], state)
+	}
+	for _, states := range []map[string][]string{services, nodes} {
+		for name := range states {
+			sort.Strings(states[name])
+		}
+	}
+
+	previous, previousNodes := p.healthStates, p.nodeStates
+	p.healthStates, p.nodeStates = services, nodes
+	if previous == nil {
+		p.notifyChange()
+		return
+	}
+
+	changed := changedKeys(previous, services)
+	for _, node := range changedKeys(previousNodes, nodes) {
+		names, found, err := p.nodeServices(node)
+		if err != nil || !found {
+			// the services of a node gone or not reachable are unknown
+			log.Debugf("%v could not list the services of node %v, new poll launched", extensionName, node)
+			p.notifyChange()
+			return
+		}
+		changed = append(changed, names...)
+	}
+
+	if len(changed) > 0 {
+		p.notifyServiceChange(changed)
+	}
+}
+
+// nodeServices returns the names of the services registered on the node matching the tags
+func (p *Provider) nodeServices(node string) (names []string, found bool, err error) {
+	catalogNode, _, err := p.catalog.Node(node, nil)
+	if err != nil || catalogNode == nil {
+		return nil, false, err
+	}
+
+	for _, svc := range catalogNode.Services {
+		if containsAll(svc.Tags, p.Tags) {
+			names = append(names, svc.Service)
+		}
+	}
+
+	return names, true, nil
+}
+
+// changedKeys returns the keys added, removed or whose values differ between the two maps
+func changedKeys(previous, current map[string][]string) []string {
+	var keys []string
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || !reflect.DeepEqual(old, value) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// notifyServiceChange requests the update of the given services, merged with the pending ones
+func (p *Provider) notifyServiceChange(names []string) {
+	p.pendingLock.Lock()
+	for _, name := range names {
+		p.pending[name] = true
+	}
+	p.pendingLock.Unlock()
+
+	select {
+	case p.serviceChanges <- true:
+	default:
+	}
+}
+
+// takePending returns the services waiting to be updated, sorted by name
+func (p *Provider) takePending() []string {
+	p.pendingLock.Lock()
+	defer p.pendingLock.Unlock()
+
+	var names []string
+	for name := range p.pending {
+		names = append(names, name)
+	}
+	p.pending = make(map[string]bool)
+	sort.Strings(names)
+
+	return names
+}
+
+// updateService sends the current state of a service whose registration or health changed
+// a delete is only sent for the services pushed to the core
+func (p *Provider) updateService(name string) {
+	msg, err := p.getServiceMessage(name)
+	if err != nil {
+		log.Warnf("Error building message for service %v %v", name, err.Error())
+		return
+	}
+
+	if msg.Action == comm.AddAction {
+		p.services[name] = true
+		p.send <- msg
+		return
+	}
+
+	if p.services[name] {
+		log.Infof("consul service %v is gone or has no healthy instance, send delete", name)
+		delete(p.services, name)
+		p.send <- msg
+	}
+}
+
+// poll sends the services found in the catalog to the core
+// services no longer registered or without healthy instance are deleted
+func (p *Provider) poll() {
+	services, _, err := p.catalog.Services(nil)
+	if err != nil {
+		log.Errorf("Querying consul catalog %v", err.Error())
+		return
+	}
+
+	var names []string
+	for name, tags := range services {
+		if containsAll(tags, p.Tags) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var msgs []comm.Message
+	current := make(map[string]bool)
+	for _, name := range names {
+		msg, err := p.getServiceMessage(name)
+		if err != nil {
+			log.Warnf("Error building message for service %v %v", name, err.Error())
+			// keep the service deployed if consul could not be queried
+			current[name] = p.services[name]
+			continue
+		}
+		if msg.Action == comm.AddAction {
+			current[name] = true
+			msgs = append(msgs, msg)
+		}
+	}
+
+	for name := range p.services {
+		if !current[name] {
+			log.Infof("consul service %v is gone or has no healthy instance, send delete", name)
+			delete(p.services, name)
+			p.send <- comm.BuildDeleteMessage(name)
+		}
+	}
+
+	for _, msg := range msgs {
+		p.services[msg.Service.Name] = true
+		p.send <- msg
+	}
+}
+
+// RefreshService sends an updated state for a given service
+func (p *Provider) RefreshService(msg comm.Message) {
+	newMsg, err := p.getServiceMessage(msg.Service.Name)
+	if err != nil {
+		log.Errorf("Error building message for %v: %v", msg.Service.Name, err)
+		return
+	}
+
+	if newMsg.Action == comm.AddAction {
+		p.services[msg.Service.Name] = true
+	} else {
+		log.Debugf("consul service %v not found, send delete", msg.Service.Name)
+		delete(p.services, msg.Service.Name)
+	}
+
+	p.send <- newMsg
+}
+
+// getServiceMessage returns the message describing the service's healthy instances
+// a delete message is returned if the service is not published by interlook or has no healthy instance
+func (p *Provider) getServiceMessage(name string) (comm.Message, error) {
+	entries, _, err := p.health.ServiceMultipleTags(name, p.Tags, false, nil)
+	if err != nil {
+		return comm.Message{}, err
+	}
+
+	msg, ok := buildMessageFromEntries(name, entries)
+	if !ok || len(msg.Service.Targets) == 0 {
+		return comm.BuildDeleteMessage(name), nil
+	}
+
+	return msg, nil
+}
+
+// buildMessageFromEntries builds the message from the service instances
+// it returns false if no instance defines the hosts to publish
+func buildMessageFromEntries(name string, entries []*api.ServiceEntry) (comm.Message, bool) {
+	msg := comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:     name,
+			Provider: extensionName,
+		}}
+
+	published := false
+	for _, entry := range entries {
+		if entry.Service == nil {
+			continue
+		}
+
+		if !published {
+			values := publishLabels(entry.Service)
+			if hosts, tls := labels.ParseHosts(values); len(hosts) > 0 {
+				msg.Service.DNSAliases, msg.Service.TLS, published = hosts, tls, true
+				msg.Service.Workflow = strings.TrimSpace(values[labels.Workflow])
+			}
+		}
+
+		if entry.Checks.AggregatedStatus() != api.HealthPassing {
+			continue
+		}
+
+		host := entry.Service.Address
+		if host == "" && entry.Node != nil {
+			host = entry.Node.Address
+		}
+
+		msg.Service.Targets = append(msg.Service.Targets, comm.Target{
+			Host: host,
+			Port: uint32(entry.Service.Port),
+		})
+	}
+
+	sort.Slice(msg.Service.Targets, func(i, j int) bool {
+		if msg.Service.Targets[i].Host != msg.Service.Targets[j].Host {
+			return msg.Service.Targets[i].Host < msg.Service.Targets[j].Host
+		}
+		return msg.Service.Targets[i].Port < msg.Service.Targets[j].Port
+	})
+
+	return msg, published
+}
+
+// publishLabels returns the interlook labels of the instance, set as key=value tags
+// the service meta, whose keys can not contain dots, takes precedence over the tags
+func publishLabels(svc *api.AgentService) map[string]string {
+	values := labels.FromTags(svc.Tags)
+	for meta, label := range map[string]string{hostsMeta: labels.Hosts, sslMeta: labels.SSL, workflowMeta: labels.Workflow} {
+		if v, found := svc.Meta[meta]; found {
+			values[label] = v
+		}
+	}
+
+	return values
+}
+
+func containsAll(tags, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, t := range tags {
+			if t == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,454 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/provider/labels"
+)
+
+var (
+	passing  = api.HealthChecks{{Status: api.HealthPassing}}
+	critical = api.HealthChecks{{Status: api.HealthPassing}, {Status: api.HealthCritical}}
+
+	webMsg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "web",
+			Provider:   extensionName,
+			TLS:        true,
+			DNSAliases: []string{"web.dummy.com", "www.dummy.com"},
+			Targets:    []comm.Target{{Host: "10.32.2.1", Port: 8080}, {Host: "10.32.2.2", Port: 8080}},
+		}}
+	apiMsg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "api",
+			Provider:   extensionName,
+			DNSAliases: []string{"api.dummy.com"},
+			Targets:    []comm.Target{{Host: "10.32.2.3", Port: 9000}},
+		}}
+)
+
+// fakeConsul implements the catalog and health endpoints used by the provider
+// blocking queries return when the services are updated
+type fakeConsul struct {
+	sync.Mutex
+	index    uint64
+	updated  chan bool
+	services map[string][]*api.ServiceEntry
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{index: 1, updated: make(chan bool)}
+	f.services = map[string][]*api.ServiceEntry{
+		"web": {
+			webEntry("10.32.2.2", "", passing),
+			webEntry("", "10.32.2.1", passing),
+			webEntry("10.32.2.9", "", critical),
+		},
+		"api": {{
+			Node:    &api.Node{Address: "10.32.2.30"},
+			Service: &api.AgentService{Service: "api", Address: "10.32.2.3", Port: 9000, Tags: []string{"interlook.hosts=api.dummy.com"}},
+			Checks:  passing,
+		}},
+		"consul": {{
+			Node:    &api.Node{Address: "10.32.2.10"},
+			Service: &api.AgentService{Service: "consul", Port: 8300},
+			Checks:  passing,
+		}},
+	}
+	return f
+}
+
+func webEntry(svcAddress, nodeAddress string, checks api.HealthChecks) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node: &api.Node{Address: nodeAddress},
+		Service: &api.AgentService{
+			Service: "web",
+			Address: svcAddress,
+			Port:    8080,
+			Tags:    []string{"interlook.hosts=ignored.dummy.com", "interlook.ssl=true"},
+			Meta:    map[string]string{hostsMeta: "web.dummy.com, www.dummy.com"},
+		},
+		Checks: checks,
+	}
+}
+
+// update changes the services and releases the blocking queries
+func (f *fakeConsul) update(fn func(services map[string][]*api.ServiceEntry)) {
+	f.Lock()
+	fn(f.services)
+	f.index++
+	close(f.updated)
+	f.updated = make(chan bool)
+	f.Unlock()
+}
+
+func (f *fakeConsul) wait(q *api.QueryOptions) *api.QueryMeta {
+	f.Lock()
+	index, updated := f.index, f.updated
+	f.Unlock()
+
+	if q != nil && q.WaitIndex >= index {
+		select {
+		case <-updated:
+		case <-q.Context().Done():
+		case <-time.After(q.WaitTime):
+		}
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	return &api.QueryMeta{LastIndex: f.index}
+}
+
+func (f *fakeConsul) Services(q *api.QueryOptions) (map[string][]string, *api.QueryMeta, error) {
+	meta := f.wait(q)
+
+	f.Lock()
+	defer f.Unlock()
+	res := make(map[string][]string)
+	for name, entries := range f.services {
+		res[name] = entries[0].Service.Tags
+	}
+	return res, meta, nil
+}
+
+// Node returns the services of the node, nodeN runs the Nth instance of the services
+func (f *fakeConsul) Node(node string, q *api.QueryOptions) (*api.CatalogNode, *api.QueryMeta, error) {
+	if node == "invalid" {
+		return nil, nil, errors.New("consul unavailable")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	var res *api.CatalogNode
+	for _, entries := range f.services {
+		for i, entry := range entries {
+			if fmt.Sprintf("node%v", i) != node {
+				continue
+			}
+			if res == nil {
+				res = &api.CatalogNode{Node: &api.Node{Node: node}, Services: make(map[string]*api.AgentService)}
+			}
+			res.Services[entry.Service.Service+node] = entry.Service
+		}
+	}
+	return res, &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func (f *fakeConsul) ServiceMultipleTags(service string, tags []string, passingOnly bool, q *api.QueryOptions) ([]*api.ServiceEntry, *api.QueryMeta, error) {
+	if service == "invalid" {
+		return nil, nil, errors.New("consul unavailable")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	return f.services[service], &api.QueryMeta{LastIndex: f.index}, nil
+}
+
+func (f *fakeConsul) State(state string, q *api.QueryOptions) (api.HealthChecks, *api.QueryMeta, error) {
+	meta := f.wait(q)
+
+	f.Lock()
+	defer f.Unlock()
+	var checks api.HealthChecks
+	for name, entries := range f.services {
+		for i, entry := range entries {
+			for j, check := range entry.Checks {
+				checks = append(checks, &api.HealthCheck{
+					Node:        fmt.Sprintf("node%v", i),
+					CheckID:     fmt.Sprintf("check%v", j),
+					ServiceName: name,
+					Status:      check.Status,
+				})
+			}
+		}
+	}
+	return checks, meta, nil
+}
+
+func newFakeProvider() (*Provider, *fakeConsul) {
+	f := newFakeConsul()
+	return &Provider{catalog: f, health: f}, f
+}
+
+// receiveMessage returns the first message sent by the provider for the given service and action
+func receiveMessage(t *testing.T, send chan comm.Message, name, action string) comm.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-send:
+			if msg.Service.Name == name && msg.Action == action {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %v message received for %v", action, name)
+		}
+	}
+}
+
+func Test_publishLabels(t *testing.T) {
+	tests := []struct {
+		name         string
+		svc          *api.AgentService
+		wantHosts    []string
+		wantTLS      bool
+		wantWorkflow string
+	}{
+		{"tags", &api.AgentService{Tags: []string{"interlook.hosts=a.dummy.com,b.dummy.com", "interlook.ssl=true", "interlook.workflow=internal"}},
+			[]string{"a.dummy.com", "b.dummy.com"}, true, "internal"},
+		{"meta", &api.AgentService{Meta: map[string]string{hostsMeta: "a.dummy.com", sslMeta: "true", workflowMeta: "internal"}},
+			[]string{"a.dummy.com"}, true, "internal"},
+		{"metaOverTags", &api.AgentService{Tags: []string{"interlook.hosts=b.dummy.com", "interlook.ssl=true", "interlook.workflow=external"},
+			Meta: map[string]string{hostsMeta: "a.dummy.com", sslMeta: "false", workflowMeta: "internal"}},
+			[]string{"a.dummy.com"}, false, "internal"},
+		{"invalidSSL", &api.AgentService{Tags: []string{"interlook.hosts=a.dummy.com", "interlook.ssl=yes"}},
+			[]string{"a.dummy.com"}, false, ""},
+		{"notPublished", &api.AgentService{Tags: []string{"interlook.hosts="}}, nil, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := publishLabels(tt.svc)
+			hosts, tls := labels.ParseHosts(values)
+			if !reflect.DeepEqual(hosts, tt.wantHosts) || tls != tt.wantTLS || values[labels.Workflow] != tt.wantWorkflow {
+				t.Errorf("publishLabels() = %v, %v, %v, want %v, %v, %v", hosts, tls, values[labels.Workflow], tt.wantHosts, tt.wantTLS, tt.wantWorkflow)
+			}
+		})
+	}
+}
+
+func TestProvider_getServiceMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     string
+		want    comm.Message
+		wantErr bool
+	}{
+		{"healthyTargets", "web", webMsg, false},
+		{"tags", "api", apiMsg, false},
+		{"notPublished", "consul", comm.BuildDeleteMessage("consul"), false},
+		{"notFound", "notfound", comm.BuildDeleteMessage("notfound"), false},
+		{"error", "invalid", comm.Message{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newFakeProvider()
+			got, err := p.getServiceMessage(tt.svc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getServiceMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getServiceMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvider_poll(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		want []comm.Message
+	}{
+		{"all", nil, []comm.Message{apiMsg, webMsg}},
+		{"tagFilter", []string{"interlook.ssl=true"}, []comm.Message{webMsg}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newFakeProvider()
+			p.Tags = tt.tags
+			send := make(chan comm.Message, 10)
+			p.send = send
+			p.init()
+			p.poll()
+
+			var got []comm.Message
+			for len(send) > 0 {
+				got = append(got, <-send)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("poll() sent %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvider_Start(t *testing.T) {
+	p, f := newFakeProvider()
+	rec, send := make(chan comm.Message), make(chan comm.Message)
+	go func() {
+		if err := p.Start(rec, send); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() { go p.Stop() }()
+
+	receiveMessage(t, send, "web", comm.AddAction)
+
+	// an instance becoming unhealthy is reported without waiting for the poll
+	f.update(func(services map[string][]*api.ServiceEntry) {
+		services["web"][0].Checks = critical
+	})
+	got := receiveMessage(t, send, "web", comm.AddAction)
+	if want := []comm.Target{{Host: "10.32.2.1", Port: 8080}}; !reflect.DeepEqual(got.Service.Targets, want) {
+		t.Errorf("Targets = %v, want %v", got.Service.Targets, want)
+	}
+
+	// a deregistered service is deleted
+	f.update(func(services map[string][]*api.ServiceEntry) {
+		delete(services, "api")
+	})
+	receiveMessage(t, send, "api", comm.DeleteAction)
+
+	// a registered service is published without waiting for the poll
+	f.update(func(services map[string][]*api.ServiceEntry) {
+		services["db"] = []*api.ServiceEntry{{
+			Node:    &api.Node{Address: "10.32.2.40"},
+			Service: &api.AgentService{Service: "db", Port: 5432, Tags: []string{"interlook.hosts=db.dummy.com"}},
+		}}
+	})
+	receiveMessage(t, send, "db", comm.AddAction)
+
+	// refresh requests are answered with the current state
+	go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "api"}} }()
+	receiveMessage(t, send, "api", comm.DeleteAction)
+}
+
+func TestProvider_watchIndexReset(t *testing.T) {
+	p := &Provider{changes: make(chan bool, 1), WaitTime: time.Second}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	var waitIndexes []uint64
+	indexes := []uint64{0, 5, 5, 3, 4}
+	p.watch("test", func(q *api.QueryOptions) (*api.QueryMeta, error) {
+		waitIndexes = append(waitIndexes, q.WaitIndex)
+		if len(waitIndexes) == len(indexes) {
+			p.cancel()
+			return nil, errors.New("stopped")
+		}
+		return &api.QueryMeta{LastIndex: indexes[len(waitIndexes)]}, nil
+	}, p.notifyChange)
+
+	// initial query, index 5, no change, index went backward, new index
+	if want := []uint64{0, 5, 5, 1, 4}; !reflect.DeepEqual(waitIndexes, want) {
+		t.Errorf("WaitIndex = %v, want %v", waitIndexes, want)
+	}
+	if len(p.changes) != 1 {
+		t.Errorf("expected a change notification")
+	}
+}
+
+func TestProvider_healthChanged(t *testing.T) {
+	p, _ := newFakeProvider()
+	p.init()
+
+	check := func(node, service, status string) *api.HealthCheck {
+		return &api.HealthCheck{Node: node, CheckID: "check", ServiceName: service, Status: status}
+	}
+	tests := []struct {
+		name        string
+		checks      api.HealthChecks
+		wantPoll    bool
+		wantPending []string
+	}{
+		{"first", api.HealthChecks{check("node1", "", api.HealthPassing), check("node1", "web", api.HealthPassing), check("node1", "api", api.HealthPassing)}, true, nil},
+		{"unchanged", api.HealthChecks{check("node1", "api", api.HealthPassing), check("node1", "web", api.HealthPassing), check("node1", "", api.HealthPassing)}, false, nil},
+		{"serviceCheck", api.HealthChecks{check("node1", "", api.HealthPassing), check("node1", "web", api.HealthCritical), check("node1", "api", api.HealthPassing)}, false, []string{"web"}},
+		{"serviceDeregistered", api.HealthChecks{check("node1", "", api.HealthPassing), check("node1", "web", api.HealthCritical)}, false, []string{"api"}},
+		{"nodeCheck", api.HealthChecks{check("node1", "", api.HealthCritical), check("node1", "web", api.HealthCritical)}, false, []string{"web"}},
+		{"nodeGone", api.HealthChecks{check("node1", "", api.HealthCritical), check("node1", "web", api.HealthCritical), check("node7", "", api.HealthPassing)}, true, nil},
+		{"nodeError", api.HealthChecks{check("node1", "", api.HealthCritical), check("node1", "web", api.HealthCritical), check("invalid", "", api.HealthPassing)}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.healthChanged(tt.checks)
+
+			polled := len(p.changes) == 1
+			if polled {
+				<-p.changes
+			}
+			if polled != tt.wantPoll {
+				t.Errorf("poll requested = %v, want %v", polled, tt.wantPoll)
+			}
+			if got := p.takePending(); !reflect.DeepEqual(got, tt.wantPending) {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+			if len(p.serviceChanges) > 0 {
+				<-p.serviceChanges
+			}
+		})
+	}
+}
+
+func TestProvider_catalogChanged(t *testing.T) {
+	p := &Provider{Tags: []string{"l7aas"}}
+	p.init()
+
+	tests := []struct {
+		name        string
+		services    map[string][]string
+		wantPoll    bool
+		wantPending []string
+	}{
+		{"first", map[string][]string{"web": {"l7aas", "v1"}, "consul": nil}, true, nil},
+		{"unchanged", map[string][]string{"web": {"v1", "l7aas"}, "consul": {}}, false, nil},
+		{"tagsChanged", map[string][]string{"web": {"l7aas", "v2"}, "consul": nil}, false, []string{"web"}},
+		{"registered", map[string][]string{"web": {"l7aas", "v2"}, "api": {"l7aas"}, "db": nil, "consul": nil}, false, []string{"api"}},
+		{"tagRemoved", map[string][]string{"web": {"v2"}, "api": {"l7aas"}, "db": nil, "consul": nil}, false, []string{"web"}},
+		{"deregistered", map[string][]string{"web": {"v2"}, "consul": nil}, false, []string{"api"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.catalogChanged(tt.services)
+
+			polled := len(p.changes) == 1
+			if polled {
+				<-p.changes
+			}
+			if polled != tt.wantPoll {
+				t.Errorf("poll requested = %v, want %v", polled, tt.wantPoll)
+			}
+			if got := p.takePending(); !reflect.DeepEqual(got, tt.wantPending) {
+				t.Errorf("pending = %v, want %v", got, tt.wantPending)
+			}
+			if len(p.serviceChanges) > 0 {
+				<-p.serviceChanges
+			}
+		})
+	}
+}
+
+func TestProvider_updateService(t *testing.T) {
+	p, f := newFakeProvider()
+	send := make(chan comm.Message, 10)
+	p.send = send
+	p.init()
+
+	p.updateService("web")
+	if got := <-send; !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("Msg = %v, want %v", got, webMsg)
+	}
+
+	// a service never pushed is not deleted
+	p.updateService("notfound")
+	if len(send) != 0 {
+		t.Errorf("unexpected message sent: %v", <-send)
+	}
+
+	f.update(func(services map[string][]*api.ServiceEntry) {
+		delete(services, "web")
+	})
+	p.updateService("web")
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildDeleteMessage("web")) {
+		t.Errorf("Msg = %v, want delete web", got)
+	}
+}
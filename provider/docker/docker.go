@@ -0,0 +1,377 @@
+// Package docker publishes the containers running on standalone docker engines
+package docker
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/interlook/interlook/provider/labels"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+const (
+	extensionName = "provider.docker"
+	// containers with the same name label are published as a single service
+	nameLabel          = "interlook.name"
+	apiVersion         = "1.29"
+	watchRetryInterval = 5 * time.Second
+)
+
+type dockerCliInterface interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
+
+// Engine is a docker engine scanned by the provider
+type Engine struct {
+	Endpoint string `yaml:"endpoint"`
+	// address of the engine's host used as target for the ports published on all interfaces
+	// defaults to the endpoint's host
+	HostIP string `yaml:"hostIP"`
+	cli    dockerCliInterface
+	// containers found at last successful scan
+	containers []types.Container
+}
+
+// Provider holds the provider configuration
+type Provider struct {
+	Engines       []*Engine     `yaml:"engines"`
+	LabelSelector []string      `yaml:"labelSelector"`
+	TLSCa         string        `yaml:"tlsCa"`
+	TLSCert       string        `yaml:"tlsCert"`
+	TLSKey        string        `yaml:"tlsKey"`
+	PollInterval  time.Duration `yaml:"pollInterval"`
+	pollTicker    *time.Ticker
+	shutdown      chan bool
+	events        chan *Engine
+	ctx           context.Context
+	cancel        context.CancelFunc
+	send          chan<- comm.Message
+	// services pushed to the core
+	services         map[string]bool
+	containerFilters filters.Args
+	waitGroup        sync.WaitGroup
+}
+
+func (p *Provider) init() error {
+
+	p.shutdown = make(chan bool)
+	p.events = make(chan *Engine)
+	p.services = make(map[string]bool)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if p.PollInterval == time.Duration(0) {
+		p.PollInterval = 15 * time.Second
+	}
+
+	p.pollTicker = time.NewTicker(p.PollInterval)
+
+	p.containerFilters = filters.NewArgs()
+
+	for _, value := range p.LabelSelector {
+		p.containerFilters.Add("label", value)
+	}
+
+	p.containerFilters.Add("label", labels.Hosts)
+	p.containerFilters.Add("label", labels.Port)
+
+	if len(p.Engines) == 0 {
+		return errors.New("no docker engine configured")
+	}
+
+	for _, engine := range p.Engines {
+		if err := p.setEngine(engine); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setEngine creates the engine's client and defines its host IP
+func (p *Provider) setEngine(engine *Engine) error {
+	if engine.HostIP == "" {
+		u, err := url.Parse(engine.Endpoint)
+		if err != nil || u.Hostname() == "" {
+			return errors.New(fmt.Sprintf("could not get host from %v, hostIP must be set", engine.Endpoint))
+		}
+		engine.HostIP = u.Hostname()
+	}
+
+	if engine.cli != nil {
+		return nil
+	}
+
+	var err error
+	engine.cli, err = client.NewClientWithOpts(client.WithTLSClientConfig(p.TLSCa, p.TLSCert, p.TLSKey),
+		client.WithHost(engine.Endpoint),
+		client.WithVersion(apiVersion),
+		client.WithHTTPHeaders(map[string]string{"User-Agent": "interlook"}))
+
+	return err
+}
+
+// Start the docker provider
+func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+
+	p.send = send
+
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	for _, engine := range p.Engines {
+		go p.watch(engine)
+	}
+
+	p.poll()
+
+	p.waitGroup.Add(1)
+	for {
+		select {
+		case <-p.shutdown:
+			p.cancel()
+			p.pollTicker.Stop()
+			p.waitGroup.Done()
+
+			return nil
+
+		case <-p.pollTicker.C:
+			log.Debug("New poll launched")
+			p.poll()
+
+		case engine := <-p.events:
+			p.scan(engine)
+			p.publish()
+
+		case msg := <-receive:
+			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
+			switch msg.Action {
+			case comm.RefreshAction:
+				log.Debugf("Request to refresh service %v", msg.Service.Name)
+				p.RefreshService(msg)
+			default:
+				log.Warnf("Unhandled action requested: %v", msg.Action)
+			}
+		}
+	}
+}
+
+// Stop the docker provider
+func (p *Provider) Stop() error {
+	log.Debug("Stopping docker provider")
+	p.shutdown <- true
+	p.waitGroup.Wait()
+
+	return nil
+}
+
+// watch subscribes to the engine's container events and requests a new scan of the engine on each of them
+// the subscription is re-established on error until the provider is stopped
+func (p *Provider) watch(engine *Engine) {
+	eventFilters := filters.NewArgs()
+	eventFilters.Add("type", events.ContainerEventType)
+	for _, event := range []string{"start", "stop", "die", "pause", "unpause"} {
+		eventFilters.Add("event", event)
+	}
+
+	for {
+		log.Infof("%v subscribing to docker events on %v", extensionName, engine.Endpoint)
+		msgs, errs := engine.cli.Events(p.ctx, types.EventsOptions{Filters: eventFilters})
+
+	subscription:
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+
+			case err := <-errs:
+				log.Warnf("%v docker events stream on %v closed: %v", extensionName, engine.Endpoint, err)
+				break subscription
+
+			case event := <-msgs:
+				log.Debugf("%v received docker event %v on %v", extensionName, event.Action, event.Actor.ID)
+				select {
+				case <-p.ctx.Done():
+					return
+				case p.events <- engine:
+				}
+			}
+		}
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// poll scans all the engines and sends the services to the core
+func (p *Provider) poll() {
+	for _, engine := range p.Engines {
+		p.scan(engine)
+	}
+	p.publish()
+}
+
+// scan lists the labeled containers running on the engine
+// the containers of the previous scan are kept if the engine could not be reached
+func (p *Provider) scan(engine *Engine) {
+	containers, err := engine.cli.ContainerList(p.ctx, types.ContainerListOptions{Filters: p.containerFilters})
+	if err != nil {
+		log.Errorf("Querying containers on %v: %v", engine.Endpoint, err.Error())
+		return
+	}
+
+	engine.containers = containers
+}
+
+// publish sends the services built from the last scan of the engines
+// services that no longer have any container are deleted
+func (p *Provider) publish() {
+	msgs := p.buildMessages()
+
+	for name := range p.services {
+		if _, ok := msgs[name]; !ok {
+			log.Debugf("docker service %v is gone, send delete", name)
+			delete(p.services, name)
+			p.send <- comm.BuildDeleteMessage(name)
+		}
+	}
+
+	var names []string
+	for name := range msgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p.services[name] = true
+		p.send <- msgs[name]
+	}
+}
+
+// RefreshService sends an updated state for a given service
+func (p *Provider) RefreshService(msg comm.Message) {
+	for _, engine := range p.Engines {
+		p.scan(engine)
+	}
+
+	newMsg, ok := p.buildMessages()[msg.Service.Name]
+	if !ok {
+		log.Debugf("docker service %v not found, send delete", msg.Service.Name)
+		delete(p.services, msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	p.services[msg.Service.Name] = true
+	p.send <- newMsg
+}
+
+// buildMessages groups the containers of all engines by service name
+// the publication settings are read from the first container of the service
+func (p *Provider) buildMessages() map[string]comm.Message {
+	msgs := make(map[string]comm.Message)
+
+	for _, engine := range p.Engines {
+		for _, container := range engine.containers {
+			name := containerServiceName(container)
+
+			publishConfig, err := labels.Parse(container.Labels)
+			if err != nil {
+				log.Warnf("Error building message for container %v %v", name, err.Error())
+				continue
+			}
+
+			targets := engine.containerTargets(container, publishConfig.Port)
+			if len(targets) == 0 {
+				log.Warnf("container %v on %v does not publish port %v", name, engine.Endpoint, publishConfig.Port)
+				continue
+			}
+
+			msg, ok := msgs[name]
+			if !ok {
+				msg = comm.Message{
+					Action: comm.AddAction,
+					Service: comm.Service{
+						Name:       name,
+						Provider:   extensionName,
+						DNSAliases: publishConfig.Hosts,
+						TLS:        publishConfig.TLS,
+						Workflow:   publishConfig.Workflow,
+					}}
+			}
+			msg.Service.Targets = append(msg.Service.Targets, targets...)
+			msgs[name] = msg
+		}
+	}
+
+	for name, msg := range msgs {
+		sort.Slice(msg.Service.Targets, func(i, j int) bool {
+			if msg.Service.Targets[i].Host != msg.Service.Targets[j].Host {
+				return msg.Service.Targets[i].Host < msg.Service.Targets[j].Host
+			}
+			return msg.Service.Targets[i].Port < msg.Service.Targets[j].Port
+		})
+		msgs[name] = msg
+	}
+
+	return msgs
+}
+
+// containerServiceName returns the interlook.name label, or the container name
+func containerServiceName(container types.Container) string {
+	if name := container.Labels[nameLabel]; name != "" {
+		return name
+	}
+
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+
+	return container.ID
+}
+
+// containerTargets returns the host addresses and ports the container's port is published on
+// ports published on all interfaces are reached through the engine's host IP, loopback bindings are ignored
+func (e *Engine) containerTargets(container types.Container, port int) []comm.Target {
+	var targets []comm.Target
+	seen := make(map[comm.Target]bool)
+
+	for _, p := range container.Ports {
+		if int(p.PrivatePort) != port || p.PublicPort == 0 || p.Type != "tcp" {
+			continue
+		}
+
+		host := p.IP
+		ip := net.ParseIP(p.IP)
+		if ip == nil || ip.IsUnspecified() {
+			host = e.HostIP
+		} else if ip.IsLoopback() {
+			continue
+		}
+
+		target := comm.Target{Host: host, Port: uint32(p.PublicPort)}
+		// ports published on both 0.0.0.0 and :: are listed twice
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,221 @@
+package docker
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/interlook/interlook/comm"
+	"golang.org/x/net/context"
+)
+
+var webMsg = comm.Message{
+	Action: comm.AddAction,
+	Service: comm.Service{
+		Name:       "web",
+		Provider:   extensionName,
+		TLS:        true,
+		DNSAliases: []string{"web.dummy.com"},
+		Targets:    []comm.Target{{Host: "10.32.2.1", Port: 8080}, {Host: "10.32.2.2", Port: 8080}, {Host: "10.32.2.2", Port: 8081}},
+	}}
+
+// fakeClient returns the containers of a docker engine
+type fakeClient struct {
+	sync.Mutex
+	containers []types.Container
+	err        error
+	events     chan events.Message
+}
+
+func newFakeClient(containers ...types.Container) *fakeClient {
+	return &fakeClient{containers: containers, events: make(chan events.Message)}
+}
+
+func (f *fakeClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.containers, f.err
+}
+
+func (f *fakeClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return f.events, make(chan error)
+}
+
+// setContainers changes the engine's containers and sends an event
+func (f *fakeClient) setContainers(containers ...types.Container) {
+	f.Lock()
+	f.containers = containers
+	f.Unlock()
+	f.events <- events.Message{Type: events.ContainerEventType, Action: "start"}
+}
+
+func webContainer(name string, ports ...types.Port) types.Container {
+	return types.Container{
+		ID:     name,
+		Names:  []string{"/" + name},
+		Labels: map[string]string{"interlook.hosts": "web.dummy.com", "interlook.port": "80", "interlook.ssl": "true", nameLabel: "web"},
+		Ports:  ports,
+	}
+}
+
+// newFakeProvider returns a provider scanning two engines running the web service
+func newFakeProvider() (*Provider, *fakeClient, *fakeClient) {
+	engine1 := newFakeClient(webContainer("web-1",
+		types.Port{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+		types.Port{IP: "::", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+		types.Port{IP: "0.0.0.0", PrivatePort: 9090, PublicPort: 9090, Type: "tcp"}))
+	engine2 := newFakeClient(
+		webContainer("web-2", types.Port{IP: "10.32.2.2", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}),
+		webContainer("web-3", types.Port{PrivatePort: 80, PublicPort: 8081, Type: "tcp"}))
+
+	return &Provider{Engines: []*Engine{
+		{Endpoint: "tcp://10.32.2.1:2376", cli: engine1},
+		{Endpoint: "unix:///var/run/docker.sock", HostIP: "10.32.2.2", cli: engine2},
+	}}, engine1, engine2
+}
+
+// receiveMessage returns the first message sent by the provider for the given service and action
+func receiveMessage(t *testing.T, send chan comm.Message, name, action string) comm.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-send:
+			if msg.Service.Name == name && msg.Action == action {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %v message received for %v", action, name)
+		}
+	}
+}
+
+func TestProvider_setEngine(t *testing.T) {
+	tests := []struct {
+		name       string
+		engine     *Engine
+		wantHostIP string
+		wantErr    bool
+	}{
+		{"tcp", &Engine{Endpoint: "tcp://10.32.2.1:2376"}, "10.32.2.1", false},
+		{"hostIP", &Engine{Endpoint: "tcp://edge1:2376", HostIP: "10.32.2.1"}, "10.32.2.1", false},
+		{"unixNoHostIP", &Engine{Endpoint: "unix:///var/run/docker.sock"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Provider{}
+			err := p.setEngine(tt.engine)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("setEngine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.engine.HostIP != tt.wantHostIP {
+				t.Errorf("HostIP = %v, want %v", tt.engine.HostIP, tt.wantHostIP)
+			}
+		})
+	}
+}
+
+func TestEngine_containerTargets(t *testing.T) {
+	e := &Engine{HostIP: "10.32.2.1"}
+	tests := []struct {
+		name  string
+		ports []types.Port
+		want  []comm.Target
+	}{
+		{"allInterfaces", []types.Port{
+			{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"},
+			{IP: "::", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}},
+			[]comm.Target{{Host: "10.32.2.1", Port: 8080}}},
+		{"boundIP", []types.Port{{IP: "10.32.2.5", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}},
+			[]comm.Target{{Host: "10.32.2.5", Port: 8080}}},
+		{"loopback", []types.Port{{IP: "127.0.0.1", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}}, nil},
+		{"notPublished", []types.Port{{PrivatePort: 80, Type: "tcp"}}, nil},
+		{"otherPort", []types.Port{{IP: "0.0.0.0", PrivatePort: 443, PublicPort: 8443, Type: "tcp"}}, nil},
+		{"udp", []types.Port{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "udp"}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.containerTargets(types.Container{Ports: tt.ports}, 80); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("containerTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_containerServiceName(t *testing.T) {
+	tests := []struct {
+		name      string
+		container types.Container
+		want      string
+	}{
+		{"label", types.Container{ID: "abc", Names: []string{"/web-1"}, Labels: map[string]string{nameLabel: "web"}}, "web"},
+		{"containerName", types.Container{ID: "abc", Names: []string{"/web-1"}}, "web-1"},
+		{"id", types.Container{ID: "abc"}, "abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containerServiceName(tt.container); got != tt.want {
+				t.Errorf("containerServiceName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProvider_poll(t *testing.T) {
+	p, _, engine2 := newFakeProvider()
+	send := make(chan comm.Message, 10)
+	p.send = send
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	p.poll()
+
+	if got := <-send; !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("poll() sent %v, want %v", got, webMsg)
+	}
+
+	// an unreachable engine keeps its containers
+	engine2.err = errors.New("unreachable")
+	p.poll()
+	if got := <-send; !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("poll() sent %v, want %v", got, webMsg)
+	}
+}
+
+func TestProvider_Start(t *testing.T) {
+	p, engine1, engine2 := newFakeProvider()
+	rec, send := make(chan comm.Message), make(chan comm.Message)
+	go func() {
+		if err := p.Start(rec, send); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() { go p.Stop() }()
+
+	receiveMessage(t, send, "web", comm.AddAction)
+
+	// a stopped container is removed from the targets
+	go engine2.setContainers()
+	got := receiveMessage(t, send, "web", comm.AddAction)
+	if want := []comm.Target{{Host: "10.32.2.1", Port: 8080}}; !reflect.DeepEqual(got.Service.Targets, want) {
+		t.Errorf("Targets = %v, want %v", got.Service.Targets, want)
+	}
+
+	// the service is deleted with its last container
+	go engine1.setContainers()
+	receiveMessage(t, send, "web", comm.DeleteAction)
+
+	// refresh requests are answered with the current state
+	go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "web"}} }()
+	receiveMessage(t, send, "web", comm.DeleteAction)
+}
+
+func TestProvider_StartNoEngine(t *testing.T) {
+	p := &Provider{}
+	if err := p.Start(make(chan comm.Message), make(chan comm.Message)); err == nil {
+		t.Errorf("Start() expected error without engine")
+	}
+}
@@ -0,0 +1,279 @@
+package file
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const extensionName = "provider.file"
+
+// Provider holds the file provider configuration
+type Provider struct {
+	// file, or directory of .yml, .yaml and .json files, holding the service definitions
+	Path         string        `yaml:"path"`
+	PollInterval time.Duration `yaml:"pollInterval"`
+	pollTicker   *time.Ticker
+	shutdown     chan bool
+	send         chan<- comm.Message
+	// services pushed to the core at last poll
+	services  map[string]bool
+	waitGroup sync.WaitGroup
+}
+
+// definitionFile is the content of a service definitions file
+type definitionFile struct {
+	Services []serviceDefinition `yaml:"services"`
+}
+
+// serviceDefinition describes a service to be published
+type serviceDefinition struct {
+	Name    string   `yaml:"name"`
+	Hosts   []string `yaml:"hosts"`
+	TLS     bool     `yaml:"tls"`
+	Targets []target `yaml:"targets"`
+	// workflow to follow, the default one if empty
+	Workflow string `yaml:"workflow"`
+}
+
+type target struct {
+	Host string `yaml:"host"`
+	Port uint32 `yaml:"port"`
+}
+
+func (p *Provider) init() {
+
+	p.shutdown = make(chan bool)
+	p.services = make(map[string]bool)
+
+	if p.PollInterval == time.Duration(0) {
+		p.PollInterval = 5 * time.Second
+	}
+
+	p.pollTicker = time.NewTicker(p.PollInterval)
+}
+
+// Start the file provider
+func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+	log.Infof("Starting %v on %v\n", extensionName, p.Path)
+	p.send = send
+
+	if _, err := os.Stat(p.Path); err != nil {
+		return err
+	}
+
+	p.init()
+	p.poll()
+
+	p.waitGroup.Add(1)
+	for {
+		select {
+		case <-p.shutdown:
+			p.pollTicker.Stop()
+			p.waitGroup.Done()
+
+			return nil
+
+		case <-p.pollTicker.C:
+			log.Debug("New poll launched")
+			p.poll()
+
+		case msg := <-receive:
+			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
+			switch msg.Action {
+			case comm.RefreshAction:
+				log.Debugf("Request to refresh service %v", msg.Service.Name)
+				p.RefreshService(msg)
+			default:
+				log.Warnf("Unhandled action requested: %v", msg.Action)
+			}
+		}
+	}
+}
+
+// Stop the file provider
+func (p *Provider) Stop() error {
+	log.Debug("Stopping file provider")
+	p.shutdown <- true
+	p.waitGroup.Wait()
+
+	return nil
+}
+
+// poll reads the service definitions and sends them to the core
+// services removed from the files since the last poll are deleted
+// services whose definition became invalid keep their current state until it is fixed
+func (p *Provider) poll() {
+	definitions, invalid, err := p.load()
+	if err != nil {
+		// do not delete the services because of an unreadable file
+		log.Errorf("could not read service definitions from %v: %v", p.Path, err.Error())
+		return
+	}
+
+	for name := range p.services {
+		_, ok := definitions[name]
+		if _, isInvalid := invalid[name]; !ok && !isInvalid {
+			log.Infof("service %v removed from %v, send delete", name, p.Path)
+			delete(p.services, name)
+			p.send <- comm.BuildDeleteMessage(name)
+		}
+	}
+
+	for _, name := range sortedNames(definitions) {
+		p.services[name] = true
+		p.send <- definitions[name].buildMessage()
+	}
+}
+
+// RefreshService sends an updated state for a given service
+func (p *Provider) RefreshService(msg comm.Message) {
+	definitions, invalid, err := p.load()
+	if err != nil {
+		log.Errorf("could not read service definitions from %v: %v", p.Path, err.Error())
+		return
+	}
+
+	if err, ok := invalid[msg.Service.Name]; ok {
+		log.Errorf("service %v definition is invalid, keeping its current state: %v", msg.Service.Name, err.Error())
+		return
+	}
+
+	definition, ok := definitions[msg.Service.Name]
+	if !ok {
+		log.Infof("service %v not found, send delete", msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	p.send <- definition.buildMessage()
+}
+
+// load reads the service definitions from the file or the directory's files
+// the invalid definitions are returned by name with their error, so that their service is not deleted
+func (p *Provider) load() (definitions map[string]serviceDefinition, invalid map[string]error, err error) {
+	files, err := definitionFiles(p.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	definitions = make(map[string]serviceDefinition)
+	invalid = make(map[string]error)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var df definitionFile
+		if err := yaml.Unmarshal(content, &df); err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("could not parse %v: %v", file, err.Error()))
+		}
+
+		for _, definition := range df.Services {
+			_, defined := definitions[definition.Name]
+			if _, isInvalid := invalid[definition.Name]; defined || isInvalid {
+				log.Warnf("service %v defined several times, definition from %v ignored", definition.Name, file)
+				continue
+			}
+			if err := definition.validate(); err != nil {
+				log.Errorf("invalid service definition in %v: %v", file, err.Error())
+				if definition.Name != "" {
+					invalid[definition.Name] = err
+				}
+				continue
+			}
+			definitions[definition.Name] = definition
+		}
+	}
+
+	return definitions, invalid, nil
+}
+
+// definitionFiles returns the given file or the .yml, .yaml and .json files of the given directory
+func definitionFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yml", ".yaml", ".json":
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+func (d serviceDefinition) validate() error {
+	if d.Name == "" {
+		return errors.New("service name is missing")
+	}
+
+	if len(d.Targets) == 0 {
+		return errors.New(fmt.Sprintf("service %v has no target", d.Name))
+	}
+
+	for _, t := range d.Targets {
+		if t.Host == "" || t.Port == 0 {
+			return errors.New(fmt.Sprintf("service %v has an invalid target %v:%v", d.Name, t.Host, t.Port))
+		}
+	}
+
+	return nil
+}
+
+func (d serviceDefinition) buildMessage() comm.Message {
+	msg := comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       d.Name,
+			Provider:   extensionName,
+			TLS:        d.TLS,
+			DNSAliases: d.Hosts,
+			Workflow:   d.Workflow,
+		}}
+
+	for _, t := range d.Targets {
+		msg.Service.Targets = append(msg.Service.Targets, comm.Target{
+			Host: t.Host,
+			Port: t.Port,
+		})
+	}
+
+	return msg
+}
+
+func sortedNames(definitions map[string]serviceDefinition) []string {
+	var names []string
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
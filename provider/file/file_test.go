@@ -0,0 +1,239 @@
+package file
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+const (
+	webDefinition = `
+services:
+  - name: web
+    hosts:
+      - web.dummy.com
+    tls: true
+    targets:
+      - host: 10.32.2.1
+        port: 8080
+      - host: 10.32.2.2
+        port: 8080
+`
+	apiDefinition = `{
+	"services": [
+		{
+			"name": "api",
+			"hosts": ["api.dummy.com"],
+			"targets": [{"host": "10.32.2.3", "port": 9000}]
+		}
+	]
+}`
+	invalidDefinition = `
+services:
+  - name: notarget
+    hosts:
+      - notarget.dummy.com
+  - hosts:
+      - noname.dummy.com
+    targets:
+      - host: 10.32.2.4
+        port: 80
+  - name: web
+    targets:
+      - host: 10.32.2.5
+        port: 80
+`
+)
+
+var (
+	webMsg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "web",
+			Provider:   extensionName,
+			TLS:        true,
+			DNSAliases: []string{"web.dummy.com"},
+			Targets:    []comm.Target{{Host: "10.32.2.1", Port: 8080}, {Host: "10.32.2.2", Port: 8080}},
+		}}
+	apiMsg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "api",
+			Provider:   extensionName,
+			DNSAliases: []string{"api.dummy.com"},
+			Targets:    []comm.Target{{Host: "10.32.2.3", Port: 9000}},
+		}}
+)
+
+// writeDefinitions writes the given files to a new temporary directory
+func writeDefinitions(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "interlook-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestProvider_load(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		path        string
+		want        []string
+		wantInvalid []string
+		wantErr     bool
+	}{
+		{"directory", map[string]string{"web.yml": webDefinition, "api.json": apiDefinition, "README.md": "# services"}, "", []string{"api", "web"}, nil, false},
+		{"file", map[string]string{"web.yml": webDefinition, "api.json": apiDefinition}, "web.yml", []string{"web"}, nil, false},
+		{"invalidSkipped", map[string]string{"a.yml": webDefinition, "b.yml": invalidDefinition}, "", []string{"web"}, []string{"notarget"}, false},
+		{"parseError", map[string]string{"web.yml": webDefinition, "broken.yml": "services: [\n"}, "", nil, nil, true},
+		{"notFound", map[string]string{}, "notfound.yml", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeDefinitions(t, tt.files)
+			defer os.RemoveAll(dir)
+
+			p := &Provider{Path: filepath.Join(dir, tt.path)}
+			got, invalid, err := p.load()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if names := sortedNames(got); !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("load() = %v, want %v", names, tt.want)
+			}
+			var invalidNames []string
+			for name := range invalid {
+				invalidNames = append(invalidNames, name)
+			}
+			if !reflect.DeepEqual(invalidNames, tt.wantInvalid) {
+				t.Errorf("load() invalid = %v, want %v", invalidNames, tt.wantInvalid)
+			}
+		})
+	}
+}
+
+func TestProvider_pollInvalid(t *testing.T) {
+	dir := writeDefinitions(t, map[string]string{"web.yml": webDefinition})
+	defer os.RemoveAll(dir)
+
+	p := &Provider{Path: dir}
+	p.init()
+	send := make(chan comm.Message, 10)
+	p.send = send
+
+	p.poll()
+	if got := <-send; !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("Msg = %v, want %v", got, webMsg)
+	}
+
+	// a typo in the pushed definition does not un-deploy the service
+	broken := "services:\n  - name: web\n    targets:\n      - host: 10.32.2.1\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "web.yml"), []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.poll()
+	p.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "web"}})
+	if len(send) != 0 {
+		t.Errorf("unexpected message sent for invalid definition: %v", <-send)
+	}
+
+	// the service is deleted once removed from the file
+	if err := ioutil.WriteFile(filepath.Join(dir, "web.yml"), []byte("services: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.poll()
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildDeleteMessage("web")) {
+		t.Errorf("Msg = %v, want delete web", got)
+	}
+}
+
+func Test_serviceDefinition_buildMessage(t *testing.T) {
+	dir := writeDefinitions(t, map[string]string{"web.yml": webDefinition})
+	defer os.RemoveAll(dir)
+
+	p := &Provider{Path: dir}
+	definitions, _, err := p.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := definitions["web"].buildMessage(); !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("buildMessage() = %v, want %v", got, webMsg)
+	}
+}
+
+// receiveMessage returns the next message sent by the provider
+func receiveMessage(t *testing.T, send chan comm.Message) comm.Message {
+	select {
+	case msg := <-send:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return comm.Message{}
+}
+
+func TestProvider_Start(t *testing.T) {
+	dir := writeDefinitions(t, map[string]string{"web.yml": webDefinition, "api.json": apiDefinition})
+	defer os.RemoveAll(dir)
+
+	p := &Provider{Path: dir, PollInterval: 100 * time.Millisecond}
+	rec, send := make(chan comm.Message), make(chan comm.Message)
+	go func() {
+		if err := p.Start(rec, send); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() { go p.Stop() }()
+
+	if got := receiveMessage(t, send); !reflect.DeepEqual(got, apiMsg) {
+		t.Errorf("Msg = %v, want %v", got, apiMsg)
+	}
+	if got := receiveMessage(t, send); !reflect.DeepEqual(got, webMsg) {
+		t.Errorf("Msg = %v, want %v", got, webMsg)
+	}
+
+	// removing a file deletes its services
+	if err := os.Remove(filepath.Join(dir, "api.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		got := receiveMessage(t, send)
+		if got.Action == comm.DeleteAction {
+			if !reflect.DeepEqual(got, comm.BuildDeleteMessage("api")) {
+				t.Errorf("Msg = %v, want delete api", got)
+			}
+			break
+		}
+	}
+
+	// refresh requests are answered with the current definition
+	go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "api"}} }()
+	for {
+		if got := receiveMessage(t, send); got.Service.Name == "api" {
+			if !reflect.DeepEqual(got, comm.BuildDeleteMessage("api")) {
+				t.Errorf("Msg = %v, want delete api", got)
+			}
+			break
+		}
+	}
+}
+
+func TestProvider_StartNotFound(t *testing.T) {
+	p := &Provider{Path: "/notfound"}
+	if err := p.Start(make(chan comm.Message), make(chan comm.Message)); err == nil {
+		t.Errorf("Start() expected error on missing path")
+	}
+}
@@ -0,0 +1,134 @@
+package kubernetes
+
+import (
+	"context"
+
+	"fmt"
+	"sort"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// endpointTargets returns the targets built from the ready endpoints of the service's endpoint slices
+// targets are the endpoints addresses on the endpoint port with PodTargets, the endpoints nodes on the node port otherwise
+func (p *Extension) endpointTargets(service *v1.Service, port v1.ServicePort) (targets []comm.Target, err error) {
+	slices, err := p.listEndpointSlices(service.Namespace, service.Name)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error getting endpoint slices: %v", err.Error()))
+	}
+
+	var hostIPs map[string]string
+	if !p.PodTargets {
+		hostIPs, err = p.podHostIPs(service)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, slice := range slices {
+		if slice.AddressType == discovery.AddressTypeFQDN {
+			continue
+		}
+
+		endpointPort, ok := sliceEndpointPort(slice, port.Name)
+		if !ok {
+			continue
+		}
+
+		for _, endpoint := range slice.Endpoints {
+			if !isEndpointReady(endpoint) || len(endpoint.Addresses) == 0 {
+				continue
+			}
+
+			if p.PodTargets {
+				targets = append(targets, comm.Target{Host: endpoint.Addresses[0], Port: uint32(endpointPort)})
+				continue
+			}
+
+			// one target per endpoint, the core weights the nodes running several endpoints
+			if endpoint.TargetRef == nil || endpoint.TargetRef.Kind != "Pod" {
+				continue
+			}
+			hostIP, ok := hostIPs[endpoint.TargetRef.Name]
+			if !ok || hostIP == "" {
+				continue
+			}
+			targets = append(targets, comm.Target{Host: hostIP, Port: uint32(port.NodePort)})
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no ready endpoint found for service " + serviceKey(service))
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Host == targets[j].Host {
+			return targets[i].Port < targets[j].Port
+		}
+		return targets[i].Host < targets[j].Host
+	})
+
+	return targets, nil
+}
+
+// isEndpointReady returns true if the endpoint is ready, an unknown state being considered as ready
+func isEndpointReady(endpoint discovery.Endpoint) bool {
+	return endpoint.Conditions.Ready == nil || *endpoint.Conditions.Ready
+}
+
+// sliceEndpointPort returns the port of the slice matching the service port name
+func sliceEndpointPort(slice *discovery.EndpointSlice, name string) (int32, bool) {
+	for _, port := range slice.Ports {
+		if port.Port == nil {
+			continue
+		}
+		if (port.Name == nil && name == "") || (port.Name != nil && *port.Name == name) {
+			return *port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// podHostIPs returns the host IP of the service's pods by pod name
+func (p *Extension) podHostIPs(service *v1.Service) (map[string]string, error) {
+	hostIPs := make(map[string]string)
+	if len(service.Spec.Selector) == 0 {
+		return hostIPs, nil
+	}
+
+	pods, err := p.listPods(service.Namespace, service.Spec.Selector)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("error getting pods: %v", err.Error()))
+	}
+
+	for _, pod := range pods {
+		hostIPs[pod.Name] = pod.Status.HostIP
+	}
+
+	return hostIPs, nil
+}
+
+// listEndpointSlices returns the endpoint slices of the given service, from the informer cache when watching
+func (p *Extension) listEndpointSlices(namespace, serviceName string) (res []*discovery.EndpointSlice, err error) {
+	selector := labels.SelectorFromSet(map[string]string{discovery.LabelServiceName: serviceName})
+
+	if p.watcher != nil {
+		return p.watcher.listEndpointSlices(namespace, selector)
+	}
+
+	slices, err := p.cli.DiscoveryV1beta1().EndpointSlices(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range slices.Items {
+		res = append(res, &slices.Items[i])
+	}
+
+	return res, nil
+}
@@ -0,0 +1,201 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/interlook/interlook/comm"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// dummyEndpointSlice returns the slice of dummyNPSvc, dummypod-2 being not ready
+func dummyEndpointSlice() *discovery.EndpointSlice {
+	ready, notReady := true, false
+	port := int32(8080)
+
+	return &discovery.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "dummyNPSvc-abcde",
+			Namespace: "default",
+			Labels:    map[string]string{discovery.LabelServiceName: "dummyNPSvc"},
+		},
+		AddressType: discovery.AddressTypeIPv4,
+		Endpoints: []discovery.Endpoint{
+			{
+				Addresses:  []string{"10.1.0.1"},
+				Conditions: discovery.EndpointConditions{Ready: &ready},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "dummypod-1"},
+			},
+			{
+				Addresses:  []string{"10.1.0.2"},
+				Conditions: discovery.EndpointConditions{Ready: &notReady},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "dummypod-2"},
+			},
+		},
+		Ports: []discovery.EndpointPort{{Port: &port}},
+	}
+}
+
+// initEndpointTests returns a provider reading the endpoint slices with the slice fixture created
+func initEndpointTests(t *testing.T) *Extension {
+	p := initTests()
+	p.EndpointSlices = true
+	if _, err := p.cli.DiscoveryV1beta1().EndpointSlices("default").Create(context.Background(), dummyEndpointSlice(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestExtension_endpointTargets(t *testing.T) {
+	ready, notReady := true, false
+	// dummypod-3 runs on the node of dummypod-1
+	pod3Endpoint := func(ready *bool) discovery.Endpoint {
+		return discovery.Endpoint{
+			Addresses:  []string{"10.1.0.3"},
+			Conditions: discovery.EndpointConditions{Ready: ready},
+			TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "dummypod-3"},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		podTargets bool
+		svc        *v1.Service
+		endpoints  []discovery.Endpoint
+		want       []comm.Target
+		wantErr    bool
+	}{
+		{"nodeTargets", false, &dummyNPSvc, nil, []comm.Target{{Host: "10.32.2.1", Port: 32200}}, false},
+		{"podTargets", true, &dummyNPSvc, nil, []comm.Target{{Host: "10.1.0.1", Port: 8080}}, false},
+		{"noSlice", false, &dummyNPSvcNoPod, nil, nil, true},
+		// one target per ready endpoint, so that the core weights the node
+		{"severalEndpointsSameNode", false, &dummyNPSvc, []discovery.Endpoint{pod3Endpoint(&ready)},
+			[]comm.Target{{Host: "10.32.2.1", Port: 32200}, {Host: "10.32.2.1", Port: 32200}}, false},
+		{"notReadyEndpointSameNode", false, &dummyNPSvc, []discovery.Endpoint{pod3Endpoint(&notReady)},
+			[]comm.Target{{Host: "10.32.2.1", Port: 32200}}, false},
+		{"notReadyEndpointPodTargets", true, &dummyNPSvc, []discovery.Endpoint{pod3Endpoint(&notReady)},
+			[]comm.Target{{Host: "10.1.0.1", Port: 8080}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initEndpointTests(t)
+			p.PodTargets = tt.podTargets
+			if tt.endpoints != nil {
+				slice := dummyEndpointSlice()
+				slice.Endpoints = append(slice.Endpoints, tt.endpoints...)
+				if _, err := p.cli.DiscoveryV1beta1().EndpointSlices("default").Update(context.Background(), slice, metav1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				dummyPod3 := dummyPod1.DeepCopy()
+				dummyPod3.Name = "dummypod-3"
+				if _, err := p.cli.CoreV1().Pods("default").Create(context.Background(), dummyPod3, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := p.endpointTargets(tt.svc, tt.svc.Spec.Ports[0])
+			if (err != nil) != tt.wantErr {
+				t.Errorf("endpointTargets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("endpointTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isEndpointReady(t *testing.T) {
+	ready, notReady := true, false
+	tests := []struct {
+		name  string
+		ready *bool
+		want  bool
+	}{
+		{"ready", &ready, true},
+		{"notReady", &notReady, false},
+		{"unknown", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := discovery.Endpoint{Conditions: discovery.EndpointConditions{Ready: tt.ready}}
+			if got := isEndpointReady(endpoint); got != tt.want {
+				t.Errorf("isEndpointReady() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sliceEndpointPort(t *testing.T) {
+	httpName, httpPort, metricsName, metricsPort := "http", int32(8080), "metrics", int32(9090)
+	named := &discovery.EndpointSlice{Ports: []discovery.EndpointPort{
+		{Name: &metricsName, Port: &metricsPort},
+		{Name: &httpName, Port: &httpPort},
+	}}
+
+	tests := []struct {
+		name   string
+		slice  *discovery.EndpointSlice
+		port   string
+		want   int32
+		wantOK bool
+	}{
+		{"unnamed", dummyEndpointSlice(), "", 8080, true},
+		{"named", named, "http", 8080, true},
+		{"notFound", named, "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := sliceEndpointPort(tt.slice, tt.port)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("sliceEndpointPort() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestExtension_isServiceEligibleClusterIP(t *testing.T) {
+	clusterIPSvc := dummyNPSvc.DeepCopy()
+	clusterIPSvc.Spec.Type = v1.ServiceTypeClusterIP
+
+	tests := []struct {
+		name       string
+		podTargets bool
+		want       bool
+	}{
+		{"podTargets", true, true},
+		{"nodeTargets", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Extension{PodTargets: tt.podTargets}
+			if got := p.isServiceEligible(clusterIPSvc); got != tt.want {
+				t.Errorf("isServiceEligible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_WatchEndpointSlices(t *testing.T) {
+	p := initEndpointTests(t)
+	p.Watch = true
+	p.PodTargets = true
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	waitMessage(t, send, "default/dummyNPSvc", comm.AddAction, func(msg comm.Message) bool {
+		return reflect.DeepEqual(msg.Service.Targets, []comm.Target{{Host: "10.1.0.1", Port: 8080}})
+	})
+
+	// the endpoint becoming ready is added to the targets
+	slice := dummyEndpointSlice()
+	slice.Endpoints[1].Conditions.Ready = nil
+	if _, err := p.cli.DiscoveryV1beta1().EndpointSlices("default").Update(context.Background(), slice, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMessage(t, send, "default/dummyNPSvc", comm.AddAction, func(msg comm.Message) bool {
+		return len(msg.Service.Targets) == 2
+	})
+}
@@ -0,0 +1,395 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/api/networking/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// ":" can not appear in a namespace name, ingress keys do not collide with the namespace/name service keys
+	ingressKeyPrefix       = "ingress:"
+	ingressClassAnnotation = "kubernetes.io/ingress.class"
+)
+
+// ingressResource identifies the ingresses in the listers errors
+var ingressResource = networkingv1.Resource("ingresses")
+
+// ingressKey returns the ingress:namespace/name identifying the ingress in interlook
+func ingressKey(ing *networkingv1.Ingress) string {
+	return ingressKeyPrefix + ing.Namespace + "/" + ing.Name
+}
+
+// isIngressKey returns true if the given key identifies an ingress
+func isIngressKey(key string) bool {
+	return strings.HasPrefix(key, ingressKeyPrefix)
+}
+
+// isIngressEligible returns true if the ingress belongs to the configured ingress class
+// set either by the ingressClassName or the deprecated annotation
+func (p *Extension) isIngressEligible(ing *networkingv1.Ingress) bool {
+	if p.IngressClass == "" {
+		return true
+	}
+	if ing.Spec.IngressClassName != nil {
+		return *ing.Spec.IngressClassName == p.IngressClass
+	}
+	return ing.Annotations[ingressClassAnnotation] == p.IngressClass
+}
+
+// ingressHosts returns the hosts of the ingress rules
+func ingressHosts(ing *networkingv1.Ingress) (hosts []string) {
+	seen := make(map[string]bool)
+	for _, rule := range ing.Spec.Rules {
+		if rule.Host == "" || seen[rule.Host] {
+			continue
+		}
+		seen[rule.Host] = true
+		hosts = append(hosts, rule.Host)
+	}
+	return hosts
+}
+
+// ingressBackends returns the default backend and the rules backends of the ingress
+// resource backends are not published by interlook, only service backends are returned
+func ingressBackends(ing *networkingv1.Ingress) (backends []networkingv1.IngressServiceBackend) {
+	if ing.Spec.DefaultBackend != nil && ing.Spec.DefaultBackend.Service != nil {
+		backends = append(backends, *ing.Spec.DefaultBackend.Service)
+	}
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			if path.Backend.Service != nil {
+				backends = append(backends, *path.Backend.Service)
+			}
+		}
+	}
+	return backends
+}
+
+// ingressBackend returns the single backend the ingress routes to
+// interlook publishes an ingress as one virtual server, path based routing to several services is not supported
+func ingressBackend(ing *networkingv1.Ingress) (backend networkingv1.IngressServiceBackend, err error) {
+	backends := ingressBackends(ing)
+	if len(backends) == 0 {
+		return backend, errors.New(fmt.Sprintf("ingress %v has no service backend", ingressKey(ing)))
+	}
+
+	backend = backends[0]
+	for _, b := range backends[1:] {
+		if b != backend {
+			return backend, errors.New(fmt.Sprintf("ingress %v routes to several backends, only single backend ingresses are supported", ingressKey(ing)))
+		}
+	}
+
+	return backend, nil
+}
+
+// backendPort returns the number or the name of the backend service port
+func backendPort(backend networkingv1.IngressServiceBackend) intstr.IntOrString {
+	if backend.Port.Name != "" {
+		return intstr.FromString(backend.Port.Name)
+	}
+	return intstr.FromInt(int(backend.Port.Number))
+}
+
+// toIngress returns the given networking.k8s.io/v1 ingress, converted from v1beta1 if needed
+func toIngress(obj interface{}) (*networkingv1.Ingress, bool) {
+	switch ing := obj.(type) {
+	case *networkingv1.Ingress:
+		return ing, true
+	case *v1beta1.Ingress:
+		return ingressFromV1beta1(ing), true
+	}
+	return nil, false
+}
+
+// ingressFromV1beta1 converts the ingress read from a cluster not serving networking.k8s.io/v1 (kubernetes < 1.19)
+func ingressFromV1beta1(old *v1beta1.Ingress) *networkingv1.Ingress {
+	ing := &networkingv1.Ingress{ObjectMeta: old.ObjectMeta}
+	ing.Spec.IngressClassName = old.Spec.IngressClassName
+
+	if old.Spec.Backend != nil {
+		backend := backendFromV1beta1(*old.Spec.Backend)
+		ing.Spec.DefaultBackend = &backend
+	}
+
+	for _, tls := range old.Spec.TLS {
+		ing.Spec.TLS = append(ing.Spec.TLS, networkingv1.IngressTLS{Hosts: tls.Hosts, SecretName: tls.SecretName})
+	}
+
+	for _, oldRule := range old.Spec.Rules {
+		rule := networkingv1.IngressRule{Host: oldRule.Host}
+		if oldRule.HTTP != nil {
+			rule.HTTP = &networkingv1.HTTPIngressRuleValue{}
+			for _, path := range oldRule.HTTP.Paths {
+				rule.HTTP.Paths = append(rule.HTTP.Paths, networkingv1.HTTPIngressPath{Path: path.Path, Backend: backendFromV1beta1(path.Backend)})
+			}
+		}
+		ing.Spec.Rules = append(ing.Spec.Rules, rule)
+	}
+
+	return ing
+}
+
+// backendFromV1beta1 converts a networking.k8s.io/v1beta1 ingress backend
+func backendFromV1beta1(old v1beta1.IngressBackend) networkingv1.IngressBackend {
+	if old.ServiceName == "" {
+		return networkingv1.IngressBackend{Resource: old.Resource}
+	}
+
+	port := networkingv1.ServiceBackendPort{Number: old.ServicePort.IntVal}
+	if old.ServicePort.Type == intstr.String {
+		port = networkingv1.ServiceBackendPort{Name: old.ServicePort.StrVal}
+	}
+
+	return networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{Name: old.ServiceName, Port: port}}
+}
+
+// servesIngressV1 returns true if the cluster serves the networking.k8s.io/v1 ingresses (kubernetes >= 1.19)
+func (p *Extension) servesIngressV1() (bool, error) {
+	resources, err := p.cli.Discovery().ServerResourcesForGroupVersion(networkingv1.SchemeGroupVersion.String())
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for _, resource := range resources.APIResources {
+		if resource.Name == ingressResource.Resource {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// backendServicePort returns the given service port (number or name)
+func backendServicePort(service *v1.Service, servicePort intstr.IntOrString) (v1.ServicePort, error) {
+	for _, port := range service.Spec.Ports {
+		if (servicePort.Type == intstr.Int && port.Port == servicePort.IntVal) ||
+			(servicePort.Type == intstr.String && port.Name == servicePort.StrVal) {
+			return port, nil
+		}
+	}
+	return v1.ServicePort{}, errors.New(fmt.Sprintf("service %v has no port %v", serviceKey(service), servicePort.String()))
+}
+
+func (p *Extension) buildMessageFromIngress(ing *networkingv1.Ingress) (msg comm.Message, err error) {
+	msg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       ingressKey(ing),
+			Provider:   extensionName,
+			TLS:        len(ing.Spec.TLS) > 0,
+			DNSAliases: ingressHosts(ing),
+			Workflow:   ing.Labels[workflowLabel],
+		}}
+
+	backend, err := ingressBackend(ing)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Service.Targets, err = p.backendTargets(ing.Namespace, backend.Name, backendPort(backend))
+
+	return msg, err
+}
+
+// backendTargets returns the targets of the given port of a namespace's service
+func (p *Extension) backendTargets(namespace, serviceName string, servicePort intstr.IntOrString) ([]comm.Target, error) {
+	service, ok := p.getBackendService(namespace, serviceName)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("backend service %v/%v not found", namespace, serviceName))
+	}
+
+	port, err := backendServicePort(service, servicePort)
+	if err != nil {
+		return nil, err
+	}
+
+	// pod targets do not go through the node port
+	if port.NodePort == 0 && !p.PodTargets {
+		return nil, errors.New(fmt.Sprintf("service %v port %v has no node port", serviceKey(service), servicePort.String()))
+	}
+
+	return p.serviceTargets(service, port)
+}
+
+// pollIngresses sends the eligible ingresses of the namespace and returns their keys
+// the ingresses whose message could not be built are returned, so that they are not un-deployed
+func (p *Extension) pollIngresses(namespace string) (keys []string, err error) {
+	ingresses, err := p.listIngresses(namespace)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	for _, ing := range ingresses {
+		if !p.isIngressEligible(ing) {
+			continue
+		}
+		keys = append(keys, ingressKey(ing))
+		msg, err := p.buildMessageFromIngress(ing)
+		if err != nil {
+			log.Warnf("error building message for ingress %v %v", ingressKey(ing), err.Error())
+			continue
+		}
+		p.send <- msg
+	}
+
+	return keys, nil
+}
+
+// listIngresses returns the namespace's ingresses, read from networking.k8s.io/v1beta1 if the cluster does not serve v1
+func (p *Extension) listIngresses(namespace string) (res []*networkingv1.Ingress, err error) {
+	if p.ingressV1beta1 {
+		il, err := p.cli.NetworkingV1beta1().Ingresses(namespace).List(context.Background(), p.resourceListOptions)
+		if err != nil {
+			return nil, err
+		}
+		for i := range il.Items {
+			res = append(res, ingressFromV1beta1(&il.Items[i]))
+		}
+		return res, nil
+	}
+
+	il, err := p.cli.NetworkingV1().Ingresses(namespace).List(context.Background(), p.resourceListOptions)
+	if err != nil {
+		return nil, err
+	}
+	for i := range il.Items {
+		res = append(res, &il.Items[i])
+	}
+	return res, nil
+}
+
+// refreshIngress sends an updated state for a given ingress
+func (p *Extension) refreshIngress(msg comm.Message) {
+	ing, found, err := p.getIngressByName(msg.Service.Name)
+	if err != nil {
+		log.Warnf("Could not get k8s ingress %v, keeping its current state: %v", msg.Service.Name, err)
+		return
+	}
+
+	if !found || !p.isIngressEligible(ing) {
+		log.Infof("k8s ingress %v not found, send delete", msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	res, err := p.buildMessageFromIngress(ing)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error building message for %v: %v", msg.Service.Name, err.Error())
+		log.Errorf(errMsg)
+		res.Error = errMsg
+	}
+
+	p.send <- res
+}
+
+// getIngressByName returns the ingress identified by the given ingress:namespace/name key
+func (p *Extension) getIngressByName(key string) (ing *networkingv1.Ingress, found bool, err error) {
+	namespace, name, err := splitServiceKey(strings.TrimPrefix(key, ingressKeyPrefix))
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, false, nil
+	}
+
+	if !p.Ingresses || !p.isNamespaceWatched(namespace) {
+		return nil, false, nil
+	}
+
+	if p.watcher != nil {
+		ing, found = p.watcher.getIngress(namespace, name)
+		return ing, found, nil
+	}
+
+	if p.ingressV1beta1 {
+		var old *v1beta1.Ingress
+		old, err = p.cli.NetworkingV1beta1().Ingresses(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err == nil {
+			ing = ingressFromV1beta1(old)
+		}
+	} else {
+		ing, err = p.cli.NetworkingV1().Ingresses(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return ing, true, nil
+}
+
+// getBackendService returns the given service, whatever its labels
+func (p *Extension) getBackendService(namespace, name string) (*v1.Service, bool) {
+	if p.watcher != nil {
+		return p.watcher.getBackendService(namespace, name)
+	}
+
+	svc, err := p.cli.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, false
+	}
+
+	return svc, true
+}
+
+// handleIngressEvent pushes the current definition of the ingress to the core
+func (p *Extension) handleIngressEvent(event watchEvent) {
+	ing, ok, err := p.getIngressByName(event.service)
+	if err != nil {
+		log.Warnf("Could not get k8s ingress %v, keeping its current state: %v", event.service, err)
+		return
+	}
+	if event.deleted || !ok {
+		if p.watcher.pushed[event.service] {
+			log.Infof("k8s ingress %v deleted, send delete", event.service)
+			delete(p.watcher.pushed, event.service)
+			p.send <- comm.BuildDeleteMessage(event.service)
+		}
+		return
+	}
+
+	p.sendIngress(ing)
+}
+
+// sendIngress pushes the ingress definition to the core if it is valid
+// a previously pushed ingress that is no more eligible is deleted
+func (p *Extension) sendIngress(ing *networkingv1.Ingress) {
+	key := ingressKey(ing)
+
+	if !p.isIngressEligible(ing) {
+		if p.watcher.pushed[key] {
+			log.Infof("k8s ingress %v is no more eligible, send delete", key)
+			delete(p.watcher.pushed, key)
+			p.send <- comm.BuildDeleteMessage(key)
+		}
+		return
+	}
+
+	msg, err := p.buildMessageFromIngress(ing)
+	if err != nil {
+		log.Warnf("error building message for ingress %v %v", key, err.Error())
+		return
+	}
+
+	p.watcher.pushed[key] = true
+	p.send <- msg
+}
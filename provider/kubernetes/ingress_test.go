@@ -0,0 +1,444 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/interlook/interlook/comm"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	testclient "k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	ingressTargets = []comm.Target{{Host: "10.32.2.1", Port: 30080}, {Host: "10.32.2.2", Port: 30080}}
+	ingressMsgOK   = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "ingress:default/web",
+			Provider:   extensionName,
+			TLS:        true,
+			DNSAliases: []string{"web.dummy.com", "www.dummy.com"},
+			Targets:    ingressTargets,
+		}}
+)
+
+// backendService returns a NodePort service without interlook labels
+func backendService() *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+		},
+		Spec: v1.ServiceSpec{
+			Ports: []v1.ServicePort{
+				{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080},
+				{Name: "metrics", Protocol: "TCP", Port: 9090},
+			},
+			Type:     v1.ServiceTypeNodePort,
+			Selector: map[string]string{"app": "dummy"},
+		},
+	}
+}
+
+func ingressRule(host, service string, port networkingv1.ServiceBackendPort) networkingv1.IngressRule {
+	return networkingv1.IngressRule{
+		Host: host,
+		IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+			Paths: []networkingv1.HTTPIngressPath{{Path: "/", Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{Name: service, Port: port},
+			}}},
+		}},
+	}
+}
+
+func dummyIngress() *networkingv1.Ingress {
+	http := networkingv1.ServiceBackendPort{Name: "http"}
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{ingressClassAnnotation: "interlook"},
+		},
+		Spec: networkingv1.IngressSpec{
+			TLS: []networkingv1.IngressTLS{{Hosts: []string{"web.dummy.com"}, SecretName: "web-tls"}},
+			Rules: []networkingv1.IngressRule{
+				ingressRule("web.dummy.com", "web", http),
+				ingressRule("www.dummy.com", "web", http),
+				ingressRule("web.dummy.com", "web", http),
+			},
+		},
+	}
+}
+
+// dummyIngressV1beta1 returns the dummy ingress as read from a cluster not serving networking.k8s.io/v1
+func dummyIngressV1beta1() *v1beta1.Ingress {
+	rule := func(host string) v1beta1.IngressRule {
+		return v1beta1.IngressRule{
+			Host: host,
+			IngressRuleValue: v1beta1.IngressRuleValue{HTTP: &v1beta1.HTTPIngressRuleValue{
+				Paths: []v1beta1.HTTPIngressPath{{Path: "/", Backend: v1beta1.IngressBackend{ServiceName: "web", ServicePort: intstr.FromString("http")}}},
+			}},
+		}
+	}
+	return &v1beta1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{ingressClassAnnotation: "interlook"},
+		},
+		Spec: v1beta1.IngressSpec{
+			TLS:   []v1beta1.IngressTLS{{Hosts: []string{"web.dummy.com"}, SecretName: "web-tls"}},
+			Rules: []v1beta1.IngressRule{rule("web.dummy.com"), rule("www.dummy.com"), rule("web.dummy.com")},
+		},
+	}
+}
+
+// initIngressTests returns a provider with ingresses enabled and the ingress fixtures created
+func initIngressTests(t *testing.T) *Extension {
+	p := initTests()
+	p.Ingresses = true
+	if _, err := p.cli.CoreV1().Services("default").Create(context.Background(), backendService(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.cli.NetworkingV1().Ingresses("default").Create(context.Background(), dummyIngress(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func Test_ingressBackend(t *testing.T) {
+	port := networkingv1.ServiceBackendPort{Number: 80}
+	tests := []struct {
+		name    string
+		spec    networkingv1.IngressSpec
+		want    string
+		wantErr bool
+	}{
+		{"rules", networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{
+			ingressRule("a.com", "web", port),
+			ingressRule("b.com", "web", port),
+		}}, "web", false},
+		{"defaultBackend", networkingv1.IngressSpec{DefaultBackend: &networkingv1.IngressBackend{
+			Service: &networkingv1.IngressServiceBackend{Name: "web", Port: port},
+		}}, "web", false},
+		{"noBackend", networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{Host: "a.com"}}}, "", true},
+		{"resourceBackend", networkingv1.IngressSpec{DefaultBackend: &networkingv1.IngressBackend{
+			Resource: &v1.TypedLocalObjectReference{Kind: "StorageBucket", Name: "static"},
+		}}, "", true},
+		{"severalServices", networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{
+			ingressRule("a.com", "web", port),
+			ingressRule("b.com", "api", port),
+		}}, "", true},
+		{"severalPorts", networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{
+			ingressRule("a.com", "web", port),
+			ingressRule("b.com", "web", networkingv1.ServiceBackendPort{Number: 8080}),
+		}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ingressBackend(&networkingv1.Ingress{Spec: tt.spec})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ingressBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.Name != tt.want {
+				t.Errorf("ingressBackend() = %v, want %v", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ingressFromV1beta1(t *testing.T) {
+	if got := ingressFromV1beta1(dummyIngressV1beta1()); !reflect.DeepEqual(got, dummyIngress()) {
+		t.Errorf("ingressFromV1beta1() = %v, want %v", got, dummyIngress())
+	}
+
+	// a numbered port is kept as a number
+	old := &v1beta1.Ingress{Spec: v1beta1.IngressSpec{Backend: &v1beta1.IngressBackend{ServiceName: "web", ServicePort: intstr.FromInt(80)}}}
+	want := networkingv1.ServiceBackendPort{Number: 80}
+	if got := ingressFromV1beta1(old).Spec.DefaultBackend.Service.Port; got != want {
+		t.Errorf("ingressFromV1beta1() default backend port = %v, want %v", got, want)
+	}
+}
+
+func Test_backendServicePort(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    intstr.IntOrString
+		want    int32
+		wantErr bool
+	}{
+		{"number", intstr.FromInt(80), 30080, false},
+		{"name", intstr.FromString("http"), 30080, false},
+		{"noNodePort", intstr.FromString("metrics"), 0, false},
+		{"notFound", intstr.FromInt(443), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := backendServicePort(backendService(), tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("backendServicePort() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.NodePort != tt.want {
+				t.Errorf("backendServicePort() node port = %v, want %v", got.NodePort, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_isIngressEligible(t *testing.T) {
+	tests := []struct {
+		name         string
+		ingressClass string
+		want         bool
+	}{
+		{"noClass", "", true},
+		{"sameClass", "interlook", true},
+		{"otherClass", "nginx", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Extension{IngressClass: tt.ingressClass}
+			if got := p.isIngressEligible(dummyIngress()); got != tt.want {
+				t.Errorf("isIngressEligible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the ingressClassName takes precedence over the deprecated annotation
+	className := "nginx"
+	ing := dummyIngress()
+	ing.Spec.IngressClassName = &className
+	if p := (&Extension{IngressClass: "interlook"}); p.isIngressEligible(ing) {
+		t.Errorf("isIngressEligible() = true for ingress class name %v", className)
+	}
+}
+
+func TestExtension_servesIngressV1(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		want      bool
+	}{
+		{"v1", []*metav1.APIResourceList{{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "ingresses"}}}}, true},
+		{"v1beta1", []*metav1.APIResourceList{{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "networkpolicies"}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initTests()
+			p.cli.(*testclient.Clientset).Resources = tt.resources
+			got, err := p.servesIngressV1()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("servesIngressV1() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_PollIngressesV1beta1(t *testing.T) {
+	p := initTests()
+	p.Ingresses = true
+	p.ingressV1beta1 = true
+	if _, err := p.cli.CoreV1().Services("default").Create(context.Background(), backendService(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.cli.NetworkingV1beta1().Ingresses("default").Create(context.Background(), dummyIngressV1beta1(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	send := make(chan comm.Message, 10)
+	p.send = send
+
+	keys, err := p.pollIngresses("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"ingress:default/web"}) {
+		t.Errorf("pollIngresses() = %v, want the v1beta1 ingress", keys)
+	}
+	if got := <-send; !reflect.DeepEqual(got, ingressMsgOK) {
+		t.Errorf("Msg = %v, want %v", got, ingressMsgOK)
+	}
+}
+
+func TestExtension_RefreshServiceIngressNamespace(t *testing.T) {
+	p := initTests()
+	p.Ingresses = true
+	p.InterlookServices = true
+	for _, namespace := range []string{"ingress", "interlookservice"} {
+		svc := dummyNPSvc.DeepCopy()
+		svc.Namespace = namespace
+		pod := dummyPod1.DeepCopy()
+		pod.Namespace = namespace
+		if _, err := p.cli.CoreV1().Pods(namespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.cli.CoreV1().Services(namespace).Create(context.Background(), svc, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send := make(chan comm.Message, 1)
+	p.send = send
+
+	// the services of the namespaces named after the resource kinds are not mistaken for ingresses or interlook services
+	for _, key := range []string{"ingress/dummyNPSvc", "interlookservice/dummyNPSvc"} {
+		p.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: key}})
+		if got := <-send; got.Action != comm.AddAction || got.Service.Name != key {
+			t.Errorf("got %v of %v, want add of %v", got.Action, got.Service.Name, key)
+		}
+	}
+}
+
+func TestExtension_buildMessageFromIngress(t *testing.T) {
+	noService := dummyIngress()
+	noService.Spec.Rules = []networkingv1.IngressRule{ingressRule("web.dummy.com", "notfound", networkingv1.ServiceBackendPort{Number: 80})}
+	noNodePort := dummyIngress()
+	noNodePort.Spec.Rules = []networkingv1.IngressRule{ingressRule("web.dummy.com", "web", networkingv1.ServiceBackendPort{Name: "metrics"})}
+
+	tests := []struct {
+		name    string
+		ingress *networkingv1.Ingress
+		want    comm.Message
+		wantErr bool
+	}{
+		{"basic", dummyIngress(), ingressMsgOK, false},
+		{"serviceNotFound", noService, comm.Message{}, true},
+		{"noNodePort", noNodePort, comm.Message{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initIngressTests(t)
+			got, err := p.buildMessageFromIngress(tt.ingress)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("buildMessageFromIngress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildMessageFromIngress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_PollIngresses(t *testing.T) {
+	tests := []struct {
+		name         string
+		ingressClass string
+		want         bool
+	}{
+		{"sameClass", "interlook", true},
+		{"otherClass", "nginx", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initIngressTests(t)
+			p.IngressClass = tt.ingressClass
+			send := make(chan comm.Message, 10)
+			p.send = send
+			p.init()
+			p.poll()
+
+			got, listed := false, false
+			for len(send) > 0 {
+				msg := <-send
+				if msg.Service.Name == "ingress:default/web" {
+					got = reflect.DeepEqual(msg, ingressMsgOK)
+				}
+				for _, key := range msg.Snapshot {
+					listed = listed || key == "ingress:default/web"
+				}
+			}
+			if got != tt.want {
+				t.Errorf("poll() sent ingress = %v, want %v", got, tt.want)
+			}
+			// the ingresses of another class are not part of the snapshot
+			if listed != tt.want {
+				t.Errorf("poll() snapshot lists ingress = %v, want %v", listed, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_RefreshIngress(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want comm.Message
+	}{
+		{"refreshAdd", "ingress:default/web", ingressMsgOK},
+		{"refreshDel", "ingress:default/notfound", comm.BuildDeleteMessage("ingress:default/notfound")},
+		{"otherNamespace", "ingress:other/web", comm.BuildDeleteMessage("ingress:other/web")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initIngressTests(t)
+			p.Namespaces = []string{"default"}
+			rec, send := p.startTestK8s()
+			go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: tt.key}} }()
+			got := receiveMessage(t, send, tt.key, tt.want.Action)
+			go p.Stop()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Msg = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_WatchIngresses(t *testing.T) {
+	p := initIngressTests(t)
+	p.Watch = true
+	p.IngressClass = "interlook"
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	got := receiveMessage(t, send, "ingress:default/web", comm.AddAction)
+	if !reflect.DeepEqual(got, ingressMsgOK) {
+		t.Errorf("Msg = %v, want %v", got, ingressMsgOK)
+	}
+
+	// a new backend pod is reflected in the ingress targets
+	dummyPod3 := dummyPod1.DeepCopy()
+	dummyPod3.Name = "dummypod-3"
+	dummyPod3.Status.HostIP = "10.32.2.3"
+	if _, err := p.cli.CoreV1().Pods("default").Create(context.Background(), dummyPod3, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMessage(t, send, "ingress:default/web", comm.AddAction, func(msg comm.Message) bool {
+		return len(msg.Service.Targets) == 3
+	})
+
+	// moving the ingress to another class deletes it
+	ing := dummyIngress()
+	ing.Annotations[ingressClassAnnotation] = "nginx"
+	if _, err := p.cli.NetworkingV1().Ingresses("default").Update(context.Background(), ing, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiveMessage(t, send, "ingress:default/web", comm.DeleteAction)
+}
+
+func TestExtension_WatchIngressesV1beta1(t *testing.T) {
+	p := initTests()
+	p.Ingresses = true
+	p.Watch = true
+	p.cli.(*testclient.Clientset).Resources = []*metav1.APIResourceList{{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "networkpolicies"}}}}
+	if _, err := p.cli.CoreV1().Services("default").Create(context.Background(), backendService(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.cli.NetworkingV1beta1().Ingresses("default").Create(context.Background(), dummyIngressV1beta1(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	got := receiveMessage(t, send, "ingress:default/web", comm.AddAction)
+	if !reflect.DeepEqual(got, ingressMsgOK) {
+		t.Errorf("Msg = %v, want %v", got, ingressMsgOK)
+	}
+}
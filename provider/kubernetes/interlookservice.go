@@ -0,0 +1,480 @@
+package kubernetes
+
+import (
+	"context"
+
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ":" can not appear in a namespace name, interlook service keys do not collide with the namespace/name service keys
+const interlookServiceKeyPrefix = "interlookservice:"
+
+// interlookServiceResource is the InterlookService custom resource
+var interlookServiceResource = schema.GroupVersionResource{
+	Group:    "interlook.io",
+	Version:  "v1alpha1",
+	Resource: "interlookservices",
+}
+
+// interlookService is the InterlookService custom resource describing a service to publish
+type interlookService struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              interlookServiceSpec   `json:"spec"`
+	Status            interlookServiceStatus `json:"status,omitempty"`
+}
+
+type interlookServiceSpec struct {
+	// hosts to be published, default of the ports without hosts
+	Hosts []string `json:"hosts,omitempty"`
+	// publish the hosts with TLS, default of the ports without tls setting
+	TLS bool `json:"tls,omitempty"`
+	// name of the backend service, in the same namespace
+	Service string `json:"service"`
+	// backend service port, number or name, when a single port is published
+	Port intstr.IntOrString `json:"port,omitempty"`
+	// backend service ports, each one published as its own service
+	Ports []interlookServicePort `json:"ports,omitempty"`
+	// workflow to follow, the default one if empty
+	Workflow string `json:"workflow,omitempty"`
+}
+
+// interlookServicePort is a backend service port published on its own hosts
+type interlookServicePort struct {
+	// name identifying the port in interlook, the backend port if empty
+	Name string `json:"name,omitempty"`
+	// backend service port, number or name
+	Port intstr.IntOrString `json:"port"`
+	// hosts to be published, the spec hosts if empty
+	Hosts []string `json:"hosts,omitempty"`
+	// publish the hosts with TLS, the spec tls setting if not set
+	TLS *bool `json:"tls,omitempty"`
+}
+
+// interlookServiceStatus reports the workflow state of the service
+type interlookServiceStatus struct {
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+	PublicIP string `json:"publicIP,omitempty"`
+	// workflow state of each published port, when the ports are listed
+	Ports []interlookServicePortStatus `json:"ports,omitempty"`
+}
+
+// interlookServicePortStatus reports the workflow state of a published port
+type interlookServicePortStatus struct {
+	Name     string `json:"name"`
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+	PublicIP string `json:"publicIP,omitempty"`
+}
+
+// interlookServiceKey returns the interlookservice:namespace/name identifying the custom resource in interlook
+func interlookServiceKey(svc *interlookService) string {
+	return interlookServiceKeyPrefix + svc.Namespace + "/" + svc.Name
+}
+
+// interlookServicePortKey returns the key identifying the published port in interlook
+// interlookservice:namespace/name/port when the ports are listed, the custom resource key otherwise
+func interlookServicePortKey(svc *interlookService, port interlookServicePort) string {
+	if port.Name == "" {
+		return interlookServiceKey(svc)
+	}
+	return interlookServiceKey(svc) + "/" + port.Name
+}
+
+// splitInterlookServiceKey returns the namespace, name and port name of the given interlook service key
+func splitInterlookServiceKey(key string) (namespace, name, port string, err error) {
+	parts := strings.Split(strings.TrimPrefix(key, interlookServiceKeyPrefix), "/")
+	if len(parts) == 3 {
+		if parts[2] == "" {
+			return "", "", "", errors.New(fmt.Sprintf("invalid interlook service key %v, empty port name", key))
+		}
+		port = parts[2]
+		parts = parts[:2]
+	}
+
+	namespace, name, err = splitServiceKey(strings.Join(parts, "/"))
+	return namespace, name, port, err
+}
+
+// isInterlookServiceKey returns true if the given key identifies an interlook service
+func isInterlookServiceKey(key string) bool {
+	return strings.HasPrefix(key, interlookServiceKeyPrefix)
+}
+
+// publishedPorts returns the ports to be published, with their hosts and tls setting
+// the spec port is published alone, with an empty name, if the ports are not listed
+func (svc *interlookService) publishedPorts() []interlookServicePort {
+	if len(svc.Spec.Ports) == 0 {
+		tls := svc.Spec.TLS
+		return []interlookServicePort{{Port: svc.Spec.Port, Hosts: svc.Spec.Hosts, TLS: &tls}}
+	}
+
+	var ports []interlookServicePort
+	for _, port := range svc.Spec.Ports {
+		if port.Name == "" {
+			port.Name = port.Port.String()
+		}
+		if len(port.Hosts) == 0 {
+			port.Hosts = svc.Spec.Hosts
+		}
+		if port.TLS == nil {
+			tls := svc.Spec.TLS
+			port.TLS = &tls
+		}
+		ports = append(ports, port)
+	}
+
+	return ports
+}
+
+// publishedKeys returns the keys of the published ports
+func (svc *interlookService) publishedKeys() (keys []string) {
+	for _, port := range svc.publishedPorts() {
+		keys = append(keys, interlookServicePortKey(svc, port))
+	}
+	return keys
+}
+
+// validate checks the interlook service can be published
+// a host can not be shared by several ports, as each published port gets its own public IP
+func (svc *interlookService) validate() error {
+	if svc.Spec.Service == "" {
+		return errors.New(fmt.Sprintf("interlook service %v has no backend service", interlookServiceKey(svc)))
+	}
+
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	for _, port := range svc.publishedPorts() {
+		if port.Port.String() == "" || port.Port.String() == "0" {
+			return errors.New(fmt.Sprintf("interlook service %v has no backend port", interlookServiceKey(svc)))
+		}
+		if strings.Contains(port.Name, "/") {
+			return errors.New(fmt.Sprintf("interlook service %v port name %v must not contain /", interlookServiceKey(svc), port.Name))
+		}
+		if names[port.Name] {
+			return errors.New(fmt.Sprintf("interlook service %v port %v is listed twice", interlookServiceKey(svc), port.Name))
+		}
+		names[port.Name] = true
+
+		for _, host := range port.Hosts {
+			if other, ok := hosts[host]; ok {
+				return errors.New(fmt.Sprintf("interlook service %v host %v is published by ports %v and %v", interlookServiceKey(svc), host, other, port.Name))
+			}
+			hosts[host] = port.Name
+		}
+	}
+
+	return nil
+}
+
+// toInterlookService converts the custom resource read by the dynamic client
+func toInterlookService(obj runtime.Object) (*interlookService, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unexpected object %T", obj))
+	}
+
+	svc := &interlookService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, svc); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid interlook service %v/%v: %v", u.GetNamespace(), u.GetName(), err.Error()))
+	}
+
+	return svc, nil
+}
+
+// buildMessageFromInterlookService returns the message of the given published port
+func (p *Extension) buildMessageFromInterlookService(svc *interlookService, port interlookServicePort) (msg comm.Message, err error) {
+	msg = comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       interlookServicePortKey(svc, port),
+			Provider:   extensionName,
+			TLS:        port.TLS != nil && *port.TLS,
+			DNSAliases: port.Hosts,
+			Workflow:   svc.Spec.Workflow,
+		}}
+
+	if err := svc.validate(); err != nil {
+		return msg, err
+	}
+
+	msg.Service.Targets, err = p.backendTargets(svc.Namespace, svc.Spec.Service, port.Port)
+
+	return msg, err
+}
+
+// buildMessagesFromInterlookService returns the messages of all the published ports
+// no message is returned if a port is invalid, so that the ports are published consistently
+func (p *Extension) buildMessagesFromInterlookService(svc *interlookService) (msgs []comm.Message, err error) {
+	for _, port := range svc.publishedPorts() {
+		msg, err := p.buildMessageFromInterlookService(svc, port)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// pollInterlookServices sends the interlook services of the namespace and returns their keys
+// the invalid interlook services are returned, so that they are not un-deployed
+func (p *Extension) pollInterlookServices(namespace string) (keys []string, err error) {
+	list, err := p.dyn.Resource(interlookServiceResource).Namespace(namespace).List(context.Background(), p.resourceListOptions)
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	for i := range list.Items {
+		svc, err := toInterlookService(&list.Items[i])
+		if err != nil {
+			log.Warn(err.Error())
+			keys = append(keys, interlookServiceKeyPrefix+list.Items[i].GetNamespace()+"/"+list.Items[i].GetName())
+			continue
+		}
+		keys = append(keys, svc.publishedKeys()...)
+		p.sendInterlookService(svc)
+	}
+
+	return keys, nil
+}
+
+// refreshInterlookService sends an updated state for a given published port of an interlook service
+func (p *Extension) refreshInterlookService(msg comm.Message) {
+	svc, port, ok := p.getInterlookServicePort(msg.Service.Name)
+	if !ok {
+		log.Infof("k8s interlook service %v not found, send delete", msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	res, err := p.buildMessageFromInterlookService(svc, port)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error building message for %v: %v", msg.Service.Name, err.Error())
+		log.Errorf(errMsg)
+		res.Error = errMsg
+	}
+
+	p.send <- res
+}
+
+// getInterlookServicePort returns the interlook service and its published port identified by the given key
+func (p *Extension) getInterlookServicePort(key string) (*interlookService, interlookServicePort, bool) {
+	svc, ok := p.getInterlookServiceByName(key)
+	if !ok {
+		return nil, interlookServicePort{}, false
+	}
+
+	for _, port := range svc.publishedPorts() {
+		if interlookServicePortKey(svc, port) == key {
+			return svc, port, true
+		}
+	}
+
+	return nil, interlookServicePort{}, false
+}
+
+// getInterlookServiceByName returns the interlook service identified by the given interlookservice:namespace/name key
+// the port name of a published port key is ignored
+func (p *Extension) getInterlookServiceByName(key string) (*interlookService, bool) {
+	namespace, name, _, err := splitInterlookServiceKey(key)
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, false
+	}
+
+	if !p.InterlookServices || !p.isNamespaceWatched(namespace) {
+		return nil, false
+	}
+
+	var obj runtime.Object
+	if p.watcher != nil {
+		obj, err = p.watcher.getInterlookService(namespace, name)
+	} else {
+		obj, err = p.dyn.Resource(interlookServiceResource).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, false
+	}
+
+	svc, err := toInterlookService(obj)
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, false
+	}
+
+	return svc, true
+}
+
+// handleInterlookServiceEvent pushes the current definition of the interlook service ports to the core
+func (p *Extension) handleInterlookServiceEvent(event watchEvent) {
+	svc, ok := p.getInterlookServiceByName(event.service)
+	if event.deleted || !ok {
+		p.deletePushedPorts(event.service, nil)
+		return
+	}
+
+	p.sendInterlookService(svc)
+}
+
+// deletePushedPorts deletes the pushed ports of the interlook service identified by key, but the given ones
+func (p *Extension) deletePushedPorts(key string, keep []string) {
+	var keys []string
+	for pushed := range p.watcher.pushed {
+		if (pushed == key || strings.HasPrefix(pushed, key+"/")) && !sliceContainString(pushed, keep) {
+			keys = append(keys, pushed)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, pushed := range keys {
+		log.Infof("k8s interlook service %v deleted, send delete", pushed)
+		delete(p.watcher.pushed, pushed)
+		p.send <- comm.BuildDeleteMessage(pushed)
+	}
+}
+
+// sendInterlookService pushes the interlook service ports definition to the core if they are valid
+// the error is reported in the custom resource status otherwise
+func (p *Extension) sendInterlookService(svc *interlookService) {
+	msgs, err := p.buildMessagesFromInterlookService(svc)
+	if err != nil {
+		log.Warnf("error building message for interlook service %v %v", interlookServiceKey(svc), err.Error())
+		p.updateInterlookServiceStatus(svc.Namespace, svc.Name, func(current *interlookService) {
+			current.Status.Error = err.Error()
+		})
+		return
+	}
+
+	// clear the previous error and the states of the ports no more published
+	if status := publishedStatus(svc); !reflect.DeepEqual(status, svc.Status) {
+		p.updateInterlookServiceStatus(svc.Namespace, svc.Name, func(current *interlookService) {
+			current.Status = publishedStatus(current)
+		})
+	}
+
+	if p.watcher != nil {
+		// ports removed from the list are un-deployed
+		p.deletePushedPorts(interlookServiceKey(svc), svc.publishedKeys())
+		for _, msg := range msgs {
+			p.watcher.pushed[msg.Service.Name] = true
+		}
+	}
+
+	for _, msg := range msgs {
+		p.send <- msg
+	}
+}
+
+// publishedStatus returns the status of the interlook service, without error
+// and without the states of the ports no more published
+func publishedStatus(svc *interlookService) interlookServiceStatus {
+	status := svc.Status
+	status.Error = ""
+	if len(svc.Spec.Ports) > 0 {
+		// the workflow error of a single port is reported in the port state
+		status.State, status.PublicIP = "", ""
+	}
+
+	status.Ports = nil
+	for _, port := range svc.Status.Ports {
+		if sliceContainString(interlookServiceKey(svc)+"/"+port.Name, svc.publishedKeys()) {
+			status.Ports = append(status.Ports, port)
+		}
+	}
+
+	return status
+}
+
+// interlookServiceStatus writes the workflow state reported by the core to the custom resource status
+// the state of a listed port is written to its entry of the status ports
+func (p *Extension) interlookServiceStatus(msg comm.Message) {
+	if !p.InterlookServices {
+		return
+	}
+
+	namespace, name, port, err := splitInterlookServiceKey(msg.Service.Name)
+	if err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
+	publicIP := ""
+	if msg.State == comm.DeployedState {
+		publicIP = msg.Service.PublicIP
+	}
+
+	p.updateInterlookServiceStatus(namespace, name, func(current *interlookService) {
+		if port == "" {
+			current.Status.State, current.Status.Error, current.Status.PublicIP = msg.State, msg.Error, publicIP
+			return
+		}
+
+		// the port was removed from the list since
+		if !sliceContainString(msg.Service.Name, current.publishedKeys()) {
+			return
+		}
+
+		portStatus := interlookServicePortStatus{Name: port, State: msg.State, Error: msg.Error, PublicIP: publicIP}
+		for i := range current.Status.Ports {
+			if current.Status.Ports[i].Name == port {
+				current.Status.Ports[i] = portStatus
+				return
+			}
+		}
+		current.Status.Ports = append(current.Status.Ports, portStatus)
+		sort.Slice(current.Status.Ports, func(i, j int) bool { return current.Status.Ports[i].Name < current.Status.Ports[j].Name })
+	})
+}
+
+// updateInterlookServiceStatus updates the status subresource of the custom resource if the update changes it
+func (p *Extension) updateInterlookServiceStatus(namespace, name string, update func(current *interlookService)) {
+	client := p.dyn.Resource(interlookServiceResource).Namespace(namespace)
+
+	obj, err := client.Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("could not get interlook service %v/%v to update its status: %v", namespace, name, err)
+		return
+	}
+
+	current, err := toInterlookService(obj)
+	if err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
+	status := current.Status
+	status.Ports = append([]interlookServicePortStatus(nil), current.Status.Ports...)
+	update(current)
+	if reflect.DeepEqual(current.Status, status) {
+		return
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&current.Status)
+	if err != nil {
+		log.Errorf("could not convert status of interlook service %v/%v: %v", namespace, name, err)
+		return
+	}
+
+	obj.Object["status"] = content
+	if _, err := client.UpdateStatus(context.Background(), obj, metav1.UpdateOptions{}); err != nil {
+		log.Errorf("could not update status of interlook service %v/%v: %v", namespace, name, err)
+		return
+	}
+
+	log.Infof("interlook service %v/%v status updated to %v", namespace, name, current.Status)
+}
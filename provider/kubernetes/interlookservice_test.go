@@ -0,0 +1,393 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/interlook/interlook/comm"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+var interlookServiceMsgOK = comm.Message{
+	Action: comm.AddAction,
+	Service: comm.Service{
+		Name:       "interlookservice:default/web",
+		Provider:   extensionName,
+		TLS:        true,
+		DNSAliases: []string{"web.dummy.com"},
+		Targets:    ingressTargets,
+	}}
+
+func dummyInterlookService(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "interlook.io/v1alpha1",
+		"kind":       "InterlookService",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": "default",
+		},
+		"spec": spec,
+	}}
+}
+
+// initInterlookServiceTests returns a provider with interlook services enabled and the custom resources fixtures created
+func initInterlookServiceTests(t *testing.T) *Extension {
+	p := initTests()
+	p.InterlookServices = true
+	if _, err := p.cli.CoreV1().Services("default").Create(context.Background(), backendService(), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.dyn = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		dummyInterlookService("web", map[string]interface{}{
+			"hosts":   []interface{}{"web.dummy.com"},
+			"tls":     true,
+			"service": "web",
+			"port":    "http",
+		}),
+		dummyInterlookService("invalid", map[string]interface{}{
+			"hosts": []interface{}{"invalid.dummy.com"},
+		}),
+		dummyInterlookService("ports", map[string]interface{}{
+			"hosts":   []interface{}{"ports.dummy.com"},
+			"service": "web",
+			"ports": []interface{}{
+				map[string]interface{}{"port": "http", "tls": true},
+				map[string]interface{}{"name": "plain", "port": int64(80), "hosts": []interface{}{"plain.dummy.com"}},
+			},
+		}))
+	return p
+}
+
+// interlookServicePortsMsgs are the messages of the ports interlook service
+var interlookServicePortsMsgs = []comm.Message{
+	{Action: comm.AddAction, Service: comm.Service{
+		Name:       "interlookservice:default/ports/http",
+		Provider:   extensionName,
+		TLS:        true,
+		DNSAliases: []string{"ports.dummy.com"},
+		Targets:    ingressTargets,
+	}},
+	{Action: comm.AddAction, Service: comm.Service{
+		Name:       "interlookservice:default/ports/plain",
+		Provider:   extensionName,
+		DNSAliases: []string{"plain.dummy.com"},
+		Targets:    ingressTargets,
+	}},
+}
+
+// getInterlookServiceStatus returns the status of the custom resource
+func getInterlookServiceStatus(t *testing.T, p *Extension, name string) interlookServiceStatus {
+	obj, err := p.dyn.Resource(interlookServiceResource).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := toInterlookService(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc.Status
+}
+
+func TestExtension_buildMessageFromInterlookService(t *testing.T) {
+	tests := []struct {
+		name    string
+		svc     string
+		want    comm.Message
+		wantErr bool
+	}{
+		{"basic", "web", interlookServiceMsgOK, false},
+		{"noBackend", "invalid", comm.Message{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initInterlookServiceTests(t)
+			svc, ok := p.getInterlookServiceByName("interlookservice:default/" + tt.svc)
+			if !ok {
+				t.Fatalf("getInterlookServiceByName() did not find %v", tt.svc)
+			}
+			got, err := p.buildMessageFromInterlookService(svc, svc.publishedPorts()[0])
+			if (err != nil) != tt.wantErr {
+				t.Errorf("buildMessageFromInterlookService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildMessageFromInterlookService() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_buildMessagesFromInterlookService(t *testing.T) {
+	p := initInterlookServiceTests(t)
+	svc, ok := p.getInterlookServiceByName("interlookservice:default/ports")
+	if !ok {
+		t.Fatal("getInterlookServiceByName() did not find ports")
+	}
+
+	got, err := p.buildMessagesFromInterlookService(svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, interlookServicePortsMsgs) {
+		t.Errorf("buildMessagesFromInterlookService() = %v, want %v", got, interlookServicePortsMsgs)
+	}
+}
+
+func Test_interlookService_validate(t *testing.T) {
+	tls := true
+	tests := []struct {
+		name    string
+		spec    interlookServiceSpec
+		wantErr bool
+	}{
+		{"singlePort", interlookServiceSpec{Hosts: []string{"a.com"}, Service: "web", Port: intstr.FromString("http")}, false},
+		{"noBackend", interlookServiceSpec{Hosts: []string{"a.com"}, Port: intstr.FromString("http")}, true},
+		{"noPort", interlookServiceSpec{Hosts: []string{"a.com"}, Service: "web"}, true},
+		{"ports", interlookServiceSpec{Service: "web", Ports: []interlookServicePort{
+			{Port: intstr.FromString("http"), Hosts: []string{"a.com"}},
+			{Port: intstr.FromString("https"), Hosts: []string{"b.com"}, TLS: &tls},
+		}}, false},
+		// each port gets its own public IP
+		{"sharedHost", interlookServiceSpec{Hosts: []string{"a.com"}, Service: "web", Ports: []interlookServicePort{
+			{Port: intstr.FromString("http")},
+			{Port: intstr.FromString("https"), TLS: &tls},
+		}}, true},
+		{"duplicatePort", interlookServiceSpec{Service: "web", Ports: []interlookServicePort{
+			{Port: intstr.FromInt(80), Hosts: []string{"a.com"}},
+			{Name: "80", Port: intstr.FromString("http"), Hosts: []string{"b.com"}},
+		}}, true},
+		{"invalidPortName", interlookServiceSpec{Service: "web", Ports: []interlookServicePort{
+			{Name: "a/b", Port: intstr.FromInt(80), Hosts: []string{"a.com"}},
+		}}, true},
+		{"portWithoutBackendPort", interlookServiceSpec{Service: "web", Ports: []interlookServicePort{
+			{Name: "http", Hosts: []string{"a.com"}},
+		}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &interlookService{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"}, Spec: tt.spec}
+			if err := svc.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_splitInterlookServiceKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		wantNamespace string
+		wantName      string
+		wantPort      string
+		wantErr       bool
+	}{
+		{"service", "interlookservice:default/web", "default", "web", "", false},
+		{"port", "interlookservice:default/web/http", "default", "web", "http", false},
+		{"emptyPort", "interlookservice:default/web/", "", "", "", true},
+		{"invalid", "interlookservice:web", "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, name, port, err := splitInterlookServiceKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("splitInterlookServiceKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if namespace != tt.wantNamespace || name != tt.wantName || port != tt.wantPort {
+				t.Errorf("splitInterlookServiceKey() = %v, %v, %v, want %v, %v, %v", namespace, name, port, tt.wantNamespace, tt.wantName, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestExtension_PollInterlookServices(t *testing.T) {
+	p := initInterlookServiceTests(t)
+	send := make(chan comm.Message, 10)
+	p.send = send
+	p.init()
+	p.poll()
+
+	var got []comm.Message
+	for len(send) > 0 {
+		if msg := <-send; isInterlookServiceKey(msg.Service.Name) {
+			got = append(got, msg)
+		}
+	}
+	want := append([]comm.Message{interlookServiceMsgOK}, interlookServicePortsMsgs...)
+	// the interlook services are listed in no particular order
+	sort.Slice(got, func(i, j int) bool { return got[i].Service.Name < got[j].Service.Name })
+	sort.Slice(want, func(i, j int) bool { return want[i].Service.Name < want[j].Service.Name })
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("poll() sent %v, want %v", got, want)
+	}
+
+	// the invalid service is reported in its status
+	if status := getInterlookServiceStatus(t, p, "invalid"); status.Error == "" {
+		t.Errorf("status = %v, want an error", status)
+	}
+}
+
+func TestExtension_interlookServiceStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		key      string
+		msg      comm.Message
+		want     interlookServiceStatus
+	}{
+		{"deployed", "web", "interlookservice:default/web", comm.Message{State: comm.DeployedState, Service: comm.Service{PublicIP: "10.1.1.1"}},
+			interlookServiceStatus{State: comm.DeployedState, PublicIP: "10.1.1.1"}},
+		{"error", "web", "interlookservice:default/web", comm.Message{State: comm.DeployedState, Error: "lb error", Service: comm.Service{PublicIP: "10.1.1.1"}},
+			interlookServiceStatus{State: comm.DeployedState, Error: "lb error", PublicIP: "10.1.1.1"}},
+		{"undeployed", "web", "interlookservice:default/web", comm.Message{State: comm.UndeployedState, Service: comm.Service{PublicIP: "10.1.1.1"}},
+			interlookServiceStatus{State: comm.UndeployedState}},
+		{"port", "ports", "interlookservice:default/ports/http", comm.Message{State: comm.DeployedState, Service: comm.Service{PublicIP: "10.1.1.1"}},
+			interlookServiceStatus{Ports: []interlookServicePortStatus{{Name: "http", State: comm.DeployedState, PublicIP: "10.1.1.1"}}}},
+		{"removedPort", "ports", "interlookservice:default/ports/https", comm.Message{State: comm.UndeployedState},
+			interlookServiceStatus{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initInterlookServiceTests(t)
+			tt.msg.Action = comm.StatusAction
+			tt.msg.Service.Name = tt.key
+			p.ServiceStatus(tt.msg)
+
+			if got := getInterlookServiceStatus(t, p, tt.resource); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_interlookServicePortsStatus(t *testing.T) {
+	p := initInterlookServiceTests(t)
+	for _, port := range []string{"plain", "http"} {
+		p.ServiceStatus(comm.Message{Action: comm.StatusAction, State: comm.DeployedState,
+			Service: comm.Service{Name: "interlookservice:default/ports/" + port, PublicIP: "10.1.1.1"}})
+	}
+
+	want := interlookServiceStatus{Ports: []interlookServicePortStatus{
+		{Name: "http", State: comm.DeployedState, PublicIP: "10.1.1.1"},
+		{Name: "plain", State: comm.DeployedState, PublicIP: "10.1.1.1"},
+	}}
+	if got := getInterlookServiceStatus(t, p, "ports"); !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %v, want %v", got, want)
+	}
+
+	// the state of a port removed from the list is removed once the service is sent again
+	client := p.dyn.Resource(interlookServiceResource).Namespace("default")
+	obj, err := client.Get(context.Background(), "ports", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, _, _ := unstructured.NestedSlice(obj.Object, "spec", "ports")
+	if err := unstructured.SetNestedSlice(obj.Object, ports[:1], "spec", "ports"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(context.Background(), obj, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc, _ := p.getInterlookServiceByName("interlookservice:default/ports")
+	p.send = make(chan comm.Message, 10)
+	p.sendInterlookService(svc)
+
+	want.Ports = want.Ports[:1]
+	if got := getInterlookServiceStatus(t, p, "ports"); !reflect.DeepEqual(got, want) {
+		t.Errorf("status = %v, want %v", got, want)
+	}
+}
+
+func TestExtension_RefreshInterlookService(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want comm.Message
+	}{
+		{"refreshAdd", "interlookservice:default/web", interlookServiceMsgOK},
+		{"refreshDel", "interlookservice:default/notfound", comm.BuildDeleteMessage("interlookservice:default/notfound")},
+		{"refreshPort", "interlookservice:default/ports/plain", interlookServicePortsMsgs[1]},
+		{"refreshRemovedPort", "interlookservice:default/ports/https", comm.BuildDeleteMessage("interlookservice:default/ports/https")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initInterlookServiceTests(t)
+			rec, send := p.startTestK8s()
+			go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: tt.key}} }()
+			got := receiveMessage(t, send, tt.key, tt.want.Action)
+			go p.Stop()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Msg = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_WatchInterlookServices(t *testing.T) {
+	p := initInterlookServiceTests(t)
+	p.Watch = true
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	got := receiveMessage(t, send, "interlookservice:default/web", comm.AddAction)
+	if !reflect.DeepEqual(got, interlookServiceMsgOK) {
+		t.Errorf("Msg = %v, want %v", got, interlookServiceMsgOK)
+	}
+
+	// a spec change is pushed
+	updated := dummyInterlookService("web", map[string]interface{}{
+		"hosts":   []interface{}{"web.dummy.com", "www.dummy.com"},
+		"service": "web",
+		"port":    int64(80),
+	})
+	if _, err := p.dyn.Resource(interlookServiceResource).Namespace("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMessage(t, send, "interlookservice:default/web", comm.AddAction, func(msg comm.Message) bool {
+		return len(msg.Service.DNSAliases) == 2 && !msg.Service.TLS
+	})
+
+	// deleting the custom resource deletes the service
+	if err := p.dyn.Resource(interlookServiceResource).Namespace("default").Delete(context.Background(), "web", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiveMessage(t, send, "interlookservice:default/web", comm.DeleteAction)
+}
+
+func TestExtension_WatchInterlookServicePorts(t *testing.T) {
+	p := initInterlookServiceTests(t)
+	p.Watch = true
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	for _, want := range interlookServicePortsMsgs {
+		if got := receiveMessage(t, send, want.Service.Name, comm.AddAction); !reflect.DeepEqual(got, want) {
+			t.Errorf("Msg = %v, want %v", got, want)
+		}
+	}
+
+	// a port removed from the list is deleted
+	updated := dummyInterlookService("ports", map[string]interface{}{
+		"hosts":   []interface{}{"ports.dummy.com"},
+		"service": "web",
+		"ports":   []interface{}{map[string]interface{}{"port": "http", "tls": true}},
+	})
+	if _, err := p.dyn.Resource(interlookServiceResource).Namespace("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	receiveMessage(t, send, "interlookservice:default/ports/plain", comm.DeleteAction)
+
+	// deleting the custom resource deletes its remaining ports
+	if err := p.dyn.Resource(interlookServiceResource).Namespace("default").Delete(context.Background(), "ports", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	receiveMessage(t, send, "interlookservice:default/ports/http", comm.DeleteAction)
+}
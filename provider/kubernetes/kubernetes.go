@@ -1,44 +1,81 @@
 package kubernetes
 
 import (
+	"context"
 	"fmt"
 	"github.com/interlook/interlook/comm"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
 
 	"k8s.io/client-go/rest"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/interlook/interlook/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 )
 
 const (
 	hostsLabel    = "interlook.hosts"
 	portLabel     = "interlook.port"
 	sslLabel      = "interlook.ssl"
+	workflowLabel = "interlook.workflow"
 	extensionName = "provider.kubernetes"
 )
 
 // Extension holds the Kubernetes provider configuration
 type Extension struct {
-	Name          string        `yaml:"name"`
-	Endpoint      string        `yaml:"endpoint"`
-	LabelSelector []string      `yaml:"listOptions"`
-	TLSCa         string        `yaml:"tlsCa"`
-	TLSCert       string        `yaml:"tlsCert"`
-	TLSKey        string        `yaml:"tlsKey"`
-	PollInterval  time.Duration `yaml:"pollInterval"`
-	pollTicker    *time.Ticker
-	shutdown      chan bool
-	send          chan<- comm.Message
-	cli           kubernetes.Interface
-	waitGroup     sync.WaitGroup
-	listOptions   metav1.ListOptions
+	Name                 string        `yaml:"name"`
+	Endpoint             string        `yaml:"endpoint"`
+	LabelSelector        []string      `yaml:"listOptions"`
+	TLSCa                string        `yaml:"tlsCa"`
+	TLSCert              string        `yaml:"tlsCert"`
+	TLSKey               string        `yaml:"tlsKey"`
+	Token                string        `yaml:"token"`
+	TokenFile            string        `yaml:"tokenFile"`
+	Exec                 ExecConfig    `yaml:"exec"`
+	InCluster            bool          `yaml:"inCluster"`
+	Kubeconfig           string        `yaml:"kubeconfig"`
+	Context              string        `yaml:"context"`
+	PollInterval         time.Duration `yaml:"pollInterval"`
+	Watch                bool          `yaml:"watch"`
+	WatchInterval        time.Duration `yaml:"watchInterval"`
+	Namespaces           []string      `yaml:"namespaces"`
+	LoadBalancerServices bool          `yaml:"loadBalancerServices"`
+	Ingresses            bool          `yaml:"ingresses"`
+	IngressClass         string        `yaml:"ingressClass"`
+	EndpointSlices       bool          `yaml:"endpointSlices"`
+	PodTargets           bool          `yaml:"podTargets"`
+	InterlookServices    bool          `yaml:"interlookServices"`
+	pollTicker           *time.Ticker
+	shutdown             chan bool
+	send                 chan<- comm.Message
+	cli                  kubernetes.Interface
+	dyn                  dynamic.Interface
+	waitGroup            sync.WaitGroup
+	listOptions          metav1.ListOptions
+	resourceListOptions  metav1.ListOptions
+	watcher              *watcher
+	// the ingresses are read from networking.k8s.io/v1beta1 on the clusters not serving v1
+	ingressV1beta1 bool
+}
+
+// ExecConfig holds the exec credential plugin used to authenticate to the endpoint
+type ExecConfig struct {
+	Command    string            `yaml:"command"`
+	Args       []string          `yaml:"args"`
+	Env        map[string]string `yaml:"env"`
+	APIVersion string            `yaml:"apiVersion"`
 }
 
 func (p *Extension) init() {
@@ -49,13 +86,27 @@ func (p *Extension) init() {
 		p.PollInterval = 15 * time.Second
 	}
 
+	if p.WatchInterval == time.Duration(0) {
+		p.WatchInterval = 5 * time.Minute
+	}
+
 	p.pollTicker = time.NewTicker(p.PollInterval)
 
-	p.listOptions.LabelSelector = hostsLabel + "," + portLabel
-	if len(p.LabelSelector) > 0 {
-		p.listOptions.LabelSelector = p.listOptions.LabelSelector + "," + strings.Join(p.LabelSelector, ",")
+	// pod targets are read from the endpoint slices
+	if p.PodTargets {
+		p.EndpointSlices = true
+	}
+
+	// LoadBalancer services do not need the interlook labels, eligibility is then checked per service
+	var selector []string
+	if !p.LoadBalancerServices {
+		selector = append(selector, hostsLabel, portLabel)
 	}
+	p.listOptions.LabelSelector = strings.Join(append(selector, p.LabelSelector...), ",")
 	log.Debugf("label selector: %v", p.listOptions.LabelSelector)
+
+	// ingresses and interlook services are only filtered by the configured labels
+	p.resourceListOptions.LabelSelector = strings.Join(p.LabelSelector, ",")
 }
 
 // Start the kubernetes provider
@@ -73,15 +124,56 @@ func (p *Extension) Start(receive <-chan comm.Message, send chan<- comm.Message)
 		}
 	}
 
+	if p.InterlookServices && p.dyn == nil {
+		p.dyn, err = p.connectDynamic()
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = p.cli.Discovery().ServerVersion()
 	if err != nil {
 		return err
 	}
 
+	if p.Ingresses {
+		servesV1, err := p.servesIngressV1()
+		if err != nil {
+			return err
+		}
+		if !servesV1 {
+			log.Info("networking.k8s.io/v1 ingresses not served, reading networking.k8s.io/v1beta1")
+			p.ingressV1beta1 = true
+		}
+	}
+
+	var events <-chan watchEvent
+	if p.Watch {
+		// informers replace the periodic List, resync is driven by WatchInterval
+		p.pollTicker.Stop()
+		p.watcher = newWatcher(p.cli, p.listOptions.LabelSelector, p.WatchInterval, p.namespaces())
+		if p.EndpointSlices {
+			p.watcher.watchEndpointSlices(p.namespaces())
+		}
+		if p.Ingresses {
+			p.watcher.watchIngresses(p.cli, p.resourceListOptions.LabelSelector, p.WatchInterval, p.namespaces(), p.ingressV1beta1)
+		}
+		if p.InterlookServices {
+			p.watcher.watchInterlookServices(p.dyn, p.resourceListOptions.LabelSelector, p.WatchInterval, p.namespaces())
+		}
+		events = p.watcher.events
+		if err := p.watcher.start(); err != nil {
+			return err
+		}
+	}
+
 	p.waitGroup.Add(1)
 	for {
 		select {
 		case <-p.shutdown:
+			if p.watcher != nil {
+				p.watcher.stop()
+			}
 			p.waitGroup.Done()
 
 			return nil
@@ -90,12 +182,20 @@ func (p *Extension) Start(receive <-chan comm.Message, send chan<- comm.Message)
 			log.Debug("New poll launched")
 			p.poll()
 
+		case event := <-events:
+			p.handleWatchEvent(event)
+
 		case msg := <-receive:
 			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
 			switch msg.Action {
 			case comm.RefreshAction:
 				log.Debugf("Request to refresh service %v", msg.Service.Name)
 				p.RefreshService(msg)
+			case comm.SnapshotAction:
+				log.Debug("Request to send a snapshot of the services")
+				p.Snapshot(msg)
+			case comm.StatusAction:
+				p.ServiceStatus(msg)
 			default:
 				log.Warnf("Unhandled action requested: %v", msg.Action)
 			}
@@ -113,50 +213,255 @@ func (p *Extension) Stop() error {
 	return nil
 }
 
+// poll sends the eligible services, ingresses and interlook services, followed by the snapshot of their keys
+// the snapshot is not sent if a list failed, as the core would un-deploy the services not listed
 func (p *Extension) poll() {
+	var found []string
+	complete := true
 
-	sl, err := p.cli.CoreV1().Services("").List(p.listOptions)
-	if err != nil {
-		log.Error(err.Error())
-		return
-	}
+	for _, namespace := range p.namespaces() {
+		sl, err := p.cli.CoreV1().Services(namespace).List(context.Background(), p.listOptions)
+		if err != nil {
+			log.Error(err.Error())
+			complete = false
+			continue
+		}
 
-	for _, svc := range sl.Items {
-		if svc.Spec.Type == v1.ServiceTypeNodePort {
-			msg, err := p.buildMessageFromService(&svc)
+		for _, svc := range sl.Items {
+			if p.isServiceEligible(&svc) {
+				found = append(found, serviceKey(&svc))
+				msg, err := p.buildMessageFromService(&svc)
+				if err != nil {
+					log.Warnf("error building message for service %v %v", serviceKey(&svc), err.Error())
+				}
+				p.send <- msg
+			}
+		}
+
+		if p.Ingresses {
+			keys, err := p.pollIngresses(namespace)
+			if err != nil {
+				complete = false
+			}
+			found = append(found, keys...)
+		}
+
+		if p.InterlookServices {
+			keys, err := p.pollInterlookServices(namespace)
 			if err != nil {
-				log.Warnf("error building message for service %v %v", svc.Name, err.Error())
+				complete = false
 			}
-			p.send <- msg
+			found = append(found, keys...)
 		}
 	}
+
+	if complete {
+		p.send <- comm.BuildSnapshotMessage(found)
+	}
+}
+
+// isServiceEligible returns true if the service must be published by interlook
+// NodePort services need the interlook labels, LoadBalancer ones are published when LoadBalancerServices is enabled
+// ClusterIP services need the interlook labels and are only published when targeting the pods directly
+func (p *Extension) isServiceEligible(service *v1.Service) bool {
+	_, hostsOK := service.Labels[hostsLabel]
+	_, portOK := service.Labels[portLabel]
+
+	switch service.Spec.Type {
+	case v1.ServiceTypeNodePort:
+		return hostsOK && portOK
+	case v1.ServiceTypeClusterIP:
+		return p.PodTargets && hostsOK && portOK
+	case v1.ServiceTypeLoadBalancer:
+		return p.LoadBalancerServices
+	}
+	return false
+}
+
+// namespaces returns the namespaces to watch, metav1.NamespaceAll if none is configured
+func (p *Extension) namespaces() []string {
+	if len(p.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+	return p.Namespaces
+}
+
+// isNamespaceWatched returns true if the given namespace is part of the configured ones
+func (p *Extension) isNamespaceWatched(namespace string) bool {
+	if len(p.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range p.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceKey returns the namespace/name identifying the service in interlook
+func serviceKey(service *v1.Service) string {
+	return service.Namespace + "/" + service.Name
+}
+
+// splitServiceKey returns the namespace and name from a namespace/name service key
+func splitServiceKey(key string) (namespace, name string, err error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New(fmt.Sprintf("invalid service key %v, expecting namespace/name", key))
+	}
+	return parts[0], parts[1], nil
+}
+
+// sliceContainString returns true if the slice contains the string
+func sliceContainString(s string, sl []string) bool {
+	for _, x := range sl {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Snapshot sends the services found, followed by the snapshot of their names
+func (p *Extension) Snapshot(msg comm.Message) {
+	p.poll()
 }
 
 // RefreshService sends an updated state for a given service
 func (p *Extension) RefreshService(msg comm.Message) {
-	var (
-		res comm.Message
-		err error
-	)
-	if svc, ok := p.getServiceByName(msg.Service.Name); ok {
-		res, err = p.buildMessageFromService(svc)
-		if err != nil {
-			errMsg := fmt.Sprintf("Error building message for %v: %v", msg.Service.Name, err.Error())
-			log.Errorf(errMsg)
-			res.Error = errMsg
-		}
+	if isIngressKey(msg.Service.Name) {
+		p.refreshIngress(msg)
+		return
+	}
 
-	} else {
+	if isInterlookServiceKey(msg.Service.Name) {
+		p.refreshInterlookService(msg)
+		return
+	}
+
+	svc, found, err := p.getServiceByName(msg.Service.Name)
+	if err != nil {
+		log.Warnf("Could not get k8s service %v, keeping its current state: %v", msg.Service.Name, err)
+		return
+	}
+
+	if !found {
 		log.Infof("k8s service %v not found, send delete", msg.Service.Name)
-		res = comm.BuildDeleteMessage(msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	res, err := p.buildMessageFromService(svc)
+	if err != nil {
+		errMsg := fmt.Sprintf("Error building message for %v: %v", msg.Service.Name, err.Error())
+		log.Errorf(errMsg)
+		res.Error = errMsg
 	}
 
 	p.send <- res
 }
 
+// IsLegacyKey returns true for the service keys without namespace, used before services were identified as namespace/name
+func (p *Extension) IsLegacyKey(name string) bool {
+	return !isIngressKey(name) && !isInterlookServiceKey(name) && !strings.Contains(name, "/")
+}
+
+// ServiceStatus writes the public IP allocated by interlook back to the LoadBalancer service status
+// so that it is shown as the service's external IP, and the workflow state to the interlook service status
+func (p *Extension) ServiceStatus(msg comm.Message) {
+	if isInterlookServiceKey(msg.Service.Name) {
+		p.interlookServiceStatus(msg)
+		return
+	}
+
+	if !p.LoadBalancerServices || isIngressKey(msg.Service.Name) {
+		return
+	}
+
+	namespace, name, err := splitServiceKey(msg.Service.Name)
+	if err != nil {
+		log.Warn(err.Error())
+		return
+	}
+
+	svc, err := p.cli.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("could not get service %v to update its status: %v", msg.Service.Name, err)
+		return
+	}
+
+	if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return
+	}
+
+	var ingress []v1.LoadBalancerIngress
+
+	switch {
+	case msg.State == comm.DeployedState && msg.Error == "" && msg.Service.PublicIP != "":
+		ingress = []v1.LoadBalancerIngress{{IP: msg.Service.PublicIP}}
+	case msg.State == comm.UndeployedState:
+		ingress = nil
+	default:
+		// keep current status while the service is in error
+		return
+	}
+
+	if reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, ingress) {
+		return
+	}
+
+	svc.Status.LoadBalancer.Ingress = ingress
+	if _, err := p.cli.CoreV1().Services(namespace).UpdateStatus(context.Background(), svc, metav1.UpdateOptions{}); err != nil {
+		log.Errorf("could not update status of service %v: %v", msg.Service.Name, err)
+		return
+	}
+
+	log.Infof("service %v status updated with ingress %v", msg.Service.Name, ingress)
+}
+
 func (p *Extension) connect() (kubernetes.Interface, error) {
 
-	config := rest.Config{
+	config, err := p.restConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	config.UserAgent = "interlook"
+	return kubernetes.NewForConfig(config)
+}
+
+// connectDynamic returns the client used for the custom resources
+func (p *Extension) connectDynamic() (dynamic.Interface, error) {
+
+	config, err := p.restConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	config.UserAgent = "interlook"
+	return dynamic.NewForConfig(config)
+}
+
+// restConfig returns the client configuration
+// in-cluster (service account) or kubeconfig when configured, otherwise the endpoint with mTLS, bearer token or exec plugin
+func (p *Extension) restConfig() (*rest.Config, error) {
+	if p.InCluster {
+		log.Debug("using in-cluster configuration")
+		return rest.InClusterConfig()
+	}
+
+	if p.Kubeconfig != "" {
+		log.Debugf("using kubeconfig %v, context %v", p.Kubeconfig, p.Context)
+		overrides := &clientcmd.ConfigOverrides{CurrentContext: p.Context}
+		if p.Endpoint != "" {
+			overrides.ClusterInfo.Server = p.Endpoint
+		}
+		return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: p.Kubeconfig}, overrides).ClientConfig()
+	}
+
+	config := &rest.Config{
 		Host: p.Endpoint,
 		TLSClientConfig: rest.TLSClientConfig{
 			Insecure: false,
@@ -164,65 +469,155 @@ func (p *Extension) connect() (kubernetes.Interface, error) {
 			KeyFile:  p.TLSKey,
 			CAFile:   p.TLSCa,
 		},
-		UserAgent: "interlook",
+		BearerToken:     p.Token,
+		BearerTokenFile: p.TokenFile,
+	}
+
+	if p.Exec.Command != "" {
+		config.ExecProvider = p.Exec.execProvider()
 	}
-	return kubernetes.NewForConfig(&config)
+
+	return config, nil
+}
+
+// execProvider returns the client-go exec credential plugin configuration
+func (e ExecConfig) execProvider() *clientcmdapi.ExecConfig {
+	exec := &clientcmdapi.ExecConfig{
+		Command:    e.Command,
+		Args:       e.Args,
+		APIVersion: e.APIVersion,
+	}
+
+	if exec.APIVersion == "" {
+		exec.APIVersion = "client.authentication.k8s.io/v1beta1"
+	}
+
+	var names []string
+	for name := range e.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		exec.Env = append(exec.Env, clientcmdapi.ExecEnvVar{Name: name, Value: e.Env[name]})
+	}
+
+	return exec
 }
 
 func (p *Extension) buildMessageFromService(service *v1.Service) (msg comm.Message, err error) {
-	var targetPort int32
+	var servicePort v1.ServicePort
 	tlsService, _ := strconv.ParseBool(service.Labels[sslLabel])
 
 	msg = comm.Message{
 		Action: comm.AddAction,
 		Service: comm.Service{
-			Name:       service.Name,
-			Provider:   extensionName,
-			DNSAliases: strings.Split(service.Labels[hostsLabel], ","),
-			TLS:        tlsService,
+			Name:     serviceKey(service),
+			Provider: extensionName,
+			TLS:      tlsService,
+			Workflow: service.Labels[workflowLabel],
 		}}
 
+	if hosts := service.Labels[hostsLabel]; hosts != "" {
+		msg.Service.DNSAliases = strings.Split(hosts, ",")
+	}
+
 	for _, port := range service.Spec.Ports {
 		if strconv.Itoa(int(port.Port)) == service.Labels[portLabel] {
-			targetPort = port.NodePort
+			servicePort = port
 		}
 	}
-	if len(service.Spec.Selector) > 0 {
-		var labelSelect []string
-		for k, v := range service.Spec.Selector {
-			labelSelect = append(labelSelect, fmt.Sprintf("%v=%v", k, v))
-		}
 
-		pods, err := p.cli.CoreV1().Pods("").List(metav1.ListOptions{LabelSelector: strings.Join(labelSelect, ",")})
+	// LoadBalancer services do not need the port label, their first port is published
+	if _, ok := service.Labels[portLabel]; !ok && len(service.Spec.Ports) > 0 {
+		servicePort = service.Spec.Ports[0]
+	}
+
+	msg.Service.Targets, err = p.serviceTargets(service, servicePort)
+
+	return msg, err
+}
+
+// serviceTargets returns the hosts running the service's pods, targeted on the node port of the given service port
+func (p *Extension) serviceTargets(service *v1.Service, port v1.ServicePort) (targets []comm.Target, err error) {
+	if p.EndpointSlices {
+		return p.endpointTargets(service, port)
+	}
+
+	if len(service.Spec.Selector) == 0 {
+		return nil, nil
+	}
+
+	pods, err := p.listPods(service.Namespace, service.Spec.Selector)
+	if err != nil {
+		errMsg := fmt.Sprintf("error getting pods: %v", err.Error())
+		log.Error(errMsg)
+		return nil, errors.New(errMsg)
+	}
+
+	if len(pods) == 0 {
+		return nil, errors.New("no pod found for service " + serviceKey(service))
+	}
+
+	for _, pod := range pods {
+		targets = append(targets, comm.Target{
+			Host: pod.Status.HostIP,
+			Port: uint32(port.NodePort),
+		})
+	}
+
+	return targets, nil
+}
+
+// listPods returns the namespace's pods matching the given selector, from the informer cache when watching
+// pods are sorted by name so that the targets order is stable
+func (p *Extension) listPods(namespace string, selector map[string]string) (res []*v1.Pod, err error) {
+	if p.watcher != nil {
+		res, err = p.watcher.listPods(namespace, labels.SelectorFromSet(selector))
 		if err != nil {
-			errMsg := fmt.Sprintf("error getting pods: %v", err.Error())
-			log.Error(errMsg)
-			return msg, errors.New(errMsg)
+			return nil, err
 		}
-
-		if len(pods.Items) == 0 {
-			return msg, errors.New("no pod found for service " + service.Name)
+	} else {
+		pods, err := p.cli.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: labels.SelectorFromSet(selector).String()})
+		if err != nil {
+			return nil, err
 		}
 
-		var targets []comm.Target
-		for _, pod := range pods.Items {
-			targets = append(targets, comm.Target{
-				Host: pod.Status.HostIP,
-				Port: uint32(targetPort),
-			})
-			msg.Service.Targets = targets
+		for i := range pods.Items {
+			res = append(res, &pods.Items[i])
 		}
 	}
 
-	return msg, nil
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
 }
 
-func (p *Extension) getServiceByName(svcName string) (*v1.Service, bool) {
+// getServiceByName returns the service identified by the given namespace/name key
+func (p *Extension) getServiceByName(svcKey string) (svc *v1.Service, found bool, err error) {
+	namespace, name, err := splitServiceKey(svcKey)
+	if err != nil {
+		log.Warn(err.Error())
+		return nil, false, nil
+	}
+
+	if !p.isNamespaceWatched(namespace) {
+		return nil, false, nil
+	}
 
-	svc, err := p.cli.CoreV1().Services("").Get(svcName, metav1.GetOptions{})
+	if p.watcher != nil {
+		svc, found = p.watcher.getService(namespace, name)
+		return svc, found, nil
+	}
+
+	svc, err = p.cli.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
 	if err != nil {
-		return nil, false
+		return nil, false, err
 	}
 
-	return svc, true
+	return svc, true, nil
 }
@@ -1,14 +1,21 @@
 package kubernetes
 
 import (
+	"context"
 	"github.com/interlook/interlook/comm"
 	"github.com/interlook/interlook/log"
+	"github.com/pkg/errors"
+	"io/ioutil"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
 	testclient "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	"os"
 	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -41,8 +48,9 @@ func initTests() *Extension {
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   "dummyNPSvc",
-			Labels: map[string]string{hostsLabel: "dummy.com", portLabel: "8080", sslLabel: "false", "l7aas": "true"},
+			Name:      "dummyNPSvc",
+			Namespace: "default",
+			Labels:    map[string]string{hostsLabel: "dummy.com", portLabel: "8080", sslLabel: "false", "l7aas": "true"},
 		},
 		Spec: v1.ServiceSpec{
 			Ports: []v1.ServicePort{{Protocol: "TCP",
@@ -59,8 +67,9 @@ func initTests() *Extension {
 			APIVersion: "v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   "dummyNPSvcNoPod",
-			Labels: map[string]string{hostsLabel: "dummynp.com", portLabel: "8080", sslLabel: "false", "l7aas": "true"},
+			Name:      "dummyNPSvcNoPod",
+			Namespace: "default",
+			Labels:    map[string]string{hostsLabel: "dummynp.com", portLabel: "8080", sslLabel: "false", "l7aas": "true"},
 		},
 		Spec: v1.ServiceSpec{
 			Ports: []v1.ServicePort{{Protocol: "TCP",
@@ -110,7 +119,7 @@ func initTests() *Extension {
 		}}
 
 	msgOK = comm.Message{Service: comm.Service{
-		Name:       "dummyNPSvc",
+		Name:       "default/dummyNPSvc",
 		DNSAliases: []string{"dummy.com"},
 		Targets:    targetOK,
 		TLS:        false,
@@ -118,7 +127,9 @@ func initTests() *Extension {
 	},
 		Action: comm.AddAction}
 
-	k8s.cli = testclient.NewSimpleClientset(&dummyNPSvc, &dummyNPSvcNoPod, dummyPod1, dummyPod2)
+	cli := testclient.NewSimpleClientset(&dummyNPSvc, &dummyNPSvcNoPod, dummyPod1, dummyPod2)
+	cli.Resources = []*metav1.APIResourceList{{GroupVersion: "networking.k8s.io/v1", APIResources: []metav1.APIResource{{Name: "ingresses"}}}}
+	k8s.cli = cli
 	return &k8s
 
 }
@@ -145,18 +156,29 @@ func TestExtension_getServiceByName(t *testing.T) {
 	type args struct {
 		svcName string
 	}
+	apiError := initTests()
+	apiError.cli.(*testclient.Clientset).PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
 	tests := []struct {
-		name string
-		k8s  *Extension
-		svc  string
-		want bool
+		name    string
+		k8s     *Extension
+		svc     string
+		want    bool
+		wantErr bool
 	}{
-		{"found", k8s, "dummyNPSvc", true},
-		{"notFound", k8s, "notFound", false},
+		{"found", k8s, "default/dummyNPSvc", true, false},
+		{"notFound", k8s, "default/notFound", false, false},
+		{"otherNamespace", k8s, "other/dummyNPSvc", false, false},
+		{"invalidKey", k8s, "dummyNPSvc", false, false},
+		{"apiError", apiError, "default/dummyNPSvc", false, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, ok := tt.k8s.getServiceByName(tt.svc)
+			got, ok, err := tt.k8s.getServiceByName(tt.svc)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getServiceByName() error = %v, wantErr %v", err, tt.wantErr)
+			}
 			if ok != tt.want {
 				t.Errorf("getServiceByName() got = %v, want %v", got, tt.want)
 			}
@@ -164,6 +186,41 @@ func TestExtension_getServiceByName(t *testing.T) {
 	}
 }
 
+func TestExtension_RefreshServiceAPIError(t *testing.T) {
+	p := initTests()
+	p.cli.(*testclient.Clientset).PrependReactor("get", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	send := make(chan comm.Message, 1)
+	p.send = send
+
+	// the service is not deleted because the API server could not be reached
+	p.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "default/dummyNPSvc"}})
+	if len(send) != 0 {
+		t.Errorf("RefreshService() sent %v, want the current state to be kept", <-send)
+	}
+}
+
+func TestExtension_IsLegacyKey(t *testing.T) {
+	p := initTests()
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"service", "default/dummyNPSvc", false},
+		{"legacyService", "dummyNPSvc", true},
+		{"ingress", "ingress:default/web", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.IsLegacyKey(tt.key); got != tt.want {
+				t.Errorf("IsLegacyKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestExtension_buildMessageFromService(t *testing.T) {
 	k8s := initTests()
 	type args struct {
@@ -181,7 +238,7 @@ func TestExtension_buildMessageFromService(t *testing.T) {
 			Sender: "",
 			Service: comm.Service{
 				Provider: "provider.kubernetes",
-				Name:     "dummyNPSvc",
+				Name:     "default/dummyNPSvc",
 				Targets: []comm.Target{{
 					Host:   "10.32.2.1",
 					Port:   32200,
@@ -226,22 +283,23 @@ func TestExtension_RefreshService(t *testing.T) {
 	}{
 		{"refreshErr", args{msg: comm.Message{
 			Action:  "refresh",
-			Service: comm.Service{Name: "dummyNPSvcNoPod"},
+			Service: comm.Service{Name: "default/dummyNPSvcNoPod"},
 		}}, comm.Message{}, true},
 		{"refreshAdd", args{msg: comm.Message{
 			Action:  "refresh",
-			Service: comm.Service{Name: "dummyNPSvc"},
+			Service: comm.Service{Name: "default/dummyNPSvc"},
 		}}, msgOK, false},
 		{"refreshDel", args{msg: comm.Message{
 			Action:  "refresh",
-			Service: comm.Service{Name: "notfound"},
-		}}, comm.BuildDeleteMessage("notfound"), false},
+			Service: comm.Service{Name: "default/notfound"},
+		}}, comm.BuildDeleteMessage("default/notfound"), false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			p := initTests()
-			_, send := p.startTestK8s()
-			go p.RefreshService(tt.args.msg)
+			rec, send := p.startTestK8s()
+			// refreshes are handled by the provider loop, as sent by the core
+			go func() { rec <- tt.args.msg }()
 			got := <-send
 			go p.Stop()
 			if len(got.Error) > 0 && !tt.wantErr {
@@ -263,7 +321,7 @@ func TestExtension_SendRefreshRequest(t *testing.T) {
 	}{
 		{"refresh", comm.Message{
 			Action:  "refresh",
-			Service: comm.Service{Name: "dummyNPSvc"},
+			Service: comm.Service{Name: "default/dummyNPSvc"},
 		}, msgOK},
 	}
 	for _, tt := range tests {
@@ -309,6 +367,81 @@ func TestExtension_Poll(t *testing.T) {
 	}
 }
 
+func TestExtension_PollSnapshot(t *testing.T) {
+	tests := []struct {
+		name         string
+		listError    bool
+		wantSnapshot []string
+	}{
+		{"complete", false, []string{"default/dummyNPSvc", "default/dummyNPSvcNoPod"}},
+		{"listError", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initTests()
+			if tt.listError {
+				p.cli.(*testclient.Clientset).PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			send := make(chan comm.Message, 10)
+			p.send = send
+			p.poll()
+
+			var snapshots []comm.Message
+			for len(send) > 0 {
+				if msg := <-send; msg.Action == comm.SnapshotAction {
+					snapshots = append(snapshots, msg)
+				} else if len(snapshots) > 0 {
+					t.Errorf("%v sent after the snapshot", msg.Service.Name)
+				}
+			}
+
+			if !tt.listError {
+				if len(snapshots) != 1 {
+					t.Fatalf("poll() sent %v snapshots, want 1", len(snapshots))
+				}
+				got := snapshots[0].Snapshot
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, tt.wantSnapshot) {
+					t.Errorf("snapshot = %v, want %v", got, tt.wantSnapshot)
+				}
+			} else if len(snapshots) != 0 {
+				t.Errorf("poll() sent snapshot %v, want none as a list failed", snapshots[0].Snapshot)
+			}
+		})
+	}
+}
+
+func TestExtension_Snapshot(t *testing.T) {
+	p := initTests()
+	p.PollInterval = time.Hour
+	rec, send := p.startTestK8s()
+	defer p.Stop()
+
+	// the snapshot requested by the core follows the services found
+	rec <- comm.Message{Action: comm.SnapshotAction}
+	var found []string
+	for {
+		select {
+		case msg := <-send:
+			if msg.Action != comm.SnapshotAction {
+				found = append(found, msg.Service.Name)
+				continue
+			}
+			want := []string{"default/dummyNPSvc", "default/dummyNPSvcNoPod"}
+			sort.Strings(found)
+			sort.Strings(msg.Snapshot)
+			if !reflect.DeepEqual(found, want) || !reflect.DeepEqual(msg.Snapshot, want) {
+				t.Errorf("Snapshot() sent %v then snapshot %v, want %v", found, msg.Snapshot, want)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no snapshot sent")
+		}
+	}
+}
+
 func TestExtension_Start(t *testing.T) {
 	type fields struct {
 		Name          string
@@ -349,3 +482,256 @@ func TestExtension_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestExtension_PollNamespaces(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		want       comm.Message
+	}{
+		{"watched", []string{"other", "default"}, msgOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := initTests()
+			p.Namespaces = tt.namespaces
+			p.LabelSelector = []string{"l7aas"}
+			p.PollInterval = 500
+			_, send := p.startTestK8s()
+			got := <-send
+			for got.Error != "" || len(got.Service.Targets) == 0 {
+				got = <-send
+			}
+			go p.Stop()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Msg = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtension_isNamespaceWatched(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		namespace  string
+		want       bool
+	}{
+		{"all", nil, "default", true},
+		{"watched", []string{"default"}, "default", true},
+		{"notWatched", []string{"other"}, "default", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Extension{Namespaces: tt.namespaces}
+			if got := p.isNamespaceWatched(tt.namespace); got != tt.want {
+				t.Errorf("isNamespaceWatched() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_splitServiceKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		key           string
+		wantNamespace string
+		wantName      string
+		wantErr       bool
+	}{
+		{"ok", "default/web", "default", "web", false},
+		{"noNamespace", "web", "", "", true},
+		{"empty", "/web", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotNamespace, gotName, err := splitServiceKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("splitServiceKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if gotNamespace != tt.wantNamespace || gotName != tt.wantName {
+				t.Errorf("splitServiceKey() = %v, %v, want %v, %v", gotNamespace, gotName, tt.wantNamespace, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestExtension_LoadBalancerServices(t *testing.T) {
+	lbSvc := dummyNPSvc.DeepCopy()
+	lbSvc.Name = "dummyLBSvc"
+	lbSvc.Labels = nil
+	lbSvc.Spec.Type = v1.ServiceTypeLoadBalancer
+
+	p := initTests()
+	if _, err := p.cli.CoreV1().Services("default").Create(context.Background(), lbSvc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	p.LoadBalancerServices = true
+	p.init()
+
+	if p.listOptions.LabelSelector != "" {
+		t.Errorf("LabelSelector = %v, want none", p.listOptions.LabelSelector)
+	}
+
+	got, err := p.buildMessageFromService(lbSvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := msgOK
+	want.Service.Name = "default/dummyLBSvc"
+	want.Service.DNSAliases = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Msg = %v, want %v", got, want)
+	}
+
+	tests := []struct {
+		name        string
+		msg         comm.Message
+		wantIngress []v1.LoadBalancerIngress
+	}{
+		{"deployed", comm.Message{
+			Action:  comm.StatusAction,
+			State:   comm.DeployedState,
+			Service: comm.Service{Name: "default/dummyLBSvc", PublicIP: "10.32.30.2"},
+		}, []v1.LoadBalancerIngress{{IP: "10.32.30.2"}}},
+		{"error", comm.Message{
+			Action:  comm.StatusAction,
+			State:   comm.DeployedState,
+			Error:   "lb.f5ltm failed",
+			Service: comm.Service{Name: "default/dummyLBSvc", PublicIP: "10.32.30.3"},
+		}, []v1.LoadBalancerIngress{{IP: "10.32.30.2"}}},
+		{"undeployed", comm.Message{
+			Action:  comm.StatusAction,
+			State:   comm.UndeployedState,
+			Service: comm.Service{Name: "default/dummyLBSvc"},
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.ServiceStatus(tt.msg)
+			svc, err := p.cli.CoreV1().Services("default").Get(context.Background(), "dummyLBSvc", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(svc.Status.LoadBalancer.Ingress, tt.wantIngress) {
+				t.Errorf("Ingress = %v, want %v", svc.Status.LoadBalancer.Ingress, tt.wantIngress)
+			}
+		})
+	}
+}
+
+func TestExtension_isServiceEligible(t *testing.T) {
+	lbSvc := dummyNPSvc.DeepCopy()
+	lbSvc.Labels = nil
+	lbSvc.Spec.Type = v1.ServiceTypeLoadBalancer
+	npNoLabel := dummyNPSvc.DeepCopy()
+	npNoLabel.Labels = nil
+
+	tests := []struct {
+		name                 string
+		loadBalancerServices bool
+		svc                  *v1.Service
+		want                 bool
+	}{
+		{"nodePort", false, &dummyNPSvc, true},
+		{"nodePortNoLabel", true, npNoLabel, false},
+		{"loadBalancer", true, lbSvc, true},
+		{"loadBalancerDisabled", false, lbSvc, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Extension{LoadBalancerServices: tt.loadBalancerServices}
+			if got := p.isServiceEligible(tt.svc); got != tt.want {
+				t.Errorf("isServiceEligible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: prod
+  cluster:
+    server: https://prod.k8s:6443
+- name: dev
+  cluster:
+    server: https://dev.k8s:6443
+users:
+- name: interlook
+  user:
+    token: secret
+contexts:
+- name: prod
+  context:
+    cluster: prod
+    user: interlook
+- name: dev
+  context:
+    cluster: dev
+    user: interlook
+current-context: prod
+`
+
+func TestExtension_restConfig(t *testing.T) {
+	kubeconfig, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(kubeconfig.Name())
+	if _, err := kubeconfig.WriteString(testKubeconfig); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig.Close()
+
+	tests := []struct {
+		name      string
+		k8s       *Extension
+		wantHost  string
+		wantToken string
+		wantExec  bool
+		wantErr   bool
+	}{
+		{"endpoint", &Extension{Endpoint: "https://k8s:6443", Token: "token"}, "https://k8s:6443", "token", false, false},
+		{"exec", &Extension{Endpoint: "https://k8s:6443", Exec: ExecConfig{Command: "aws"}}, "https://k8s:6443", "", true, false},
+		{"kubeconfig", &Extension{Kubeconfig: kubeconfig.Name()}, "https://prod.k8s:6443", "secret", false, false},
+		{"kubeconfigContext", &Extension{Kubeconfig: kubeconfig.Name(), Context: "dev"}, "https://dev.k8s:6443", "secret", false, false},
+		{"kubeconfigEndpoint", &Extension{Kubeconfig: kubeconfig.Name(), Endpoint: "https://k8s:6443"}, "https://k8s:6443", "secret", false, false},
+		{"kubeconfigNotFound", &Extension{Kubeconfig: "/notfound"}, "", "", false, true},
+		{"kubeconfigUnknownContext", &Extension{Kubeconfig: kubeconfig.Name(), Context: "unknown"}, "", "", false, true},
+		{"inClusterOutside", &Extension{InCluster: true}, "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.k8s.restConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("restConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.Host != tt.wantHost || got.BearerToken != tt.wantToken || (got.ExecProvider != nil) != tt.wantExec {
+				t.Errorf("restConfig() = %v, want host %v, token %v, exec %v", got, tt.wantHost, tt.wantToken, tt.wantExec)
+			}
+		})
+	}
+}
+
+func TestExecConfig_execProvider(t *testing.T) {
+	exec := ExecConfig{
+		Command: "aws",
+		Args:    []string{"eks", "get-token"},
+		Env:     map[string]string{"B": "2", "A": "1"},
+	}
+
+	got := exec.execProvider()
+	want := &clientcmdapi.ExecConfig{
+		Command:    "aws",
+		Args:       []string{"eks", "get-token"},
+		Env:        []clientcmdapi.ExecEnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "2"}},
+		APIVersion: "client.authentication.k8s.io/v1beta1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("execProvider() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,752 @@
+package kubernetes
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	v1 "k8s.io/api/core/v1"
+	discovery "k8s.io/api/discovery/v1beta1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1beta1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchEvent tells the provider loop which service needs to be pushed to the core
+type watchEvent struct {
+	// namespace/name of the service, ingress:namespace/name of the ingress
+	service string
+	deleted bool
+	// resync requests all the services to be pushed again
+	resync bool
+}
+
+// watcher holds the shared informers used by the watch mode
+type watcher struct {
+	events         chan watchEvent
+	stopCh         chan struct{}
+	factories      []informers.SharedInformerFactory
+	serviceListers map[string]corelisters.ServiceLister
+	podListers     map[string]corelisters.PodLister
+	// networking.k8s.io/v1 or v1beta1 ingresses, read with toIngress
+	ingressListers map[string]cache.GenericLister
+	// all the services, whatever their labels, referenced as ingress backends
+	backendServiceListers map[string]corelisters.ServiceLister
+	endpointSliceListers  map[string]discoverylisters.EndpointSliceLister
+	// interlook services are read with the dynamic client
+	interlookServiceListers map[string]cache.GenericLister
+	dynamicFactories        []dynamicinformer.DynamicSharedInformerFactory
+	informersSynced         []cache.InformerSynced
+	// services pushed to the core
+	pushed map[string]bool
+	// pod informers factories by namespace, shared with the backend services and endpoint slices informers
+	podFactories map[string]informers.SharedInformerFactory
+}
+
+// newWatcher creates the informers over services (filtered by labelSelector) and pods of the given namespaces
+// and over the cluster nodes
+func newWatcher(cli kubernetes.Interface, labelSelector string, resync time.Duration, namespaces []string) *watcher {
+	w := &watcher{
+		events:         make(chan watchEvent),
+		stopCh:         make(chan struct{}),
+		serviceListers: make(map[string]corelisters.ServiceLister),
+		podListers:     make(map[string]corelisters.PodLister),
+		pushed:         make(map[string]bool),
+		podFactories:   make(map[string]informers.SharedInformerFactory),
+	}
+
+	for _, namespace := range namespaces {
+		serviceFactory := informers.NewSharedInformerFactoryWithOptions(cli, resync,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labelSelector
+			}))
+		// pods do not need to be resynced, the services resync re-computes them anyway
+		podFactory := informers.NewSharedInformerFactoryWithOptions(cli, 0, informers.WithNamespace(namespace))
+
+		serviceInformer := serviceFactory.Core().V1().Services()
+		podInformer := podFactory.Core().V1().Pods()
+		w.addServiceHandlers(serviceInformer.Informer())
+		w.addPodHandlers(podInformer.Informer())
+
+		w.serviceListers[namespace] = serviceInformer.Lister()
+		w.podListers[namespace] = podInformer.Lister()
+		w.podFactories[namespace] = podFactory
+		w.factories = append(w.factories, serviceFactory, podFactory)
+		w.informersSynced = append(w.informersSynced,
+			serviceInformer.Informer().HasSynced,
+			podInformer.Informer().HasSynced)
+	}
+
+	nodeFactory := informers.NewSharedInformerFactory(cli, 0)
+	nodeInformer := nodeFactory.Core().V1().Nodes()
+	w.addNodeHandlers(nodeInformer.Informer())
+	w.factories = append(w.factories, nodeFactory)
+	w.informersSynced = append(w.informersSynced, nodeInformer.Informer().HasSynced)
+
+	return w
+}
+
+// watchIngresses adds the informers over the ingresses (filtered by labelSelector) of the given namespaces
+// and over the services they may reference as backend
+// the networking.k8s.io/v1beta1 ingresses are watched on the clusters not serving v1
+func (w *watcher) watchIngresses(cli kubernetes.Interface, labelSelector string, resync time.Duration, namespaces []string, v1beta1Only bool) {
+	w.ingressListers = make(map[string]cache.GenericLister)
+	w.watchBackendServices(namespaces)
+
+	for _, namespace := range namespaces {
+		ingressFactory := informers.NewSharedInformerFactoryWithOptions(cli, resync,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.LabelSelector = labelSelector
+			}))
+
+		ingressInformer := ingressFactory.Networking().V1().Ingresses().Informer()
+		if v1beta1Only {
+			ingressInformer = ingressFactory.Networking().V1beta1().Ingresses().Informer()
+		}
+		w.addIngressHandlers(ingressInformer)
+
+		w.ingressListers[namespace] = cache.NewGenericLister(ingressInformer.GetIndexer(), ingressResource)
+		w.factories = append(w.factories, ingressFactory)
+		w.informersSynced = append(w.informersSynced, ingressInformer.HasSynced)
+	}
+}
+
+// watchInterlookServices adds the informers over the interlook services (filtered by labelSelector) of the given namespaces
+// and over the services they may reference as backend
+func (w *watcher) watchInterlookServices(dyn dynamic.Interface, labelSelector string, resync time.Duration, namespaces []string) {
+	w.interlookServiceListers = make(map[string]cache.GenericLister)
+	w.watchBackendServices(namespaces)
+
+	for _, namespace := range namespaces {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dyn, resync, namespace,
+			func(options *metav1.ListOptions) {
+				options.LabelSelector = labelSelector
+			})
+
+		informer := factory.ForResource(interlookServiceResource)
+		w.addInterlookServiceHandlers(informer.Informer())
+
+		w.interlookServiceListers[namespace] = informer.Lister()
+		w.dynamicFactories = append(w.dynamicFactories, factory)
+		w.informersSynced = append(w.informersSynced, informer.Informer().HasSynced)
+	}
+}
+
+// watchBackendServices adds the informers over all the services of the given namespaces
+// so that ingresses and interlook services backends are resolved whatever their labels
+func (w *watcher) watchBackendServices(namespaces []string) {
+	if w.backendServiceListers != nil {
+		return
+	}
+	w.backendServiceListers = make(map[string]corelisters.ServiceLister)
+
+	for _, namespace := range namespaces {
+		backendServiceInformer := w.podFactories[namespace].Core().V1().Services()
+		w.addBackendServiceHandlers(backendServiceInformer.Informer())
+
+		w.backendServiceListers[namespace] = backendServiceInformer.Lister()
+		w.informersSynced = append(w.informersSynced, backendServiceInformer.Informer().HasSynced)
+	}
+}
+
+// watchEndpointSlices adds the informers over the endpoint slices of the given namespaces
+func (w *watcher) watchEndpointSlices(namespaces []string) {
+	w.endpointSliceListers = make(map[string]discoverylisters.EndpointSliceLister)
+
+	for _, namespace := range namespaces {
+		endpointSliceInformer := w.podFactories[namespace].Discovery().V1beta1().EndpointSlices()
+		w.addEndpointSliceHandlers(endpointSliceInformer.Informer())
+
+		w.endpointSliceListers[namespace] = endpointSliceInformer.Lister()
+		w.informersSynced = append(w.informersSynced, endpointSliceInformer.Informer().HasSynced)
+	}
+}
+
+func (w *watcher) addServiceHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if svc, ok := obj.(*v1.Service); ok {
+				w.enqueue(watchEvent{service: serviceKey(svc)})
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if svc, ok := newObj.(*v1.Service); ok {
+				w.enqueue(watchEvent{service: serviceKey(svc)})
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if svc, ok := deletedObject(obj).(*v1.Service); ok {
+				w.enqueue(watchEvent{service: serviceKey(svc), deleted: true})
+			}
+		},
+	})
+}
+
+func (w *watcher) addIngressHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ing, ok := toIngress(obj); ok {
+				w.enqueue(watchEvent{service: ingressKey(ing)})
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if ing, ok := toIngress(newObj); ok {
+				w.enqueue(watchEvent{service: ingressKey(ing)})
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if ing, ok := toIngress(deletedObject(obj)); ok {
+				w.enqueue(watchEvent{service: ingressKey(ing), deleted: true})
+			}
+		},
+	})
+}
+
+func (w *watcher) addInterlookServiceHandlers(informer cache.SharedIndexInformer) {
+	key := func(obj interface{}) (string, bool) {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return "", false
+		}
+		return interlookServiceKeyPrefix + u.GetNamespace() + "/" + u.GetName(), true
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if key, ok := key(obj); ok {
+				w.enqueue(watchEvent{service: key})
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSvc, _ := oldObj.(*unstructured.Unstructured)
+			newSvc, ok := newObj.(*unstructured.Unstructured)
+			// status updates written by the provider itself do not change the service definition
+			if ok && oldSvc != nil && oldSvc.GetResourceVersion() != newSvc.GetResourceVersion() &&
+				reflect.DeepEqual(oldSvc.Object["spec"], newSvc.Object["spec"]) &&
+				reflect.DeepEqual(oldSvc.GetLabels(), newSvc.GetLabels()) {
+				return
+			}
+			if key, ok := key(newObj); ok {
+				w.enqueue(watchEvent{service: key})
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if key, ok := key(deletedObject(obj)); ok {
+				w.enqueue(watchEvent{service: key, deleted: true})
+			}
+		},
+	})
+}
+
+func (w *watcher) addBackendServiceHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if svc, ok := obj.(*v1.Service); ok {
+				w.enqueueServiceBackends(svc.Namespace, svc.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if svc, ok := newObj.(*v1.Service); ok {
+				w.enqueueServiceBackends(svc.Namespace, svc.Name)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if svc, ok := deletedObject(obj).(*v1.Service); ok {
+				w.enqueueServiceBackends(svc.Namespace, svc.Name)
+			}
+		},
+	})
+}
+
+func (w *watcher) addEndpointSliceHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if slice, ok := obj.(*discovery.EndpointSlice); ok {
+				w.enqueueSliceService(slice)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if slice, ok := newObj.(*discovery.EndpointSlice); ok {
+				w.enqueueSliceService(slice)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if slice, ok := deletedObject(obj).(*discovery.EndpointSlice); ok {
+				w.enqueueSliceService(slice)
+			}
+		},
+	})
+}
+
+func (w *watcher) addPodHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*v1.Pod); ok {
+				w.enqueuePodServices(pod)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPod, _ := oldObj.(*v1.Pod)
+			newPod, ok := newObj.(*v1.Pod)
+			if !ok || (oldPod != nil && oldPod.ResourceVersion == newPod.ResourceVersion) {
+				return
+			}
+			if oldPod != nil && !reflect.DeepEqual(oldPod.Labels, newPod.Labels) {
+				w.enqueuePodServices(oldPod)
+			}
+			w.enqueuePodServices(newPod)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if pod, ok := deletedObject(obj).(*v1.Pod); ok {
+				w.enqueuePodServices(pod)
+			}
+		},
+	})
+}
+
+func (w *watcher) addNodeHandlers(informer cache.SharedIndexInformer) {
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, _ := oldObj.(*v1.Node)
+			newNode, ok := newObj.(*v1.Node)
+			if !ok || oldNode == nil || reflect.DeepEqual(oldNode.Status.Addresses, newNode.Status.Addresses) {
+				return
+			}
+			w.enqueue(watchEvent{resync: true})
+		},
+		DeleteFunc: func(obj interface{}) {
+			w.enqueue(watchEvent{resync: true})
+		},
+	})
+}
+
+// start the informers and wait for the caches to be filled
+func (w *watcher) start() error {
+	for _, factory := range w.factories {
+		factory.Start(w.stopCh)
+	}
+	for _, factory := range w.dynamicFactories {
+		factory.Start(w.stopCh)
+	}
+
+	if !cache.WaitForCacheSync(w.stopCh, w.informersSynced...) {
+		return errors.New("could not sync kubernetes informers cache")
+	}
+
+	log.Infof("%v informers synced", extensionName)
+	return nil
+}
+
+func (w *watcher) stop() {
+	close(w.stopCh)
+}
+
+// enqueue sends the event to the provider loop unless the watcher is stopped
+func (w *watcher) enqueue(event watchEvent) {
+	select {
+	case w.events <- event:
+	case <-w.stopCh:
+	}
+}
+
+// enqueuePodServices enqueues the watched services selecting the given pod
+func (w *watcher) enqueuePodServices(pod *v1.Pod) {
+	services, err := w.listServices(pod.Namespace)
+	if err != nil {
+		log.Errorf("error listing services from cache: %v", err)
+		return
+	}
+
+	for _, svc := range services {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			w.enqueue(watchEvent{service: serviceKey(svc)})
+		}
+	}
+
+	w.enqueuePodBackends(pod)
+}
+
+// backendRef links an ingress or interlook service to the service it uses as backend
+type backendRef struct {
+	key     string
+	service string
+}
+
+// backendRefs returns the backend services referenced by the watched ingresses and interlook services of the namespace
+func (w *watcher) backendRefs(namespace string) (refs []backendRef) {
+	ingresses, err := w.listIngresses(namespace)
+	if err != nil {
+		log.Errorf("error listing ingresses from cache: %v", err)
+	}
+	for _, ing := range ingresses {
+		for _, backend := range ingressBackends(ing) {
+			refs = append(refs, backendRef{key: ingressKey(ing), service: backend.Name})
+		}
+	}
+
+	services, err := w.listInterlookServices(namespace)
+	if err != nil {
+		log.Errorf("error listing interlook services from cache: %v", err)
+	}
+	for _, svc := range services {
+		refs = append(refs, backendRef{key: interlookServiceKey(svc), service: svc.Spec.Service})
+	}
+
+	return refs
+}
+
+// enqueuePodBackends enqueues the watched ingresses and interlook services whose backend service selects the given pod
+func (w *watcher) enqueuePodBackends(pod *v1.Pod) {
+	enqueued := make(map[string]bool)
+	for _, ref := range w.backendRefs(pod.Namespace) {
+		if enqueued[ref.key] {
+			continue
+		}
+		svc, ok := w.getBackendService(pod.Namespace, ref.service)
+		if !ok || len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(svc.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			enqueued[ref.key] = true
+			w.enqueue(watchEvent{service: ref.key})
+		}
+	}
+}
+
+// enqueueSliceService enqueues the watched service owning the endpoint slice and the ingresses and interlook services
+// referencing it
+func (w *watcher) enqueueSliceService(slice *discovery.EndpointSlice) {
+	name := slice.Labels[discovery.LabelServiceName]
+	if name == "" {
+		return
+	}
+
+	if svc, ok := w.getService(slice.Namespace, name); ok {
+		w.enqueue(watchEvent{service: serviceKey(svc)})
+	}
+
+	w.enqueueServiceBackends(slice.Namespace, name)
+}
+
+// enqueueServiceBackends enqueues the watched ingresses and interlook services referencing the given service as backend
+func (w *watcher) enqueueServiceBackends(namespace, name string) {
+	enqueued := make(map[string]bool)
+	for _, ref := range w.backendRefs(namespace) {
+		if ref.service == name && !enqueued[ref.key] {
+			enqueued[ref.key] = true
+			w.enqueue(watchEvent{service: ref.key})
+		}
+	}
+}
+
+// serviceLister returns the lister holding the given namespace's services
+func (w *watcher) serviceLister(namespace string) (corelisters.ServiceLister, bool) {
+	if lister, ok := w.serviceListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.serviceListers[namespace]
+	return lister, ok
+}
+
+// podLister returns the lister holding the given namespace's pods
+func (w *watcher) podLister(namespace string) (corelisters.PodLister, bool) {
+	if lister, ok := w.podListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.podListers[namespace]
+	return lister, ok
+}
+
+// listServices returns the watched services of the given namespace, all of them for metav1.NamespaceAll
+func (w *watcher) listServices(namespace string) (res []*v1.Service, err error) {
+	if namespace == metav1.NamespaceAll {
+		for _, lister := range w.serviceListers {
+			services, err := lister.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, services...)
+		}
+		return res, nil
+	}
+
+	lister, ok := w.serviceLister(namespace)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Services(namespace).List(labels.Everything())
+}
+
+// listPods returns the pods of the given namespace matching the selector
+func (w *watcher) listPods(namespace string, selector labels.Selector) ([]*v1.Pod, error) {
+	lister, ok := w.podLister(namespace)
+	if !ok {
+		return nil, nil
+	}
+	return lister.Pods(namespace).List(selector)
+}
+
+// getService returns the watched service
+func (w *watcher) getService(namespace, name string) (*v1.Service, bool) {
+	lister, ok := w.serviceLister(namespace)
+	if !ok {
+		return nil, false
+	}
+
+	svc, err := lister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return svc, true
+}
+
+// ingressLister returns the lister holding the given namespace's ingresses
+func (w *watcher) ingressLister(namespace string) (cache.GenericLister, bool) {
+	if lister, ok := w.ingressListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.ingressListers[namespace]
+	return lister, ok
+}
+
+// backendServiceLister returns the lister holding all the given namespace's services
+func (w *watcher) backendServiceLister(namespace string) (corelisters.ServiceLister, bool) {
+	if lister, ok := w.backendServiceListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.backendServiceListers[namespace]
+	return lister, ok
+}
+
+// listIngresses returns the watched ingresses of the given namespace, all of them for metav1.NamespaceAll
+func (w *watcher) listIngresses(namespace string) (res []*networkingv1.Ingress, err error) {
+	var objects []runtime.Object
+
+	if namespace == metav1.NamespaceAll {
+		for _, lister := range w.ingressListers {
+			list, err := lister.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, list...)
+		}
+	} else if lister, ok := w.ingressLister(namespace); ok {
+		objects, err = lister.ByNamespace(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, obj := range objects {
+		if ing, ok := toIngress(obj); ok {
+			res = append(res, ing)
+		}
+	}
+
+	return res, nil
+}
+
+// endpointSliceLister returns the lister holding the given namespace's endpoint slices
+func (w *watcher) endpointSliceLister(namespace string) (discoverylisters.EndpointSliceLister, bool) {
+	if lister, ok := w.endpointSliceListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.endpointSliceListers[namespace]
+	return lister, ok
+}
+
+// listEndpointSlices returns the endpoint slices of the given namespace matching the selector
+func (w *watcher) listEndpointSlices(namespace string, selector labels.Selector) ([]*discovery.EndpointSlice, error) {
+	lister, ok := w.endpointSliceLister(namespace)
+	if !ok {
+		return nil, nil
+	}
+	return lister.EndpointSlices(namespace).List(selector)
+}
+
+// interlookServiceLister returns the lister holding the given namespace's interlook services
+func (w *watcher) interlookServiceLister(namespace string) (cache.GenericLister, bool) {
+	if lister, ok := w.interlookServiceListers[metav1.NamespaceAll]; ok {
+		return lister, true
+	}
+	lister, ok := w.interlookServiceListers[namespace]
+	return lister, ok
+}
+
+// listInterlookServices returns the watched interlook services of the given namespace, all of them for metav1.NamespaceAll
+func (w *watcher) listInterlookServices(namespace string) (res []*interlookService, err error) {
+	var objects []runtime.Object
+
+	if namespace == metav1.NamespaceAll {
+		for _, lister := range w.interlookServiceListers {
+			list, err := lister.List(labels.Everything())
+			if err != nil {
+				return nil, err
+			}
+			objects = append(objects, list...)
+		}
+	} else if lister, ok := w.interlookServiceLister(namespace); ok {
+		objects, err = lister.ByNamespace(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, obj := range objects {
+		svc, err := toInterlookService(obj)
+		if err != nil {
+			log.Warn(err.Error())
+			continue
+		}
+		res = append(res, svc)
+	}
+
+	return res, nil
+}
+
+// getInterlookService returns the watched interlook service
+func (w *watcher) getInterlookService(namespace, name string) (runtime.Object, error) {
+	lister, ok := w.interlookServiceLister(namespace)
+	if !ok {
+		return nil, errors.New("namespace " + namespace + " is not watched")
+	}
+
+	return lister.ByNamespace(namespace).Get(name)
+}
+
+// getIngress returns the watched ingress
+func (w *watcher) getIngress(namespace, name string) (*networkingv1.Ingress, bool) {
+	lister, ok := w.ingressLister(namespace)
+	if !ok {
+		return nil, false
+	}
+
+	obj, err := lister.ByNamespace(namespace).Get(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return toIngress(obj)
+}
+
+// getBackendService returns the service, whatever its labels
+func (w *watcher) getBackendService(namespace, name string) (*v1.Service, bool) {
+	lister, ok := w.backendServiceLister(namespace)
+	if !ok {
+		return nil, false
+	}
+
+	svc, err := lister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, false
+	}
+
+	return svc, true
+}
+
+// deletedObject unwraps the object from a tombstone
+func deletedObject(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// handleWatchEvent pushes the current definition of the service(s) to the core
+func (p *Extension) handleWatchEvent(event watchEvent) {
+	if event.resync {
+		services, err := p.watcher.listServices(metav1.NamespaceAll)
+		if err != nil {
+			log.Errorf("error listing services from cache: %v", err)
+			return
+		}
+		for _, svc := range services {
+			p.sendService(svc)
+		}
+
+		ingresses, err := p.watcher.listIngresses(metav1.NamespaceAll)
+		if err != nil {
+			log.Errorf("error listing ingresses from cache: %v", err)
+			return
+		}
+		for _, ing := range ingresses {
+			p.sendIngress(ing)
+		}
+
+		interlookServices, err := p.watcher.listInterlookServices(metav1.NamespaceAll)
+		if err != nil {
+			log.Errorf("error listing interlook services from cache: %v", err)
+			return
+		}
+		for _, svc := range interlookServices {
+			p.sendInterlookService(svc)
+		}
+		return
+	}
+
+	if isIngressKey(event.service) {
+		p.handleIngressEvent(event)
+		return
+	}
+
+	if isInterlookServiceKey(event.service) {
+		p.handleInterlookServiceEvent(event)
+		return
+	}
+
+	svc, ok, err := p.getServiceByName(event.service)
+	if err != nil {
+		log.Warnf("Could not get k8s service %v, keeping its current state: %v", event.service, err)
+		return
+	}
+	if event.deleted || !ok {
+		// services never pushed (ie not eligible) are unknown to the core
+		if p.watcher.pushed[event.service] {
+			log.Infof("k8s service %v deleted, send delete", event.service)
+			delete(p.watcher.pushed, event.service)
+			p.send <- comm.BuildDeleteMessage(event.service)
+		}
+		return
+	}
+
+	p.sendService(svc)
+}
+
+// sendService pushes the service definition to the core if it is valid
+// a previously pushed service that is no more eligible is deleted
+func (p *Extension) sendService(svc *v1.Service) {
+	if !p.isServiceEligible(svc) {
+		if p.watcher.pushed[serviceKey(svc)] {
+			log.Infof("k8s service %v is no more eligible, send delete", serviceKey(svc))
+			delete(p.watcher.pushed, serviceKey(svc))
+			p.send <- comm.BuildDeleteMessage(serviceKey(svc))
+		}
+		return
+	}
+
+	msg, err := p.buildMessageFromService(svc)
+	if err != nil {
+		log.Warnf("error building message for service %v %v", serviceKey(svc), err.Error())
+		return
+	}
+
+	p.watcher.pushed[serviceKey(svc)] = true
+	p.send <- msg
+}
@@ -0,0 +1,143 @@
+package kubernetes
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// receiveMessage waits for a message matching the given service name and action
+func receiveMessage(t *testing.T, send chan comm.Message, svcName, action string) comm.Message {
+	return waitMessage(t, send, svcName, action, func(comm.Message) bool { return true })
+}
+
+// waitMessage waits for a message matching the given service name and action and the match function
+// informers may push several times the same definition before the expected one
+func waitMessage(t *testing.T, send chan comm.Message, svcName, action string, match func(comm.Message) bool) comm.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-send:
+			if msg.Service.Name == svcName && msg.Action == action && match(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no message received for %v", svcName)
+		}
+	}
+}
+
+func TestExtension_Watch(t *testing.T) {
+	p := initTests()
+	p.Watch = true
+	p.LabelSelector = []string{"l7aas"}
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	got := receiveMessage(t, send, "default/dummyNPSvc", comm.AddAction)
+	if !reflect.DeepEqual(got, msgOK) {
+		t.Errorf("Msg = %v, want %v", got, msgOK)
+	}
+
+	// a new pod is reflected in the service targets
+	dummyPod3 := dummyPod1.DeepCopy()
+	dummyPod3.Name = "dummypod-3"
+	dummyPod3.Status.HostIP = "10.32.2.3"
+	if _, err := p.cli.CoreV1().Pods("default").Create(context.Background(), dummyPod3, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitMessage(t, send, "default/dummyNPSvc", comm.AddAction, func(msg comm.Message) bool {
+		return len(msg.Service.Targets) == 3
+	})
+
+	// deleting the service sends a delete message
+	if err := p.cli.CoreV1().Services("default").Delete(context.Background(), "dummyNPSvc", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got = receiveMessage(t, send, "default/dummyNPSvc", comm.DeleteAction)
+	if !reflect.DeepEqual(got, comm.BuildDeleteMessage("default/dummyNPSvc")) {
+		t.Errorf("Msg = %v, want delete", got)
+	}
+}
+
+func TestExtension_WatchRefreshService(t *testing.T) {
+	p := initTests()
+	p.Watch = true
+	rec, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	// drain the initial add events
+	receiveMessage(t, send, "default/dummyNPSvc", comm.AddAction)
+
+	go func() {
+		rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "default/notfound"}}
+	}()
+	receiveMessage(t, send, "default/notfound", comm.DeleteAction)
+
+	if _, ok, _ := p.getServiceByName("default/dummyNPSvc"); !ok {
+		t.Errorf("getServiceByName() did not find dummyNPSvc in cache")
+	}
+}
+
+func Test_deletedObject(t *testing.T) {
+	svc := &v1.Service{}
+	if got := deletedObject(svc); got != svc {
+		t.Errorf("deletedObject() = %v, want %v", got, svc)
+	}
+}
+
+func TestExtension_WatchNamespaces(t *testing.T) {
+	p := initTests()
+	p.Watch = true
+	p.Namespaces = []string{"other"}
+	_, send := p.startTestK8s()
+	defer func() { go p.Stop() }()
+
+	otherSvc := dummyNPSvc.DeepCopy()
+	otherSvc.Namespace = "other"
+	otherPod := dummyPod1.DeepCopy()
+	otherPod.Namespace = "other"
+	if _, err := p.cli.CoreV1().Pods("other").Create(context.Background(), otherPod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.cli.CoreV1().Services("other").Create(context.Background(), otherSvc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := receiveMessage(t, send, "other/dummyNPSvc", comm.AddAction)
+	if len(got.Service.Targets) != 1 || got.Service.Targets[0].Host != "10.32.2.1" {
+		t.Errorf("Targets = %v, want only the other namespace's pod", got.Service.Targets)
+	}
+
+	if _, ok, _ := p.getServiceByName("default/dummyNPSvc"); ok {
+		t.Errorf("getServiceByName() found a service from a non watched namespace")
+	}
+}
+
+func TestExtension_handleWatchEventDeleteNotPushed(t *testing.T) {
+	p := initTests()
+	send := make(chan comm.Message, 2)
+	p.send = send
+	p.watcher = &watcher{pushed: map[string]bool{"default/pushed": true}}
+
+	p.handleWatchEvent(watchEvent{service: "default/notpushed", deleted: true})
+	p.handleWatchEvent(watchEvent{service: "default/notpushed"})
+	p.handleWatchEvent(watchEvent{service: "default/pushed", deleted: true})
+
+	if len(send) != 1 {
+		t.Fatalf("%v messages sent, want only the pushed service delete", len(send))
+	}
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildDeleteMessage("default/pushed")) {
+		t.Errorf("Msg = %v, want delete of default/pushed", got)
+	}
+	if p.watcher.pushed["default/pushed"] {
+		t.Errorf("deleted service still flagged as pushed")
+	}
+}
@@ -0,0 +1,70 @@
+// Package labels parses the interlook labels set on docker services and containers
+package labels
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Hosts is the comma separated list of hosts to be published
+	Hosts = "interlook.hosts"
+	// Port is the application's target port
+	Port = "interlook.port"
+	// SSL indicates if the application is ssl exposed
+	SSL = "interlook.ssl"
+	// Workflow is the name of the workflow to follow, the default one if not set
+	Workflow = "interlook.workflow"
+)
+
+// PublishConfig holds the publication settings read from the labels
+type PublishConfig struct {
+	Hosts    []string
+	Port     int
+	TLS      bool
+	Workflow string
+}
+
+// Parse reads the publication settings from the given labels
+// the hosts and tls settings are returned along with the error if the port is invalid
+func Parse(labels map[string]string) (PublishConfig, error) {
+	var cfg PublishConfig
+
+	cfg.Hosts, cfg.TLS = ParseHosts(labels)
+	cfg.Workflow = strings.TrimSpace(labels[Workflow])
+
+	port, err := strconv.Atoi(labels[Port])
+	if err != nil {
+		return cfg, errors.New(fmt.Sprintf("Error converting %v to int (%v). Is %v correctly specified?", labels[Port], err.Error(), Port))
+	}
+	cfg.Port = port
+
+	return cfg, nil
+}
+
+// ParseHosts reads the hosts and tls settings from the given labels
+func ParseHosts(labels map[string]string) (hosts []string, tls bool) {
+	for _, host := range strings.Split(labels[Hosts], ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	tls, _ = strconv.ParseBool(labels[SSL])
+
+	return hosts, tls
+}
+
+// FromTags returns the labels set as key=value tags, as on consul or nomad services
+func FromTags(tags []string) map[string]string {
+	labels := make(map[string]string)
+	for _, tag := range tags {
+		if kv := strings.SplitN(tag, "=", 2); len(kv) == 2 {
+			labels[kv[0]] = kv[1]
+		}
+	}
+	return labels
+}
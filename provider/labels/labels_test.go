@@ -0,0 +1,45 @@
+package labels
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		want    PublishConfig
+		wantErr bool
+	}{
+		{"basic", map[string]string{Hosts: "a.dummy.com", Port: "80"},
+			PublishConfig{Hosts: []string{"a.dummy.com"}, Port: 80}, false},
+		{"hostsAndSSL", map[string]string{Hosts: "a.dummy.com, b.dummy.com,", Port: "443", SSL: "true"},
+			PublishConfig{Hosts: []string{"a.dummy.com", "b.dummy.com"}, Port: 443, TLS: true}, false},
+		{"invalidSSL", map[string]string{Hosts: "a.dummy.com", Port: "80", SSL: "yes"},
+			PublishConfig{Hosts: []string{"a.dummy.com"}, Port: 80}, false},
+		{"workflow", map[string]string{Hosts: "a.dummy.com", Port: "80", Workflow: " internal "},
+			PublishConfig{Hosts: []string{"a.dummy.com"}, Port: 80, Workflow: "internal"}, false},
+		{"invalidPort", map[string]string{Hosts: "a.dummy.com", Port: "http", SSL: "true"},
+			PublishConfig{Hosts: []string{"a.dummy.com"}, TLS: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromTags(t *testing.T) {
+	tags := []string{"interlook.hosts=a.dummy.com,b.dummy.com", "interlook.ssl=true", "urlprefix-/", "a=b=c"}
+	want := map[string]string{Hosts: "a.dummy.com,b.dummy.com", SSL: "true", "a": "b=c"}
+	if got := FromTags(tags); !reflect.DeepEqual(got, want) {
+		t.Errorf("FromTags() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,230 @@
+package nomad
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const requestTimeout = 30 * time.Second
+
+// client queries the nomad HTTP API
+type client struct {
+	address    string
+	token      string
+	region     string
+	namespace  string
+	httpClient *http.Client
+}
+
+// allocationStub is an allocation as listed by /v1/allocations
+type allocationStub struct {
+	ID           string
+	Namespace    string
+	ClientStatus string
+	ModifyIndex  uint64
+}
+
+// allocation is the allocation detail returned by /v1/allocation/:id
+type allocation struct {
+	ID                 string
+	Namespace          string
+	TaskGroup          string
+	ClientStatus       string
+	ModifyIndex        uint64
+	Job                *job
+	AllocatedResources *allocatedResources
+}
+
+type job struct {
+	ID         string
+	TaskGroups []taskGroup
+}
+
+type taskGroup struct {
+	Name     string
+	Services []service
+	Tasks    []task
+}
+
+type task struct {
+	Name     string
+	Services []service
+}
+
+type service struct {
+	Name      string
+	PortLabel string
+	Tags      []string
+}
+
+type allocatedResources struct {
+	Tasks  map[string]taskResources
+	Shared sharedResources
+}
+
+type taskResources struct {
+	Networks []network
+}
+
+// sharedResources holds the group network, ports are listed in Ports since nomad 0.12
+type sharedResources struct {
+	Networks []network
+	Ports    []portMapping
+}
+
+type network struct {
+	IP            string
+	ReservedPorts []port
+	DynamicPorts  []port
+}
+
+type port struct {
+	Label string
+	Value int
+}
+
+type portMapping struct {
+	Label  string
+	Value  int
+	HostIP string
+}
+
+// eventFrame is a frame of the event stream, heartbeats are empty frames
+type eventFrame struct {
+	Index  uint64
+	Events []json.RawMessage
+}
+
+func newClient(address, token, region, namespace, tlsCa, tlsCert, tlsKey string) (*client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if tlsCa != "" {
+		ca, err := ioutil.ReadFile(tlsCa)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New(fmt.Sprintf("no certificate found in %v", tlsCa))
+		}
+	}
+
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &client{
+		address:    strings.TrimSuffix(address, "/"),
+		token:      token,
+		region:     region,
+		namespace:  namespace,
+		httpClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// listAllocations returns the allocations of the namespace
+func (c *client) listAllocations(ctx context.Context) ([]allocationStub, error) {
+	var allocs []allocationStub
+	err := c.get(ctx, "/v1/allocations", nil, &allocs)
+	return allocs, err
+}
+
+// getAllocation returns the allocation with its job and allocated resources
+func (c *client) getAllocation(ctx context.Context, id string) (*allocation, error) {
+	alloc := &allocation{}
+	err := c.get(ctx, "/v1/allocation/"+url.PathEscape(id), nil, alloc)
+	return alloc, err
+}
+
+func (c *client) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	res, err := c.do(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// streamEvents follows the allocation events from the given index, onFrame is called for each non empty frame
+// it returns when the stream is closed or the context cancelled
+func (c *client) streamEvents(ctx context.Context, index uint64, onFrame func(eventFrame)) error {
+	query := url.Values{}
+	query.Set("topic", "Allocation")
+	if index > 0 {
+		query.Set("index", fmt.Sprintf("%d", index))
+	}
+
+	res, err := c.do(ctx, "/v1/event/stream", query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var frame eventFrame
+		if err := decoder.Decode(&frame); err != nil {
+			if err == io.EOF {
+				return errors.New("event stream closed")
+			}
+			return err
+		}
+		if len(frame.Events) > 0 {
+			onFrame(frame)
+		}
+	}
+}
+
+func (c *client) do(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.namespace != "" {
+		query.Set("namespace", c.namespace)
+	}
+	if c.region != "" {
+		query.Set("region", c.region)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+
+	if c.token != "" {
+		req.Header.Set("X-Nomad-Token", c.token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, errors.New(fmt.Sprintf("nomad returned %v on %v: %v", res.StatusCode, path, strings.TrimSpace(string(body))))
+	}
+
+	return res, nil
+}
@@ -0,0 +1,351 @@
+// Package nomad publishes the services of the allocations running on nomad
+package nomad
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/log"
+	"github.com/interlook/interlook/provider/labels"
+)
+
+const (
+	extensionName      = "provider.nomad"
+	runningStatus      = "running"
+	watchRetryInterval = 5 * time.Second
+)
+
+// Provider holds the nomad provider configuration
+type Provider struct {
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+	Region  string `yaml:"region"`
+	// namespace to scan, * for all namespaces
+	Namespace    string        `yaml:"namespace"`
+	TLSCa        string        `yaml:"tlsCa"`
+	TLSCert      string        `yaml:"tlsCert"`
+	TLSKey       string        `yaml:"tlsKey"`
+	PollInterval time.Duration `yaml:"pollInterval"`
+	pollTicker   *time.Ticker
+	shutdown     chan bool
+	changes      chan bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	send         chan<- comm.Message
+	client       *client
+	// running allocations, refreshed when their modify index changes
+	allocations map[string]*allocation
+	// services pushed to the core
+	services  map[string]bool
+	waitGroup sync.WaitGroup
+}
+
+func (p *Provider) init() error {
+
+	p.shutdown = make(chan bool)
+	p.changes = make(chan bool, 1)
+	p.allocations = make(map[string]*allocation)
+	p.services = make(map[string]bool)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if p.Address == "" {
+		p.Address = "http://127.0.0.1:4646"
+	}
+
+	if p.Namespace == "" {
+		p.Namespace = "*"
+	}
+
+	if p.PollInterval == time.Duration(0) {
+		p.PollInterval = 30 * time.Second
+	}
+
+	p.pollTicker = time.NewTicker(p.PollInterval)
+
+	var err error
+	p.client, err = newClient(p.Address, p.Token, p.Region, p.Namespace, p.TLSCa, p.TLSCert, p.TLSKey)
+
+	return err
+}
+
+// Start the nomad provider
+func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message) error {
+	log.Infof("Starting %v on %v\n", extensionName, p.Address)
+	p.send = send
+
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	go p.watch()
+
+	p.poll()
+
+	p.waitGroup.Add(1)
+	for {
+		select {
+		case <-p.shutdown:
+			p.cancel()
+			p.pollTicker.Stop()
+			p.waitGroup.Done()
+
+			return nil
+
+		case <-p.pollTicker.C:
+			log.Debug("New poll launched")
+			p.poll()
+
+		case <-p.changes:
+			log.Debug("nomad allocations changed, new poll launched")
+			p.poll()
+
+		case msg := <-receive:
+			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
+			switch msg.Action {
+			case comm.RefreshAction:
+				log.Debugf("Request to refresh service %v", msg.Service.Name)
+				p.RefreshService(msg)
+			default:
+				log.Warnf("Unhandled action requested: %v", msg.Action)
+			}
+		}
+	}
+}
+
+// Stop the nomad provider
+func (p *Provider) Stop() error {
+	log.Debug("Stopping nomad provider")
+	p.shutdown <- true
+	p.waitGroup.Wait()
+
+	return nil
+}
+
+// watch follows the allocation events and requests a poll on each of them
+// the stream is re-established on error, from the last received index, until the provider is stopped
+func (p *Provider) watch() {
+	var index uint64
+
+	for {
+		log.Infof("%v subscribing to nomad allocation events", extensionName)
+		err := p.client.streamEvents(p.ctx, index, func(frame eventFrame) {
+			log.Debugf("%v received %v nomad events at index %v", extensionName, len(frame.Events), frame.Index)
+			index = frame.Index
+			p.notifyChange()
+		})
+
+		select {
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+
+		log.Warnf("%v nomad event stream failed: %v", extensionName, err)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// notifyChange requests a poll, changes received while a poll is pending are merged
+func (p *Provider) notifyChange() {
+	select {
+	case p.changes <- true:
+	default:
+	}
+}
+
+// poll sends the services of the running allocations to the core
+// services without running allocation are deleted
+func (p *Provider) poll() {
+	msgs, err := p.buildMessages()
+	if err != nil {
+		log.Errorf("Querying nomad allocations %v", err.Error())
+		return
+	}
+
+	for name := range p.services {
+		if _, ok := msgs[name]; !ok {
+			log.Infof("nomad service %v has no running allocation, send delete", name)
+			delete(p.services, name)
+			p.send <- comm.BuildDeleteMessage(name)
+		}
+	}
+
+	var names []string
+	for name := range msgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p.services[name] = true
+		p.send <- msgs[name]
+	}
+}
+
+// RefreshService sends an updated state for a given service
+func (p *Provider) RefreshService(msg comm.Message) {
+	msgs, err := p.buildMessages()
+	if err != nil {
+		log.Errorf("Error building message for %v: %v", msg.Service.Name, err)
+		return
+	}
+
+	newMsg, ok := msgs[msg.Service.Name]
+	if !ok {
+		log.Debugf("nomad service %v not found, send delete", msg.Service.Name)
+		delete(p.services, msg.Service.Name)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	p.services[msg.Service.Name] = true
+	p.send <- newMsg
+}
+
+// refreshAllocations lists the running allocations and gets the detail of the new or modified ones
+func (p *Provider) refreshAllocations() error {
+	stubs, err := p.client.listAllocations(p.ctx)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]*allocation)
+	for _, stub := range stubs {
+		if stub.ClientStatus != runningStatus {
+			continue
+		}
+
+		alloc, ok := p.allocations[stub.ID]
+		if !ok || alloc.ModifyIndex != stub.ModifyIndex {
+			if alloc, err = p.client.getAllocation(p.ctx, stub.ID); err != nil {
+				return err
+			}
+		}
+		running[stub.ID] = alloc
+	}
+
+	p.allocations = running
+
+	return nil
+}
+
+// buildMessages groups the targets of the running allocations by service name
+func (p *Provider) buildMessages() (map[string]comm.Message, error) {
+	if err := p.refreshAllocations(); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for id := range p.allocations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	msgs := make(map[string]comm.Message)
+	for _, id := range ids {
+		alloc := p.allocations[id]
+		for _, svc := range alloc.services() {
+			tagLabels := labels.FromTags(svc.Tags)
+			hosts, tls := labels.ParseHosts(tagLabels)
+			if len(hosts) == 0 {
+				continue
+			}
+
+			host, port, ok := alloc.resolvePort(svc.task, svc.PortLabel)
+			if !ok {
+				log.Warnf("could not resolve port %v of service %v in allocation %v", svc.PortLabel, svc.Name, alloc.ID)
+				continue
+			}
+
+			msg, ok := msgs[svc.Name]
+			if !ok {
+				msg = comm.Message{
+					Action: comm.AddAction,
+					Service: comm.Service{
+						Name:       svc.Name,
+						Provider:   extensionName,
+						DNSAliases: hosts,
+						TLS:        tls,
+						Workflow:   strings.TrimSpace(tagLabels[labels.Workflow]),
+					}}
+			}
+			msg.Service.Targets = append(msg.Service.Targets, comm.Target{Host: host, Port: uint32(port)})
+			msgs[svc.Name] = msg
+		}
+	}
+
+	return msgs, nil
+}
+
+// allocService is a service of the allocation's task group, or of one of its tasks
+type allocService struct {
+	service
+	task string
+}
+
+// services returns the services of the allocation's task group and tasks
+func (a *allocation) services() []allocService {
+	var services []allocService
+	if a.Job == nil {
+		return services
+	}
+
+	for _, group := range a.Job.TaskGroups {
+		if group.Name != a.TaskGroup {
+			continue
+		}
+		for _, svc := range group.Services {
+			services = append(services, allocService{service: svc})
+		}
+		for _, t := range group.Tasks {
+			for _, svc := range t.Services {
+				services = append(services, allocService{service: svc, task: t.Name})
+			}
+		}
+	}
+
+	return services
+}
+
+// resolvePort returns the host address and port allocated to the given port label
+// the task's networks are looked up first for task services, then the group network
+func (a *allocation) resolvePort(taskName, label string) (string, int, bool) {
+	if a.AllocatedResources == nil || label == "" {
+		return "", 0, false
+	}
+
+	if taskName != "" {
+		if host, port, ok := networksPort(a.AllocatedResources.Tasks[taskName].Networks, label); ok {
+			return host, port, true
+		}
+	}
+
+	for _, mapping := range a.AllocatedResources.Shared.Ports {
+		if mapping.Label == label {
+			return mapping.HostIP, mapping.Value, true
+		}
+	}
+
+	return networksPort(a.AllocatedResources.Shared.Networks, label)
+}
+
+func networksPort(networks []network, label string) (string, int, bool) {
+	for _, n := range networks {
+		for _, ports := range [][]port{n.ReservedPorts, n.DynamicPorts} {
+			for _, p := range ports {
+				if p.Label == label {
+					return n.IP, p.Value, true
+				}
+			}
+		}
+	}
+	return "", 0, false
+}
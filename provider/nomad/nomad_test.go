@@ -0,0 +1,264 @@
+package nomad
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/interlook/interlook/comm"
+)
+
+var webMsg = comm.Message{
+	Action: comm.AddAction,
+	Service: comm.Service{
+		Name:       "web",
+		Provider:   extensionName,
+		TLS:        true,
+		DNSAliases: []string{"web.dummy.com"},
+		Targets:    []comm.Target{{Host: "10.32.2.1", Port: 23456}, {Host: "10.32.2.2", Port: 8080}},
+	}}
+
+// fakeNomad imitates the allocations and event stream endpoints of the nomad API
+type fakeNomad struct {
+	sync.Mutex
+	allocations map[string]*allocation
+	requests    []string
+	events      chan eventFrame
+}
+
+func newFakeNomad() *fakeNomad {
+	webJob := &job{ID: "web", TaskGroups: []taskGroup{{
+		Name: "web",
+		Services: []service{
+			{Name: "web", PortLabel: "http", Tags: []string{"interlook.hosts=web.dummy.com", "interlook.ssl=true"}},
+			{Name: "web-metrics", PortLabel: "metrics"},
+		},
+		Tasks: []task{{
+			Name:     "admin",
+			Services: []service{{Name: "admin", PortLabel: "admin", Tags: []string{"interlook.hosts=admin.dummy.com"}}},
+		}},
+	}}}
+
+	return &fakeNomad{
+		events: make(chan eventFrame),
+		allocations: map[string]*allocation{
+			// group network, dynamic port
+			"a1": {ID: "a1", TaskGroup: "web", ClientStatus: runningStatus, ModifyIndex: 1, Job: webJob,
+				AllocatedResources: &allocatedResources{
+					Tasks: map[string]taskResources{"admin": {Networks: []network{{IP: "10.32.2.1", DynamicPorts: []port{{Label: "admin", Value: 25000}}}}}},
+					Shared: sharedResources{Ports: []portMapping{
+						{Label: "http", Value: 23456, HostIP: "10.32.2.1"},
+						{Label: "metrics", Value: 23457, HostIP: "10.32.2.1"}}},
+				}},
+			// pre 0.12 group network, static port
+			"a2": {ID: "a2", TaskGroup: "web", ClientStatus: runningStatus, ModifyIndex: 1, Job: webJob,
+				AllocatedResources: &allocatedResources{
+					Shared: sharedResources{Networks: []network{{IP: "10.32.2.2", ReservedPorts: []port{{Label: "http", Value: 8080}}}}},
+				}},
+			"a3": {ID: "a3", TaskGroup: "web", ClientStatus: "complete", ModifyIndex: 1, Job: webJob},
+		},
+	}
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	f.requests = append(f.requests, r.URL.Path)
+	f.Unlock()
+
+	if r.Header.Get("X-Nomad-Token") != "secret" {
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v1/allocations":
+		f.Lock()
+		var stubs []allocationStub
+		for _, alloc := range f.allocations {
+			stubs = append(stubs, allocationStub{ID: alloc.ID, ClientStatus: alloc.ClientStatus, ModifyIndex: alloc.ModifyIndex})
+		}
+		f.Unlock()
+		json.NewEncoder(w).Encode(stubs)
+
+	case strings.HasPrefix(r.URL.Path, "/v1/allocation/"):
+		f.Lock()
+		alloc, ok := f.allocations[strings.TrimPrefix(r.URL.Path, "/v1/allocation/")]
+		f.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(alloc)
+
+	case r.URL.Path == "/v1/event/stream":
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case frame := <-f.events:
+				json.NewEncoder(w).Encode(frame)
+				w.(http.Flusher).Flush()
+			}
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// update changes the allocations and sends an allocation event
+func (f *fakeNomad) update(fn func(allocations map[string]*allocation)) {
+	f.Lock()
+	fn(f.allocations)
+	f.Unlock()
+	f.events <- eventFrame{Index: 2, Events: []json.RawMessage{json.RawMessage(`{"Topic":"Allocation"}`)}}
+}
+
+func (f *fakeNomad) countRequests(path string) int {
+	f.Lock()
+	defer f.Unlock()
+	n := 0
+	for _, r := range f.requests {
+		if r == path {
+			n++
+		}
+	}
+	return n
+}
+
+func newFakeProvider(t *testing.T) (*Provider, *fakeNomad, func()) {
+	f := newFakeNomad()
+	srv := httptest.NewServer(f)
+	p := &Provider{Address: srv.URL, Token: "secret"}
+	if err := p.init(); err != nil {
+		t.Fatal(err)
+	}
+	return p, f, srv.Close
+}
+
+// receiveMessage returns the first message sent by the provider for the given service and action
+func receiveMessage(t *testing.T, send chan comm.Message, name, action string) comm.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-send:
+			if msg.Service.Name == name && msg.Action == action {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %v message received for %v", action, name)
+		}
+	}
+}
+
+func TestAllocation_resolvePort(t *testing.T) {
+	allocs := newFakeNomad().allocations
+	tests := []struct {
+		name     string
+		alloc    *allocation
+		task     string
+		label    string
+		wantHost string
+		wantPort int
+		wantOK   bool
+	}{
+		{"groupPorts", allocs["a1"], "", "http", "10.32.2.1", 23456, true},
+		{"taskNetwork", allocs["a1"], "admin", "admin", "10.32.2.1", 25000, true},
+		{"taskFallbackGroup", allocs["a1"], "admin", "http", "10.32.2.1", 23456, true},
+		{"groupNetwork", allocs["a2"], "", "http", "10.32.2.2", 8080, true},
+		{"unknownLabel", allocs["a2"], "", "grpc", "", 0, false},
+		{"noResources", allocs["a3"], "", "http", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, port, ok := tt.alloc.resolvePort(tt.task, tt.label)
+			if host != tt.wantHost || port != tt.wantPort || ok != tt.wantOK {
+				t.Errorf("resolvePort() = %v, %v, %v, want %v, %v, %v", host, port, ok, tt.wantHost, tt.wantPort, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestProvider_buildMessages(t *testing.T) {
+	p, f, stop := newFakeProvider(t)
+	defer stop()
+
+	got, err := p.buildMessages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := comm.Message{
+		Action: comm.AddAction,
+		Service: comm.Service{
+			Name:       "admin",
+			Provider:   extensionName,
+			DNSAliases: []string{"admin.dummy.com"},
+			Targets:    []comm.Target{{Host: "10.32.2.1", Port: 25000}},
+		}}
+	// a2 has no admin port, the metrics service has no interlook tag
+	if want := map[string]comm.Message{"web": webMsg, "admin": admin}; !reflect.DeepEqual(got, want) {
+		t.Errorf("buildMessages() = %v, want %v", got, want)
+	}
+
+	// unchanged allocations are not fetched again
+	if _, err := p.buildMessages(); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.countRequests("/v1/allocation/a1"); n != 1 {
+		t.Errorf("allocation fetched %v times, want 1", n)
+	}
+}
+
+func TestProvider_buildMessagesError(t *testing.T) {
+	p, _, stop := newFakeProvider(t)
+	defer stop()
+
+	p.client.token = "invalid"
+	if _, err := p.buildMessages(); err == nil {
+		t.Errorf("buildMessages() expected error on denied request")
+	}
+}
+
+func TestProvider_Start(t *testing.T) {
+	f := newFakeNomad()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	p := &Provider{Address: srv.URL, Token: "secret", PollInterval: time.Minute}
+	rec, send := make(chan comm.Message), make(chan comm.Message)
+	go func() {
+		if err := p.Start(rec, send); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer func() { go p.Stop() }()
+
+	receiveMessage(t, send, "web", comm.AddAction)
+
+	// a stopped allocation is removed from the targets without waiting for the poll
+	f.update(func(allocations map[string]*allocation) {
+		allocations["a2"].ClientStatus = "complete"
+	})
+	got := receiveMessage(t, send, "web", comm.AddAction)
+	if want := []comm.Target{{Host: "10.32.2.1", Port: 23456}}; !reflect.DeepEqual(got.Service.Targets, want) {
+		t.Errorf("Targets = %v, want %v", got.Service.Targets, want)
+	}
+
+	// the service is deleted with its last allocation
+	f.update(func(allocations map[string]*allocation) {
+		delete(allocations, "a1")
+	})
+	receiveMessage(t, send, "web", comm.DeleteAction)
+
+	// refresh requests are answered with the current state
+	go func() { rec <- comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "web"}} }()
+	receiveMessage(t, send, "web", comm.DeleteAction)
+}
@@ -4,13 +4,14 @@ import (
 	"fmt"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/interlook/interlook/comm"
+	"github.com/interlook/interlook/provider/labels"
 	"github.com/pkg/errors"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/interlook/interlook/log"
@@ -18,11 +19,16 @@ import (
 )
 
 const (
-	hostsLabel    = "interlook.hosts"
-	portLabel     = "interlook.port"
-	sslLabel      = "interlook.ssl"
+	hostsLabel    = labels.Hosts
+	portLabel     = labels.Port
 	extensionName = "provider.swarm"
 	runningState  = "running"
+	// swarm scoped events (service, node) are only available from API 1.30
+	watchAPIVersion    = "1.30"
+	defaultAPIVersion  = "1.29"
+	watchRetryInterval = 5 * time.Second
+	// give the orchestrator time to schedule the tasks before inspecting an updated service
+	eventSettleDelay = 2 * time.Second
 )
 
 type servicePublishConfig struct {
@@ -34,6 +40,7 @@ type dockerCliInterface interface {
 	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
 	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
 	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
 }
 
 // Provider holds the provider configuration
@@ -45,8 +52,12 @@ type Provider struct {
 	TLSKey                 string        `yaml:"tlsKey"`
 	PollInterval           time.Duration `yaml:"pollInterval"`
 	DefaultPortPublishMode string        `yaml:"defaultPortPublishMode"`
+	Watch                  bool          `yaml:"watch"`
 	pollTicker             *time.Ticker
 	shutdown               chan bool
+	events                 chan events.Message
+	ctx                    context.Context
+	cancel                 context.CancelFunc
 	send                   chan<- comm.Message
 	services               []string
 	servicesLock           sync.RWMutex
@@ -61,12 +72,15 @@ func (p *Provider) init() error {
 	var err error
 
 	p.shutdown = make(chan bool)
-	p.pollTicker = time.NewTicker(p.PollInterval)
+	p.events = make(chan events.Message)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
 
 	if p.PollInterval == time.Duration(0) {
 		p.PollInterval = 15 * time.Second
 	}
 
+	p.pollTicker = time.NewTicker(p.PollInterval)
+
 	p.serviceFilters = filters.NewArgs()
 
 	for _, value := range p.LabelSelector {
@@ -85,9 +99,14 @@ func (p *Provider) init() error {
 }
 
 func (p *Provider) setCli() (err error) {
+	apiVersion := defaultAPIVersion
+	if p.Watch {
+		apiVersion = watchAPIVersion
+	}
+
 	p.cli, err = client.NewClientWithOpts(client.WithTLSClientConfig(p.TLSCa, p.TLSCert, p.TLSKey),
 		client.WithHost(p.Endpoint),
-		client.WithVersion("1.29"),
+		client.WithVersion(apiVersion),
 		client.WithHTTPHeaders(map[string]string{"User-Agent": "interlook"}))
 	if err != nil {
 		return err
@@ -103,10 +122,16 @@ func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message)
 		return err
 	}
 
+	if p.Watch {
+		go p.watch()
+	}
+
 	p.waitGroup.Add(1)
 	for {
 		select {
 		case <-p.shutdown:
+			p.cancel()
+			p.pollTicker.Stop()
 			p.waitGroup.Done()
 
 			return nil
@@ -115,12 +140,18 @@ func (p *Provider) Start(receive <-chan comm.Message, send chan<- comm.Message)
 			log.Debug("New poll launched")
 			p.poll()
 
+		case event := <-p.events:
+			p.handleEvent(event)
+
 		case msg := <-receive:
 			log.Debugf("Received message from core: %v on %v", msg.Action, msg.Service.Name)
 			switch msg.Action {
 			case comm.RefreshAction:
 				log.Debugf("Request to refresh service %v", msg.Service.Name)
 				p.RefreshService(msg)
+			case comm.SnapshotAction:
+				log.Debug("Request to send a snapshot of the services")
+				p.Snapshot(msg)
 			default:
 				log.Warnf("Unhandled action requested: %v", msg.Action)
 			}
@@ -139,7 +170,7 @@ func (p *Provider) Stop() error {
 // poll get the services to be deployed
 // list docker services with filters (interlook.hosts and interlook.port labels)
 // for each, inspect the container(s) to get IPs and ports
-// finally send the info to the core
+// finally send the info to the core, followed by the snapshot of the services found
 func (p *Provider) poll() {
 
 	log.Debugf("looking for services with filters %v", p.serviceFilters)
@@ -150,8 +181,16 @@ func (p *Provider) poll() {
 		return
 	}
 
+	// the services found are kept even if their message could not be built
+	var found []string
 	for _, service := range data {
 		log.Debugf("Swarm service: %v", service)
+		// the services scaled to zero are left out of the snapshot, so that they are un-deployed
+		if isScaledDown(service) {
+			log.Debugf("Swarm service %v scaled to zero", service.Spec.Name)
+			continue
+		}
+		found = append(found, service.Spec.Name)
 		msg, err := p.buildMessageFromService(service)
 		log.Debugf("swarm message %v", msg)
 		if err != nil {
@@ -165,33 +204,178 @@ func (p *Provider) poll() {
 		}
 
 		log.Debugf("%v sent msg %v", extensionName, msg)
+		p.setServiceManaged(msg.Service.Name, true)
 		p.send <- msg
 	}
+
+	// the core un-deploys the services missing from the snapshot
+	p.send <- comm.BuildSnapshotMessage(found)
 }
 
-func (p *Provider) RefreshService(msg comm.Message) {
-	var (
-		newMsg comm.Message
-		err    error
-	)
+// watch subscribes to the swarm service and node events and forwards them to the provider loop
+// the subscription is re-established on error until the provider is stopped
+func (p *Provider) watch() {
+	eventFilters := filters.NewArgs()
+	eventFilters.Add("type", events.ServiceEventType)
+	eventFilters.Add("type", events.NodeEventType)
 
-	if service, ok := p.getServiceByName(msg.Service.Name); ok {
-		newMsg, err = p.buildMessageFromService(service)
-		if err != nil {
-			log.Errorf("Error building message for %v: %v", msg.Service.Name, err)
+	for {
+		log.Infof("%v subscribing to docker events", extensionName)
+		msgs, errs := p.cli.Events(p.ctx, types.EventsOptions{Filters: eventFilters})
+
+	subscription:
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+
+			case err := <-errs:
+				log.Warnf("%v docker events stream closed: %v", extensionName, err)
+				break subscription
+
+			case event := <-msgs:
+				log.Debugf("%v received docker event %v %v on %v", extensionName, event.Type, event.Action, event.Actor.ID)
+				if event.Type == events.ServiceEventType && event.Action != "remove" {
+					// tasks are scheduled asynchronously, delay the inspection of the service
+					p.forwardEvent(event, eventSettleDelay)
+					continue
+				}
+				p.forwardEvent(event, 0)
+			}
 		}
 
-		if newMsg.Service.Name == "" || len(newMsg.Service.Targets) == 0 {
-			log.Debugf("Swarm service %v not found, send delete", msg.Service.Name)
-			newMsg = comm.BuildDeleteMessage(msg.Service.Name)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
 		}
-	} else if !ok {
-		newMsg = comm.BuildDeleteMessage(msg.Service.Name)
 	}
+}
 
-	p.send <- newMsg
+// forwardEvent sends the event to the provider loop after the given delay
+func (p *Provider) forwardEvent(event events.Message, delay time.Duration) {
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		select {
+		case <-p.ctx.Done():
+		case p.events <- event:
+		}
+	}()
+}
+
+// handleEvent pushes an up to date definition of the service affected by the event
+// node events trigger a full poll as any service's targets may have changed
+func (p *Provider) handleEvent(event events.Message) {
+	switch event.Type {
+	case events.NodeEventType:
+		p.poll()
+
+	case events.ServiceEventType:
+		svcName := event.Actor.Attributes["name"]
+		if svcName == "" {
+			log.Warnf("%v service event without service name %v", extensionName, event.Actor.ID)
+			return
+		}
+
+		if event.Action != "remove" {
+			service, found, err := p.getServiceByName(svcName)
+			if err != nil {
+				log.Warnf("Could not get service %v, keeping its current state: %v", svcName, err)
+				return
+			}
+			if found && !isScaledDown(service) {
+				p.pushService(service)
+				return
+			}
+		}
+
+		// only un-deploy services that were pushed by this provider
+		if p.isServiceManaged(svcName) {
+			log.Debugf("Swarm service %v is gone, send delete", svcName)
+			p.setServiceManaged(svcName, false)
+			p.send <- comm.BuildDeleteMessage(svcName)
+		}
+	}
+}
+
+// setServiceManaged keeps track of the services pushed to the core
+func (p *Provider) setServiceManaged(svcName string, managed bool) {
+	p.servicesLock.Lock()
+	defer p.servicesLock.Unlock()
+
+	for k, v := range p.services {
+		if v == svcName {
+			if !managed {
+				p.services = append(p.services[:k], p.services[k+1:]...)
+			}
+			return
+		}
+	}
+
+	if managed {
+		p.services = append(p.services, svcName)
+	}
+}
+
+func (p *Provider) isServiceManaged(svcName string) bool {
+	p.servicesLock.RLock()
+	defer p.servicesLock.RUnlock()
+
+	return sliceContainString(svcName, p.services)
+}
+
+// Snapshot sends the services found, followed by the snapshot of their names
+func (p *Provider) Snapshot(msg comm.Message) {
+	p.poll()
+}
+
+// RefreshService pushes an up to date definition of the service
+// a delete is sent only if docker confirms the service does not exist
+func (p *Provider) RefreshService(msg comm.Message) {
+	service, found, err := p.getServiceByName(msg.Service.Name)
+	if err != nil {
+		log.Warnf("Could not get service %v, keeping its current state: %v", msg.Service.Name, err)
+		return
+	}
+
+	if !found || isScaledDown(service) {
+		log.Debugf("Swarm service %v not found or scaled to zero, send delete", msg.Service.Name)
+		p.setServiceManaged(msg.Service.Name, false)
+		p.send <- comm.BuildDeleteMessage(msg.Service.Name)
+		return
+	}
+
+	p.pushService(service)
+}
+
+// pushService sends the definition of an existing service
+// a service without running task (ie during a rolling update) keeps its current state
+func (p *Provider) pushService(service swarm.Service) {
+	msg, err := p.buildMessageFromService(service)
+	if err != nil {
+		log.Warnf("Error building message for service %v %v", service.Spec.Name, err.Error())
+		return
+	}
+
+	if len(msg.Service.Targets) == 0 {
+		log.Debugf("No running task found for service %v, keeping its current state", service.Spec.Name)
+		return
+	}
+
+	p.setServiceManaged(msg.Service.Name, true)
+	p.send <- msg
+}
 
-	return
+// isScaledDown returns true if the replicated service was scaled to zero replicas
+// unlike a service without running task (ie during a rolling update), it is un-deployed
+func isScaledDown(service swarm.Service) bool {
+	replicated := service.Spec.Mode.Replicated
+	return replicated != nil && replicated.Replicas != nil && *replicated.Replicas == 0
 }
 
 func (p *Provider) getFilteredServices() (services []swarm.Service, err error) {
@@ -208,7 +392,9 @@ func (p *Provider) getFilteredServices() (services []swarm.Service, err error) {
 	return data, nil
 }
 
-func (p *Provider) getServiceByName(svcName string) (swarm.Service, bool) {
+// getServiceByName returns the service matching the name and the provider filters
+// found is false only if docker answered without such service
+func (p *Provider) getServiceByName(svcName string) (service swarm.Service, found bool, err error) {
 
 	ctx := context.Background()
 
@@ -219,14 +405,13 @@ func (p *Provider) getServiceByName(svcName string) (swarm.Service, bool) {
 	p.serviceFilters.Del("name", svcName)
 
 	if err != nil {
-		log.Errorf("Error getting service %v : %v", svcName, err)
-		return swarm.Service{}, false
+		return swarm.Service{}, false, errors.Wrapf(err, "error getting service %v", svcName)
 	}
 
 	if len(services) == 0 {
-		return swarm.Service{}, false
+		return swarm.Service{}, false, nil
 	}
-	return services[0], true
+	return services[0], true, nil
 }
 
 func (p *Provider) getTaskPublishInfo(svcName string) (publishConfig []servicePublishConfig, err error) {
@@ -296,21 +481,22 @@ func (p *Provider) getNodeIP(nodeID string) (IP string, err error) {
 
 func (p *Provider) buildMessageFromService(service swarm.Service) (comm.Message, error) {
 
-	tlsService, _ := strconv.ParseBool(service.Spec.Labels[sslLabel])
+	publishConfig, err := labels.Parse(service.Spec.Labels)
 
 	msg := comm.Message{
 		Action: comm.AddAction,
 		Service: comm.Service{
 			Name:       service.Spec.Name,
 			Provider:   extensionName,
-			DNSAliases: strings.Split(service.Spec.Labels[hostsLabel], ","),
-			TLS:        tlsService,
+			DNSAliases: publishConfig.Hosts,
+			TLS:        publishConfig.TLS,
+			Workflow:   publishConfig.Workflow,
 		}}
 
-	targetPort, err := strconv.Atoi(service.Spec.Labels[portLabel])
 	if err != nil {
-		return msg, errors.New(fmt.Sprintf("Error converting %v to int (%v). Is %v correctly specified?", service.Spec.Labels[portLabel], err.Error(), portLabel))
+		return msg, err
 	}
+	targetPort := publishConfig.Port
 
 	// get host published hosts / ports
 	pubPortInfo, err := p.getTaskPublishInfo(service.Spec.Name)
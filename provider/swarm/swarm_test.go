@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/interlook/interlook/comm"
@@ -38,6 +39,9 @@ type fakeClient struct {
 	manualOverride    bool
 	negotiateVersion  bool
 	negotiated        bool
+	events            chan events.Message
+	// the services listed are scaled to zero replicas
+	scaledDown bool
 }
 
 func newFakeProvider() Provider {
@@ -52,7 +56,11 @@ func newFakeProvider() Provider {
 }
 
 func newFakeClient() *fakeClient {
-	return &fakeClient{}
+	return &fakeClient{events: make(chan events.Message)}
+}
+
+func (f *fakeClient) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return f.events, make(chan error)
 }
 
 func (f *fakeClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
@@ -61,11 +69,38 @@ func (f *fakeClient) ServiceList(ctx context.Context, options types.ServiceListO
 		if svc[0] == "invalid" {
 			return []swarm.Service{swarm.Service{}}, errors.New("not found")
 		}
+		if svc[0] == "missing" {
+			return nil, nil
+		}
+		if svc[0] == "scaling" {
+			scaling := testService
+			scaling.Spec.Annotations.Name = "scaling"
+			return []swarm.Service{scaling}, nil
+		}
+		if svc[0] == "scaleddown" {
+			return []swarm.Service{scaledDownService("scaleddown")}, nil
+		}
+	}
+	if f.scaledDown {
+		return []swarm.Service{scaledDownService(testService.Spec.Name)}, nil
 	}
 	return []swarm.Service{testService}, nil
 }
 
+// scaledDownService returns the test service scaled to zero replicas
+func scaledDownService(name string) swarm.Service {
+	var replicas uint64
+	service := testService
+	service.Spec.Annotations.Name = name
+	service.Spec.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	return service
+}
+
 func (f *fakeClient) TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error) {
+	// no task running yet, ie during a rolling update
+	if options.Filters.ExactMatch("service", "scaling") {
+		return nil, nil
+	}
 	node1Task := swarm.Task{
 		ID:   "testServiceNode1Task",
 		Meta: swarm.Meta{},
@@ -325,20 +360,29 @@ func TestProvider_getServiceByName(t *testing.T) {
 		svcName string
 	}
 	tests := []struct {
-		name   string
-		pr     Provider
-		args   args
-		want   swarm.Service
-		wantOK bool
+		name    string
+		args    args
+		want    swarm.Service
+		wantOK  bool
+		wantErr bool
 	}{
-		{"found", newFakeProvider(), args{svcName: "test"}, testService, true},
-		{"notFound", newFakeProvider(), args{svcName: "invalid"}, swarm.Service{}, false},
+		{"found", args{svcName: "test"}, testService, true, false},
+		{"notFound", args{svcName: "missing"}, swarm.Service{}, false, false},
+		{"error", args{svcName: "invalid"}, swarm.Service{}, false, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got, _ := tt.pr.getServiceByName(tt.args.svcName); !reflect.DeepEqual(got, tt.want) {
+			p := newFakeProvider()
+			got, ok, err := p.getServiceByName(tt.args.svcName)
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("getServiceByName() = %v, want %v", got, tt.want)
 			}
+			if ok != tt.wantOK {
+				t.Errorf("getServiceByName() found = %v, want %v", ok, tt.wantOK)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("getServiceByName() error = %v, wantErr %v", err, tt.wantErr)
+			}
 		})
 	}
 }
@@ -455,7 +499,7 @@ func TestProvider_RefreshService(t *testing.T) {
 	msgDelete := comm.Message{
 		Action: comm.DeleteAction,
 		Service: comm.Service{
-			Name: "invalid",
+			Name: "missing",
 			//Port: 80,
 		},
 	}
@@ -473,7 +517,7 @@ func TestProvider_RefreshService(t *testing.T) {
 		{"delete", newFakeProvider(), args{msg: msgDelete}, comm.Message{
 			Action: comm.DeleteAction,
 			Service: comm.Service{
-				Name: "invalid",
+				Name: "missing",
 			},
 		}},
 	}
@@ -491,6 +535,23 @@ func TestProvider_RefreshService(t *testing.T) {
 	}
 }
 
+func TestProvider_RefreshServiceError(t *testing.T) {
+	p := newFakeProvider()
+	send := make(chan comm.Message, 1)
+	p.send = send
+	p.setServiceManaged("invalid", true)
+
+	// the service is kept as is if docker could not be queried
+	p.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "invalid"}})
+
+	if len(send) != 0 {
+		t.Errorf("unexpected message sent on docker error: %v", <-send)
+	}
+	if !p.isServiceManaged("invalid") {
+		t.Errorf("service no longer managed after docker error")
+	}
+}
+
 //add test for refresh msg in provider.start
 func TestProvider_SendRefreshRequest(t *testing.T) {
 	var (
@@ -564,6 +625,79 @@ func TestProvider_poll(t *testing.T) {
 	}
 }
 
+func TestProvider_pollSnapshot(t *testing.T) {
+	p := newFakeProvider()
+	send := make(chan comm.Message, 10)
+	p.send = send
+
+	p.poll()
+
+	var got []comm.Message
+	for len(send) > 0 {
+		got = append(got, <-send)
+	}
+	// the snapshot follows the services found
+	if len(got) != 2 || !reflect.DeepEqual(got[0], msgOK) {
+		t.Fatalf("poll() sent %v, want the service followed by the snapshot", got)
+	}
+	if want := comm.BuildSnapshotMessage([]string{testService.Spec.Name}); !reflect.DeepEqual(got[1], want) {
+		t.Errorf("poll() snapshot = %v, want %v", got[1], want)
+	}
+}
+
+func TestProvider_Snapshot(t *testing.T) {
+	p := newFakeProvider()
+	p.PollInterval = time.Hour
+	rec, send := p.startFakeProvider()
+	defer p.Stop()
+
+	// the snapshot requested by the core follows the services found
+	rec <- comm.Message{Action: comm.SnapshotAction}
+	want := []comm.Message{msgOK, comm.BuildSnapshotMessage([]string{testService.Spec.Name})}
+	for _, w := range want {
+		select {
+		case got := <-send:
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("Snapshot() sent %v, want %v", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Snapshot() did not send %v", w)
+		}
+	}
+}
+
+func TestProvider_pollScaledDown(t *testing.T) {
+	p := newFakeProvider()
+	p.cli.(*fakeClient).scaledDown = true
+	send := make(chan comm.Message, 10)
+	p.send = send
+
+	p.poll()
+
+	// the service scaled to zero is left out of the snapshot, so that the core un-deploys it
+	if len(send) != 1 {
+		t.Fatalf("poll() sent %v messages, want the snapshot only", len(send))
+	}
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildSnapshotMessage(nil)) {
+		t.Errorf("poll() snapshot = %v, want an empty snapshot", got)
+	}
+}
+
+func TestProvider_RefreshServiceScaledDown(t *testing.T) {
+	p := newFakeProvider()
+	send := make(chan comm.Message, 1)
+	p.send = send
+
+	p.RefreshService(comm.Message{Action: comm.RefreshAction, Service: comm.Service{Name: "scaleddown"}})
+
+	if len(send) != 1 {
+		t.Fatal("RefreshService() sent no message")
+	}
+	if got := <-send; !reflect.DeepEqual(got, comm.BuildDeleteMessage("scaleddown")) {
+		t.Errorf("RefreshService() = %v, want delete", got)
+	}
+}
+
 func TestProvider_setCli(t *testing.T) {
 	type fields struct {
 		Endpoint               string
@@ -616,3 +750,123 @@ func TestProvider_setCli(t *testing.T) {
 		})
 	}
 }
+
+func TestProvider_handleEvent(t *testing.T) {
+	updateEvent := events.Message{
+		Type:   events.ServiceEventType,
+		Action: "update",
+		Actor:  events.Actor{ID: "testService", Attributes: map[string]string{"name": "testService"}},
+	}
+	removeEvent := events.Message{
+		Type:   events.ServiceEventType,
+		Action: "remove",
+		Actor:  events.Actor{ID: "testService", Attributes: map[string]string{"name": "testService"}},
+	}
+
+	tests := []struct {
+		name    string
+		managed bool
+		event   events.Message
+		want    comm.Message
+	}{
+		{"update", false, updateEvent, msgOK},
+		{"removeManaged", true, removeEvent, comm.BuildDeleteMessage("testService")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeProvider()
+			send := make(chan comm.Message)
+			p.send = send
+			p.setServiceManaged("testService", tt.managed)
+			go p.handleEvent(tt.event)
+			got := <-send
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Msg = %v, want %v", got, tt.want)
+			}
+			if p.isServiceManaged("testService") != (tt.want.Action == comm.AddAction) {
+				t.Errorf("isServiceManaged() = %v", p.isServiceManaged("testService"))
+			}
+		})
+	}
+}
+
+func TestProvider_handleEventUnmanaged(t *testing.T) {
+	p := newFakeProvider()
+	send := make(chan comm.Message, 1)
+	p.send = send
+
+	p.handleEvent(events.Message{
+		Type:   events.ServiceEventType,
+		Action: "remove",
+		Actor:  events.Actor{ID: "other", Attributes: map[string]string{"name": "other"}},
+	})
+
+	if len(send) != 0 {
+		t.Errorf("unexpected message sent for unmanaged service: %v", <-send)
+	}
+}
+
+func TestProvider_handleEventKeepState(t *testing.T) {
+	tests := []struct {
+		name    string
+		svcName string
+		want    []comm.Message
+	}{
+		{"dockerError", "invalid", nil},
+		{"noRunningTask", "scaling", nil},
+		{"notFound", "missing", []comm.Message{comm.BuildDeleteMessage("missing")}},
+		{"scaledDown", "scaleddown", []comm.Message{comm.BuildDeleteMessage("scaleddown")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakeProvider()
+			send := make(chan comm.Message, 1)
+			p.send = send
+			p.setServiceManaged(tt.svcName, true)
+
+			p.handleEvent(events.Message{
+				Type:   events.ServiceEventType,
+				Action: "update",
+				Actor:  events.Actor{ID: tt.svcName, Attributes: map[string]string{"name": tt.svcName}},
+			})
+
+			var got []comm.Message
+			if len(send) > 0 {
+				got = append(got, <-send)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Msg = %v, want %v", got, tt.want)
+			}
+			if p.isServiceManaged(tt.svcName) != (tt.want == nil) {
+				t.Errorf("isServiceManaged() = %v", p.isServiceManaged(tt.svcName))
+			}
+		})
+	}
+}
+
+func TestProvider_watch(t *testing.T) {
+	cli := newFakeClient()
+	p := Provider{
+		PollInterval: 1 * time.Hour,
+		Watch:        true,
+		cli:          cli,
+	}
+	_, send := p.startFakeProvider()
+
+	cli.events <- events.Message{
+		Type:   events.ServiceEventType,
+		Action: "remove",
+		Actor:  events.Actor{ID: "testService", Attributes: map[string]string{"name": "testService"}},
+	}
+	cli.events <- events.Message{
+		Type:   events.NodeEventType,
+		Action: "update",
+		Actor:  events.Actor{ID: "node1"},
+	}
+
+	got := <-send
+	go p.Stop()
+	if !reflect.DeepEqual(got, msgOK) {
+		t.Errorf("Msg = %v, want %v", got, msgOK)
+	}
+}
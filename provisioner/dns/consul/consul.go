@@ -2,6 +2,8 @@
 package consul
 
 import (
+	"fmt"
+
 	"github.com/hashicorp/consul/api"
 	"github.com/interlook/interlook/comm"
 	"github.com/interlook/interlook/log"
@@ -13,6 +15,7 @@ type Consul struct {
 	Domain   string `json:"domain,omitempty"`
 	client   *api.Client
 	shutdown chan bool
+	send     chan<- comm.Message
 }
 
 func (c *Consul) init() error {
@@ -40,6 +43,8 @@ func (c *Consul) Start(receive <-chan comm.Message, send chan<- comm.Message) er
 		return err
 	}
 
+	c.send = send
+
 	for {
 		select {
 		case msg := <-receive:
@@ -55,6 +60,9 @@ func (c *Consul) Start(receive <-chan comm.Message, send chan<- comm.Message) er
 				}
 				send <- msg
 
+			case comm.VerifyAction:
+				c.VerifyService(msg)
+
 			default:
 				msg.Action = comm.UpdateAction
 				var servicePort int
@@ -116,6 +124,34 @@ func (c *Consul) Stop() error {
 	return nil
 }
 
+// VerifyService reports if the nodes of the service's DNS aliases are registered with its public IP
+func (c *Consul) VerifyService(msg comm.Message) {
+	msg.State = comm.InSyncState
+
+	for _, dnsAlias := range msg.Service.DNSAliases {
+		node, _, err := c.client.Catalog().Node(dnsAlias, nil)
+		if err != nil {
+			msg.State = ""
+			msg.Error = err.Error()
+			break
+		}
+
+		if node == nil || node.Node == nil {
+			msg.State = comm.DriftedState
+			msg.Error = fmt.Sprintf("node %v not found", dnsAlias)
+			break
+		}
+
+		if node.Node.Address != msg.Service.PublicIP {
+			msg.State = comm.DriftedState
+			msg.Error = fmt.Sprintf("address %v of node %v differs from %v", node.Node.Address, dnsAlias, msg.Service.PublicIP)
+			break
+		}
+	}
+
+	c.send <- msg
+}
+
 func (c *Consul) isServiceExist(name string) (bool, error) {
 	consulServices, _, err := c.client.Catalog().Service(name, "", nil)
 	if err != nil {
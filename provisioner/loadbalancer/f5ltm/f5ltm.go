@@ -141,6 +141,10 @@ func (f5 *BigIP) Start(receive <-chan comm.Message, send chan<- comm.Message) er
 				updatedMsg := f5.handleDelete(msg)
 				f5.send <- updatedMsg
 				f5.wg.Done()
+
+			case comm.VerifyAction:
+				f5.VerifyService(msg)
+				f5.wg.Done()
 			}
 		}
 	}
@@ -183,10 +187,35 @@ func (f5 *BigIP) handleDelete(msg comm.Message) comm.Message {
 	}
 }
 
+// VerifyService reports if the pool and the virtual server or policy rule of the service are as deployed
+func (f5 *BigIP) VerifyService(msg comm.Message) {
+	f5.send <- f5.verify(msg)
+}
+
+// verify compares the bigip objects of the service with its definition
+func (f5 *BigIP) verify(msg comm.Message) comm.Message {
+	msg.Action = comm.VerifyAction
+
+	drift, err := f5.drift(msg)
+	if err != nil {
+		msg.Error = err.Error()
+		return msg
+	}
+
+	if drift != "" {
+		msg.State = comm.DriftedState
+		msg.Error = drift
+		return msg
+	}
+
+	msg.State = comm.InSyncState
+	return msg
+}
+
 // manages the update event for virtual server mode
 func (f5 *BigIP) HandleVSUpdate(msg comm.Message) comm.Message {
 
-	vs, err := f5.cli.GetVirtualServer(f5.addPartitionToName(msg.Service.Name))
+	vs, err := f5.cli.GetVirtualServer(f5.addPartitionToName(objectName(msg.Service.Name)))
 	if err != nil {
 		msg.Error = fmt.Sprintf("Could not get VS %v %v", msg.Service.Name, err.Error())
 		return msg
@@ -232,11 +261,11 @@ func (f5 *BigIP) handleVSDelete(msg comm.Message) comm.Message {
 
 	msg.Action = comm.UpdateAction
 
-	if err := f5.cli.DeleteVirtualServer(f5.addPartitionToName(msg.Service.Name)); err != nil {
+	if err := f5.cli.DeleteVirtualServer(f5.addPartitionToName(objectName(msg.Service.Name))); err != nil {
 		msg.Error = err.Error()
 	}
 
-	if err := f5.cli.DeletePool(f5.addPartitionToName(msg.Service.Name)); err != nil {
+	if err := f5.cli.DeletePool(f5.addPartitionToName(objectName(msg.Service.Name))); err != nil {
 		msg.Error = err.Error()
 	}
 
@@ -281,7 +310,7 @@ func (f5 *BigIP) handleGlobalPolicyUpdate(msg comm.Message) comm.Message {
 
 		log.Debugf("updating policy %v", globalPolicy)
 
-		if err := f5.cli.ModifyPolicyRule(draftName, msg.Service.Name, f5.buildPolicyRuleFromMsg(msg)); err != nil {
+		if err := f5.cli.ModifyPolicyRule(draftName, objectName(msg.Service.Name), f5.buildPolicyRuleFromMsg(msg)); err != nil {
 			msg.Error = fmt.Sprintf("could not modify policy rule %v %v", msg.Service.Name, err.Error())
 			return msg
 		}
@@ -328,7 +357,7 @@ func (f5 *BigIP) handleGlobalPolicyDelete(msg comm.Message) comm.Message {
 	}()
 
 	// remove policy rule
-	if err := f5.cli.RemoveRuleFromPolicy(msg.Service.Name, draftName); err != nil {
+	if err := f5.cli.RemoveRuleFromPolicy(objectName(msg.Service.Name), draftName); err != nil {
 		msg.Error = fmt.Sprintf("error remove rule %v from policy %v", msg.Service.Name, err.Error())
 	}
 
@@ -339,7 +368,7 @@ func (f5 *BigIP) handleGlobalPolicyDelete(msg comm.Message) comm.Message {
 	}
 
 	// delete pool
-	if err := f5.cli.DeletePool(f5.addPartitionToName(msg.Service.Name)); err != nil {
+	if err := f5.cli.DeletePool(f5.addPartitionToName(objectName(msg.Service.Name))); err != nil {
 		msg.Error = err.Error()
 	}
 	return msg
@@ -395,10 +424,10 @@ func (f5 *BigIP) updatePoolMembers(pool *bigip.Pool, msg comm.Message) error {
 func (f5 *BigIP) createVirtualServer(msg comm.Message) error {
 
 	vs := bigip.VirtualServer{
-		Name:        msg.Service.Name,
+		Name:        objectName(msg.Service.Name),
 		Destination: msg.Service.PublicIP + ":" + strconv.Itoa(f5.getLBPort(msg)),
 		IPProtocol:  "tcp",
-		Pool:        msg.Service.Name,
+		Pool:        objectName(msg.Service.Name),
 		Partition:   f5.Partition,
 		Description: fmt.Sprintf("Virtual Server for %v %v", msg.Service.Name, f5.ObjectDescriptionSuffix),
 	}
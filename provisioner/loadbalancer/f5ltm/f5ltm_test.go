@@ -197,7 +197,7 @@ func (f fakeBigIPClient) GetVirtualServer(name string) (*bigip.VirtualServer, er
 			Name:        "test",
 			Partition:   "interlook",
 			FullPath:    "~interlook~test",
-			Destination: "10.0.0.2",
+			Destination: "/interlook/10.0.0.2:80",
 		}, nil
 	}
 
@@ -1368,3 +1368,45 @@ func TestBigIP_initialize1(t *testing.T) {
 		})
 	}
 }
+
+func TestBigIP_verify(t *testing.T) {
+	service := func(publicIP string, dnsAlias string, hosts ...string) comm.Service {
+		svc := comm.Service{Name: "test", PublicIP: publicIP, DNSAliases: []string{dnsAlias}}
+		for i, host := range hosts {
+			svc.Targets = append(svc.Targets, comm.Target{Host: host, Port: 30001, Weight: 2 - i})
+		}
+		return svc
+	}
+	vsMode := newFakeProvider()
+	vsMode.UpdateMode = vsUpdateMode
+	policyMode := newFakeProvider()
+	policyMode.UpdateMode = policyUpdateMode
+	policyMode.GlobalHTTPPolicy = "interlook_http_policy"
+
+	tests := []struct {
+		name      string
+		f5        *BigIP
+		service   comm.Service
+		wantState string
+		wantErr   bool
+	}{
+		{"vsInSync", vsMode, service("10.0.0.2", "test.caas.csnet.me", "10.32.2.2", "10.32.2.3"), comm.InSyncState, false},
+		{"vsDestinationDrifted", vsMode, service("10.0.0.3", "test.caas.csnet.me", "10.32.2.2", "10.32.2.3"), comm.DriftedState, true},
+		{"membersDrifted", vsMode, service("10.0.0.2", "test.caas.csnet.me", "10.32.2.2", "10.32.2.99"), comm.DriftedState, true},
+		{"policyInSync", policyMode, service("10.0.0.2", "test.caas.csnet.me", "10.32.2.2", "10.32.2.3"), comm.InSyncState, false},
+		{"policyRuleDrifted", policyMode, service("10.0.0.2", "www.caas.csnet.me", "10.32.2.2", "10.32.2.3"), comm.DriftedState, true},
+		{"poolError", vsMode, comm.Service{Name: "notfound"}, "", true},
+		{"unsupportedMode", newFakeProvider(), service("10.0.0.2", "test.caas.csnet.me", "10.32.2.2", "10.32.2.3"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.f5.verify(comm.Message{Action: comm.VerifyAction, Service: tt.service})
+			if got.Action != comm.VerifyAction || got.State != tt.wantState {
+				t.Errorf("verify() = %v %v, want %v %v", got.Action, got.State, comm.VerifyAction, tt.wantState)
+			}
+			if (got.Error != "") != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", got.Error, tt.wantErr)
+			}
+		})
+	}
+}
@@ -30,7 +30,7 @@ func (f5 *BigIP) getNodeByAddress(address string) (bigip.Node, bool) {
 // upsertPool update a Pool. Create it if it doesn't exist
 func (f5 *BigIP) upsertPool(msg comm.Message) error {
 
-	pool, err := f5.cli.GetPool(f5.addPartitionToName(msg.Service.Name))
+	pool, err := f5.cli.GetPool(f5.addPartitionToName(objectName(msg.Service.Name)))
 	if err != nil {
 		return errors.New(fmt.Sprintf("Could not get Pool %v %v", msg.Service.Name, err.Error()))
 	}
@@ -93,7 +93,7 @@ func (f5 *BigIP) buildPolicyRuleFromMsg(msg comm.Message) bigip.PolicyRule {
 	pra := bigip.PolicyRuleAction{
 		Name:    "0",
 		Forward: true,
-		Pool:    f5.addPartitionToPath(msg.Service.Name),
+		Pool:    f5.addPartitionToPath(objectName(msg.Service.Name)),
 	}
 
 	switch msg.Service.TLS {
@@ -113,7 +113,7 @@ func (f5 *BigIP) buildPolicyRuleFromMsg(msg comm.Message) bigip.PolicyRule {
 	}
 
 	pr := bigip.PolicyRule{
-		Name:        msg.Service.Name,
+		Name:        objectName(msg.Service.Name),
 		Description: fmt.Sprintf("ingress rule for %v %v", msg.Service.Name, f5.ObjectDescriptionSuffix),
 		Conditions:  []bigip.PolicyRuleCondition{prc},
 		Actions:     []bigip.PolicyRuleAction{pra},
@@ -137,7 +137,7 @@ func (f5 *BigIP) policyNeedsUpdate(name string, msg comm.Message) (updateNeeded,
 
 	// get the matching rule and check if they need update
 	for _, r := range policy.Rules {
-		if r.Name == msg.Service.Name {
+		if r.Name == objectName(msg.Service.Name) {
 			log.Debugf("found matching PolicyRule %v", r.Name)
 			policyRuleExist = true
 			for _, condition := range r.Conditions {
@@ -148,7 +148,7 @@ func (f5 *BigIP) policyNeedsUpdate(name string, msg comm.Message) (updateNeeded,
 
 			}
 			for _, action := range r.Actions {
-				if action.Forward && action.Pool != f5.addPartitionToPath(msg.Service.Name) {
+				if action.Forward && action.Pool != f5.addPartitionToPath(objectName(msg.Service.Name)) {
 					log.Debugf("PolicyRule action for %v differs", msg.Service.Name)
 					return true, policyRuleExist, nil
 				}
@@ -192,6 +192,65 @@ func (f5 *BigIP) poolMembersNeedsUpdate(pool *bigip.Pool, msg comm.Message) (boo
 	return false, nil
 }
 
+// drift returns how the bigip objects differ from the service definition, empty if they match
+func (f5 *BigIP) drift(msg comm.Message) (string, error) {
+	name := objectName(msg.Service.Name)
+
+	pool, err := f5.cli.GetPool(f5.addPartitionToName(name))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Could not get Pool %v %v", msg.Service.Name, err.Error()))
+	}
+
+	if pool == nil {
+		return fmt.Sprintf("pool %v not found", name), nil
+	}
+
+	membersDiffer, err := f5.poolMembersNeedsUpdate(pool, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if membersDiffer {
+		return fmt.Sprintf("members of pool %v differ", name), nil
+	}
+
+	switch f5.UpdateMode {
+	case vsUpdateMode:
+		vs, err := f5.cli.GetVirtualServer(f5.addPartitionToName(name))
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Could not get VS %v %v", msg.Service.Name, err.Error()))
+		}
+
+		if vs == nil {
+			return fmt.Sprintf("virtual server %v not found", name), nil
+		}
+
+		destination := msg.Service.PublicIP + ":" + strconv.Itoa(f5.getLBPort(msg))
+		if !strings.Contains(vs.Destination, destination) {
+			return fmt.Sprintf("destination %v of virtual server %v differs from %v", vs.Destination, name, destination), nil
+		}
+	case policyUpdateMode:
+		globalPolicy, _, _ := f5.getGlobalPolicyInfo(msg.Service.TLS)
+
+		ruleDiffers, ruleExist, err := f5.policyNeedsUpdate(f5.addPartitionToName(globalPolicy), msg)
+		if err != nil {
+			return "", err
+		}
+
+		if !ruleExist {
+			return fmt.Sprintf("rule %v not found in policy %v", name, globalPolicy), nil
+		}
+
+		if ruleDiffers {
+			return fmt.Sprintf("rule %v of policy %v differs", name, globalPolicy), nil
+		}
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported updateMode %v", f5.UpdateMode))
+	}
+
+	return "", nil
+}
+
 func (f5 *BigIP) getLBPort(msg comm.Message) int {
 	if !msg.Service.TLS {
 		return f5.HttpPort
@@ -204,7 +263,7 @@ func (f5 *BigIP) getLBPort(msg comm.Message) int {
 func (f5 *BigIP) newPoolFromService(msg comm.Message) *bigip.Pool {
 
 	pool := &bigip.Pool{
-		Name:              msg.Service.Name,
+		Name:              objectName(msg.Service.Name),
 		Partition:         f5.Partition,
 		Description:       fmt.Sprintf("Pool for %v %v", msg.Service.Name, f5.ObjectDescriptionSuffix),
 		LoadBalancingMode: f5.LoadBalancingMode,
@@ -240,3 +299,19 @@ func (f5 *BigIP) addPartitionToName(name string) (fullName string) {
 	}
 	return name
 }
+
+// objectName returns the bigip object name for the given service name
+// the characters other than letters, digits, "_" and "-" are escaped as "." followed by their hex code
+// so that distinct service names never share an object name
+// ie: namespaced service myNamespace/myService -> myNamespace.2fmyService
+func objectName(svcName string) string {
+	var name strings.Builder
+	for _, c := range []byte(svcName) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			name.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&name, ".%02x", c)
+	}
+	return name.String()
+}
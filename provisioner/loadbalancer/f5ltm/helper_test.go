@@ -593,3 +593,27 @@ func TestBigIP_upsertPool(t *testing.T) {
 		})
 	}
 }
+
+func Test_objectName(t *testing.T) {
+	tests := []struct {
+		name    string
+		svcName string
+		want    string
+	}{
+		{"plain", "my_Service-1", "my_Service-1"},
+		{"namespaced", "myNamespace/myService", "myNamespace.2fmyService"},
+		{"escaped", "my.Service", "my.2eService"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := objectName(tt.svcName); got != tt.want {
+				t.Errorf("objectName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// "_" is kept as is, the namespaces separator can not be mistaken for it
+	if objectName("a_b/c") == objectName("a/b_c") {
+		t.Errorf("objectName() of a_b/c and a/b_c collide: %v", objectName("a_b/c"))
+	}
+}